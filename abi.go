@@ -0,0 +1,212 @@
+package main
+
+/*
+  ABI compatibility checking.
+
+  Exported symbols of a package's libraries are compared against a baseline
+  recorded in '<devroot>/.cpm/abi/<package>.json'. Symbols that disappeared
+  from a library (or libraries that disappeared altogether) are breaking
+  changes; new symbols are only reported.
+*/
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+// Exported symbols of each library of a package, keyed by library path
+// relative to the shared lib folder
+type AbiBaseline struct {
+	Package string
+	Libs    map[string][]string
+}
+
+// Library file extensions scanned for symbols
+var lib_extensions = []string{".a", ".lib", ".so", ".dylib"}
+
+// Implementation of 'cpm abi-check' command
+func abi_check(args []string) {
+	flags := flag.NewFlagSet("abi-check", flag.ExitOnError)
+	update := flags.Bool("update", false, "record current symbols as new baseline")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		log.Fatal("Usage: cpm abi-check [-update] <package>")
+	}
+	pkg := flags.Arg(0)
+
+	current := AbiBaseline{Package: pkg, Libs: make(map[string][]string)}
+	libdir := lib_dir()
+	for _, lib := range package_libs(libdir, pkg) {
+		syms, err := lib_symbols(lib, false)
+		if err != nil {
+			log.Fatalf("cannot list symbols of %s - %v", lib, err)
+		}
+		rel, _ := filepath.Rel(libdir, lib)
+		current.Libs[filepath.ToSlash(rel)] = syms
+	}
+	if len(current.Libs) == 0 {
+		log.Fatalf("No libraries found for package %s in %s", pkg, libdir)
+	}
+
+	fname := filepath.Join(devroot, ".cpm", "abi", pkg+".json")
+	var baseline AbiBaseline
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		save_abi_baseline(fname, &current)
+		fmt.Printf("No ABI baseline for %s. Recorded current symbols in %s\n", pkg, fname)
+		return
+	}
+	if err = json.Unmarshal(data, &baseline); err != nil {
+		log.Fatalf("cannot parse %s - %v", fname, err)
+	}
+
+	breaking := 0
+	for lib, old_syms := range baseline.Libs {
+		new_syms, ok := current.Libs[lib]
+		if !ok {
+			fmt.Printf("BREAKING %s - library no longer exists\n", lib)
+			breaking++
+			continue
+		}
+		for _, s := range old_syms {
+			if _, found := slices.BinarySearch(new_syms, s); !found {
+				fmt.Printf("BREAKING %s - removed symbol %s\n", lib, s)
+				breaking++
+			}
+		}
+		for _, s := range new_syms {
+			if _, found := slices.BinarySearch(old_syms, s); !found {
+				Verbosef("%s - added symbol %s\n", lib, s)
+			}
+		}
+	}
+
+	if *update {
+		save_abi_baseline(fname, &current)
+		fmt.Printf("ABI baseline for %s updated\n", pkg)
+	}
+	if breaking != 0 {
+		fmt.Printf("Package %s has %d breaking ABI change(s)\n", pkg, breaking)
+		if !*update {
+			exit_failed("breaking ABI changes")
+		}
+	} else {
+		fmt.Printf("Package %s is ABI compatible with baseline\n", pkg)
+	}
+}
+
+func save_abi_baseline(fname string, b *AbiBaseline) {
+	data, _ := json.MarshalIndent(b, "", "  ")
+	os.MkdirAll(filepath.Dir(fname), 0755)
+	if err := os.WriteFile(fname, data, 0644); err != nil {
+		log.Fatalf("cannot write %s - %v", fname, err)
+	}
+}
+
+// Find library files belonging to a package in the lib folder (and its
+// subfolders)
+func package_libs(libdir string, pkg string) []string {
+	var libs []string
+	filepath.WalkDir(libdir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if is_package_lib(d.Name(), pkg) {
+			libs = append(libs, path)
+		}
+		return nil
+	})
+	return libs
+}
+
+// Return (lowercase) package name of a library file or an empty string if
+// the file is not a library
+func lib_package(fname string) string {
+	ext := filepath.Ext(fname)
+	if !slices.Contains(lib_extensions, strings.ToLower(ext)) {
+		return ""
+	}
+	name := strings.ToLower(strings.TrimSuffix(fname, ext))
+	if strings.ToLower(ext) != ".lib" {
+		name = strings.TrimPrefix(name, "lib")
+	}
+	return name
+}
+
+// Return true if library file fname belongs to package pkg: its name without
+// extension, with or without the 'lib' prefix, matches the package name
+func is_package_lib(fname string, pkg string) bool {
+	name := lib_package(fname)
+	if name == "" {
+		return false
+	}
+	return name == strings.ToLower(pkg) ||
+		strings.EqualFold(strings.TrimSuffix(fname, filepath.Ext(fname)), pkg)
+}
+
+// Return sorted list of global symbols defined in a library. If strong is
+// true, weak and COMDAT symbols (inline functions, template instances) are
+// omitted.
+func lib_symbols(lib string, strong bool) ([]string, error) {
+	var syms []string
+	if runtime.GOOS == "windows" {
+		out, err := Output("dumpbin", "/nologo", "/symbols", lib)
+		if err != nil {
+			return nil, err
+		}
+		comdat := make(map[string]bool)
+		section := ""
+		for _, line := range strings.Split(out, "\n") {
+			f := strings.Fields(line)
+			switch {
+			case strings.Contains(line, "COFF SYMBOL TABLE"):
+				//new object file
+				comdat = make(map[string]bool)
+			case strings.Contains(line, "Static") && len(f) > 2:
+				section = f[2]
+			case strings.Contains(line, "selection"):
+				comdat[section] = true
+			case strings.Contains(line, "External") && !strings.Contains(line, "UNDEF"):
+				//Format is: 008 00000000 SECT3  notype ()    External     | ?foo@@YAXXZ (void __cdecl foo(void))
+				if strong && len(f) > 2 && comdat[f[2]] {
+					continue
+				}
+				if _, name, ok := strings.Cut(line, "| "); ok {
+					if n := strings.Fields(name); len(n) > 0 {
+						syms = append(syms, n[0])
+					}
+				}
+			}
+		}
+	} else {
+		args := []string{"-g", "--defined-only", "-P"}
+		if ext := filepath.Ext(lib); ext == ".so" || ext == ".dylib" {
+			args = append(args, "-D")
+		}
+		out, err := Output("nm", append(args, lib)...)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(out, "\n") {
+			//Format is: <name> <type> [<value> <size>]; archive members end with ':'
+			f := strings.Fields(line)
+			if len(f) < 2 || strings.HasSuffix(f[0], ":") {
+				continue
+			}
+			if strong && strings.ContainsAny(f[1], "uVvWw") {
+				continue
+			}
+			syms = append(syms, f[0])
+		}
+	}
+	slices.Sort(syms)
+	return slices.Compact(syms), nil
+}
@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestLibPackage(t *testing.T) {
+	tests := []struct {
+		fname, want string
+	}{
+		{"libutils.a", "utils"},
+		{"utils.lib", "utils"},
+		{"LIBUTILS.LIB", "libutils"},
+		{"libutils.Lib", "libutils"},
+		{"libutils.so", "utils"},
+		{"utils.txt", ""},
+	}
+	for _, tt := range tests {
+		if got := lib_package(tt.fname); got != tt.want {
+			t.Errorf("lib_package(%q) = %q, want %q", tt.fname, got, tt.want)
+		}
+	}
+}
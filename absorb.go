@@ -0,0 +1,105 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Implementation of 'cpm absorb' command
+func absorb(args []string) {
+	flags := flag.NewFlagSet("absorb", flag.ExitOnError)
+	into := flags.String("into", "", "package that absorbs the dependency")
+	squash := flags.Bool("squash", false, "squash dependency history into one commit")
+	pos := parse_interspersed(flags, args)
+	if len(pos) != 1 {
+		log.Fatal("Usage: cpm absorb <package> [--into <package>] [--squash]")
+	}
+	pkg := pos[0]
+	root_name, descriptor := find_root(*into)
+	rootdir := filepath.Dir(descriptor)
+
+	var root PacUnit
+	if err := read_descriptor(descriptor, &root); err != nil {
+		log.Fatalf("cannot read %s - %v", descriptor, err)
+	}
+	var dep *DependencyDescriptor
+	for i := range root.Depends {
+		if strings.EqualFold(root.Depends[i].Name, pkg) {
+			dep = &root.Depends[i]
+		}
+	}
+	if dep == nil {
+		log.Fatalf("Package %s doesn't depend on %s", root_name, pkg)
+	}
+	if dep.Path != "" {
+		log.Fatalf("Package %s is already a local package of %s", pkg, root_name)
+	}
+	uri := package_uri(dep.Git, dep.Https)
+	branch := dep.Branch
+	if dep.Version != "" {
+		branch = resolve_version(dep, filepath.Join(devroot, pkg))
+	} else if branch == "" {
+		if branch = default_branch(uri); branch == "" {
+			log.Fatalf("Cannot find default branch of %s", uri)
+		}
+	}
+
+	//bring dependency with its history in a subfolder of root repository
+	args = []string{"-C", rootdir, "subtree", "add", "--prefix=" + pkg}
+	if *squash {
+		args = append(args, "--squash")
+	}
+	args = append(args, uri, branch)
+	Verboseln("Running git ", args)
+	if stat, err := Run("git", args); err != nil || stat != 0 {
+		log.Fatalf("Merging %s failed \nStatus %d Error: %v\n", pkg, stat, err)
+	}
+
+	//make it a path dependency of all consumers
+	newdir := filepath.Join(rootdir, pkg)
+	olddir := filepath.Join(devroot, pkg)
+	remove := []string{"branch", "version"}
+	for _, attr := range repository_attributes {
+		if attr != "path" {
+			remove = append(remove, attr)
+		}
+	}
+	for _, c := range find_consumers(pkg) {
+		cdir := filepath.Dir(c.Descriptor)
+		path, _ := filepath.Rel(cdir, newdir)
+		err := edit_dependency(c.Descriptor, pkg, func(data []byte, deps *JNode, idx int) []byte {
+			return edit_members(data, deps.items[idx], []json_member{{"path", filepath.ToSlash(path)}}, remove)
+		})
+		if err != nil {
+			fmt.Printf("WARNING - cannot update %s - %v\n", c.Descriptor, err)
+			continue
+		}
+		fmt.Printf("Updated %s\n", c.Descriptor)
+		remove_links_to(filepath.Join(cdir, "include"), olddir)
+	}
+
+	edit_lockfiles(func(l *Lockfile) bool { return l.remove(pkg) })
+
+	fmt.Printf("Package %s absorbed into %s. Descriptor changes are not committed.\n", pkg, rootdir)
+	fmt.Printf("Folder %s is no longer used and can be removed\n", olddir)
+}
+
+// Remove symlinks in a folder that point inside target folder
+func remove_links_to(dir string, target string) {
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if e.Type()&fs.ModeSymlink == 0 {
+			continue
+		}
+		link := filepath.Join(dir, e.Name())
+		if t, err := os.Readlink(link); err == nil && strings.HasPrefix(t, target+string(filepath.Separator)) {
+			Verbosef("Removing symlink %s --> %s\n", link, t)
+			os.Remove(link)
+		}
+	}
+}
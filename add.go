@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Dependency descriptor written by 'cpm add'
+type AddedDependency struct {
+	Name      string `json:"name"`
+	Git       string `json:"git,omitempty"`
+	Https     string `json:"https,omitempty"`
+	Branch    string `json:"branch,omitempty"`
+	Version   string `json:"version,omitempty"`
+	FetchOnly bool   `json:"fetchOnly,omitempty"`
+}
+
+// Return package name derived from a repository URL (last path component
+// without '.git' suffix)
+func repo_name(uri string) string {
+	_, path := split_uri(uri)
+	return path[strings.LastIndexAny(path, "/\\")+1:]
+}
+
+// Return package name from descriptor in dir or empty string if there is no
+// descriptor or it doesn't have a name
+func descriptor_package_name(dir string) string {
+	var desc struct{ Name string }
+	data, err := os.ReadFile(filepath.Join(dir, descriptor_name))
+	if err != nil || json.Unmarshal(data, &desc) != nil {
+		return ""
+	}
+	return desc.Name
+}
+
+// Implementation of 'cpm add' command
+func add_dependency(args []string) {
+	flags := flag.NewFlagSet("add", flag.ExitOnError)
+	name := flags.String("name", "", "package name (default is derived from repository)")
+	branch := flags.String("branch", "", "branch of dependency")
+	version := flags.String("version", "", "version constraint of dependency")
+	to := flags.String("to", "", "package that receives the dependency (default is current folder)")
+	fetch_only := flags.Bool("fetch-only", false, "add a weak (fetch only) dependency")
+	no_fetch := flags.Bool("no-fetch", false, "only edit descriptor")
+	pos := parse_interspersed(flags, args)
+	if len(pos) != 1 {
+		log.Fatal("Usage: cpm add <url> [--name <name>] [--branch <branch>|--version <constraint>] [--to <package>] [--fetch-only] [--no-fetch]")
+	}
+	uri := pos[0]
+	if *branch != "" && *version != "" {
+		log.Fatal("Options --branch and --version cannot be used together")
+	}
+
+	_, descriptor := find_root(*to)
+	data, err := os.ReadFile(descriptor)
+	if err != nil {
+		log.Fatalf("Cannot read %s - %v", descriptor, err)
+	}
+	root, err := parse_jnodes(data)
+	if err != nil {
+		log.Fatalf("Cannot parse %s - %v", descriptor, err)
+	}
+	if root.kind != '{' {
+		log.Fatalf("Invalid descriptor %s", descriptor)
+	}
+
+	dep := AddedDependency{Name: *name, Branch: *branch, Version: *version, FetchOnly: *fetch_only}
+	dep.Git, dep.Https = remote_urls(uri)
+	if dep.Name == "" {
+		dep.Name = repo_name(uri)
+		if dep.Name == "" {
+			log.Fatalf("Cannot derive package name from %s. Use --name option.", uri)
+		}
+	}
+
+	//clone the repository to find the package name in its descriptor
+	if !*no_fetch {
+		dir := filepath.Join(devroot, dep.Name)
+		cloned := false
+		if _, err := os.Stat(dir); err != nil {
+			os.MkdirAll(devroot, 0755)
+			git_clone(&PacUnit{Name: dep.Name, Git: uri, Branch: *branch})
+			cloned = true
+		}
+		if desc_name := descriptor_package_name(dir); *name == "" && desc_name != "" && desc_name != dep.Name {
+			newdir := filepath.Join(devroot, desc_name)
+			if _, err := os.Stat(newdir); err != nil {
+				Verbosef("Renaming %s to %s\n", dir, newdir)
+				if err := rename_file(dir, newdir); err != nil {
+					log.Fatalf("Cannot rename %s - %v", dir, err)
+				}
+			} else if cloned {
+				//package already in development tree
+				remove_all(dir)
+			}
+			dep.Name = desc_name
+		}
+	}
+
+	deps, idx, _ := find_dependency_node(data, root, dep.Name)
+	switch {
+	case idx >= 0:
+		log.Fatalf("%s already depends on %s", descriptor, dep.Name)
+	case deps == nil:
+		data = set_member(data, root, "depends", []AddedDependency{dep})
+	default:
+		data = append_element(data, deps, dep)
+	}
+	if err := os.WriteFile(descriptor, data, 0644); err != nil {
+		log.Fatalf("Cannot write %s - %v", descriptor, err)
+	}
+	fmt.Printf("Added %s to %s\n", dep.Name, descriptor)
+
+	if !*no_fetch {
+		*fetch_flag = true
+		update_tree(*to)
+	}
+}
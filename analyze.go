@@ -0,0 +1,285 @@
+package main
+
+/*
+  Static analysis.
+
+  'cpm analyze [<package>...]' runs clang-tidy over the sources of the given
+  packages (default is all packages of the tree). The compilation databases
+  of the packages ('compile_commands.json' in the package folder or in one of
+  its build folders, as written by CMake with CMAKE_EXPORT_COMPILE_COMMANDS)
+  are merged in '<devroot>/.cpm/compile_commands.json' so that all packages
+  are analyzed with the same database. Packages without a compilation
+  database are skipped with a warning.
+
+  Files are analyzed in parallel, using the number of build jobs. All
+  packages use the same configuration: the file given with '--config-file',
+  otherwise the '.clang-tidy' file in the root of the development tree, if
+  any, otherwise the configuration clang-tidy finds for each file. The
+  '--checks' option adds to the checks of the configuration. Diagnostics in
+  headers of a package are reported with the package.
+
+  Diagnostics of all packages are merged in one report, with each problem
+  listed once (see problems.go). The '--output <file>' option writes the
+  report as JSON. The command fails if clang-tidy reports errors. The
+  program is 'clang-tidy' or the one given by the 'analyze.clang-tidy'
+  configuration setting.
+*/
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Entry of a compilation database
+type CompileCommand struct {
+	Directory string   `json:"directory"`
+	File      string   `json:"file"`
+	Command   string   `json:"command,omitempty"`
+	Arguments []string `json:"arguments,omitempty"`
+	Output    string   `json:"output,omitempty"`
+}
+
+// Analysis results of a package
+type AnalyzedPackage struct {
+	Name     string `json:"name"`
+	Files    int    `json:"files"`
+	Errors   int    `json:"errors"`
+	Warnings int    `json:"warnings"`
+}
+
+// Report written by 'cpm analyze --output'
+type AnalysisReport struct {
+	Packages []AnalyzedPackage `json:"packages"`
+	Problems []Problem         `json:"problems"`
+}
+
+// Return compilation database of a package or "" if it has none. Looks in
+// the package folder and in its subfolders, up to two levels deep.
+func find_compile_commands(p *PacUnit) string {
+	dir := package_dir(p)
+	fname := filepath.Join(dir, "compile_commands.json")
+	if _, err := os.Stat(fname); err == nil {
+		return fname
+	}
+	var found string
+	filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || found != "" {
+			return filepath.SkipDir
+		}
+		if !d.IsDir() {
+			if d.Name() == "compile_commands.json" {
+				found = path
+				return filepath.SkipAll
+			}
+			return nil
+		}
+		if path == dir {
+			return nil
+		}
+		if slices.Contains(metadata_dirs, d.Name()) || is_owned(path) {
+			return filepath.SkipDir
+		}
+		if rel, _ := filepath.Rel(dir, path); strings.Count(rel, string(filepath.Separator)) > 1 {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return found
+}
+
+// Read a compilation database making all file names absolute
+func read_compile_commands(fname string) ([]CompileCommand, error) {
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	var commands []CompileCommand
+	if err = json.Unmarshal(data, &commands); err != nil {
+		return nil, err
+	}
+	for i := range commands {
+		c := &commands[i]
+		if !filepath.IsAbs(c.File) {
+			c.File = filepath.Join(c.Directory, c.File)
+		}
+		c.File = filepath.Clean(c.File)
+	}
+	return commands, nil
+}
+
+// Return true if path is a regular file
+func is_regular(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// Return true if file is in folder dir
+func in_folder(fname string, dir string) bool {
+	rel, err := filepath.Rel(dir, fname)
+	return err == nil && filepath.IsLocal(rel)
+}
+
+// Implementation of 'cpm analyze' command
+func analyze(args []string) {
+	flags := flag.NewFlagSet("analyze", flag.ExitOnError)
+	checks := flags.String("checks", "", "additional checks")
+	config_file := flags.String("config-file", "", "clang-tidy configuration used for all packages")
+	output := flags.String("output", "", "write report as JSON to file")
+	names := parse_interspersed(flags, args)
+
+	load_tree("")
+	packs := all_packs
+	if len(names) != 0 {
+		packs = nil
+		for _, name := range names {
+			p := find_pack(name)
+			if p == nil {
+				log.Fatalf("Fatal - package %s is not in the development tree", name)
+			}
+			packs = append(packs, p)
+		}
+	} else if workspace {
+		packs = all_packs[1:]
+	}
+
+	//merge compilation databases of all packages
+	var database []CompileCommand
+	seen := make(map[string]bool)
+	for _, p := range all_packs {
+		fname := find_compile_commands(p)
+		if fname == "" {
+			if slices.Contains(packs, p) {
+				fmt.Printf("WARNING - package %s has no compile_commands.json. Configure it with CMAKE_EXPORT_COMPILE_COMMANDS=ON\n", p.Name)
+			}
+			continue
+		}
+		commands, err := read_compile_commands(fname)
+		if err != nil {
+			log.Fatalf("Fatal - cannot read %s - %v", fname, err)
+		}
+		Verbosef("Package %s - %d files in %s\n", p.Name, len(commands), fname)
+		for _, c := range commands {
+			if !seen[c.File] {
+				seen[c.File] = true
+				database = append(database, c)
+			}
+		}
+	}
+	db_dir := filepath.Join(devroot, ".cpm")
+	os.MkdirAll(db_dir, 0755)
+	data, _ := json.MarshalIndent(database, "", "  ")
+	if err := os.WriteFile(filepath.Join(db_dir, "compile_commands.json"), data, 0644); err != nil {
+		log.Fatalf("Fatal - cannot write compilation database - %v", err)
+	}
+
+	//shared configuration
+	if *config_file == "" {
+		if fname := filepath.Join(devroot, ".clang-tidy"); is_regular(fname) {
+			*config_file = fname
+		}
+	}
+	prog := config_get("analyze.clang-tidy", "clang-tidy")
+	if _, err := exec.LookPath(prog); err != nil {
+		log.Fatalf("Fatal - %s not found", prog)
+	}
+
+	//assign files to packages, the innermost package folder wins
+	dirs := make(map[*PacUnit]string)
+	for _, p := range all_packs {
+		dirs[p] = package_dir(p)
+	}
+	owner := func(fname string) *PacUnit {
+		var best *PacUnit
+		for _, p := range all_packs {
+			if in_folder(fname, dirs[p]) && (best == nil || len(dirs[p]) > len(dirs[best])) {
+				best = p
+			}
+		}
+		return best
+	}
+	files := make(map[*PacUnit][]string)
+	for _, c := range database {
+		if p := owner(c.File); p != nil && slices.Contains(packs, p) {
+			files[p] = append(files[p], c.File)
+		}
+	}
+
+	pool := new_job_pool(build_jobs)
+	var wg sync.WaitGroup
+	for _, p := range packs {
+		if len(files[p]) == 0 {
+			continue
+		}
+		fmt.Printf("Analyzing %s (%d files)\n", p.Name, len(files[p]))
+		cmd_args := []string{"-p", db_dir, "--quiet",
+			"--header-filter=^" + regexp.QuoteMeta(dirs[p]+string(filepath.Separator))}
+		if *config_file != "" {
+			cmd_args = append(cmd_args, "--config-file="+*config_file)
+		}
+		if *checks != "" {
+			cmd_args = append(cmd_args, "--checks="+*checks)
+		}
+		for _, fname := range files[p] {
+			wg.Add(1)
+			pool.acquire()
+			go func(p *PacUnit, fname string) {
+				defer wg.Done()
+				defer pool.release()
+				cmd := exec.Command(prog, append(slices.Clone(cmd_args), fname)...)
+				out, err := cmd.CombinedOutput()
+				Verbosef("%s %s\n", prog, fname)
+				for _, line := range strings.Split(normalize_output(string(out)), "\n") {
+					match_problem(p.Name, line)
+				}
+				if _, ok := err.(*exec.ExitError); !ok && err != nil {
+					fmt.Printf("WARNING - cannot run %s on %s - %v\n", prog, fname, err)
+				}
+			}(p, fname)
+		}
+	}
+	wg.Wait()
+
+	report := AnalysisReport{Problems: sorted_problems()}
+	nerr := 0
+	for _, p := range packs {
+		if len(files[p]) == 0 {
+			continue
+		}
+		a := AnalyzedPackage{Name: p.Name, Files: len(files[p])}
+		for _, q := range package_problems[p.Name] {
+			if q.Severity == "error" {
+				a.Errors++
+			} else {
+				a.Warnings++
+			}
+		}
+		nerr += a.Errors
+		report.Packages = append(report.Packages, a)
+	}
+	sort.Slice(report.Packages, func(i, j int) bool { return report.Packages[i].Name < report.Packages[j].Name })
+
+	fmt.Printf("%-20s %-8s %-8s %s\n", "PACKAGE", "FILES", "ERRORS", "WARNINGS")
+	for _, a := range report.Packages {
+		fmt.Printf("%-20s %-8d %-8d %d\n", a.Name, a.Files, a.Errors, a.Warnings)
+	}
+	print_problems(os.Stdout)
+	if *output != "" {
+		data, _ := json.MarshalIndent(report, "", "  ")
+		if err := os.WriteFile(*output, append(data, '\n'), 0644); err != nil {
+			log.Fatalf("Fatal - cannot write %s - %v", *output, err)
+		}
+	}
+	if nerr != 0 {
+		log.Fatalf("Fatal - static analysis found %d errors", nerr)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+/*
+  Archive dependencies.
+
+  A dependency with an 'archive' attribute is downloaded as a release
+  archive instead of being cloned:
+
+    {"name": "zlib", "archive": "https://zlib.net/zlib-1.3.1.tar.gz",
+     "sha256": "9a93b2b7dfdac77ceba5a558a580e74667dd6fede4585b91eefb60f03b72df23"}
+
+  Supported formats are .tar.gz (.tgz), .tar.bz2, .tar and .zip. URLs can
+  be http(s), file:// or local paths. The archive is verified against the
+  'sha256' attribute, if present, and extracted in the package folder. If
+  all entries of the archive are in one top folder, like 'zlib-1.3.1/', that
+  folder becomes the package folder.
+
+  The URL and hash of the extracted archive are recorded in the package
+  folder ('.cpm/archive.json'); the archive is downloaded again only when
+  the 'archive' attribute changes.
+*/
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/bzip2"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Archive extracted in a package folder
+type ArchiveState struct {
+	Url    string
+	Sha256 string
+}
+
+const archive_state_name = ".cpm/archive.json"
+
+// Check that a dependency with an archive doesn't have Git attributes
+func check_archive_dependency(p *PacUnit, d *DependencyDescriptor) {
+	if d.Archive == "" {
+		return
+	}
+	if d.Git != "" || d.Https != "" || d.Branch != "" || d.Version != "" || d.Commit != "" ||
+		d.Tree != "" || d.Path != "" || d.Shallow || d.Depth != 0 || len(d.SparsePaths) != 0 {
+		log.Fatalf("Package %s - dependency %s has an archive and Git attributes", p.Name, d.Name)
+	}
+}
+
+// Return archive state of package in dir or nil if it was not extracted from
+// an archive
+func load_archive_state(dir string) *ArchiveState {
+	data, err := os.ReadFile(filepath.Join(dir, archive_state_name))
+	if err != nil {
+		return nil
+	}
+	st := new(ArchiveState)
+	if json.Unmarshal(data, st) != nil {
+		return nil
+	}
+	return st
+}
+
+// Download and extract the archive of a package if needed
+func fetch_archive(p *PacUnit) {
+	pacdir := package_dir(p)
+	st := load_archive_state(pacdir)
+	if st != nil && st.Url == p.archive && (p.sha256 == "" || strings.EqualFold(st.Sha256, p.sha256)) {
+		Verbosef("Package %s - archive %s already extracted\n", p.Name, p.archive)
+		return
+	}
+	if st == nil {
+		if entries, err := os.ReadDir(pacdir); err == nil && len(entries) != 0 {
+			log.Fatalf("Fatal - Package %s - folder %s exists and was not extracted from an archive", p.Name, pacdir)
+		}
+	}
+
+	release := acquire_host(p.archive)
+	defer release()
+	tmpdir := filepath.Join(devroot, ".cpm", "archives")
+	os.MkdirAll(tmpdir, 0755)
+	fname := filepath.Join(tmpdir, p.Name+"-"+archive_file_name(p.archive))
+	fmt.Printf("Downloading %s\n", p.archive)
+	var hash string
+	err := with_retries("Package "+p.Name+" - download", func() (bool, error) {
+		var err error
+		hash, err = download(p.archive, fname)
+		return transient_download(err), err
+	})
+	if err != nil {
+		log.Fatalf("Fatal - Package %s - cannot download %s - %v", p.Name, p.archive, err)
+	}
+	defer os.Remove(fname)
+	if p.sha256 == "" {
+		warn("unpinned-archive", "package %s - archive has no sha256 attribute. Its hash is %s", p.Name, hash)
+	} else if !strings.EqualFold(hash, p.sha256) {
+		log.Fatalf("Fatal - Package %s - sha256 of %s is %s, expected %s", p.Name, p.archive, hash, p.sha256)
+	}
+
+	extract := filepath.Join(tmpdir, p.Name+".extract")
+	remove_all(extract)
+	if err = extract_archive(fname, archive_file_name(p.archive), extract); err != nil {
+		remove_all(extract)
+		log.Fatalf("Fatal - Package %s - cannot extract %s - %v", p.Name, p.archive, err)
+	}
+	top := extract
+	if entries, _ := os.ReadDir(extract); len(entries) == 1 && entries[0].IsDir() {
+		top = filepath.Join(extract, entries[0].Name())
+	}
+	if err = remove_all(pacdir); err != nil {
+		log.Fatalf("Fatal - cannot remove %s - %v", pacdir, err)
+	}
+	if err = rename_file(top, pacdir); err != nil {
+		log.Fatalf("Fatal - cannot move %s to %s - %v", top, pacdir, err)
+	}
+	remove_all(extract)
+
+	os.MkdirAll(filepath.Join(pacdir, ".cpm"), 0755)
+	data, _ := json.MarshalIndent(ArchiveState{p.archive, hash}, "", "  ")
+	os.WriteFile(filepath.Join(pacdir, archive_state_name), data, 0644)
+	fmt.Printf("Package %s - extracted %s\n", p.Name, archive_file_name(p.archive))
+}
+
+// Return file name of an archive URL
+func archive_file_name(uri string) string {
+	if u, err := url.Parse(uri); err == nil && u.Scheme != "" && len(u.Scheme) > 1 {
+		return path.Base(u.Path)
+	}
+	return filepath.Base(uri)
+}
+
+// Unexpected HTTP status of a download
+type http_status_error struct {
+	code   int
+	status string
+}
+
+func (e http_status_error) Error() string {
+	return e.status
+}
+
+// Return true if a download error can be transient: network errors, server
+// errors and rate limiting
+func transient_download(err error) bool {
+	var status http_status_error
+	var neterr net.Error
+	if errors.As(err, &status) {
+		return status.code >= 500 || status.code == 429
+	}
+	return errors.As(err, &neterr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// Download a file. Returns its SHA-256 hash.
+func download(uri string, fname string) (string, error) {
+	var src io.ReadCloser
+	u, err := url.Parse(uri)
+	switch {
+	case err == nil && (u.Scheme == "http" || u.Scheme == "https"):
+		resp, err := http_get(uri)
+		if err != nil {
+			return "", err
+		}
+		if resp.StatusCode != 200 {
+			resp.Body.Close()
+			return "", http_status_error{resp.StatusCode, resp.Status}
+		}
+		src = resp.Body
+	case err == nil && u.Scheme == "file":
+		if src, err = os.Open(filepath.FromSlash(u.Path)); err != nil {
+			return "", err
+		}
+	default:
+		if src, err = os.Open(uri); err != nil {
+			return "", err
+		}
+	}
+	defer src.Close()
+
+	out, err := os.Create(fname)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+	h := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(out, h), src); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Return destination of an archive entry, rejecting names that escape the
+// destination folder
+func entry_path(dir string, name string) (string, error) {
+	name = filepath.FromSlash(name)
+	if filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return "", fmt.Errorf("invalid entry %s", name)
+	}
+	dst := filepath.Join(dir, name)
+	if !inside_folder(dir, dst) {
+		return "", fmt.Errorf("invalid entry %s", name)
+	}
+	//an earlier symlink entry must not redirect the files that follow
+	for f := dst; f != dir; f = filepath.Dir(f) {
+		if fi, err := os.Lstat(f); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("invalid entry %s - %s is a symbolic link", name, f)
+		}
+	}
+	return dst, nil
+}
+
+// Return true if file f is folder dir or is inside it
+func inside_folder(dir string, f string) bool {
+	return f == dir || strings.HasPrefix(f, dir+string(filepath.Separator))
+}
+
+// Check the target of a symlink entry: it must be relative and stay inside
+// the destination folder
+func check_link_target(dir string, dst string, target string) error {
+	t := filepath.FromSlash(target)
+	if filepath.IsAbs(t) || filepath.VolumeName(t) != "" || !inside_folder(dir, filepath.Join(filepath.Dir(dst), t)) {
+		return fmt.Errorf("invalid symlink %s -> %s", dst, target)
+	}
+	return nil
+}
+
+// Write a regular file extracted from an archive
+func write_entry(dst string, mode os.FileMode, r io.Reader) error {
+	os.MkdirAll(filepath.Dir(dst), 0755)
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm()|0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, r)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Extract an archive in folder dir. The format is given by the file name.
+func extract_archive(fname string, name string, dir string) error {
+	dir = filepath.Clean(dir)
+	os.MkdirAll(dir, 0755)
+	lname := strings.ToLower(name)
+	if strings.HasSuffix(lname, ".zip") {
+		return extract_zip(fname, dir)
+	}
+
+	f, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader
+	switch {
+	case strings.HasSuffix(lname, ".tar.gz") || strings.HasSuffix(lname, ".tgz"):
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		r = gz
+	case strings.HasSuffix(lname, ".tar.bz2") || strings.HasSuffix(lname, ".tbz2"):
+		r = bzip2.NewReader(f)
+	case strings.HasSuffix(lname, ".tar"):
+		r = f
+	default:
+		return fmt.Errorf("unknown archive format")
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		dst, err := entry_path(dir, hdr.Name)
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			os.MkdirAll(dst, 0755)
+		case tar.TypeReg:
+			if err = write_entry(dst, hdr.FileInfo().Mode(), tr); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err = check_link_target(dir, dst, hdr.Linkname); err != nil {
+				return err
+			}
+			os.MkdirAll(filepath.Dir(dst), 0755)
+			if err = os.Symlink(hdr.Linkname, dst); err != nil {
+				Verbosef("Cannot create symlink %s - %v\n", dst, err)
+			}
+		default:
+			Verbosef("Skipping archive entry %s\n", hdr.Name)
+		}
+	}
+}
+
+func extract_zip(fname string, dir string) error {
+	zr, err := zip.OpenReader(fname)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	for _, zf := range zr.File {
+		dst, err := entry_path(dir, zf.Name)
+		if err != nil {
+			return err
+		}
+		if zf.FileInfo().IsDir() {
+			os.MkdirAll(dst, 0755)
+			continue
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			return err
+		}
+		err = write_entry(dst, zf.Mode(), rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
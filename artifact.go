@@ -0,0 +1,202 @@
+package main
+
+/*
+  Artifact repositories.
+
+  Dependencies can be taken from Artifactory or Nexus repositories. A
+  dependency with a 'repository' attribute names a repository configured in
+  the configuration file and its 'artifact' attribute gives the artifact:
+    {"name": "zlib", "repository": "corp", "artifact": "libs/zlib-1.3.1.tar.gz",
+     "sha256": "9a93b2b7dfdac77ceba5a558a580e74667dd6fede4585b91eefb60f03b72df23"}
+  The repository is configured with these settings:
+    repository.corp.url = https://artifacts.example.com/artifactory/generic-local
+    repository.corp.type = generic
+    repository.corp.user = builder
+    repository.corp.password = ...
+  or, instead of user and password, 'repository.corp.token'. Tokens are sent
+  as bearer tokens; user and password use basic authentication. The
+  credentials are also sent with any 'archive' download from the repository
+  URL.
+
+  For generic (Artifactory) or raw (Nexus) repositories, the artifact is the
+  path of an archive in the repository. For Conan repositories (type
+  'conan'), the artifact is a recipe reference, like 'zlib/1.3.1@corp/stable'
+  or 'zlib/1.3.1#<revision>'; CPM downloads the exported sources of the
+  latest (or given) recipe revision. The archive is then verified and
+  extracted like archive dependencies (see archive.go).
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+var repository_types = []string{"generic", "conan"}
+
+// Provider of packages from artifact repositories
+type artifact_provider struct{}
+
+func (artifact_provider) Name() string { return "artifact" }
+
+func (artifact_provider) Handles(p *PacUnit) bool { return p.repository != "" }
+
+// Stop if a dependency from an artifact repository has other attributes or
+// if the repository is not configured
+func (artifact_provider) Check(p *PacUnit, d *DependencyDescriptor) {
+	if d.Repository == "" {
+		if d.Artifact != "" {
+			log.Fatalf("Package %s - dependency %s has an artifact but no repository", p.Name, d.Name)
+		}
+		return
+	}
+	if d.Artifact == "" {
+		log.Fatalf("Package %s - dependency %s must have both repository and artifact attributes", p.Name, d.Name)
+	}
+	if d.Git != "" || d.Https != "" || d.Hg != "" || d.Svn != "" || d.P4Port != "" || d.Depot != "" || d.Archive != "" || d.Path != "" {
+		log.Fatalf("Package %s - dependency %s has more than one repository", p.Name, d.Name)
+	}
+	if d.Branch != "" || d.Version != "" || d.Commit != "" || d.Tree != "" || d.Shallow || d.Depth != 0 || len(d.SparsePaths) != 0 {
+		log.Fatalf("Package %s - dependency %s - branch, version, commit, tree, shallow, depth and sparsePaths attributes are not available for artifacts",
+			p.Name, d.Name)
+	}
+	repository_url(d.Repository)
+	if repository_type(d.Repository) == "conan" {
+		if _, err := conan_reference(d.Artifact); err != nil {
+			log.Fatalf("Package %s - dependency %s - %v", p.Name, d.Name, err)
+		}
+	}
+}
+
+func (artifact_provider) Fetch(p *PacUnit, dir string) {
+	if repository_type(p.repository) == "conan" {
+		p.archive = conan_sources_url(p)
+	}
+	fetch_archive(p)
+}
+
+// Return base URL of a configured repository
+func repository_url(name string) string {
+	uri := strings.TrimSuffix(config_get("repository."+name+".url", ""), "/")
+	if uri == "" {
+		log.Fatalf("Fatal - repository %s is not configured. Set 'repository.%s.url' in the configuration file", name, name)
+	}
+	return uri
+}
+
+// Return type of a configured repository
+func repository_type(name string) string {
+	t := strings.ToLower(config_get("repository."+name+".type", "generic"))
+	if !slices.Contains(repository_types, t) {
+		log.Fatalf("Fatal - repository %s has unknown type '%s'. Must be one of %s", name, t, strings.Join(repository_types, ", "))
+	}
+	return t
+}
+
+// Return archive URL of an artifact. Conan URLs are resolved when the
+// package is fetched.
+func artifact_url(d *DependencyDescriptor) string {
+	base := strings.TrimSuffix(config_get("repository."+d.Repository+".url", d.Repository+":"), "/")
+	if strings.EqualFold(config_get("repository."+d.Repository+".type", ""), "conan") {
+		ref, _ := conan_reference(d.Artifact)
+		return base + "/v2/conans/" + ref.path() + "/latest"
+	}
+	return base + "/" + strings.TrimPrefix(d.Artifact, "/")
+}
+
+// Add credentials of the repository containing an URL to a request. If
+// several repository URLs contain it, the longest one is used.
+func repository_auth(req *http.Request) {
+	uri := req.URL.String()
+	config_once.Do(load_config)
+	repo, longest := "", ""
+	for key, base := range config {
+		name, ok := strings.CutPrefix(key, "repository.")
+		if !ok || !strings.HasSuffix(name, ".url") || base == "" {
+			continue
+		}
+		name = strings.TrimSuffix(name, ".url")
+		base = strings.TrimSuffix(base, "/") + "/"
+		if !strings.HasPrefix(uri, base) || len(base) < len(longest) || (len(base) == len(longest) && name > repo) {
+			continue
+		}
+		repo, longest = name, base
+	}
+	if repo == "" {
+		return
+	}
+	if token := config_get("repository."+repo+".token", ""); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if user := config_get("repository."+repo+".user", ""); user != "" {
+		req.SetBasicAuth(user, config_get("repository."+repo+".password", ""))
+	}
+}
+
+// Send a GET request with the credentials of its repository
+func http_get(uri string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	repository_auth(req)
+	return http_client().Do(req)
+}
+
+// Conan recipe reference
+type ConanRef struct {
+	Name, Version, User, Channel, Revision string
+}
+
+// Parse a recipe reference like 'name/version[@user/channel][#revision]'
+func conan_reference(s string) (ConanRef, error) {
+	var ref ConanRef
+	s, ref.Revision, _ = strings.Cut(s, "#")
+	s, uc, found := strings.Cut(s, "@")
+	var ok bool
+	if ref.Name, ref.Version, ok = strings.Cut(s, "/"); !ok || ref.Name == "" || ref.Version == "" {
+		return ref, fmt.Errorf("invalid Conan reference '%s'", s)
+	}
+	ref.User, ref.Channel = "_", "_"
+	if found {
+		if ref.User, ref.Channel, ok = strings.Cut(uc, "/"); !ok || ref.User == "" || ref.Channel == "" {
+			return ref, fmt.Errorf("invalid Conan reference '%s@%s'", s, uc)
+		}
+	}
+	return ref, nil
+}
+
+// Return path of a recipe in Conan REST API URLs
+func (r ConanRef) path() string {
+	return r.Name + "/" + r.Version + "/" + r.User + "/" + r.Channel
+}
+
+// Return URL of the exported sources of a Conan package, resolving the
+// latest recipe revision if the reference doesn't have one
+func conan_sources_url(p *PacUnit) string {
+	ref, _ := conan_reference(p.artifact)
+	base := repository_url(p.repository) + "/v2/conans/" + ref.path()
+	if ref.Revision == "" {
+		var latest struct{ Revision string }
+		err := with_retries("Package "+p.Name+" - resolving recipe revision", func() (bool, error) {
+			resp, err := http_get(base + "/latest")
+			if err != nil {
+				return transient_download(err), err
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != 200 {
+				err = http_status_error{resp.StatusCode, resp.Status}
+				return transient_download(err), err
+			}
+			return false, json.NewDecoder(resp.Body).Decode(&latest)
+		})
+		if err != nil || latest.Revision == "" {
+			log.Fatalf("Fatal - Package %s - cannot find latest revision of %s - %v", p.Name, p.artifact, err)
+		}
+		ref.Revision = latest.Revision
+		Verbosef("Package %s - recipe revision %s\n", p.Name, ref.Revision)
+	}
+	return base + "/revisions/" + ref.Revision + "/files/conan_sources.tgz"
+}
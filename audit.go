@@ -0,0 +1,412 @@
+package main
+
+/*
+  Vulnerability advisories.
+
+  'cpm audit [--feed <url|file>] [--format text|json] [--allow-unaudited] [<package>]'
+  checks the resolved dependencies of a package against an advisory
+  database and reports the known vulnerabilities. A Git dependency is
+  identified by its repository URL and commit: the checked out commit if
+  the package is in the development tree, or the commit in the lockfile
+  otherwise. An archive dependency is identified by its name and the
+  version in the archive file name, like 'zlib-1.3.1.tar.gz'.
+
+  By default the OSV database (https://osv.dev) is queried by commit. With
+  '--feed' or the 'audit.feed' setting, advisories are read instead from a
+  JSON file or URL with OSV records (an array or an object with a 'vulns'
+  array). A record affects a dependency if one of its 'GIT' ranges is for
+  the same repository and the commit is at or after an 'introduced' event
+  and before the following 'fixed' or 'limit' event, or if its 'versions'
+  list contains a version tag of the commit (or the archive version) and the
+  record is for the same repository or the package name is the dependency
+  name. Commits can be compared only if the repository or its mirror is
+  available; otherwise the advisory cannot be checked. The OSV database
+  is queried by package name and version for archives. Advisories listed in
+  'audit.ignore' are not reported.
+
+  Dependencies that cannot be audited (Mercurial, Subversion and Perforce
+  packages, archives without a version, packages neither fetched nor
+  locked, or advisories that cannot be checked) are reported. The command
+  exits with status 1 if any vulnerability is found or, unless
+  '--allow-unaudited' is given, if any dependency cannot be audited, so it
+  can gate CI pipelines.
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const osv_query_url = "https://api.osv.dev/v1/query"
+
+// Advisory record in OSV format (only the fields used by CPM)
+type osv_vuln struct {
+	Id       string
+	Summary  string
+	Aliases  []string
+	Affected []struct {
+		Package struct {
+			Name string
+		}
+		Ranges []struct {
+			Type   string
+			Repo   string
+			Events []map[string]string
+		}
+		Versions []string
+	}
+	Database_specific struct {
+		Severity string
+	} `json:"database_specific"`
+}
+
+// Vulnerability of a dependency
+type AuditFinding struct {
+	Package  string
+	Uri      string
+	Commit   string
+	Version  string   `json:",omitempty"`
+	Id       string   //advisory identifier
+	Aliases  []string `json:",omitempty"` //CVE and other identifiers
+	Severity string   `json:",omitempty"`
+	Summary  string   `json:",omitempty"`
+	Fixed    []string `json:",omitempty"` //commits or versions fixing the vulnerability
+}
+
+// Dependency to audit
+type audit_target struct {
+	pack    *PacUnit
+	uri     string //repository, empty for archives
+	commit  string //empty for archives
+	version string
+	dir     string //working copy or mirror, empty if not available
+}
+
+var archive_version_re = regexp.MustCompile(`\d+(\.\d+)+`)
+
+// Return the version in the file name of an archive, like '1.3.1' for
+// 'zlib-1.3.1.tar.gz', or an empty string
+func archive_version(uri string) string {
+	name := archive_file_name(uri)
+	for _, ext := range []string{".tar.gz", ".tar.bz2", ".tar.xz", ".tgz", ".zip"} {
+		name = strings.TrimSuffix(name, ext)
+	}
+	found := archive_version_re.FindAllString(name, -1)
+	if len(found) == 0 {
+		return ""
+	}
+	return found[len(found)-1]
+}
+
+// Return true if two versions are the same, ignoring a 'v' prefix
+func same_version(a string, b string) bool {
+	return strings.TrimLeft(a, "vV") == strings.TrimLeft(b, "vV")
+}
+
+// Return true if two repository URLs designate the same repository
+func same_repository(a string, b string) bool {
+	ha, pa := split_uri(a)
+	hb, pb := split_uri(b)
+	return ha == hb && strings.EqualFold(pa, pb)
+}
+
+// Return true if commit 'a' is an ancestor of commit 'b' or the same commit.
+// The second result is false if it cannot be determined because the
+// repository is not available.
+func is_ancestor(dir string, a string, b string) (bool, bool) {
+	if dir == "" {
+		if strings.HasPrefix(b, a) || strings.HasPrefix(a, b) {
+			return true, true
+		}
+		return false, false
+	}
+	return exec.Command("git", "-C", dir, "merge-base", "--is-ancestor", a, b).Run() == nil, true
+}
+
+// Return true if an advisory affects a dependency and false if it doesn't
+// or cannot be checked (third result false). Also returns the events fixing
+// the vulnerability.
+func vuln_affects(v *osv_vuln, t *audit_target) (bool, []string, bool) {
+	affected, known := false, true
+	var fixed []string
+	ancestor := func(a string) bool {
+		is, ok := is_ancestor(t.dir, a, t.commit)
+		known = known && ok
+		return is
+	}
+	for _, a := range v.Affected {
+		//versions apply to the package or repository of the entry
+		ours := strings.EqualFold(a.Package.Name, t.pack.Name) || t.uri != "" && a.Package.Name != "" && same_repository(a.Package.Name, t.uri)
+		for _, r := range a.Ranges {
+			if r.Type != "GIT" || t.uri == "" || !same_repository(r.Repo, t.uri) {
+				continue
+			}
+			ours = true
+			in_range := false
+			for _, e := range r.Events {
+				switch {
+				case e["introduced"] != "":
+					if e["introduced"] == "0" || ancestor(e["introduced"]) {
+						in_range = true
+					}
+				case e["fixed"] != "":
+					fixed = append(fixed, short_hash(e["fixed"]))
+					if in_range && ancestor(e["fixed"]) {
+						in_range = false
+					}
+				case e["limit"] != "":
+					if in_range && ancestor(e["limit"]) {
+						in_range = false
+					}
+				}
+			}
+			affected = affected || in_range
+		}
+		if ours && t.version != "" && slices.ContainsFunc(a.Versions, func(v string) bool { return same_version(v, t.version) }) {
+			return true, fixed, true
+		}
+	}
+	return affected && known, fixed, known
+}
+
+// Read advisories from a file or URL
+func read_advisory_feed(feed string) ([]osv_vuln, error) {
+	var data []byte
+	var err error
+	if strings.HasPrefix(feed, "http://") || strings.HasPrefix(feed, "https://") {
+		var resp *http.Response
+		if resp, err = http_client().Get(feed); err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s - %s", feed, resp.Status)
+		}
+		data, err = io.ReadAll(resp.Body)
+	} else {
+		data, err = os.ReadFile(feed)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var vulns []osv_vuln
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		err = json.Unmarshal(data, &vulns)
+	} else {
+		var doc struct{ Vulns []osv_vuln }
+		err = json.Unmarshal(data, &doc)
+		vulns = doc.Vulns
+	}
+	return vulns, err
+}
+
+// Query OSV database for vulnerabilities affecting a dependency: a commit or,
+// for archives, a package version
+func query_osv(t *audit_target) ([]osv_vuln, error) {
+	var query []byte
+	if t.commit != "" {
+		query, _ = json.Marshal(map[string]string{"commit": t.commit})
+	} else {
+		query, _ = json.Marshal(map[string]any{"package": map[string]string{"name": t.pack.Name}, "version": t.version})
+	}
+	resp, err := http_client().Post(config_get("audit.osv-url", osv_query_url), "application/json", bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OSV query - %s", resp.Status)
+	}
+	var result struct{ Vulns []osv_vuln }
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	return result.Vulns, err
+}
+
+// Return dependencies of root package that can be audited. Also returns
+// the number of dependencies that cannot be audited.
+func audit_targets(root *PacUnit, warn io.Writer) ([]audit_target, int) {
+	lock, _ := read_lockfile(root_lockfile())
+	var targets []audit_target
+	unaudited := 0
+	for _, p := range all_packs {
+		if p == root {
+			continue
+		}
+		if p.archive != "" {
+			t := audit_target{pack: p, version: archive_version(p.archive)}
+			if t.version == "" {
+				fmt.Fprintf(warn, "WARNING - Package %s - no version in archive name %s. Not audited\n", p.Name, archive_file_name(p.archive))
+				unaudited++
+				continue
+			}
+			targets = append(targets, t)
+			continue
+		}
+		if p.Git == "" && p.Https == "" {
+			kind := "local package"
+			if p.provider != "" {
+				kind = "package of provider " + p.provider
+			} else if p.path == "" {
+				kind = package_vcs(p).Name() + " repository"
+			}
+			fmt.Fprintf(warn, "WARNING - Package %s - %s. Not audited\n", p.Name, kind)
+			unaudited++
+			continue
+		}
+		t := audit_target{pack: p, uri: package_uri(p.Git, p.Https)}
+		dir := package_dir(p)
+		if commit, err := (git_vcs{}).Revision(dir); err == nil {
+			t.commit, t.dir = commit, dir
+		} else if lock != nil {
+			for _, e := range lock.Packages {
+				if e.Name == p.Name {
+					t.commit = e.Commit
+				}
+			}
+			if md := mirror_dir(t.uri); mirror_exists(md) {
+				t.dir = md
+			}
+		}
+		if t.commit == "" {
+			fmt.Fprintf(warn, "WARNING - Package %s is not fetched and not locked. Not audited\n", p.Name)
+			unaudited++
+			continue
+		}
+		if t.dir != "" {
+			out, _ := exec.Command("git", "-C", t.dir, "tag", "--points-at", t.commit).Output()
+			if tags := version_tags(strings.Fields(string(out))); len(tags) != 0 {
+				t.version = tags[len(tags)-1]
+			}
+		}
+		targets = append(targets, t)
+	}
+	return targets, unaudited
+}
+
+// Implementation of 'cpm audit [--feed <url|file>] [--format text|json] [--allow-unaudited] [<package>]' command
+func audit(args []string) {
+	flags := flag.NewFlagSet("audit", flag.ExitOnError)
+	feed := flags.String("feed", config_get("audit.feed", ""), "file or URL with advisories in OSV format (default is querying OSV)")
+	format := flags.String("format", "text", "output format (text or json)")
+	allow_unaudited := flags.Bool("allow-unaudited", false, "don't fail if some dependencies cannot be audited")
+	pos := parse_interspersed(flags, args)
+	if len(pos) > 1 || *format != "text" && *format != "json" {
+		log.Fatal("Usage: cpm audit [--feed <url|file>] [--format text|json] [--allow-unaudited] [<package>]")
+	}
+	pkg := ""
+	if len(pos) == 1 {
+		pkg = pos[0]
+	}
+	root := load_tree(pkg)
+	ignore := strings.FieldsFunc(config_get("audit.ignore", ""), func(r rune) bool { return r == ',' || r == ' ' })
+	//warnings don't mix with JSON output
+	var warn io.Writer = os.Stdout
+	if *format == "json" {
+		warn = os.Stderr
+	}
+
+	var feed_vulns []osv_vuln
+	if *feed != "" {
+		var err error
+		if feed_vulns, err = read_advisory_feed(*feed); err != nil {
+			log.Fatalf("Fatal - cannot read advisories from %s - %v", *feed, err)
+		}
+		Verbosef("Read %d advisories from %s\n", len(feed_vulns), *feed)
+	}
+
+	findings := []AuditFinding{}
+	targets, unaudited := audit_targets(root, warn)
+	audited := 0
+	for i := range targets {
+		t := &targets[i]
+		vulns := feed_vulns
+		if *feed == "" {
+			var err error
+			if vulns, err = query_osv(t); err != nil {
+				log.Fatalf("Fatal - Package %s - %v", t.pack.Name, err)
+			}
+		}
+		checked := true
+		for j := range vulns {
+			v := &vulns[j]
+			affected, fixed, known := vuln_affects(v, t)
+			if *feed != "" && !known {
+				fmt.Fprintf(warn, "WARNING - Package %s - cannot check %s without the repository. Fetch the package or create its mirror\n", t.pack.Name, v.Id)
+				checked = false
+				continue
+			}
+			//OSV answers only with advisories affecting the dependency
+			if *feed != "" && !affected {
+				continue
+			}
+			if slices.Contains(ignore, v.Id) || slices.ContainsFunc(v.Aliases, func(a string) bool { return slices.Contains(ignore, a) }) {
+				Verbosef("Package %s - %s ignored\n", t.pack.Name, v.Id)
+				continue
+			}
+			findings = append(findings, AuditFinding{Package: t.pack.Name, Uri: t.uri, Commit: short_hash(t.commit),
+				Version: t.version, Id: v.Id, Aliases: v.Aliases, Severity: v.Database_specific.Severity,
+				Summary: v.Summary, Fixed: fixed})
+		}
+		if checked {
+			audited++
+		} else {
+			unaudited++
+		}
+	}
+
+	if *format == "json" {
+		data, _ := json.MarshalIndent(findings, "", "  ")
+		fmt.Println(string(data))
+	} else {
+		for _, f := range findings {
+			at := f.Commit
+			switch {
+			case f.Commit == "":
+				at = f.Version
+			case f.Version != "":
+				at = f.Version + " (" + f.Commit + ")"
+			}
+			id := f.Id
+			if len(f.Aliases) != 0 {
+				id += " (" + strings.Join(f.Aliases, ", ") + ")"
+			}
+			fmt.Printf("Package %s %s - %s", f.Package, at, id)
+			if f.Severity != "" {
+				fmt.Printf(" [%s]", f.Severity)
+			}
+			fmt.Println()
+			if f.Summary != "" {
+				fmt.Printf("    %s\n", f.Summary)
+			}
+			if len(f.Fixed) != 0 {
+				fmt.Printf("    fixed in %s\n", strings.Join(f.Fixed, ", "))
+			}
+		}
+	}
+	if *format == "text" {
+		if len(findings) != 0 {
+			fmt.Printf("%d vulnerabilities found in %d dependencies\n", len(findings), audited)
+		} else {
+			fmt.Printf("No known vulnerabilities in %d dependencies\n", audited)
+		}
+	}
+	if unaudited != 0 {
+		fmt.Fprintf(warn, "WARNING - %d dependencies not audited\n", unaudited)
+	}
+	if len(findings) != 0 {
+		exit_failed("known vulnerabilities found")
+	}
+	if unaudited != 0 && !*allow_unaudited {
+		exit_failed("dependencies not audited")
+	}
+}
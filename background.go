@@ -0,0 +1,32 @@
+package main
+
+/*
+  Background runs.
+
+  With the '--background' option CPM lowers its CPU and I/O priority before
+  doing anything else. Programs it starts, like Git and build commands,
+  inherit the lower priority, so scheduled prefetch or build jobs don't make
+  the machine unusable for interactive work:
+  - on Linux, the nice value becomes 19 and the I/O scheduling class idle;
+  - on macOS and other Unix systems, the nice value becomes 19;
+  - on Windows, CPM runs in the idle priority class and in background
+    processing mode, which also lowers its I/O and memory priority.
+*/
+
+import (
+	"flag"
+	"fmt"
+)
+
+var background_flag = flag.Bool("background", false, "run at low CPU and I/O priority")
+
+const background_nice = 19 //nice value of background runs
+
+// Lower priority of CPM and of programs it starts
+func setup_background() {
+	if err := lower_priority(); err != nil {
+		fmt.Printf("WARNING - cannot lower priority - %v\n", err)
+		return
+	}
+	Verboseln("Running at low priority")
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+)
+
+const ioprio_who_process = 1
+const ioprio_class_idle = 3
+const ioprio_class_shift = 13
+
+// Set lowest CPU and I/O priority for all threads of CPM. On Linux both
+// are per thread; threads and processes started later inherit them.
+func lower_priority() error {
+	tasks, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return err
+	}
+	for _, t := range tasks {
+		tid, err := strconv.Atoi(t.Name())
+		if err != nil {
+			continue
+		}
+		if err = syscall.Setpriority(syscall.PRIO_PROCESS, tid, background_nice); err != nil {
+			return err
+		}
+		_, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprio_who_process, uintptr(tid), ioprio_class_idle<<ioprio_class_shift)
+		if errno != 0 {
+			Verbosef("Cannot set I/O priority - %v\n", errno)
+		}
+	}
+	return nil
+}
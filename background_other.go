@@ -0,0 +1,10 @@
+//go:build !linux && !windows
+
+package main
+
+import "syscall"
+
+// Set lowest CPU priority for CPM and the processes it starts
+func lower_priority() error {
+	return syscall.Setpriority(syscall.PRIO_PROCESS, 0, background_nice)
+}
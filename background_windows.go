@@ -0,0 +1,23 @@
+package main
+
+import (
+	"syscall"
+)
+
+var proc_set_priority_class = kernel32.NewProc("SetPriorityClass")
+
+const idle_priority_class = 0x40
+const process_mode_background_begin = 0x00100000
+
+// Run in the idle priority class, inherited by child processes, and in
+// background processing mode, which lowers I/O and memory priority
+func lower_priority() error {
+	process, _ := syscall.GetCurrentProcess()
+	if r, _, err := proc_set_priority_class.Call(uintptr(process), idle_priority_class); r == 0 {
+		return err
+	}
+	if r, _, err := proc_set_priority_class.Call(uintptr(process), process_mode_background_begin); r == 0 {
+		Verbosef("Cannot enter background mode - %v\n", err)
+	}
+	return nil
+}
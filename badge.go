@@ -0,0 +1,211 @@
+package main
+
+/*
+  Status page and badges.
+
+  The result of the last build of each package is kept in
+  '<devroot>/.cpm/build-status.json'. The 'cpm badge' command uses it,
+  together with the checked out versions, commit dates and licenses, to
+  produce a static status page of the package tree ('index.html') and SVG
+  badges:
+  - 'packages.svg': number of packages;
+  - 'build.svg': passing if the last build of every package succeeded;
+  - 'freshness.svg': number of packages older than the 'maxAge' of the
+    freshness policy of the root package;
+  - 'licenses.svg': number of packages without a recognized license.
+  The files can be published from CI, for instance with GitHub Pages.
+*/
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Result of the last build of a package
+type BuildStatus struct {
+	Passed bool
+	Time   time.Time
+}
+
+var build_status_mutex sync.Mutex
+
+func build_status_file() string {
+	return filepath.Join(devroot, ".cpm", "build-status.json")
+}
+
+// Read results of last builds
+func load_build_status() map[string]BuildStatus {
+	status := make(map[string]BuildStatus)
+	if data, err := os.ReadFile(build_status_file()); err == nil {
+		json.Unmarshal(data, &status)
+	}
+	return status
+}
+
+// Record result of a package build
+func record_build_status(p *PacUnit, passed bool) {
+	build_status_mutex.Lock()
+	defer build_status_mutex.Unlock()
+	status := load_build_status()
+	status[p.Name] = BuildStatus{passed, time.Now()}
+	data, _ := json.MarshalIndent(status, "", "  ")
+	os.MkdirAll(filepath.Dir(build_status_file()), 0755)
+	if err := os.WriteFile(build_status_file(), data, 0644); err != nil {
+		Verbosef("Cannot save build status - %v\n", err)
+	}
+}
+
+// Package shown on status page
+type PackageHealth struct {
+	Name    string
+	Version string
+	Commit  string
+	Date    time.Time //commit date
+	Stale   bool
+	License string
+	Build   string //passing, failing or unknown
+}
+
+// Implementation of 'cpm badge' command
+func badge(args []string) {
+	flags := flag.NewFlagSet("badge", flag.ExitOnError)
+	output := flags.String("output", "cpm-status", "output folder")
+	pos := parse_interspersed(flags, args)
+	if len(pos) > 1 {
+		log.Fatal("Usage: cpm badge [--output <folder>] [<package>]")
+	}
+	pkg := ""
+	if len(pos) == 1 {
+		pkg = pos[0]
+	}
+	root := load_tree(pkg)
+	status := load_build_status()
+
+	var packs []PackageHealth
+	failing, stale, unlicensed := 0, 0, 0
+	for _, p := range all_packs {
+		dir := package_dir(p)
+		h := PackageHealth{Name: p.Name, Build: "unknown"}
+		h.Version, h.Commit = checked_out(dir)
+		if v := package_version(dir); v != "" {
+			h.Version = v
+		}
+		if out, err := Output("git", "-C", dir, "log", "-1", "--format=%ct", "HEAD"); err == nil {
+			if ts, err := strconv.ParseInt(strings.TrimSpace(out), 10, 64); err == nil {
+				h.Date = time.Unix(ts, 0)
+			}
+		}
+		if root.Freshness != nil && root.Freshness.MaxAge > 0 && !h.Date.IsZero() &&
+			h.Date.AddDate(0, root.Freshness.MaxAge, 0).Before(time.Now()) {
+			h.Stale = true
+			stale++
+		}
+		if p != root {
+			if h.License = detect_license(dir); h.License == "" || h.License == "unknown" {
+				unlicensed++
+			}
+		}
+		if s, ok := status[p.Name]; ok {
+			h.Build = "passing"
+			if !s.Passed {
+				h.Build = "failing"
+				failing++
+			}
+		}
+		packs = append(packs, h)
+	}
+
+	if err := os.MkdirAll(*output, 0755); err != nil {
+		log.Fatalf("Cannot create %s - %v", *output, err)
+	}
+	files := map[string]string{
+		"packages.svg":  badge_svg("packages", strconv.Itoa(len(packs)), "#007ec6"),
+		"build.svg":     badge_svg("build", "passing", "#4c1"),
+		"freshness.svg": badge_svg("freshness", "up to date", "#4c1"),
+		"licenses.svg":  badge_svg("licenses", "ok", "#4c1"),
+	}
+	if failing != 0 {
+		files["build.svg"] = badge_svg("build", fmt.Sprintf("%d failing", failing), "#e05d44")
+	}
+	if stale != 0 {
+		files["freshness.svg"] = badge_svg("freshness", fmt.Sprintf("%d stale", stale), "#dfb317")
+	}
+	if unlicensed != 0 {
+		files["licenses.svg"] = badge_svg("licenses", fmt.Sprintf("%d unknown", unlicensed), "#dfb317")
+	}
+	files["index.html"] = status_page(root, packs)
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(*output, name), []byte(content), 0644); err != nil {
+			log.Fatalf("Cannot write %s - %v", filepath.Join(*output, name), err)
+		}
+	}
+	fmt.Printf("Status page and badges written to %s\n", *output)
+}
+
+// Return SVG badge with a label and a value, in the usual flat style
+func badge_svg(label string, value string, color string) string {
+	lw := 6*len(label) + 10
+	vw := 6*len(value) + 10
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%[1]d" height="20" role="img" aria-label="%[3]s: %[4]s">
+<title>%[3]s: %[4]s</title>
+<rect width="%[2]d" height="20" fill="#555"/>
+<rect x="%[2]d" width="%[6]d" height="20" fill="%[5]s"/>
+<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">
+<text x="%[7]d" y="14">%[3]s</text>
+<text x="%[8]d" y="14">%[4]s</text>
+</g>
+</svg>
+`, lw+vw, lw, html.EscapeString(label), html.EscapeString(value), color, vw, lw/2, lw+vw/2)
+}
+
+// Return HTML status page of package tree
+func status_page(root *PacUnit, packs []PackageHealth) string {
+	var b strings.Builder
+	title := html.EscapeString(root.Name) + " dependencies"
+	fmt.Fprintf(&b, `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>%s</title>
+<style>
+body {font-family: sans-serif; margin: 2em;}
+table {border-collapse: collapse;}
+th, td {border: 1px solid #ccc; padding: 4px 10px; text-align: left;}
+th {background: #eee;}
+.passing {color: #2a2;} .failing {color: #d22;} .stale, .unknown {color: #b80;}
+</style>
+</head>
+<body>
+<h1>%s</h1>
+<p><img src="packages.svg" alt="packages"> <img src="build.svg" alt="build"> <img src="freshness.svg" alt="freshness"> <img src="licenses.svg" alt="licenses"></p>
+<table>
+<tr><th>Package</th><th>Version</th><th>Commit</th><th>Date</th><th>License</th><th>Build</th></tr>
+`, title, title)
+	for _, h := range packs {
+		date, date_class := "", ""
+		if !h.Date.IsZero() {
+			date = h.Date.Format("2006-01-02")
+		}
+		if h.Stale {
+			date_class = ` class="stale"`
+		}
+		license, license_class := h.License, ""
+		if h.Name != root.Name && (license == "" || license == "unknown") {
+			license, license_class = "unknown", ` class="unknown"`
+		}
+		fmt.Fprintf(&b, "<tr><td>%s</td><td>%s</td><td><code>%s</code></td><td%s>%s</td><td%s>%s</td><td class=\"%s\">%s</td></tr>\n",
+			html.EscapeString(h.Name), html.EscapeString(h.Version), html.EscapeString(h.Commit),
+			date_class, date, license_class, html.EscapeString(license), h.Build, h.Build)
+	}
+	fmt.Fprintf(&b, "</table>\n<p>Generated by CPM %s on %s</p>\n</body>\n</html>\n", Version, time.Now().Format("2006-01-02 15:04"))
+	return b.String()
+}
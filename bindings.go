@@ -0,0 +1,165 @@
+package main
+
+/*
+  Language bindings.
+
+  A package can generate bindings for other languages (SWIG, cppyy, pybind11
+  stubs, etc.) after it is built. Each entry of the 'bindings' array of its
+  descriptor has:
+  - 'name': name of the bindings, usually the language, like "python";
+  - 'inputs': files and folders, relative to the package folder, the
+    bindings are generated from. Glob patterns are allowed. Default is the
+    'include' folder;
+  - 'output': folder, relative to the package folder, where the generator
+    writes its output. Default is 'bindings/<name>';
+  - 'commands': generator commands, with the same attributes as build
+    commands.
+
+  Generators run only if their inputs, their commands, or the libraries of
+  the package or of its dependencies changed since they last ran. Outputs
+  are staged in '<devroot>/bindings/<name>/<package>', so that products
+  written in other languages find them in one place.
+
+  The '--bindings' option selects the bindings that are generated (comma
+  separated names) or disables them ('none').
+*/
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+var bindings_flag = flag.String("bindings", "", "bindings to generate (comma separated names or 'none')")
+
+// Bindings generator of a package
+type Binding struct {
+	Name     string
+	Inputs   []string
+	Output   string
+	Commands []Command
+}
+
+// Return true if bindings with given name are selected
+func binding_selected(name string) bool {
+	if *bindings_flag == "" {
+		return true
+	}
+	return slices.ContainsFunc(strings.Split(*bindings_flag, ","), func(s string) bool {
+		return strings.EqualFold(strings.TrimSpace(s), name)
+	})
+}
+
+// Return folder where bindings of a package are staged
+func bindings_dir(name string, pkg string) string {
+	return filepath.Join(devroot, "bindings", name, pkg)
+}
+
+// Return a fingerprint of everything bindings depend on: input files,
+// generator commands and libraries of the package and its dependencies
+func binding_fingerprint(p *PacUnit, b *Binding) string {
+	pacdir := package_dir(p)
+	h := sha256.New()
+	cmds, _ := json.Marshal(b.Commands)
+	h.Write(cmds)
+
+	add := func(path string, info fs.FileInfo) {
+		fmt.Fprintf(h, "%s %d %d\n", filepath.ToSlash(path), info.Size(), info.ModTime().UnixNano())
+	}
+	inputs := b.Inputs
+	if len(inputs) == 0 {
+		inputs = []string{"include"}
+	}
+	for _, pattern := range inputs {
+		matches, _ := filepath.Glob(filepath.Join(pacdir, pattern))
+		for _, m := range matches {
+			filepath.WalkDir(m, func(path string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return nil
+				}
+				if d.IsDir() && path != m && is_owned(path) {
+					return filepath.SkipDir //links to dependencies
+				}
+				if info, err := d.Info(); err == nil && !d.IsDir() {
+					rel, _ := filepath.Rel(pacdir, path)
+					add(rel, info)
+				}
+				return nil
+			})
+		}
+	}
+
+	packs := []*PacUnit{p}
+	for _, d := range p.Depends {
+		if !d.FetchOnly {
+			packs = append(packs, d.pack)
+		}
+	}
+	for _, q := range packs {
+		for _, lib := range package_libs(lib_dir(), q.Name) {
+			if info, err := os.Stat(lib); err == nil {
+				add(filepath.Base(lib), info)
+			}
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Run bindings generators of a package that are selected and out of date
+func generate_bindings(p *PacUnit) {
+	if len(p.Bindings) == 0 || *bindings_flag == "none" {
+		return
+	}
+	pacdir := package_dir(p)
+	stamp_file := filepath.Join(pacdir, ".cpm", "bindings.json")
+	stamps := make(map[string]string)
+	if data, err := os.ReadFile(stamp_file); err == nil {
+		json.Unmarshal(data, &stamps)
+	}
+
+	for i := range p.Bindings {
+		b := &p.Bindings[i]
+		if b.Name == "" {
+			log.Fatalf("Package %s - bindings must have a name", p.Name)
+		}
+		if !binding_selected(b.Name) {
+			continue
+		}
+		output := b.Output
+		if output == "" {
+			output = filepath.Join("bindings", b.Name)
+		}
+		outdir := filepath.Join(pacdir, output)
+		stage := bindings_dir(b.Name, p.Name)
+
+		fingerprint := binding_fingerprint(p, b)
+		if _, err := os.Stat(stage); err == nil && stamps[b.Name] == fingerprint {
+			Verbosef("Package %s - %s bindings are up to date\n", p.Name, b.Name)
+			continue
+		}
+		fmt.Printf("Package %s - generating %s bindings\n", p.Name, b.Name)
+		os.MkdirAll(outdir, 0755)
+		if ret, err := exec_commands(pacdir, b.Commands, package_envs[p], nil); ret != 0 {
+			log.Fatalf("Package %s - %s bindings generator failed - %v", p.Name, b.Name, err)
+		}
+		if _, err := os.Stat(outdir); err != nil {
+			log.Fatalf("Package %s - %s bindings generator didn't create %s", p.Name, b.Name, outdir)
+		}
+		os.MkdirAll(stage, 0755)
+		sync_tree(outdir, stage, true)
+
+		//inputs may have been changed by the generator
+		stamps[b.Name] = binding_fingerprint(p, b)
+		os.MkdirAll(filepath.Dir(stamp_file), 0755)
+		data, _ := json.MarshalIndent(stamps, "", "  ")
+		os.WriteFile(stamp_file, data, 0644)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+/*
+  Bug reports.
+
+  The 'cpm report-bug' command gathers in a compressed tar file the
+  information needed to investigate a problem:
+  - 'envinfo.txt' with CPM version, OS, Git version and relevant environment
+    variables;
+  - the user and development tree configuration files;
+  - descriptors and local overlays of the root package and of the packages
+    in the development tree, and the lockfile of the root package;
+  - build logs and build history of the last run.
+
+  Before they are added, files are sanitized: credentials in URLs, values of
+  attributes and settings whose names look like secrets (tokens, passwords,
+  keys) and values of secret environment variables are replaced by '***',
+  and the home folder is replaced by '~'.
+*/
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Environment variables included in bug reports
+var report_env = []string{"PATH", "SHELL", "COMSPEC", "MSYSTEM", "CC", "CXX",
+	"CFLAGS", "CXXFLAGS", "LDFLAGS", "DEV_ROOT", "CPM_HOME", "CPM_PROFILE"}
+
+var secret_name = regexp.MustCompile(`(?i)token|secret|passw|credential|api_?key|private_?key`)
+var url_credentials = regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://)[^/@\s"']+@`)
+var secret_value = regexp.MustCompile(`(?i)("?[\w.-]*(token|secret|passw|credential|api_?key|private_?key)[\w.-]*"?\s*[:=]\s*)("[^"]*"|[^\s,}]+)`)
+
+// Implementation of 'cpm report-bug' command
+func report_bug(args []string) {
+	flags := flag.NewFlagSet("report-bug", flag.ExitOnError)
+	output := flags.String("output", "", "report file name")
+	pos := parse_interspersed(flags, args)
+	if len(pos) > 1 {
+		log.Fatal("Usage: cpm report-bug [--output <file>] [<package>]")
+	}
+	pkg := ""
+	if len(pos) == 1 {
+		pkg = pos[0]
+	}
+	if *output == "" {
+		*output = "cpm-bug-" + time.Now().Format("20060102-150405") + ".tar.gz"
+	}
+	_, descriptor := find_root(pkg)
+	rootdir := filepath.Dir(descriptor)
+
+	f, err := os.Create(*output)
+	if err != nil {
+		log.Fatalf("Cannot create %s - %v", *output, err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	count := 0
+	add := func(name string, fname string) {
+		data, err := os.ReadFile(fname)
+		if err != nil {
+			return
+		}
+		if err = add_report_file(tw, name, sanitize(string(data))); err != nil {
+			log.Fatalf("Cannot write %s - %v", *output, err)
+		}
+		Verbosef("Added %s\n", fname)
+		count++
+	}
+
+	if err = add_report_file(tw, "envinfo.txt", sanitize(env_info())); err != nil {
+		log.Fatalf("Cannot write %s - %v", *output, err)
+	}
+	add("config/user", filepath.Join(cpm_home(), "config"))
+	add("config/tree", filepath.Join(devroot, ".cpm", "config"))
+
+	//root package may be outside the development tree
+	dirs := []string{rootdir}
+	if entries, err := os.ReadDir(devroot); err == nil {
+		for _, e := range entries {
+			dir := filepath.Join(devroot, e.Name())
+			if e.IsDir() && dir != rootdir {
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+	for _, dir := range dirs {
+		name := filepath.Base(dir)
+		add("descriptors/"+name+"/"+descriptor_name, filepath.Join(dir, descriptor_name))
+		add("descriptors/"+name+"/"+overlay_name, filepath.Join(dir, overlay_name))
+	}
+	add(lockfile_name, filepath.Join(rootdir, lockfile_name))
+
+	logs, _ := filepath.Glob(filepath.Join(devroot, ".cpm", "logs", "*.log"))
+	for _, fname := range logs {
+		add("logs/"+filepath.Base(fname), fname)
+	}
+	add("logs/history.json", history_file())
+
+	if err = tw.Close(); err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		log.Fatalf("Cannot write %s - %v", *output, err)
+	}
+	fmt.Printf("Created bug report %s with %d files\n", *output, count+1)
+	fmt.Println("Please review its content before attaching it to an issue at https://github.com/neacsum/cpm/issues")
+}
+
+// Add a file to bug report archive
+func add_report_file(tw *tar.Writer, name string, content string) error {
+	hdr := &tar.Header{
+		Name:    "cpm-bug/" + name,
+		Mode:    0644,
+		Size:    int64(len(content)),
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write([]byte(content))
+	return err
+}
+
+// Return description of the environment CPM runs in
+func env_info() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "CPM version: %s\n", Version)
+	fmt.Fprintf(&b, "OS: %s/%s\n", runtime.GOOS, runtime.GOARCH)
+	fmt.Fprintf(&b, "Go runtime: %s\n", runtime.Version())
+	if out, err := Output("git", "--version"); err == nil {
+		fmt.Fprintf(&b, "Git: %s\n", strings.TrimSpace(out))
+	} else {
+		fmt.Fprintf(&b, "Git: not found\n")
+	}
+	fmt.Fprintf(&b, "Command line: %s\n", strings.Join(os.Args, " "))
+	fmt.Fprintf(&b, "Development tree: %s\n", devroot)
+	fmt.Fprintf(&b, "CPM home: %s\n", cpm_home())
+	fmt.Fprintf(&b, "\nEnvironment:\n")
+	for _, name := range report_env {
+		if v, ok := os.LookupEnv(name); ok {
+			fmt.Fprintf(&b, "  %s=%s\n", name, v)
+		}
+	}
+	return b.String()
+}
+
+// Remove credentials and personal information from text
+func sanitize(s string) string {
+	s = url_credentials.ReplaceAllString(s, "${1}***@")
+	s = secret_value.ReplaceAllStringFunc(s, func(m string) string {
+		sub := secret_value.FindStringSubmatch(m)
+		if strings.HasPrefix(sub[3], "\"") {
+			return sub[1] + "\"***\""
+		}
+		return sub[1] + "***"
+	})
+
+	//values of secret environment variables, longest first
+	var secrets []string
+	for _, kv := range os.Environ() {
+		if name, value, ok := strings.Cut(kv, "="); ok && len(value) >= 4 && secret_name.MatchString(name) {
+			secrets = append(secrets, value)
+		}
+	}
+	sort.Slice(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+	for _, v := range secrets {
+		s = strings.ReplaceAll(s, v, "***")
+	}
+
+	if home, err := os.UserHomeDir(); err == nil && len(home) > 1 {
+		s = strings.ReplaceAll(s, home, "~")
+	}
+	return s
+}
@@ -0,0 +1,620 @@
+package main
+
+/*
+  Build cache.
+
+  Build outputs of packages can be shared through a cache, so that CI
+  machines and developers download prebuilt libraries instead of compiling
+  dependencies. The cache is selected by the 'cache.url' setting:
+    cache.url = /mnt/share/cpm-cache                  (local or network folder)
+    cache.url = https://cache.example.com/cpm         (HTTP server)
+    cache.url = s3://cpm-cache/builds                 (S3-compatible storage)
+  Before building a package, CPM computes its cache key, a hash of:
+  - its source files: the tracked files of Git packages, with their
+    current content, or all files of other packages, except symbolic links
+    and the package outputs. Untracked files, like build outputs that are
+    not ignored, are left out so that all checkouts of a commit have the
+    same key;
+  - its build commands, the post-build commands of its dependencies and its
+    build environment, with the development tree folder replaced by
+    ${DEV_ROOT};
+  - the cache keys of its build dependencies;
+  - the toolchain: the host and target platforms, the versions shown by the
+    C and C++ compilers ('CC' and 'CXX' environment variables, or 'cc' and
+    'c++'; 'cl' on Windows) and the versions of the tools in its 'requires'
+    attribute.
+  If the cache has an artifact for the key, it is extracted instead of
+  running the build commands. The artifact holds the libraries of the
+  package in the lib folder, that is the files named after the package and
+  all files the build wrote in the folder (like 'zlibstatic.lib' or
+  'libfoo.so.1'), and the files and folders listed in the 'outputs'
+  attribute of its descriptor, relative to the package folder:
+    "outputs": ["bin", "include/generated"]
+  With 'cache.upload = true', usually set on CI machines, artifacts of
+  packages that were built are uploaded to the cache. Cache errors are not
+  fatal: the package is built as if it were not in the cache.
+
+  HTTP caches use GET and PUT requests on '<url>/<key>.tar.gz', with the
+  'cache.token' (bearer) or 'cache.user' and 'cache.password' (basic)
+  credentials. S3 caches use the 'cache.s3.endpoint' (default is AWS),
+  'cache.s3.region' (default is us-east-1), 'cache.s3.access-key' and
+  'cache.s3.secret-key' settings or the AWS_ACCESS_KEY_ID,
+  AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables. Other
+  backends can be added by implementing the CacheBackend interface.
+*/
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var no_build_cache = flag.Bool("no-build-cache", false, "don't use the build cache")
+
+// Storage of build artifacts
+type CacheBackend interface {
+	Name() string
+	Get(key string, fname string) (bool, error) //download artifact to file; false if not in cache
+	Put(key string, fname string) error         //upload artifact from file
+}
+
+var cache_backend CacheBackend
+var build_cache_once sync.Once
+
+var build_cache_keys = make(map[*PacUnit]string)
+var build_cache_mutex sync.Mutex
+
+var toolchain string
+var toolchain_once sync.Once
+
+// Return the configured build cache or nil if there is none
+func build_cache() CacheBackend {
+	build_cache_once.Do(func() {
+		uri := config_get("cache.url", "")
+		if uri == "" || *no_build_cache {
+			return
+		}
+		u, err := url.Parse(uri)
+		switch {
+		case err == nil && (u.Scheme == "http" || u.Scheme == "https"):
+			cache_backend = http_cache{strings.TrimSuffix(uri, "/")}
+		case err == nil && u.Scheme == "s3":
+			cache_backend = new_s3_cache(u)
+		case err == nil && u.Scheme == "file":
+			cache_backend = dir_cache{filepath.FromSlash(u.Path)}
+		default:
+			cache_backend = dir_cache{uri}
+		}
+		Verbosef("Using %s build cache %s\n", cache_backend.Name(), uri)
+	})
+	return cache_backend
+}
+
+// Return true if built packages are uploaded to the cache
+func cache_upload() bool {
+	return strings.EqualFold(config_get("cache.upload", ""), "true")
+}
+
+// Return description of the compilers and target platform
+func toolchain_id() string {
+	toolchain_once.Do(func() {
+		cc, cxx := "cc", "c++"
+		if runtime.GOOS == "windows" {
+			cc, cxx = "cl", "cl"
+		}
+		toolchain = fmt.Sprintf("%s/%s %s %s %s", runtime.GOOS, runtime.GOARCH, target_os(), target_name, target_variant)
+		for _, c := range []struct{ env, def string }{{"CC", cc}, {"CXX", cxx}} {
+			prog := os.Getenv(c.env)
+			if prog == "" {
+				prog = c.def
+			}
+			args := []string{"--version"}
+			if filepath.Base(strings.TrimSuffix(strings.ToLower(prog), ".exe")) == "cl" {
+				args = nil
+			}
+			v, err := probe_version(append([]string{prog}, args...))
+			if err != nil {
+				v = "none"
+			}
+			toolchain += fmt.Sprintf(" %s=%s %s", c.env, filepath.Base(prog), v)
+		}
+	})
+	return toolchain
+}
+
+// Return true if path is an output of package p, relative to package folder
+func is_output(p *PacUnit, path string) bool {
+	return slices.ContainsFunc(p.Outputs, func(out string) bool {
+		out = filepath.Clean(filepath.FromSlash(out))
+		return path == out || strings.HasPrefix(path, out+string(filepath.Separator))
+	})
+}
+
+// Return the source files of a package folder, relative to the folder: the
+// tracked files of Git packages, so that untracked build outputs are left
+// out, or all files of other packages
+func source_files(dir string) []string {
+	if v := folder_vcs(dir); v != nil && v.Name() == "git" {
+		if out, err := Output("git", "-C", dir, "ls-files", "-z", "--cached"); err == nil {
+			var files []string
+			for _, f := range strings.Split(out, "\x00") {
+				if f != "" {
+					files = append(files, filepath.FromSlash(f))
+				}
+			}
+			return files
+		}
+	}
+	return package_files(dir)
+}
+
+// Return the build cache key of a package
+func build_cache_key(p *PacUnit) string {
+	build_cache_mutex.Lock()
+	key, ok := build_cache_keys[p]
+	build_cache_mutex.Unlock()
+	if ok {
+		return key
+	}
+
+	h := sha256.New()
+	dir := package_dir(p)
+	var files []string
+	for _, rel := range source_files(dir) {
+		if fi, err := os.Lstat(filepath.Join(dir, rel)); err == nil && fi.Mode()&fs.ModeSymlink != 0 || is_output(p, rel) {
+			continue
+		}
+		files = append(files, rel)
+	}
+	hash_files(h, dir, files)
+	commands, _ := json.Marshal(build_commands(p))
+	fmt.Fprintf(h, "%s\n", strings.ReplaceAll(string(commands), devroot, "${DEV_ROOT}"))
+	for _, d := range p.Depends {
+		if d.FetchOnly {
+			continue
+		}
+		post, _ := json.Marshal(d.Post)
+		fmt.Fprintf(h, "%s %s %s\n", d.Name, build_cache_key(d.pack), strings.ReplaceAll(string(post), devroot, "${DEV_ROOT}"))
+	}
+	fmt.Fprintf(h, "%s\n", strings.ReplaceAll(fmt.Sprintf("%q", env_list(package_envs[p])), devroot, "${DEV_ROOT}"))
+	fmt.Fprintf(h, "%s\n", toolchain_id())
+	for _, req := range p.Requires {
+		if len(req.Probe) == 0 {
+			req.Probe = []string{req.Name, "--version"}
+		}
+		v, _ := probe_version(req.Probe)
+		fmt.Fprintf(h, "%s %s\n", req.Name, v)
+	}
+	key = hex.EncodeToString(h.Sum(nil))
+
+	build_cache_mutex.Lock()
+	build_cache_keys[p] = key
+	build_cache_mutex.Unlock()
+	return key
+}
+
+// Extract the cached artifact of package p instead of building it. Libraries
+// are extracted in folder libdir. Returns true if the artifact was found.
+func restore_build(p *PacUnit, libdir string) bool {
+	cache := build_cache()
+	if cache == nil {
+		return false
+	}
+	key := build_cache_key(p)
+	tmp, err := os.CreateTemp("", "cpm-cache")
+	if err != nil {
+		return false
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	found, err := cache.Get(key, tmp.Name())
+	if err != nil {
+		fmt.Printf("WARNING - package %s - cannot download from build cache - %v\n", p.Name, err)
+		return false
+	}
+	if !found {
+		Verbosef("Package %s - not in build cache (%s)\n", p.Name, key[:12])
+		return false
+	}
+	if err = read_artifact(tmp.Name(), libdir, package_dir(p)); err != nil {
+		fmt.Printf("WARNING - package %s - cannot extract build cache artifact - %v\n", p.Name, err)
+		return false
+	}
+	fmt.Printf("Package %s - restored from build cache\n", p.Name)
+	return true
+}
+
+// Upload the artifact of a package that was built. Libraries are the files
+// of folder libdir that changed since stamps 'before' were taken.
+func store_build(p *PacUnit, libdir string, before map[string]file_stamp) {
+	cache := build_cache()
+	if cache == nil || !cache_upload() {
+		return
+	}
+	key := build_cache_key(p)
+	tmp, err := os.CreateTemp("", "cpm-cache")
+	if err != nil {
+		return
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	if err = write_artifact(p, tmp.Name(), libdir, build_libs(p, libdir, before)); err == nil {
+		err = cache.Put(key, tmp.Name())
+	}
+	if err != nil {
+		fmt.Printf("WARNING - package %s - cannot upload to build cache - %v\n", p.Name, err)
+		return
+	}
+	Verbosef("Package %s - uploaded to build cache (%s)\n", p.Name, key[:12])
+}
+
+// Return the libraries of package p in folder libdir, relative to the
+// folder: the files named after the package and the files that changed since
+// stamps 'before' were taken, except libraries of other packages built at the
+// same time
+func build_libs(p *PacUnit, libdir string, before map[string]file_stamp) []string {
+	var libs []string
+	for _, lib := range package_libs(libdir, p.Name) {
+		rel, _ := filepath.Rel(libdir, lib)
+		libs = append(libs, rel)
+	}
+	for _, rel := range changed_files(libdir, before) {
+		if slices.Contains(libs, rel) {
+			continue
+		}
+		if slices.ContainsFunc(all_packs, func(q *PacUnit) bool {
+			return q != p && is_package_lib(filepath.Base(rel), q.Name)
+		}) {
+			continue
+		}
+		libs = append(libs, rel)
+	}
+	return libs
+}
+
+// Write the libraries and outputs of a package in a compressed tar file.
+// Libraries, relative to folder libdir, are under 'lib/' and outputs under
+// 'pkg/'.
+func write_artifact(p *PacUnit, fname string, libdir string, libs []string) error {
+	f, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	add := func(path string, name string) error {
+		fi, err := os.Stat(path)
+		if err != nil || !fi.Mode().IsRegular() {
+			return nil
+		}
+		hdr, _ := tar.FileInfoHeader(fi, "")
+		hdr.Name = filepath.ToSlash(name)
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		_, err = io.Copy(tw, in)
+		return err
+	}
+	for _, rel := range libs {
+		if err = add(filepath.Join(libdir, rel), filepath.Join("lib", rel)); err != nil {
+			return err
+		}
+	}
+	dir := package_dir(p)
+	for _, out := range p.Outputs {
+		root := filepath.Join(dir, filepath.FromSlash(out))
+		err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			rel, _ := filepath.Rel(dir, path)
+			return add(path, filepath.Join("pkg", rel))
+		})
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// Extract an artifact: libraries in folder libdir and outputs in package
+// folder pkgdir
+func read_artifact(fname string, libdir string, pkgdir string) error {
+	f, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		dir := pkgdir
+		name, ok := strings.CutPrefix(hdr.Name, "pkg/")
+		if lname, isLib := strings.CutPrefix(hdr.Name, "lib/"); isLib {
+			dir, name, ok = libdir, lname, true
+		}
+		if !ok || hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		dst, err := entry_path(dir, name)
+		if err != nil {
+			return err
+		}
+		if err = write_entry(dst, hdr.FileInfo().Mode(), tr); err != nil {
+			return err
+		}
+	}
+}
+
+// Copy a file, replacing the destination atomically
+func copy_file(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	os.MkdirAll(filepath.Dir(dst), 0755)
+	out, err := os.CreateTemp(filepath.Dir(dst), ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), dst)
+	}
+	if err != nil {
+		os.Remove(out.Name())
+	}
+	return err
+}
+
+// Cache in a local or network folder
+type dir_cache struct {
+	dir string
+}
+
+func (c dir_cache) Name() string { return "folder" }
+
+func (c dir_cache) Get(key string, fname string) (bool, error) {
+	src := filepath.Join(c.dir, key+".tar.gz")
+	err := copy_file(src, fname)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err == nil {
+		//'cpm maintain' removes artifacts by time of last use
+		now := time.Now()
+		os.Chtimes(src, now, now)
+	}
+	return err == nil, err
+}
+
+func (c dir_cache) Put(key string, fname string) error {
+	return copy_file(fname, filepath.Join(c.dir, key+".tar.gz"))
+}
+
+// Cache on an HTTP server accepting PUT requests
+type http_cache struct {
+	base string
+}
+
+func (c http_cache) Name() string { return "HTTP" }
+
+// Add cache credentials to a request
+func (c http_cache) auth(req *http.Request) {
+	if token := config_get("cache.token", ""); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if user := config_get("cache.user", ""); user != "" {
+		req.SetBasicAuth(user, config_get("cache.password", ""))
+	}
+}
+
+func (c http_cache) Get(key string, fname string) (bool, error) {
+	req, err := http.NewRequest("GET", c.base+"/"+key+".tar.gz", nil)
+	if err != nil {
+		return false, err
+	}
+	c.auth(req)
+	return get_artifact(req, fname)
+}
+
+func (c http_cache) Put(key string, fname string) error {
+	req, _, err := new_upload(c.base+"/"+key+".tar.gz", fname)
+	if err != nil {
+		return err
+	}
+	c.auth(req)
+	return put_artifact(req)
+}
+
+// Send a request downloading an artifact to a file. Returns false if the
+// artifact doesn't exist.
+func get_artifact(req *http.Request, fname string) (bool, error) {
+	resp, err := http_client().Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, http_status_error{resp.StatusCode, resp.Status}
+	}
+	out, err := os.Create(fname)
+	if err != nil {
+		return false, err
+	}
+	_, err = io.Copy(out, resp.Body)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err == nil, err
+}
+
+// Return a PUT request uploading a file and the hex SHA-256 hash of the file
+func new_upload(uri string, fname string) (*http.Request, string, error) {
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, "", err
+	}
+	req, err := http.NewRequest("PUT", uri, bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Content-Type", "application/gzip")
+	sum := sha256.Sum256(data)
+	return req, hex.EncodeToString(sum[:]), nil
+}
+
+// Send an upload request
+func put_artifact(req *http.Request) error {
+	resp, err := http_client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return http_status_error{resp.StatusCode, resp.Status}
+	}
+	return nil
+}
+
+// Cache in S3-compatible storage. Objects are addressed with path-style
+// URLs, which all S3-compatible services accept.
+type s3_cache struct {
+	endpoint, bucket, prefix, region string
+	access, secret, session          string
+}
+
+func new_s3_cache(u *url.URL) s3_cache {
+	c := s3_cache{bucket: u.Host, prefix: strings.Trim(u.Path, "/")}
+	c.region = config_get("cache.s3.region", "us-east-1")
+	c.endpoint = strings.TrimSuffix(config_get("cache.s3.endpoint", "https://s3."+c.region+".amazonaws.com"), "/")
+	c.access = config_get("cache.s3.access-key", os.Getenv("AWS_ACCESS_KEY_ID"))
+	c.secret = config_get("cache.s3.secret-key", os.Getenv("AWS_SECRET_ACCESS_KEY"))
+	c.session = os.Getenv("AWS_SESSION_TOKEN")
+	return c
+}
+
+func (c s3_cache) Name() string { return "S3" }
+
+// Return URL of an object
+func (c s3_cache) object(key string) string {
+	path := "/" + url.PathEscape(c.bucket)
+	if c.prefix != "" {
+		for _, seg := range strings.Split(c.prefix, "/") {
+			path += "/" + url.PathEscape(seg)
+		}
+	}
+	return c.endpoint + path + "/" + key + ".tar.gz"
+}
+
+func hmac_sha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// Sign a request with AWS Signature Version 4. Payload is the hex SHA-256
+// hash of the request body. Requests are anonymous without access key.
+func (c s3_cache) sign(req *http.Request, payload string) {
+	if c.access == "" {
+		return
+	}
+	now := time.Now().UTC()
+	amzdate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzdate)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+	headers := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	values := []string{req.URL.Host, payload, amzdate}
+	if c.session != "" {
+		req.Header.Set("X-Amz-Security-Token", c.session)
+		headers = append(headers, "x-amz-security-token")
+		values = append(values, c.session)
+	}
+	var canonical strings.Builder
+	fmt.Fprintf(&canonical, "%s\n%s\n\n", req.Method, req.URL.EscapedPath())
+	for i, h := range headers {
+		fmt.Fprintf(&canonical, "%s:%s\n", h, values[i])
+	}
+	signed := strings.Join(headers, ";")
+	fmt.Fprintf(&canonical, "\n%s\n%s", signed, payload)
+
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonical.String()))
+	to_sign := "AWS4-HMAC-SHA256\n" + amzdate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+	key := hmac_sha256([]byte("AWS4"+c.secret), date)
+	key = hmac_sha256(key, c.region)
+	key = hmac_sha256(key, "s3")
+	key = hmac_sha256(key, "aws4_request")
+	signature := hex.EncodeToString(hmac_sha256(key, to_sign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.access, scope, signed, signature))
+}
+
+func (c s3_cache) Get(key string, fname string) (bool, error) {
+	req, err := http.NewRequest("GET", c.object(key), nil)
+	if err != nil {
+		return false, err
+	}
+	empty := sha256.Sum256(nil)
+	c.sign(req, hex.EncodeToString(empty[:]))
+	found, err := get_artifact(req, fname)
+	var status http_status_error
+	if errors.As(err, &status) && status.code == http.StatusForbidden && c.access == "" {
+		//anonymous requests for missing objects are forbidden
+		return false, nil
+	}
+	return found, err
+}
+
+func (c s3_cache) Put(key string, fname string) error {
+	req, payload, err := new_upload(c.object(key), fname)
+	if err != nil {
+		return err
+	}
+	c.sign(req, payload)
+	return put_artifact(req)
+}
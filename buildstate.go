@@ -0,0 +1,185 @@
+package main
+
+/*
+  Incremental builds.
+
+  After a package is built, CPM records in '<devroot>/.cpm/state.json' a
+  hash of its build inputs:
+  - the content of its files: for Git packages, tracked files and untracked
+    files that are not ignored; for other packages, all files. Symbolic
+    links, like those to dependencies, are hashed by their target;
+  - its build commands, after profiles and overrides, the post-build
+    commands of its dependencies and its build environment;
+  - the selected target;
+  - its libraries in the lib folder;
+  - the recorded hashes of its build dependencies.
+  The hash is computed after the build, so files written by the build are
+  part of it. On the next run, packages whose hash didn't change are not
+  built again; a package is rebuilt when one of its dependencies was. The
+  '--force-build' option builds all packages.
+*/
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var force_build_flag = flag.Bool("force-build", false, "build packages whose inputs didn't change")
+
+// Inputs of last successful build of a package
+type BuildState struct {
+	Hash  string
+	Built time.Time
+}
+
+// Folders of package metadata
+var metadata_dirs = []string{".git", ".hg", ".svn", ".cpm"}
+
+var build_state map[string]BuildState
+var build_state_once sync.Once
+var build_state_mutex sync.Mutex
+
+func build_state_file() string {
+	return filepath.Join(devroot, ".cpm", "state.json")
+}
+
+// Return recorded state of a package
+func package_state(name string) (BuildState, bool) {
+	build_state_once.Do(func() {
+		build_state = make(map[string]BuildState)
+		if data, err := os.ReadFile(build_state_file()); err == nil {
+			json.Unmarshal(data, &build_state)
+		}
+	})
+	build_state_mutex.Lock()
+	defer build_state_mutex.Unlock()
+	st, ok := build_state[name]
+	return st, ok
+}
+
+// Return files of a package folder, relative to the folder
+func package_files(dir string) []string {
+	var files []string
+	if v := folder_vcs(dir); v != nil && v.Name() == "git" {
+		if out, err := Output("git", "-C", dir, "ls-files", "-z", "--cached", "--others", "--exclude-standard"); err == nil {
+			for _, f := range strings.Split(out, "\x00") {
+				if f != "" && !strings.HasPrefix(f, ".cpm/") {
+					files = append(files, filepath.FromSlash(f))
+				}
+			}
+			//files both tracked and modified are listed twice
+			slices.Sort(files)
+			return slices.Compact(files)
+		}
+	}
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() && path != dir && (slices.Contains(metadata_dirs, d.Name()) || is_owned(path)) {
+			return filepath.SkipDir
+		}
+		if !d.IsDir() {
+			rel, _ := filepath.Rel(dir, path)
+			files = append(files, rel)
+		}
+		return nil
+	})
+	return files
+}
+
+// Write names and content of files of folder dir to a hash
+func hash_files(h io.Writer, dir string, files []string) {
+	for _, rel := range files {
+		path := filepath.Join(dir, rel)
+		fi, err := os.Lstat(path)
+		switch {
+		case err != nil:
+			fmt.Fprintf(h, "%s missing\n", rel)
+		case fi.Mode()&fs.ModeSymlink != 0:
+			target, _ := os.Readlink(path)
+			fmt.Fprintf(h, "%s -> %s\n", rel, target)
+		case fi.Mode().IsRegular():
+			fmt.Fprintf(h, "%s %d\n", rel, fi.Size())
+			if f, err := os.Open(path); err == nil {
+				io.Copy(h, f)
+				f.Close()
+			}
+		}
+	}
+}
+
+// Return hash of the build inputs of a package
+func input_hash(p *PacUnit) string {
+	h := sha256.New()
+	dir := package_dir(p)
+	hash_files(h, dir, package_files(dir))
+	commands, _ := json.Marshal(build_commands(p))
+	h.Write(commands)
+	for _, d := range p.Depends {
+		if d.FetchOnly {
+			continue
+		}
+		post, _ := json.Marshal(d.Post)
+		st, _ := package_state(d.Name)
+		fmt.Fprintf(h, "\n%s %s %s", d.Name, st.Hash, post)
+	}
+	fmt.Fprintf(h, "\n%q\n%s %s %s\n", env_list(package_envs[p]), target_os(), target_name, target_variant)
+	for _, lib := range package_libs(lib_dir(), p.Name) {
+		if fi, err := os.Stat(lib); err == nil {
+			fmt.Fprintf(h, "%s %d %d\n", filepath.Base(lib), fi.Size(), fi.ModTime().UnixNano())
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Return true if the inputs of a package didn't change since its last
+// successful build
+func build_unchanged(p *PacUnit) bool {
+	if *force_build_flag {
+		return false
+	}
+	st, ok := package_state(p.Name)
+	return ok && st.Hash == input_hash(p)
+}
+
+// Record inputs of a successful build
+func record_build_state(p *PacUnit) {
+	hash := input_hash(p)
+	package_state(p.Name)
+	build_state_mutex.Lock()
+	defer build_state_mutex.Unlock()
+	build_state[p.Name] = BuildState{hash, time.Now()}
+	save_build_state()
+}
+
+// Forget the last build of a package, so it is built on the next run
+func forget_build_state(p *PacUnit) {
+	if _, ok := package_state(p.Name); !ok {
+		return
+	}
+	build_state_mutex.Lock()
+	defer build_state_mutex.Unlock()
+	delete(build_state, p.Name)
+	save_build_state()
+}
+
+// Write recorded build states. Called with build_state_mutex locked.
+func save_build_state() {
+	data, _ := json.MarshalIndent(build_state, "", "  ")
+	os.MkdirAll(filepath.Dir(build_state_file()), 0755)
+	if err := os.WriteFile(build_state_file(), data, 0644); err != nil {
+		Verbosef("Cannot save %s - %v\n", build_state_file(), err)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+/*
+  Offline bundles.
+
+  The 'cpm bundle' command packs the repositories of a package and of all its
+  dependencies, at the commits currently checked out, in a single compressed
+  tar file. The file contains a Git bundle for each repository and a
+  'bundle.json' file listing the packages with their folder, URL, branch and
+  commit. Shallow clones don't have the history a bundle needs and cannot be
+  bundled. Local packages are bundled only if their folder, inside the
+  development tree, is a repository of its own.
+
+  With the '--offline <file>' option, CPM restores the repositories from the
+  bundle in their folders, checking out the recorded branches at the
+  recorded commits, and then works in local-only mode without any network
+  access.
+*/
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var offline_flag = flag.String("offline", "", "restore packages from bundle and work offline")
+
+const bundle_manifest = "bundle.json"
+
+// Package in a bundle
+type BundleEntry struct {
+	Name   string
+	Folder string `json:",omitempty"` //package folder relative to devroot, if not the package name
+	Uri    string
+	Branch string
+	Commit string
+}
+
+type BundleManifest struct {
+	Packages []BundleEntry
+}
+
+// Implementation of 'cpm bundle' command
+func bundle(args []string) {
+	flags := flag.NewFlagSet("bundle", flag.ExitOnError)
+	output := flags.String("output", "", "bundle file name")
+	pos := parse_interspersed(flags, args)
+	if len(pos) > 1 {
+		log.Fatal("Usage: cpm bundle [--output <file>] [<package>]")
+	}
+	pkg := ""
+	if len(pos) == 1 {
+		pkg = pos[0]
+	}
+	root := load_tree(pkg)
+	if *output == "" {
+		*output = root.Name + "-bundle.tar.gz"
+	}
+
+	tmp, err := os.MkdirTemp("", "cpm-bundle")
+	if err != nil {
+		log.Fatalf("Cannot create temporary folder - %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var m BundleManifest
+	for _, p := range all_packs {
+		dir := package_dir(p)
+		folder, err := filepath.Rel(devroot, dir)
+		if p.path != "" {
+			top, _ := Output("git", "-C", dir, "rev-parse", "--show-toplevel")
+			top_info, top_err := os.Stat(strings.TrimSpace(top))
+			dir_info, dir_err := os.Stat(dir)
+			own := top_err == nil && dir_err == nil && os.SameFile(top_info, dir_info)
+			if err != nil || strings.HasPrefix(folder, "..") || !own {
+				fmt.Printf("Package %s is a local package in another repository or outside the development tree and is not bundled\n", p.Name)
+				continue
+			}
+		}
+		if p.archive != "" {
+			fmt.Printf("Package %s is an archive and is not bundled\n", p.Name)
+			continue
+		}
+		if p.provider != "" {
+			fmt.Printf("Package %s is fetched by provider %s and is not bundled\n", p.Name, p.provider)
+			continue
+		}
+		if package_vcs(p).Name() != "git" {
+			fmt.Printf("Package %s is not in a Git repository and is not bundled\n", p.Name)
+			continue
+		}
+		commit, err := Output("git", "-C", dir, "rev-parse", "HEAD")
+		if err != nil {
+			log.Fatalf("Package %s - cannot find checked out commit - %v", p.Name, err)
+		}
+		if out, _ := Output("git", "-C", dir, "rev-parse", "--is-shallow-repository"); strings.TrimSpace(out) == "true" {
+			log.Fatalf("Fatal - Package %s is a shallow clone and cannot be bundled. Run 'git -C %s fetch --unshallow' first", p.Name, dir)
+		}
+		e := BundleEntry{Name: p.Name, Uri: package_uri(p.Git, p.Https), Commit: strings.TrimSpace(commit)}
+		if folder = filepath.ToSlash(folder); folder != p.Name {
+			e.Folder = folder
+		}
+		if uri, err := Output("git", "-C", dir, "remote", "get-url", "origin"); err == nil {
+			e.Uri = strings.TrimSpace(uri)
+		}
+		git_args := []string{"-C", dir, "bundle", "create", "--quiet", filepath.Join(tmp, p.Name+".bundle"), "HEAD", "--tags"}
+		if branch, err := Output("git", "-C", dir, "symbolic-ref", "-q", "--short", "HEAD"); err == nil {
+			e.Branch = strings.TrimSpace(branch)
+			git_args = append(git_args, e.Branch)
+		}
+		fmt.Printf("Bundling %s at %.10s\n", p.Name, e.Commit)
+		if stat, err := Run("git", git_args); err != nil || stat != 0 {
+			log.Fatalf("Package %s - cannot create bundle \nStatus %d Error: %v\n", p.Name, stat, err)
+		}
+		m.Packages = append(m.Packages, e)
+	}
+	data, _ := json.MarshalIndent(m, "", "  ")
+	if err = os.WriteFile(filepath.Join(tmp, bundle_manifest), append(data, '\n'), 0644); err != nil {
+		log.Fatalf("Cannot write %s - %v", bundle_manifest, err)
+	}
+	if err = write_tar(*output, tmp); err != nil {
+		log.Fatalf("Cannot write %s - %v", *output, err)
+	}
+	fmt.Printf("Created bundle %s with %d packages\n", *output, len(m.Packages))
+}
+
+// Write the files of a folder in a compressed tar file
+func write_tar(fname string, dir string) error {
+	f, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			return err
+		}
+		hdr, _ := tar.FileInfoHeader(info, "")
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		in, err := os.Open(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, in)
+		in.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// Extract a compressed tar file in folder dir
+func read_tar(fname string, dir string) error {
+	f, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.Base(hdr.Name) //bundles don't have folders
+		out, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, tr)
+		out.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Restore packages from a bundle file. Packages are checked out at the
+// bundled commits.
+func restore_bundle(fname string) {
+	if root_uri != "" {
+		log.Fatal("Offline mode. Cannot fetch root package!!")
+	}
+	tmp, err := os.MkdirTemp("", "cpm-bundle")
+	if err != nil {
+		log.Fatalf("Cannot create temporary folder - %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	if err = read_tar(fname, tmp); err != nil {
+		log.Fatalf("Cannot read bundle %s - %v", fname, err)
+	}
+	data, err := os.ReadFile(filepath.Join(tmp, bundle_manifest))
+	if err != nil {
+		log.Fatalf("%s is not a CPM bundle - %v", fname, err)
+	}
+	var m BundleManifest
+	if err = json.Unmarshal(data, &m); err != nil {
+		log.Fatalf("Cannot parse %s in %s - %v", bundle_manifest, fname, err)
+	}
+
+	for _, e := range m.Packages {
+		dir := filepath.Join(devroot, e.Name)
+		if e.Folder != "" {
+			if dir = filepath.Join(devroot, filepath.FromSlash(e.Folder)); !inside_folder(devroot, dir) {
+				log.Fatalf("Fatal - Package %s - folder %s is outside the development tree", e.Name, e.Folder)
+			}
+		}
+		file := filepath.Join(tmp, e.Name+".bundle")
+		var args []string
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err != nil {
+			Verbosef("Restoring %s in %s\n", e.Name, dir)
+			args = []string{"clone", "--quiet", "--no-checkout", file, dir}
+		} else {
+			Verbosef("Updating %s from bundle\n", e.Name)
+			args = []string{"-C", dir, "fetch", "--quiet", "--tags", file, "HEAD"}
+		}
+		if _, err := os.Stat(filepath.Dir(dir)); err != nil {
+			os.MkdirAll(filepath.Dir(dir), 0755)
+		}
+		if stat, err := Run("git", args); err != nil || stat != 0 {
+			log.Fatalf("Package %s - cannot restore from bundle \nStatus %d Error: %v\n", e.Name, stat, err)
+		}
+		if e.Uri != "" {
+			Run("git", []string{"-C", dir, "remote", "set-url", "origin", e.Uri})
+		}
+		if e.Branch == "" {
+			git_detach(dir, e.Commit)
+			continue
+		}
+		args = []string{"-C", dir, "checkout", "--quiet"}
+		if *force_flag {
+			args = append(args, "-f")
+		}
+		args = append(args, "-B", e.Branch, e.Commit)
+		if stat, err := Run("git", args); err != nil || stat != 0 {
+			log.Fatalf("Package %s - cannot check out branch %s at %s \nStatus %d Error: %v\n", e.Name, e.Branch, e.Commit, stat, err)
+		}
+	}
+	fmt.Printf("Restored %d packages from %s\n", len(m.Packages), fname)
+}
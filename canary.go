@@ -0,0 +1,184 @@
+package main
+
+/*
+  Canary builds.
+
+  'cpm canary <package>@<branch>' checks a branch of a core library against
+  its consumers before it is merged or released. It finds the workspace
+  members that depend, directly or indirectly, on the package and builds
+  each of them with the package overridden to the branch, as if the
+  workspace file had the override:
+    "overrides": {"<package>": {"branch": "<branch>"}}
+  Descriptors are not changed: each build uses a temporary workspace
+  descriptor, '<devroot>/.cpm/canary-<member>.json', listing only that
+  member, selected with the '--descriptor-for-root' option. The output of
+  each build goes to '<devroot>/.cpm/canary-<member>.log'.
+
+  When all builds are done, CPM shows which members build and which break,
+  checks out again the branch or commit the package had before and exits
+  with status 1 if any member breaks. Packages built from the branch are
+  rebuilt by the next normal run.
+*/
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Build a workspace member with the given workspace descriptor. Returns
+// true if the build succeeds and a description of the result.
+func canary_build(member string, ws map[string]any) (bool, string) {
+	base := "canary-" + member
+	fname := filepath.Join(devroot, ".cpm", base+".json")
+	logname := filepath.Join(devroot, ".cpm", base+".log")
+	ws["packages"] = []string{member}
+	data, _ := json.MarshalIndent(ws, "", "  ")
+	if err := os.WriteFile(fname, data, 0644); err != nil {
+		return false, err.Error()
+	}
+	defer os.Remove(fname)
+	//lockfile of the alternate descriptor
+	defer os.Remove(filepath.Join(devroot, base+".lock"))
+
+	out, err := os.Create(logname)
+	if err != nil {
+		return false, err.Error()
+	}
+	defer out.Close()
+	exe, err := os.Executable()
+	if err != nil {
+		return false, err.Error()
+	}
+	args := []string{"-r", devroot, "--descriptor-for-root", fname}
+	if *profile_flag != "" {
+		args = append(args, "--profile", *profile_flag)
+	}
+	if *background_flag {
+		args = append(args, "--background")
+	}
+	cmd := exec.Command(exe, args...)
+	cmd.Dir = devroot
+	cmd.Stdout = out
+	cmd.Stderr = out
+	start := time.Now()
+	err = cmd.Run()
+	elapsed := time.Since(start).Round(time.Second)
+	if err != nil {
+		return false, fmt.Sprintf("failed after %v (see %s)", elapsed, logname)
+	}
+	return true, fmt.Sprintf("built in %v", elapsed)
+}
+
+// Implementation of 'cpm canary <package>@<branch>' command
+func canary(args []string) {
+	flags := flag.NewFlagSet("canary", flag.ExitOnError)
+	pos := parse_interspersed(flags, args)
+	var pkg, branch string
+	ok := len(pos) == 1
+	if ok {
+		pkg, branch, ok = strings.Cut(pos[0], "@")
+	}
+	if !ok || pkg == "" || branch == "" {
+		log.Fatal("Usage: cpm canary <package>@<branch>")
+	}
+	os.Chdir(devroot)
+	root := load_tree("")
+	if !workspace {
+		log.Fatalf("Fatal - canary builds the members of a workspace and %s doesn't have a %s file", devroot, workspace_name)
+	}
+	target := find_pack(pkg)
+	if target == nil {
+		log.Fatalf("Fatal - no package in workspace depends on %s", pkg)
+	}
+
+	var consumers []string
+	lengths := chain_lengths(target, false)
+	for _, name := range root.Packages {
+		if p := find_pack(name); p != nil && p != target && lengths[p] != 0 {
+			consumers = append(consumers, name)
+		}
+	}
+	if len(consumers) == 0 {
+		log.Fatalf("Fatal - no workspace member depends on %s", pkg)
+	}
+
+	//check branch and remember working copy state
+	uri := package_uri(target.Git, target.Https)
+	if target.Git == "" && target.Https == "" {
+		log.Fatalf("Fatal - package %s is not a git repository", pkg)
+	}
+	if _, err := exec.Command("git", "ls-remote", "--exit-code", uri, branch).Output(); err != nil {
+		log.Fatalf("Fatal - branch %s not found in %s", branch, uri)
+	}
+	dir := package_dir(target)
+	restore := ""
+	created := false //local branch created by canary builds
+	if _, err := os.Stat(dir); err == nil {
+		if out, _ := Output("git", "-C", dir, "status", "--porcelain", "--untracked-files=no"); out != "" {
+			log.Fatalf("Fatal - %s has local changes. Commit or stash them before a canary build", dir)
+		}
+		if restore = (git_vcs{}).Branch(dir); restore == "" {
+			restore, _ = (git_vcs{}).Revision(dir)
+		}
+		//the clone may not know the branch yet
+		created = exec.Command("git", "-C", dir, "rev-parse", "--verify", "--quiet", "refs/heads/"+branch).Run() != nil
+		refspec := "+refs/heads/" + branch + ":refs/remotes/origin/" + branch
+		if stat, err := run_network(dir, "Fetching "+branch+" in "+dir, "git", []string{"-C", dir, "fetch", "origin", refspec}); err != nil || stat != 0 {
+			log.Fatalf("Fatal - cannot fetch branch %s in %s - status %d error %v", branch, dir, stat, err)
+		}
+	}
+
+	ws := make(map[string]any)
+	data, err := load_descriptor(root_descriptor)
+	if err == nil {
+		err = json.Unmarshal(data, &ws)
+	}
+	if err != nil {
+		log.Fatalf("Fatal - cannot read %s - %v", root_descriptor, err)
+	}
+	overrides, _ := ws["overrides"].(map[string]any)
+	if overrides == nil {
+		overrides = make(map[string]any)
+	}
+	for name := range overrides {
+		if strings.EqualFold(name, pkg) {
+			delete(overrides, name)
+		}
+	}
+	overrides[pkg] = map[string]string{"branch": branch}
+	ws["overrides"] = overrides
+
+	fmt.Printf("Canary build of %s@%s with %s\n", pkg, branch, strings.Join(consumers, ", "))
+	broken := 0
+	for _, name := range consumers {
+		ok, details := canary_build(name, ws)
+		status := "OK"
+		if !ok {
+			status = "BROKEN"
+			broken++
+		}
+		fmt.Printf("  %-20s %-6s %s\n", name, status, details)
+	}
+
+	if restore != "" {
+		Verbosef("Checking out %s in %s\n", restore, dir)
+		if _, err := exec.Command("git", "-C", dir, "checkout", "--quiet", restore).CombinedOutput(); err != nil {
+			fmt.Printf("WARNING - cannot check out %s in %s - %v\n", restore, dir, err)
+		}
+		if created && restore != branch {
+			exec.Command("git", "-C", dir, "branch", "--quiet", "-D", branch).Run()
+		}
+	}
+	if broken != 0 {
+		fmt.Printf("%d of %d consumer(s) break with %s@%s\n", broken, len(consumers), pkg, branch)
+		exit_failed("consumers break")
+	}
+	fmt.Printf("All %d consumer(s) build with %s@%s\n", len(consumers), pkg, branch)
+}
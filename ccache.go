@@ -0,0 +1,145 @@
+package main
+
+/*
+  Compiler cache (ccache/sccache) integration.
+
+  When a compiler cache is selected with the '--compiler-cache' option, CPM
+  sets the CMake compiler launcher variables so that builds go through the
+  cache and collects cache statistics before and after each package build.
+  The statistics are printed at the end of the run and included in the JSON
+  run report.
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+var compiler_cache string //selected compiler cache program
+
+type CacheStats struct {
+	Hits   int `json:"hits"`
+	Misses int `json:"misses"`
+}
+
+type PackageCacheStats struct {
+	Package string `json:"package"`
+	CacheStats
+}
+
+// Compiler cache statistics in run report
+type CacheReport struct {
+	Program  string              `json:"program"`
+	Packages []PackageCacheStats `json:"packages"`
+	Total    CacheStats          `json:"total"`
+}
+
+// Per-package cache statistics in build order
+var cache_report []PackageCacheStats
+
+// Setup environment for selected compiler cache
+func setup_compiler_cache() {
+	if compiler_cache != "ccache" && compiler_cache != "sccache" {
+		log.Fatal("Unknown compiler cache. Must be 'ccache' or 'sccache'")
+	}
+	if _, err := exec.LookPath(compiler_cache); err != nil {
+		log.Fatalf("Compiler cache %s not found - %v", compiler_cache, err)
+	}
+	os.Setenv("CMAKE_C_COMPILER_LAUNCHER", compiler_cache)
+	os.Setenv("CMAKE_CXX_COMPILER_LAUNCHER", compiler_cache)
+	Verboseln("Using compiler cache", compiler_cache)
+}
+
+// Return current compiler cache statistics
+func compiler_cache_stats() (stats CacheStats) {
+	switch compiler_cache {
+	case "ccache":
+		out, err := Output("ccache", "--print-stats")
+		if err != nil {
+			return
+		}
+		for _, line := range strings.Split(out, "\n") {
+			f := strings.Fields(line)
+			if len(f) != 2 {
+				continue
+			}
+			n, _ := strconv.Atoi(f[1])
+			switch f[0] {
+			case "direct_cache_hit", "preprocessed_cache_hit":
+				stats.Hits += n
+			case "cache_miss":
+				stats.Misses += n
+			}
+		}
+
+	case "sccache":
+		out, err := Output("sccache", "--show-stats", "--stats-format=json")
+		if err != nil {
+			return
+		}
+		var s struct {
+			Stats struct {
+				Cache_hits   struct{ Counts map[string]int }
+				Cache_misses struct{ Counts map[string]int }
+			}
+		}
+		if json.Unmarshal([]byte(out), &s) != nil {
+			return
+		}
+		for _, n := range s.Stats.Cache_hits.Counts {
+			stats.Hits += n
+		}
+		for _, n := range s.Stats.Cache_misses.Counts {
+			stats.Misses += n
+		}
+	}
+	return
+}
+
+// Record cache statistics of a package build given the statistics before
+// the build
+func record_cache_stats(pkg string, before CacheStats) {
+	after := compiler_cache_stats()
+	cache_report = append(cache_report, PackageCacheStats{pkg,
+		CacheStats{after.Hits - before.Hits, after.Misses - before.Misses}})
+}
+
+// Return compiler cache statistics for all built packages or nil if none
+// were collected
+func compiler_cache_report() *CacheReport {
+	if len(cache_report) == 0 {
+		return nil
+	}
+	r := &CacheReport{Program: compiler_cache, Packages: cache_report}
+	for _, p := range cache_report {
+		r.Total.Hits += p.Hits
+		r.Total.Misses += p.Misses
+	}
+	return r
+}
+
+// Print compiler cache statistics for all built packages
+func print_cache_report() {
+	r := compiler_cache_report()
+	if r == nil {
+		return
+	}
+	fmt.Printf("Compiler cache (%s) statistics:\n", r.Program)
+	for _, p := range r.Packages {
+		fmt.Printf("  %-20s %s\n", p.Package, p.CacheStats)
+	}
+	fmt.Printf("  %-20s %s\n", "TOTAL", r.Total)
+}
+
+func (s CacheStats) String() string {
+	if s.Hits+s.Misses == 0 {
+		return "no cacheable compilations"
+	}
+	return fmt.Sprintf("%d hits, %d misses (%.1f%% hit rate)", s.Hits, s.Misses,
+		100*float64(s.Hits)/float64(s.Hits+s.Misses))
+}
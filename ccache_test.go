@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCompilerCacheReport(t *testing.T) {
+	saved_program, saved_report := compiler_cache, cache_report
+	defer func() { compiler_cache, cache_report = saved_program, saved_report }()
+	compiler_cache = "ccache"
+	cache_report = nil
+	if r := compiler_cache_report(); r != nil {
+		t.Fatalf("report without statistics: %+v", r)
+	}
+
+	cache_report = []PackageCacheStats{{"utils", CacheStats{3, 1}}, {"app", CacheStats{2, 4}}}
+	data, _ := json.Marshal(RunReport{CompilerCache: compiler_cache_report()})
+	var got struct {
+		CompilerCache struct {
+			Program  string
+			Packages []struct {
+				Package      string
+				Hits, Misses int
+			}
+			Total struct{ Hits, Misses int }
+		}
+	}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	c := got.CompilerCache
+	if c.Program != "ccache" || len(c.Packages) != 2 || c.Packages[1].Package != "app" || c.Packages[1].Misses != 4 {
+		t.Errorf("compilerCache = %+v", c)
+	}
+	if c.Total.Hits != 5 || c.Total.Misses != 5 {
+		t.Errorf("total = %+v, want 5 hits and 5 misses", c.Total)
+	}
+}
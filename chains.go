@@ -0,0 +1,186 @@
+package main
+
+/*
+  Dependency chains.
+
+  Cycle detection, graph rules, 'cpm why' and canary builds search chains
+  of dependencies between packages. Searches start from the length of the
+  shortest chain from every package to the target, computed once by walking
+  the consumers of the target breadth first, so every package is visited
+  once per target and packages that cannot reach it are never explored.
+*/
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Dependency edge of a chain
+type chain_edge struct {
+	from *PacUnit
+	dep  *DependencyDescriptor
+}
+
+// Return true if a chain follows dependency d. If build is true, only build
+// dependencies are followed.
+func follows(d *DependencyDescriptor, build bool) bool {
+	return d.pack != nil && !(build && d.FetchOnly)
+}
+
+// Return the length of the shortest dependency chain from every package to
+// package 'to'. Packages that cannot reach it are not in the map.
+func chain_lengths(to *PacUnit, build bool) map[*PacUnit]int {
+	consumers := make(map[*PacUnit][]*PacUnit)
+	for _, p := range all_packs {
+		for i := range p.Depends {
+			if d := &p.Depends[i]; follows(d, build) {
+				consumers[d.pack] = append(consumers[d.pack], p)
+			}
+		}
+	}
+	lengths := map[*PacUnit]int{to: 0}
+	for queue := []*PacUnit{to}; len(queue) != 0; queue = queue[1:] {
+		p := queue[0]
+		for _, c := range consumers[p] {
+			if _, ok := lengths[c]; !ok {
+				lengths[c] = lengths[p] + 1
+				queue = append(queue, c)
+			}
+		}
+	}
+	return lengths
+}
+
+// Return the shortest chain of dependencies leading from package 'from' to
+// the package lengths were computed for or nil if there is none. The chain
+// is empty if 'from' is the target.
+func shortest_chain(from *PacUnit, lengths map[*PacUnit]int, build bool) []chain_edge {
+	n, ok := lengths[from]
+	if !ok {
+		return nil
+	}
+	chain := []chain_edge{}
+	for p := from; n > 0; n-- {
+		for i := range p.Depends {
+			d := &p.Depends[i]
+			if l, ok := lengths[d.pack]; ok && l == n-1 && follows(d, build) {
+				chain = append(chain, chain_edge{p, d})
+				p = d.pack
+				break
+			}
+		}
+	}
+	return chain
+}
+
+// Return the shortest chain of dependencies leading from package 'from' to
+// package 'to' or nil if there is none
+func find_chain(from *PacUnit, to *PacUnit, build bool) []chain_edge {
+	return shortest_chain(from, chain_lengths(to, build), build)
+}
+
+// Return all dependency chains, including fetch-only dependencies, leading
+// from package 'from' to package 'to'. Stops after more than limit chains.
+func all_chains(from *PacUnit, to *PacUnit, limit int) [][]chain_edge {
+	var chains [][]chain_edge
+	walk_chains(from, to, chain_lengths(to, false), nil, &chains, limit)
+	return chains
+}
+
+// Append to chains the chains leading from package p to package 'to' that
+// extend chain. Dependencies that cannot reach 'to' are not followed.
+func walk_chains(p *PacUnit, to *PacUnit, lengths map[*PacUnit]int, chain []chain_edge, chains *[][]chain_edge, limit int) {
+	if p == to {
+		*chains = append(*chains, slices.Clone(chain))
+		return
+	}
+	for i := range p.Depends {
+		d := &p.Depends[i]
+		if len(*chains) > limit {
+			return
+		}
+		if _, ok := lengths[d.pack]; !ok || chain_visits(chain, d.pack) {
+			continue
+		}
+		walk_chains(d.pack, to, lengths, append(chain, chain_edge{p, d}), chains, limit)
+	}
+}
+
+// Return true if a chain goes through package p
+func chain_visits(chain []chain_edge, p *PacUnit) bool {
+	return slices.ContainsFunc(chain, func(e chain_edge) bool { return e.from == p })
+}
+
+// Return the longest dependency chain starting at package p. Fetch-only
+// dependencies are included. The length of the longest chain from every
+// package is computed once; a dependency closing a cycle ends the chain.
+func longest_chain(p *PacUnit) []chain_edge {
+	next := make(map[*PacUnit]chain_edge) //first edge of longest chain
+	longest_from(p, make(map[*PacUnit]int), next)
+	chain := []chain_edge{}
+	for e, ok := next[p]; ok; e, ok = next[e.dep.pack] {
+		chain = append(chain, e)
+	}
+	return chain
+}
+
+// Return length of the longest chain starting at package p or -1 if p is
+// being explored
+func longest_from(p *PacUnit, lengths map[*PacUnit]int, next map[*PacUnit]chain_edge) int {
+	if n, ok := lengths[p]; ok {
+		return n
+	}
+	lengths[p] = -1
+	longest := 0
+	for i := range p.Depends {
+		d := &p.Depends[i]
+		if d.pack == nil {
+			continue
+		}
+		if n := longest_from(d.pack, lengths, next); n >= 0 && n+1 > longest {
+			longest = n + 1
+			next[p] = chain_edge{p, d}
+		}
+	}
+	lengths[p] = longest
+	return longest
+}
+
+// Return names of packages in a non-empty chain joined by arrows
+func chain_names(chain []chain_edge) string {
+	names := []string{chain[0].from.Name}
+	for _, e := range chain {
+		names = append(names, e.dep.Name)
+	}
+	return strings.Join(names, " -> ")
+}
+
+// Return the dependencies of a chain, one per line, each one with the file
+// declaring it. Lines start with indent.
+func chain_details(chain []chain_edge, indent string) string {
+	var edges []string
+	width := 0
+	for _, e := range chain {
+		edge := e.from.Name + " -> " + e.dep.Name
+		var notes []string
+		if e.dep.FetchOnly {
+			notes = append(notes, "fetch-only")
+		}
+		if e.dep.Group != "" {
+			notes = append(notes, "group "+e.dep.Group)
+		}
+		if len(notes) != 0 {
+			edge += " (" + strings.Join(notes, ", ") + ")"
+		}
+		edges = append(edges, edge)
+		if len(edge) > width {
+			width = len(edge)
+		}
+	}
+	var lines []string
+	for i, e := range chain {
+		lines = append(lines, fmt.Sprintf("%s%-*s  declared in %s", indent, width, edges[i], edge_source(e.from, e.dep.Name)))
+	}
+	return strings.Join(lines, "\n")
+}
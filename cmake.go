@@ -0,0 +1,121 @@
+package main
+
+/*
+  CMake integration.
+
+  The 'cpm cmake' command writes a 'cpm-deps.cmake' file in the root package
+  folder. The file defines an imported target 'cpm::<package>' for every
+  dependency, with the include folder of the dependency, its library (if it
+  is found in the shared 'lib' folder when CMake runs) and its own
+  dependencies. It also sets '<package>_ROOT' and adds the package folders to
+  CMAKE_PREFIX_PATH, so that find_package() can use configuration files
+  provided by dependencies.
+
+  Once the file exists, CPM regenerates it after fetching, so it stays in sync
+  with the descriptors.
+*/
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const cmake_file_name = "cpm-deps.cmake"
+
+// Implementation of 'cpm cmake' command
+func cmake(args []string) {
+	flags := flag.NewFlagSet("cmake", flag.ExitOnError)
+	output := flags.String("output", cmake_file_name, "CMake file name")
+	pos := parse_interspersed(flags, args)
+	if len(pos) > 1 {
+		log.Fatal("Usage: cpm cmake [--output <file>] [<package>]")
+	}
+	pkg := ""
+	if len(pos) == 1 {
+		pkg = pos[0]
+	}
+	root := load_tree(pkg)
+	fname := *output
+	if !filepath.IsAbs(fname) {
+		fname = filepath.Join(filepath.Dir(root_descriptor), fname)
+	}
+	if err := generate_cmake(root, fname); err != nil {
+		log.Fatalf("Cannot write %s - %v", fname, err)
+	}
+	fmt.Printf("Generated %s\n", fname)
+}
+
+// Regenerate CMake file of root package if it exists
+func update_cmake(root *PacUnit) {
+	fname := filepath.Join(filepath.Dir(root_descriptor), cmake_file_name)
+	if _, err := os.Stat(fname); err != nil {
+		return
+	}
+	if err := generate_cmake(root, fname); err != nil {
+		warn("generated-file", "cannot write %s - %v", fname, err)
+	}
+}
+
+// Quote a string for CMake
+func cmake_string(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`).Replace(s) + `"`
+}
+
+// Write CMake file with imported targets for dependencies of root package.
+// The file is rewritten only if its content changes.
+func generate_cmake(root *PacUnit, fname string) error {
+	var b bytes.Buffer
+	b.WriteString("# CMake dependencies generated by CPM - do not edit\n\n")
+	fmt.Fprintf(&b, "set(CPM_DEV_ROOT %s)\n", cmake_string(filepath.ToSlash(devroot)))
+	fmt.Fprintf(&b, "set(CPM_LIB_DIR %s)\n", cmake_string(filepath.ToSlash(lib_dir())))
+	fmt.Fprintf(&b, "set(CPM_INCLUDE_DIR %s)\n", cmake_string(filepath.ToSlash(filepath.Join(package_dir(root), "include"))))
+
+	var names []string
+	for _, p := range all_packs {
+		if p == root {
+			continue
+		}
+		names = append(names, p.Name)
+		dir := filepath.ToSlash(package_dir(p))
+		target := "cpm::" + p.Name
+		var links []string
+		for _, d := range p.Depends {
+			if !d.FetchOnly {
+				links = append(links, "cpm::"+d.Name)
+			}
+		}
+
+		fmt.Fprintf(&b, "\n# %s\n", p.Name)
+		fmt.Fprintf(&b, "set(%s_ROOT %s)\n", p.Name, cmake_string(dir))
+		fmt.Fprintf(&b, "list(APPEND CMAKE_PREFIX_PATH %s)\n", cmake_string(dir))
+		fmt.Fprintf(&b, "if(NOT TARGET %s)\n", target)
+		fmt.Fprintf(&b, "  find_library(CPM_%s_LIBRARY NAMES %s PATHS \"${CPM_LIB_DIR}\" NO_DEFAULT_PATH)\n", p.Name, p.Name)
+		fmt.Fprintf(&b, "  if(CPM_%s_LIBRARY)\n", p.Name)
+		fmt.Fprintf(&b, "    add_library(%s UNKNOWN IMPORTED)\n", target)
+		fmt.Fprintf(&b, "    set_target_properties(%s PROPERTIES IMPORTED_LOCATION \"${CPM_%s_LIBRARY}\")\n", target, p.Name)
+		b.WriteString("  else()\n")
+		fmt.Fprintf(&b, "    add_library(%s INTERFACE IMPORTED)\n", target)
+		b.WriteString("  endif()\n")
+		fmt.Fprintf(&b, "  set_target_properties(%s PROPERTIES\n", target)
+		fmt.Fprintf(&b, "    INTERFACE_INCLUDE_DIRECTORIES %s", cmake_string(dir+"/include"))
+		if len(links) != 0 {
+			fmt.Fprintf(&b, "\n    INTERFACE_LINK_LIBRARIES %s", cmake_string(strings.Join(links, ";")))
+		}
+		b.WriteString(")\n")
+		b.WriteString("endif()\n")
+	}
+	fmt.Fprintf(&b, "\nset(CPM_DEPENDENCIES %s)\n", strings.Join(names, " "))
+
+	//don't touch file if unchanged to avoid needless CMake runs
+	if old, err := os.ReadFile(fname); err == nil && bytes.Equal(old, b.Bytes()) {
+		Verboseln("CMake file", fname, "is up to date")
+		return nil
+	}
+	Verboseln("Generated CMake file", fname)
+	return os.WriteFile(fname, b.Bytes(), 0644)
+}
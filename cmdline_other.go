@@ -0,0 +1,8 @@
+//go:build !windows
+
+package main
+
+import "os/exec"
+
+// Set the command line of a CMD process. Used only on Windows.
+func set_cmdline(cmd *exec.Cmd, args string) {}
@@ -0,0 +1,12 @@
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// Set the command line of a CMD process. The arguments are passed verbatim
+// because CMD doesn't follow the usual quoting rules.
+func set_cmdline(cmd *exec.Cmd, args string) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CmdLine: syscall.EscapeArg(cmd.Path) + " " + args}
+}
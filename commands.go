@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Parse arguments of a command that accepts only an optional package name
+func package_arg(name string, args []string) string {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	pos := parse_interspersed(flags, args)
+	if len(pos) > 1 {
+		log.Fatalf("Usage: cpm %s [<package>]", name)
+	}
+	if len(pos) == 0 {
+		return ""
+	}
+	return pos[0]
+}
+
+// Parse arguments of fetch, build and update commands: an optional package
+// name and the '--profile', '--group' and '--skip-group' options, same as
+// the global ones
+func update_args(name string, args []string) string {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	profile := flags.String("profile", *profile_flag, "descriptor and build profiles (comma separated)")
+	flags.StringVar(group_flag, "group", *group_flag, "fetch and build only packages in these groups (comma separated)")
+	flags.StringVar(skip_group_flag, "skip-group", *skip_group_flag, "don't fetch or build packages in these groups (comma separated)")
+	flags.BoolVar(force_build_flag, "force-build", *force_build_flag, "build packages whose inputs didn't change")
+	flags.BoolVar(no_build_cache, "no-build-cache", *no_build_cache, "don't use the build cache")
+	pos := parse_interspersed(flags, args)
+	if len(pos) > 1 {
+		log.Fatalf("Usage: cpm %s [--profile <name>[,<name>...]] [--group <name>[,<name>...]] [--skip-group <name>[,<name>...]] [--force-build] [--no-build-cache] [<package>]", name)
+	}
+	*profile_flag = *profile
+	if len(pos) == 0 {
+		return ""
+	}
+	return pos[0]
+}
+
+// Implementation of 'cpm fetch' command: fetch without building
+func cmd_fetch(args []string) {
+	pkg := update_args("fetch", args)
+	*fetch_flag = true
+	update_tree(pkg)
+}
+
+// Implementation of 'cpm build' command: build without fetching
+func cmd_build(args []string) {
+	pkg := update_args("build", args)
+	if root_uri != "" {
+		log.Fatal("Build command doesn't fetch. Cannot use root package URI.")
+	}
+	*local_flag = true
+	update_tree(pkg)
+}
+
+// Implementation of 'cpm update' command: fetch and build
+func cmd_update(args []string) {
+	update_tree(update_args("update", args))
+}
+
+// Implementation of 'cpm clean' command
+func clean(args []string) {
+	flags := flag.NewFlagSet("clean", flag.ExitOnError)
+	deep := flags.Bool("deep", false, "also remove pkg-config files, warning records and cached tree state")
+	pos := parse_interspersed(flags, args)
+	if len(pos) > 1 {
+		log.Fatal("Usage: cpm clean [--deep] [<package>]")
+	}
+	pkg := ""
+	if len(pos) == 1 {
+		pkg = pos[0]
+	}
+	root := load_tree(pkg)
+
+	//consumers are cleaned before their dependencies
+	var order []*PacUnit
+	build_order(root, &order)
+	setup_envs(order)
+	failed := 0
+	for i := len(order) - 1; i >= 0; i-- {
+		p := order[i]
+		dir := package_dir(p)
+		if len(p.Clean) == 0 || workspace && p == root {
+			continue
+		}
+		if _, err := os.Stat(dir); err != nil {
+			Verbosef("Package %s - folder %s not found. Skipped clean commands\n", p.Name, dir)
+			continue
+		}
+		Verbosef("Package %s - executing clean commands\n", p.Name)
+		if ret, err := exec_commands(dir, p.Clean, package_envs[p], nil); ret != 0 {
+			fmt.Printf("WARNING - Package %s - clean commands failed. Status %d Error: %v\n", p.Name, ret, err)
+			failed++
+		}
+	}
+
+	for _, p := range all_packs {
+		remove_created_files(p, *deep)
+		fmt.Printf("Cleaned %s\n", p.Name)
+	}
+	//outputs removed by clean commands are not part of the fingerprint
+	os.Remove(last_run_file())
+	if *deep {
+		os.Remove(descriptor_cache_file())
+	}
+	if failed != 0 {
+		log.Fatalf("Fatal - clean commands of %d packages failed", failed)
+	}
+}
+
+// Implementation of 'cpm test' command
+func cmd_test(args []string) {
+	flags := flag.NewFlagSet("test", flag.ExitOnError)
+	pos := parse_interspersed(flags, args)
+	if len(pos) > 1 {
+		log.Fatal("Usage: cpm test [<package>]")
+	}
+	pkg := ""
+	if len(pos) == 1 {
+		pkg = pos[0]
+	}
+	root := load_tree(pkg)
+	if len(root.Tests) == 0 {
+		fmt.Printf("Package %s has no test commands\n", root.Name)
+		return
+	}
+	var order []*PacUnit
+	build_order(root, &order)
+	setup_envs(order)
+	Verbosef("Package %s - executing test commands\n", root.Name)
+	if ret, err := exec_commands(package_dir(root), root.Tests, package_envs[root], nil); ret != 0 {
+		fmt.Printf("Package %s - tests failed. Status %d Error: %v\n", root.Name, ret, err)
+		exit_failed("tests failed")
+	}
+	fmt.Printf("Package %s - tests passed\n", root.Name)
+}
+
+// Remove the links, copied files and mirrored headers CPM created in a
+// package folder and the libraries of the package and forget its build state.
+// If deep is true, also remove its pkg-config file and warning record.
+func remove_created_files(p *PacUnit, deep bool) {
+	dir := package_dir(p)
+	m := load_manifest(dir)
+	for _, rel := range append(m.Links, m.Copies...) {
+		Verboseln("Removing", filepath.Join(dir, rel))
+		os.Remove(filepath.Join(dir, rel))
+	}
+	//folders are removed only if empty, deepest first
+	dirs := slices.Clone(m.Dirs)
+	slices.SortFunc(dirs, func(a, b string) int { return len(b) - len(a) })
+	for _, rel := range dirs {
+		if os.Remove(filepath.Join(dir, rel)) == nil {
+			Verboseln("Removed folder", filepath.Join(dir, rel))
+		}
+	}
+	save_manifest(dir, m)
+
+	for _, lib := range package_libs(lib_dir(), p.Name) {
+		Verboseln("Removing", lib)
+		remove_file(lib)
+	}
+	forget_build_state(p)
+	if deep {
+		os.Remove(filepath.Join(pkgconfig_dir(), p.Name+".pc"))
+		os.Remove(last_warnings_file(p.Name))
+	}
+}
+
+// Return checked out branch (or version tag or "(detached)") and short
+// commit of package in dir. Missing packages have commit "missing".
+func checked_out(dir string) (string, string) {
+	if _, err := os.Stat(dir); err != nil {
+		return "-", "missing"
+	}
+	if workspace && dir == devroot {
+		return "(workspace)", "-"
+	}
+	if st := load_archive_state(dir); st != nil {
+		commit := st.Sha256
+		if len(commit) > 7 {
+			commit = commit[:7]
+		}
+		return "(" + archive_file_name(st.Url) + ")", commit
+	}
+	if v := folder_vcs(dir); v != nil && v.Name() != "git" {
+		rev, err := v.Revision(dir)
+		if err != nil {
+			return "-", "-"
+		}
+		if len(rev) > 12 {
+			rev = rev[:12]
+		}
+		return v.Branch(dir), rev
+	}
+	out, err := Output("git", "-C", dir, "rev-parse", "--short", "HEAD")
+	if err != nil {
+		return "-", "-"
+	}
+	commit := strings.TrimSpace(out)
+	if out, err = Output("git", "-C", dir, "symbolic-ref", "-q", "--short", "HEAD"); err == nil {
+		return strings.TrimSpace(out), commit
+	}
+	if tag := package_version(dir); tag != "" {
+		return "(" + tag + ")", commit
+	}
+	return "(detached)", commit
+}
+
+// Implementation of 'cpm list' command
+func list(args []string) {
+	load_tree(package_arg("list", args))
+	fmt.Printf("%-20s %-20s %-10s %s\n", "PACKAGE", "BRANCH", "COMMIT", "FOLDER")
+	for _, p := range all_packs {
+		dir := package_dir(p)
+		branch, commit := checked_out(dir)
+		fmt.Printf("%-20s %-20s %-10s %s\n", p.Name, branch, commit, dir)
+	}
+}
+
+// Package in dependency graph output
+type GraphNode struct {
+	Name    string      `json:"name"`
+	Branch  string      `json:"branch"` //checked out branch or version tag
+	Commit  string      `json:"commit"`
+	Depends []GraphEdge `json:"depends"`
+}
+
+// Dependency in dependency graph output
+type GraphEdge struct {
+	Name      string `json:"name"`
+	Branch    string `json:"branch,omitempty"`
+	Version   string `json:"version,omitempty"`
+	Path      string `json:"path,omitempty"`
+	FetchOnly bool   `json:"fetchOnly,omitempty"`
+}
+
+// Implementation of 'cpm tree' command
+func tree(args []string) {
+	flags := flag.NewFlagSet("tree", flag.ExitOnError)
+	format := flags.String("format", "text", "output format (text, dot or json)")
+	pos := parse_interspersed(flags, args)
+	if len(pos) > 1 {
+		log.Fatal("Usage: cpm tree [--format text|dot|json] [<package>]")
+	}
+	pkg := ""
+	if len(pos) == 1 {
+		pkg = pos[0]
+	}
+	root := load_tree(pkg)
+
+	nodes := make(map[*PacUnit]*GraphNode)
+	var graph []*GraphNode
+	for _, p := range all_packs {
+		n := &GraphNode{Name: p.Name, Depends: []GraphEdge{}}
+		n.Branch, n.Commit = checked_out(package_dir(p))
+		for _, d := range p.Depends {
+			n.Depends = append(n.Depends, GraphEdge{d.Name, d.Branch, d.Version, d.Path, d.FetchOnly})
+		}
+		nodes[p] = n
+		graph = append(graph, n)
+	}
+
+	switch *format {
+	case "text":
+		fmt.Println(root.Name + " " + node_state(nodes[root]))
+		print_tree(root, "", nodes, make(map[*PacUnit]bool))
+	case "json":
+		data, _ := json.MarshalIndent(graph, "", "  ")
+		fmt.Println(string(data))
+	case "dot":
+		fmt.Println("digraph dependencies {")
+		fmt.Println("  node [shape=box];")
+		for _, n := range graph {
+			fmt.Printf("  %q [label=%q];\n", n.Name, n.Name+"\n"+n.Branch+" "+n.Commit)
+		}
+		for _, n := range graph {
+			for _, e := range n.Depends {
+				attrs := ""
+				if label := edge_spec(e); label != "" {
+					attrs = fmt.Sprintf(" label=%q", label)
+				}
+				if e.FetchOnly {
+					attrs += " style=dashed"
+				}
+				if attrs != "" {
+					attrs = " [" + strings.TrimSpace(attrs) + "]"
+				}
+				fmt.Printf("  %q -> %q%s;\n", n.Name, e.Name, attrs)
+			}
+		}
+		fmt.Println("}")
+	default:
+		log.Fatalf("Unknown format %s. Valid formats are: text, dot, json", *format)
+	}
+}
+
+// Return requested branch, version or path of a dependency
+func edge_spec(e GraphEdge) string {
+	switch {
+	case e.Version != "":
+		return e.Version
+	case e.Branch != "":
+		return "@" + e.Branch
+	case e.Path != "":
+		return "(" + e.Path + ")"
+	}
+	return ""
+}
+
+// Return checked out state of a package as shown in text tree
+func node_state(n *GraphNode) string {
+	return "[" + n.Branch + " " + n.Commit + "]"
+}
+
+// Print dependencies of a package as a text tree. Dependencies of packages
+// already shown are not repeated; such packages are marked with (*).
+func print_tree(p *PacUnit, prefix string, nodes map[*PacUnit]*GraphNode, shown map[*PacUnit]bool) {
+	shown[p] = true
+	for i, d := range p.Depends {
+		branch, indent := "+-- ", "|   "
+		if i == len(p.Depends)-1 {
+			branch, indent = "\\-- ", "    "
+		}
+		label := d.Name
+		if spec := edge_spec(nodes[p].Depends[i]); spec != "" {
+			label += " " + spec
+		}
+		label += " " + node_state(nodes[d.pack])
+		if d.FetchOnly {
+			label += " fetch only"
+		}
+		if shown[d.pack] && len(d.pack.Depends) != 0 {
+			fmt.Println(prefix + branch + label + " (*)")
+			continue
+		}
+		fmt.Println(prefix + branch + label)
+		print_tree(d.pack, prefix+indent, nodes, shown)
+	}
+}
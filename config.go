@@ -0,0 +1,67 @@
+package main
+
+/*
+  Configuration settings.
+
+  Settings are read from '$CPM_HOME/config' (user settings) and from
+  '<devroot>/.cpm/config' (development tree settings). Tree settings
+  override user settings. Each line has the form:
+    key = value
+  Lines starting with '#' or ';' are comments.
+*/
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var config map[string]string
+var config_once sync.Once
+
+func load_config() {
+	config = make(map[string]string)
+	files := []string{
+		filepath.Join(cpm_home(), "config"),
+		filepath.Join(devroot, ".cpm", "config"),
+	}
+	for _, fname := range files {
+		f, err := os.Open(fname)
+		if err != nil {
+			continue
+		}
+		Verboseln("Reading configuration file", fname)
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || line[0] == '#' || line[0] == ';' {
+				continue
+			}
+			if key, value, ok := strings.Cut(line, "="); ok {
+				config[strings.ToLower(strings.TrimSpace(key))] = strings.TrimSpace(value)
+			}
+		}
+		f.Close()
+	}
+}
+
+// Return value of a configuration setting or def if setting doesn't exist
+func config_get(key string, def string) string {
+	config_once.Do(load_config)
+	if v, ok := config[strings.ToLower(key)]; ok {
+		return v
+	}
+	return def
+}
+
+// Return integer value of a configuration setting or def if setting doesn't
+// exist or is not a number
+func config_int(key string, def int) int {
+	if v, err := strconv.Atoi(config_get(key, "")); err == nil {
+		return v
+	}
+	return def
+}
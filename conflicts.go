@@ -0,0 +1,179 @@
+package main
+
+/*
+  Branch conflicts.
+
+  When two packages request different branches (or versions) of the same
+  dependency, the 'conflicts' attribute of the root descriptor, or the
+  '--conflicts' option, selects what CPM does:
+  - 'fail' (default): stop with an error;
+  - 'prefer-root': keep the branch requested closest to the root package.
+    Packages are read level by level, so this is the branch that was
+    configured first;
+  - 'prefer-newest-tag': use the newest version tag. Both branches must be
+    version tags;
+  - 'prompt': ask which branch to use. Fails if standard input is not a
+    terminal.
+  The 'resolutions' object of the root descriptor maps package names to
+  the branch used when requests for that package conflict, whatever the
+  policy:
+    "resolutions": {"utils": "v2.1.0"}
+
+  If the selected branch is not the one already checked out, the package is
+  fetched again and its descriptor is read again, as if the package was
+  new. Packages required only by the dependencies of the old branch are
+  dropped.
+*/
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var conflicts_flag = flag.String("conflicts", "", "branch conflict policy: fail, prefer-root, prefer-newest-tag or prompt")
+
+var conflict_policies = []string{"fail", "prefer-root", "prefer-newest-tag", "prompt"}
+
+// Return the selected conflict policy
+func conflict_policy() string {
+	policy := *conflicts_flag
+	if policy == "" {
+		policy = all_packs[0].Conflicts
+	}
+	if policy == "" {
+		return "fail"
+	}
+	if !slices.Contains(conflict_policies, policy) {
+		log.Fatalf("Fatal - unknown conflict policy '%s'. Must be one of %s", policy, strings.Join(conflict_policies, ", "))
+	}
+	return policy
+}
+
+// Return branch name for messages
+func branch_label(branch string) string {
+	if branch == "" {
+		return "HEAD"
+	}
+	return branch
+}
+
+// Return the branch to use for package v, already configured, when package
+// p requests another branch
+func resolve_conflict(v *PacUnit, p *PacUnit, branch string) string {
+	for name, r := range all_packs[0].Resolutions {
+		if strings.EqualFold(name, v.Name) {
+			Verbosef("Package %s - using branch %s from resolutions\n", v.Name, branch_label(r))
+			return r
+		}
+	}
+	conflict := fmt.Sprintf("Package %s - %s requests branch %s but branch %s has already been requested by %s",
+		v.Name, p.Name, branch_label(branch), branch_label(v.Branch), v.requested_by)
+	switch conflict_policy() {
+	case "prefer-root":
+		fmt.Printf("WARNING - %s. Using %s\n", conflict, branch_label(v.Branch))
+		return v.Branch
+	case "prefer-newest-tag":
+		v1, ok1 := parse_version(v.Branch)
+		v2, ok2 := parse_version(branch)
+		if !ok1 || !ok2 {
+			log.Fatalf("Fatal - %s. Cannot select newest tag: both branches must be version tags", conflict)
+		}
+		newest := v.Branch
+		if v2.compare(v1) > 0 {
+			newest = branch
+		}
+		fmt.Printf("WARNING - %s. Using newest tag %s\n", conflict, newest)
+		return newest
+	case "prompt":
+		return prompt_branch(conflict, v, branch)
+	}
+	log.Fatalf("Fatal - %s.\n Use a conflict policy (--conflicts option) or add the package to 'resolutions' in the root descriptor", conflict)
+	return ""
+}
+
+// Ask user which branch to use
+func prompt_branch(conflict string, v *PacUnit, branch string) string {
+	if fi, err := os.Stdin.Stat(); err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		log.Fatalf("Fatal - %s. Cannot prompt: standard input is not a terminal", conflict)
+	}
+	fmt.Printf("%s.\n  1) %s\n  2) %s\n", conflict, branch_label(v.Branch), branch_label(branch))
+	in := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Print("Branch to use [1]: ")
+		line, err := in.ReadString('\n')
+		switch n, _ := strconv.Atoi(strings.TrimSpace(line)); {
+		case strings.TrimSpace(line) == "" || n == 1:
+			return v.Branch
+		case n == 2:
+			return branch
+		case err != nil:
+			log.Fatalf("Fatal - %s", conflict)
+		}
+	}
+}
+
+// Fetch a package again after its branch changed and read its descriptor.
+// Returns the packages that were not known before.
+func refetch(v *PacUnit) []*PacUnit {
+	if *local_flag {
+		fmt.Printf("WARNING - local-only mode. Package %s is not switched to branch %s\n", v.Name, branch_label(v.Branch))
+	} else {
+		fmt.Printf("Package %s - switching to branch %s\n", v.Name, branch_label(v.Branch))
+	}
+	fetch_package(v)
+	reset_package(v)
+	refetched = true
+	return add_dependencies(v)
+}
+
+var refetched bool //a package was fetched again since the last check
+
+// Forget everything read from the descriptor of a package, keeping only the
+// attributes given by its consumers
+func reset_package(v *PacUnit) {
+	*v = PacUnit{
+		Name: v.Name, Git: v.Git, Https: v.Https, Hg: v.Hg, Svn: v.Svn, P4Port: v.P4Port, Depot: v.Depot, Branch: v.Branch,
+		path: v.path, version: v.version, depth: v.depth, sparse: v.sparse, commit: v.commit, tree: v.tree,
+		archive: v.archive, sha256: v.sha256, repository: v.repository, artifact: v.artifact,
+		registry: v.registry, provider: v.provider, source: v.source, prebuilt: v.prebuilt,
+		groups: v.groups, requested_by: v.requested_by, fetched: v.fetched, changelist: v.changelist,
+	}
+}
+
+// Remove the packages that the root package no longer depends on, after
+// packages were fetched again with other branches. Returns the packages of
+// level that are still needed.
+func drop_unreachable(level []*PacUnit) []*PacUnit {
+	if !refetched {
+		return level
+	}
+	refetched = false
+	reachable := make(map[*PacUnit]bool)
+	var visit func(p *PacUnit)
+	visit = func(p *PacUnit) {
+		if reachable[p] {
+			return
+		}
+		reachable[p] = true
+		for _, d := range p.Depends {
+			if d.pack != nil {
+				visit(d.pack)
+			}
+		}
+	}
+	root := all_packs[0]
+	visit(root)
+	all_packs = slices.DeleteFunc(all_packs, func(p *PacUnit) bool {
+		if !reachable[p] {
+			fmt.Printf("Package %s is no longer a dependency of %s\n", p.Name, root.Name)
+		}
+		return !reachable[p]
+	})
+	return slices.DeleteFunc(level, func(p *PacUnit) bool { return !reachable[p] })
+}
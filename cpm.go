@@ -11,23 +11,120 @@ package main
     cpm [options] [<package>]
     or
       cpm version
+    or
+      cpm [options] <command> [<args>]
 
   If package name is missing, the program assumes to be the current
-  directory.
+  directory. A package named like a command is built if it is the only
+  argument and its folder has a descriptor.
 
   Valid options are:
     -b <branch name> switches to specific branch or tag
     -F discards local changes when switching branches
     -f fetch-only (do not build)
     -l local-only (do not pull)
+    -j <n> | auto (or --jobs <n> | auto) - number of parallel jobs
     -v verbose
     --root <rootdir> (or -r <rootdir>) - root directory of development tree
     --uri <uri> (or -u <uri>) - URI of root package
     --proto [git | https] - protocol used for cloning
+    --compiler-cache [ccache | sccache] - compiler cache used for builds
+    --limit-rate <rate> - maximum transfer rate for fetch operations
+    --cache - use mirrors as global package cache
+    --link-mode [symlink | junction | hardlink | copy] - how include and lib
+        folders are linked
+    --profile <name>[,<name>...] - apply descriptor profiles
+    --group <name>[,<name>...] - fetch and build only packages in groups
+    --skip-group <name>[,<name>...] - don't fetch or build packages in groups
+    --features <name>[,<name>...] - select features used in conditions
+    --offline <bundle> - restore packages from bundle and work offline
+    --locked - check out dependencies at commits recorded in lockfile
+    --descriptor-for-root <file> - take root package dependencies and build
+        commands from another descriptor
+    --bindings <name>[,<name>...] | none - language bindings to generate
+    --conflicts <policy> - policy for conflicting branches of a dependency
+    --keep-going - continue building independent packages after a failure
+    --force-build - build packages whose inputs didn't change
+    --no-build-cache - don't use the build cache
+    --no-prebuilt - build all packages from sources
+    --max-cpus <n> - maximum number of processors used by a package build
+    --max-memory <size> - maximum memory used by a package build, like 4G
+    --background - run at low CPU and I/O priority
+    --werror - treat warnings as errors
+    --output [text | json] - write JSON report of the run to standard output
+    --progress [auto | on | off] - show status lines of packages instead of
+        command output
+    --report <file> - generate dependency report (C header or JSON)
+    --target <target>[:<variant>] - build for a different target (wasm,
+        android, ios)
     --version  - show version
 
+  Valid commands are:
+    abi-check [-update] <package> - compare exported symbols against baseline
+    prefetch [<package>...] - update mirror cache for all dependencies
+    check-tags <release> [<package>] - check release tag of all dependencies
+    export-package <package> --to <url> [--history] [--branch <name>] - export
+        package to a standalone repository
+    absorb <package> [--into <package>] [--squash] - merge a dependency into
+        root package repository
+    uninstall <package> [--from <package>] [--force] - remove a dependency
+    rename <old> <new> [--includes] [--dry-run] - rename a package
+    check-includes [<package>] - check dependencies against include directives
+    fetch [--profile <names>] [--group <names>] [--skip-group <names>]
+        [<package>] - fetch package and dependencies without building
+    build [--profile <names>] [--group <names>] [--skip-group <names>]
+        [<package>] - build package and dependencies without fetching
+    update [--profile <names>] [--group <names>] [--skip-group <names>]
+        [<package>] - fetch and build (same as 'cpm [options] [<package>]')
+    clean [--deep] [<package>] - run clean commands of packages and remove
+        links, mirrored headers and built libraries; with '--deep' also
+        remove pkg-config files, warning records and descriptor cache
+    test [<package>] - run test commands of package
+    list [<package>] - list package and dependencies with checked out commits
+    tree [--format text|dot|json] [<package>] - show dependency tree
+    bundle [--output <file>] [<package>] - create offline bundle of package
+        and dependencies
+    check-graph [<package>] - check dependency graph against rules
+    init [--force] [<name>] - create starter descriptor in current folder
+    add <url> [--name <name>] [--branch <branch>|--version <constraint>]
+        [--to <package>] [--fetch-only] [--no-fetch] - add a dependency
+    validate [<package>|<file>] - check descriptor against schema
+    report-bug [--output <file>] [<package>] - gather descriptors, settings
+        and logs for a bug report
+    cmake [--output <file>] [<package>] - generate CMake file with imported
+        targets for dependencies
+    schema [--output <file>] [descriptor|lockfile] - print JSON schema of
+        descriptors or lockfiles
+    badge [--output <folder>] [<package>] - generate status page and badges
+    bootstrap-tools [<package>] - download and check required build tools
+    warnings [<package>] | warnings baseline [<package>...] - show compiler
+        warnings against budgets or write warning baselines
+    analyze [--checks <list>] [--config-file <file>] [--output <file>]
+        [<package>...] - run clang-tidy over packages and merge the results
+    status [--fetch] [--format text|json] [<package>] - show branch, commit,
+        local changes, upstream and lockfile state of all packages
+    fmt [--check] [--style <file>] [<package>...] - format sources of
+        workspace members or given packages with clang-format
+    why <package> [<root>] - show dependency chains leading to a package
+    maintain - scheduled prefetch, mirror updates, build cache cleanup and
+        nightly builds
+    sbom [--format cyclonedx|spdx] [--output <file>] [<package>] - software
+        bill of materials of package and dependencies
+    history [--dependency <name>] [--format text|json] [<package>] - show
+        when dependencies were added, removed or repinned, from git history
+    diff-plan [--base <revision>] [--format text|json] [<package>] - show
+        impact of uncommitted descriptor changes without fetching
+    try-downstream [--branch <branch>] [--name <name>] <consumer-repo>
+        [<package>] - build and test a consumer against the local working copy
+    audit [--feed <url|file>] [--format text|json] [--allow-unaudited]
+        [<package>] - report known vulnerabilities of dependencies
+    canary <package>@<branch> - build workspace members depending on package
+        with the given branch of package
+
   The program opens the '<rootdir>/<package>/cpm.json' file and
-  recursively searches and builds all dependencies.
+  recursively searches and builds all dependencies. Without a package, in a
+  folder without a descriptor, it builds the packages listed in the
+  '<rootdir>/cpm.work' file.
 
   Default root of development tree is the ${DEV_ROOT} environment variable.
 */
@@ -37,44 +134,124 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/fs"
 	"log"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"runtime"
 	"slices"
 	"strings"
+	"sync"
 	"time"
 )
 
 const Version = "V0.6.2"
 
 type Command struct {
-	Os   string
-	Cmd  string
-	Args []string
+	Os    string
+	Cmd   string
+	Args  []string
+	Shell ShellName
+	Env   map[string]string
+	When  string
 }
 
 type DependencyDescriptor struct {
-	Name      string
-	Git       string
-	Branch    string
-	Https     string
-	Modules   []string
-	FetchOnly bool
-	Post      []Command
-	pack      *PacUnit
+	Name        string
+	Git         string
+	Branch      string
+	Https       string
+	Hg          string
+	Svn         string
+	P4Port      string
+	Depot       string
+	Changelist  int
+	Version     string
+	Path        string
+	Modules     []string
+	Headers     string
+	IncludeAs   string //name of the include folder of the dependency
+	Flatten     bool
+	CopyHeaders bool
+	FetchOnly   bool
+	Private     bool
+	Shallow     bool
+	Depth       int
+	SparsePaths []string
+	Commit      string
+	Tree        string
+	Post        []Command
+	Env         map[string]string
+	Archive     string
+	Sha256      string
+	Repository  string
+	Artifact    string
+	Prebuilt    map[string]PrebuiltBinary
+	Registry    string
+	Provider    string
+	Source      string
+	When        string
+	Group       string
+	pack        *PacUnit
 }
 
 type PacUnit struct {
-	Name    string
-	Git     string
-	Branch  string
-	Https   string
-	Build   []Command
-	Depends []DependencyDescriptor
-	built   bool
+	Name         string
+	Git          string
+	Branch       string
+	Https        string
+	Hg           string
+	Svn          string
+	P4Port       string
+	Depot        string
+	Build        []Command
+	Builds       map[string][]Command
+	Clean        []Command //commands removing build outputs
+	Tests        []Command //commands running the tests of the package
+	Env          map[string]string
+	Depends      []DependencyDescriptor
+	Freshness    *FreshnessPolicy
+	LicenseEnv   []LicenseEnv
+	Licenses     *LicensePolicy //allowed licenses of dependencies (root package only)
+	GraphRules   *GraphRules
+	Conflicts    string                     //conflict policy (root package only)
+	Resolutions  map[string]string          //branches of conflicting dependencies (root package only)
+	Overrides    map[string]PackageOverride //replaced dependency attributes (root package only)
+	Replace      map[string]string          //local folders of dependencies (root package only)
+	Tools        []Tool                     //required build tools (root package only)
+	Requires     []Requirement              //build prerequisites
+	Packages     []string                   //packages of a workspace
+	Outputs      []string                   //build outputs stored in the build cache
+	Warnings     *WarningBudget
+	Limits       *ResourceLimits
+	Visibility   []string
+	License      string //SPDX license expression
+	Bindings     []Binding
+	PkgConfig    *PkgConfig
+	built        bool
+	path         string   //absolute path of local package (path dependency)
+	version      string   //version tag selected by version constraint
+	depth        int      //clone depth (0 for full history)
+	sparse       []string //sparse checkout folders
+	commit       string   //expected commit
+	tree         string   //expected tree (content hash)
+	archive      string   //archive URL
+	sha256       string   //expected archive hash
+	repository   string   //artifact repository
+	artifact     string   //artifact path or Conan reference
+	registry     string   //registry giving the location
+	provider     string   //external provider
+	source       string   //location given to external provider
+	prebuilt     *PrebuiltBinary
+	descriptor   string   //descriptor file
+	groups       []string //groups given by consumers (lowercase)
+	requested_by string   //package that first requested this package
+	fetched      bool
+	deferred     bool //fetch postponed until groups are known
+	changelist   int  //Perforce changelist
 }
 
 var devroot string         //root of development tree
@@ -85,6 +262,7 @@ var all_packs []*PacUnit
 
 var inprocess []string
 var root_uri string
+var start_time time.Time
 
 // command line flags
 var force_flag = flag.Bool("F", false, "discard local changes")
@@ -93,20 +271,87 @@ var local_flag = flag.Bool("l", false, "local only (no pull)")
 var verbose_flag = flag.Bool("v", false, "verbose")
 var branch_flag = flag.String("b", "", "select branch")
 var proto_flag = flag.String("proto", "git", "download protocol")
+var root_alternate = flag.String("descriptor-for-root", "", "alternate descriptor of root package")
+
+// Subcommands invoked as 'cpm [options] <command> [args]'
+var subcommands = map[string]func(args []string){
+	"abi-check":       abi_check,
+	"prefetch":        prefetch,
+	"check-tags":      check_tags,
+	"check-graph":     check_graph,
+	"export-package":  export_package,
+	"absorb":          absorb,
+	"uninstall":       uninstall,
+	"rename":          rename,
+	"check-includes":  check_includes,
+	"bundle":          bundle,
+	"init":            init_package,
+	"add":             add_dependency,
+	"analyze":         analyze,
+	"validate":        validate,
+	"report-bug":      report_bug,
+	"cmake":           cmake,
+	"schema":          print_schema,
+	"badge":           badge,
+	"bootstrap-tools": bootstrap_tools,
+	"fetch":           cmd_fetch,
+	"build":           cmd_build,
+	"update":          cmd_update,
+	"clean":           clean,
+	"test":            cmd_test,
+	"list":            list,
+	"tree":            tree,
+	"warnings":        warnings_command,
+	"status":          status,
+	"fmt":             format_sources,
+	"why":             why,
+	"maintain":        maintain,
+	"sbom":            sbom,
+	"history":         cmd_history,
+	"diff-plan":       diff_plan,
+	"try-downstream":  try_downstream,
+	"audit":           audit,
+	"canary":          canary,
+}
+
+// Parse command arguments allowing options to be mixed with positional
+// arguments. Returns the positional arguments.
+func parse_interspersed(flags *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		flags.Parse(args)
+		if flags.NArg() == 0 {
+			return positional
+		}
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+}
 
 func main() {
 	var err error
 	var show_ver bool
 
+	if len(os.Args) > 1 && os.Args[1] == "proxy-connect" {
+		//invoked as SSH ProxyCommand; stdout belongs to SSH
+		proxy_connect(os.Args[2:])
+		return
+	}
+
 	println("C/C++ Package Manager " + Version)
 	flag.StringVar(&root_uri, "uri", "", "root URI")
 	flag.StringVar(&root_uri, "u", "", "root URI")
 	flag.StringVar(&devroot, "r", os.Getenv("DEV_ROOT"), "development tree root")
 	flag.StringVar(&devroot, "root", os.Getenv("DEV_ROOT"), "development tree root")
 	flag.BoolVar(&show_ver, "version", false, "show version")
-	start := time.Now()
+	flag.StringVar(&compiler_cache, "compiler-cache", "", "compiler cache (ccache or sccache)")
+	flag.StringVar(&limit_rate, "limit-rate", "", "maximum transfer rate (bytes/sec)")
+	flag.StringVar(&jobs_flag, "j", "1", "number of parallel jobs or 'auto'")
+	flag.StringVar(&jobs_flag, "jobs", "1", "number of parallel jobs or 'auto'")
+	start_time = time.Now()
 	flag.Usage = func() {
 		println(`Usage: cpm [options] [package]
+   or: cpm [options] <command> [args]
         
   If package is not specified, it is assumed to be the current directory.
   Valid options are:
@@ -114,14 +359,110 @@ func main() {
 		-F                          discards local changes when switching branches
     -f                        	fetch-only (no build)
     -l                        	local-only (no fetch/pull)
+    -j <n>|auto (or --jobs)   	number of parallel fetch and build jobs
     --root <dir> (or -r <dir>)  set root of development tree
     --uri <uri> (or -u <uri>) 	URI of root package
     --proto [git|https]       	preferred download protocol
+    --compiler-cache [ccache|sccache]	use compiler cache for builds
+    --limit-rate <rate>       	limit transfer rate (bytes/sec, suffixes k, M, G allowed)
+    --cache                   	share objects with mirrors in global package cache
+    --link-mode <mode>        	link folders using symlink, junction, hardlink or copy
+    --profile <names>         	apply descriptor profiles (comma separated)
+    --group <names>           	fetch and build only packages in these groups (comma separated)
+    --skip-group <names>      	don't fetch or build packages in these groups (comma separated)
+    --features <names>        	select features used in conditions (comma separated)
+    --offline <bundle>        	restore packages from bundle and work offline (no fetch/pull)
+    --locked                  	check out dependencies at commits recorded in cpm.lock
+    --descriptor-for-root <file>	use alternate descriptor for root package
+    --bindings <names>|none   	generate only named language bindings or none
+    --conflicts <policy>      	fail, prefer-root, prefer-newest-tag or prompt for conflicting branches
+    --keep-going              	continue building independent packages after a failure
+    --force-build             	build also packages whose inputs didn't change since last build
+    --no-build-cache          	don't download or upload build outputs from the build cache
+    --no-prebuilt             	fetch and build dependencies from sources, ignoring prebuilt binaries
+    --max-cpus <n>            	maximum number of processors used by a package build
+    --max-memory <size>       	maximum memory used by a package build, like 4G
+    --background              	run at low CPU and I/O priority, for scheduled jobs
+    --werror                  	treat warnings as errors
+    --output text|json        	write JSON report of the run to stdout (messages go to stderr)
+    --progress auto|on|off    	show status line of each package; command output goes to logs
+    --report <file>           	generate dependency report (.h for C header, otherwise JSON)
+    --target <target>[:<variant>]	build for a different target (wasm, android[:<abi>], ios[:<sdk>])
     -v                        	verbose
-    --help (or -h)            	prints this message`)
+    --help (or -h)            	prints this message
+
+  Valid commands are:
+    abi-check [-update] <package>	compare exported symbols against recorded baseline
+    prefetch [package...]     	update mirror cache for all dependencies
+    check-tags <release> [package]	check release tag of all dependencies
+    export-package <package> --to <url> [--history] [--branch <name>]
+                              	export package to a standalone repository
+    absorb <package> [--into <package>] [--squash]
+                              	merge a dependency into root package repository
+    uninstall <package> [--from <package>] [--force]
+                              	remove a dependency
+    rename <old> <new> [--includes] [--dry-run]
+                              	rename a package in the development tree
+    check-includes [<package>]	check dependencies against include directives
+    fetch [--profile <names>] [--group <names>] [--skip-group <names>] [<package>]
+                              	fetch package and dependencies (no build)
+    build [--profile <names>] [--group <names>] [--skip-group <names>] [<package>]
+                              	build package and dependencies (no fetch/pull)
+    update [--profile <names>] [--group <names>] [--skip-group <names>] [<package>]
+                              	fetch and build (same as 'cpm [options] [package]')
+    clean [--deep] [<package>]	run clean commands and remove links, mirrored headers and
+                              	built libraries; --deep also removes pkg-config files,
+                              	warning records and descriptor cache
+    test [<package>]          	run test commands of package
+    list [<package>]          	list package and dependencies with checked out commits
+    tree [--format text|dot|json] [<package>]
+                              	show dependency tree (as text, Graphviz DOT or JSON)
+    bundle [--output <file>] [<package>]
+                              	create offline bundle of package and dependencies
+    check-graph [<package>]   	check dependency graph against descriptor rules
+    init [--force] [<name>]   	create starter descriptor in current folder
+    add <url> [--name <name>] [--branch <branch>|--version <constraint>] [--to <package>] [--fetch-only] [--no-fetch]
+                              	add a dependency to descriptor and fetch it
+    validate [<package>|<file>]	check descriptor and overlay against schema
+    report-bug [--output <file>] [<package>]
+                              	create archive with information for a bug report
+    cmake [--output <file>] [<package>]
+                              	generate CMake file with imported targets for dependencies
+    schema [--output <file>] [descriptor|lockfile]
+                              	print JSON schema of descriptors or lockfiles
+    badge [--output <folder>] [<package>]
+                              	generate HTML status page and SVG badges
+    bootstrap-tools [<package>]	download and check build tools required by the package
+    warnings [<package>]      	show compiler warnings of last builds against budgets
+    warnings baseline [<package>...]
+                              	write warnings of last builds as baselines of packages
+    analyze [<package>...]    	run clang-tidy over packages; options are --checks <list>,
+                              	--config-file <file> and --output <file>
+    status [--fetch] [--format text|json] [<package>]
+                              	show branch, commit, local changes, ahead/behind
+                              	counts and lockfile match of all packages
+    fmt [--check] [<package>...]
+                              	format sources of workspace members or packages with
+                              	clang-format; --check lists unformatted files
+    why <package> [<root>]    	show dependency chains from the root package to a package
+    maintain                  	prefetch, update mirrors, clean build cache and build packages
+                              	as set in configuration; meant for cron or Task Scheduler
+    sbom [--format cyclonedx|spdx] [--output <file>] [<package>]
+                              	write software bill of materials of package and dependencies
+    history [--dependency <name>] [--format text|json] [<package>]
+                              	show commits that changed dependencies in descriptors and lockfiles
+    diff-plan [--base <revision>] [--format text|json] [<package>]
+                              	show packages added, removed, repinned and rebuilt by descriptor changes
+    try-downstream [--branch <branch>] [--name <name>] <consumer-repo> [<package>]
+                              	fetch, build and test a consumer with its dependency on package replaced by a copy of the working copy
+    audit [--feed <url|file>] [--format text|json] [--allow-unaudited] [<package>]
+                              	report known vulnerabilities of dependencies; exit status 1 if any
+                              	or if dependencies cannot be audited
+    canary <package>@<branch>  	build workspace members depending on package with a branch of package and report which break`)
 	}
 
 	flag.Parse()
+	setup_output()
 	if show_ver || (flag.NFlag() == 0 && flag.NArg() > 0 && flag.Arg(0) == "version") {
 		os.Exit(0)
 	}
@@ -130,12 +471,28 @@ func main() {
 		log.Fatal("Unknown protocol. Must be 'git' or 'https'")
 	}
 
+	if compiler_cache != "" {
+		setup_compiler_cache()
+	}
+
+	if limit_rate != "" {
+		setup_rate_limit()
+	}
+
+	if *background_flag {
+		setup_background()
+	}
+
+	if *progress_flag != "auto" && *progress_flag != "on" && *progress_flag != "off" {
+		log.Fatalf("Invalid progress display '%s'. Must be 'auto', 'on' or 'off'", *progress_flag)
+	}
+
 	if root_uri != "" && *local_flag {
 		log.Fatal("Local mode only. Cannot fetch root package!!")
 	}
 
 	if devroot == "" {
-		devroot,_ = os.Getwd()
+		devroot, _ = os.Getwd()
 		fmt.Printf("No development tree root specified. Using current directory %s\n", devroot)
 	}
 
@@ -146,28 +503,58 @@ func main() {
 		}
 	}
 	Verboseln("DEV_ROOT=", devroot)
+	setup_target()
+	setup_jobs()
+	if *offline_flag != "" {
+		restore_bundle(*offline_flag)
+		*local_flag = true
+	}
 
-	var root_name string
 	if flag.NArg() > 0 {
-		dir := ""
-		//root package specified on command line
-		if !strings.ContainsAny(flag.Arg(0), "\\/") {
-			//only a relative path - use DEVROOT as path
-			root_name = flag.Arg(0)
-			dir = devroot
-		} else {
-			_, root_name = filepath.Split(flag.Arg(0))
+		if cmd, ok := subcommands[flag.Arg(0)]; ok && !is_package_arg(flag.Args()) {
+			cmd(flag.Args()[1:])
+			write_run_report("")
+			return
 		}
-		root_descriptor = filepath.Join(dir, root_name, descriptor_name)
-	} else {
-		//assume root package is in current folder
-		cwd, _ := os.Getwd()
-		_, root_name = filepath.Split(cwd)
-		root_descriptor = filepath.Join(cwd, descriptor_name)
 	}
 
-	Verboseln("Top descriptor is ", root_descriptor)
-	os.Mkdir(filepath.Join(devroot, "lib"), 0755)
+	update_tree(flag.Arg(0))
+	if summary := maintenance_summary(); summary != "" {
+		fmt.Println(summary)
+	}
+	write_run_report("")
+}
+
+// Return true if command line arguments name only a package whose name is
+// also a command, so packages named like newer commands can still be built
+func is_package_arg(args []string) bool {
+	if len(args) != 1 {
+		return false
+	}
+	if _, err := os.Stat(filepath.Join(devroot, args[0], descriptor_name)); err != nil {
+		return false
+	}
+	Verbosef("Building package %s. Folder %s hides the %s command\n", args[0], filepath.Join(devroot, args[0]), args[0])
+	return true
+}
+
+// Fetch and build the root package specified on command line (or the package
+// in current folder) and all its dependencies
+func update_tree(arg string) {
+	var err error
+	var root_name string
+	root_name, root_descriptor = find_root(arg)
+	if up_to_date() {
+		fmt.Println("Development tree is up to date")
+		return
+	}
+	clear_last_run()
+	run_phase = "fetch"
+
+	source := root_source(root_descriptor)
+	Verboseln("Top descriptor is ", source)
+	setup_profiles()
+	os.MkdirAll(lib_dir(), 0755)
 
 	root := new(PacUnit)
 	root.Branch = *branch_flag
@@ -181,26 +568,54 @@ func main() {
 	}
 
 	var data []byte
-	if data, err = os.ReadFile(root_descriptor); err != nil {
-		log.Fatalf("cannot open '%s' file", root_descriptor)
+	if data, err = load_descriptor(source); err != nil {
+		log.Fatalf("cannot open '%s' file - %v", source, err)
 	}
 
 	if err = json.Unmarshal(data, root); err != nil {
-		log.Fatalf("cannot parse %s - %v\n", root_descriptor, err)
+		log.Fatalf("cannot parse %s - %v\n", source, err)
 	}
 
 	if root_name != "" && !strings.EqualFold(root.Name, root_name) {
-		fmt.Printf("WARNING specifed package directory '%s' does not match descriptor's package name (%s)\n", root_name, root.Name)
+		warn("name-mismatch", "specified package directory '%s' does not match descriptor's package name (%s)", root_name, root.Name)
 		root.Name = root_name
 	}
-	os.Chdir(filepath.Join(devroot, root.Name))
+	setup_workspace(root)
+	os.Chdir(package_dir(root))
 
 	cwd, _ := os.Getwd()
 	Verboseln("Changed directory to", cwd)
 
+	start_progress()
 	fetch_all(root)
+	save_descriptor_cache()
+	check_profiles()
+	save_manifests()
+	//a denied dependency must not be locked
+	if root.Licenses != nil {
+		check_license_policy(root)
+	}
+	if !*locked_flag {
+		update_lockfile(root)
+	}
+	if *report_flag != "" {
+		generate_report(root)
+	}
+	update_cmake(root)
+
+	if root.Freshness != nil {
+		check_freshness(root)
+	}
 
 	if !*fetch_flag {
+		if n := check_licenses(); n != 0 {
+			log.Fatalf("Fatal - %d license requirements not satisfied. Build not started.", n)
+		}
+		setup_tools(root)
+		if n := check_requirements(); n != 0 {
+			log.Fatalf("Fatal - %d prerequisites missing. Build not started.", n)
+		}
+		run_phase = "build"
 		inprocess = make([]string, 0, 10)
 		if root_name != "" && !strings.EqualFold(root.Name, root_name) {
 			//Descriptor parsing has changed the root name from what user wants.
@@ -208,128 +623,556 @@ func main() {
 			root.Name = root_name
 		}
 		build(root)
+		check_duplicate_symbols()
+		print_cache_report()
+		save_history()
+		check_build_results()
+		print_problems(os.Stdout)
+		record_last_run()
 	}
+	stop_progress()
 
-	fmt.Println("CPM operation finished in", time.Since(start).Round(100*time.Microsecond))
+	print_transfer_summary()
+	fmt.Println("CPM operation finished in", time.Since(start_time).Round(100*time.Microsecond))
 }
 
-// Fetch one package. Changes working directory to the package directory
-func fetch(p *PacUnit) {
-	pacdir := filepath.Join(devroot, p.Name)
+// Return descriptor file used for root package: the one given by the
+// '--descriptor-for-root' option, relative to the root package folder, or
+// the package descriptor
+func root_source(descriptor string) string {
+	if *root_alternate == "" {
+		return descriptor
+	}
+	if filepath.IsAbs(*root_alternate) {
+		return *root_alternate
+	}
+	return filepath.Join(filepath.Dir(descriptor), *root_alternate)
+}
 
-	if _, err := os.Stat(pacdir); os.IsNotExist(err) {
-		//package directory doesn't exist; create it and clone repo
-		if err := os.Mkdir(pacdir, 0764); err != nil {
-			log.Fatalf("error %d - cannot create folder %s", err, pacdir)
+// Return name and descriptor path of root package specified on command line.
+// If arg is empty, root package is in current folder.
+func find_root(arg string) (name string, descriptor string) {
+	if descriptor = workspace_descriptor(arg); descriptor != "" {
+		workspace = true
+		return
+	}
+	if arg != "" {
+		dir := ""
+		//root package specified on command line
+		if !strings.ContainsAny(arg, "\\/") {
+			//only a relative path - use DEVROOT as path
+			name = arg
+			dir = devroot
+		} else {
+			_, name = filepath.Split(arg)
 		}
-		git_clone(p)
-		os.Chdir(pacdir)
-	} else if _, err := os.Stat(filepath.Join(pacdir, ".git")); os.IsNotExist(err) {
-		//package directory exists but no git repo here; clone repo
-		git_clone(p)
-		os.Chdir(pacdir)
+		descriptor = filepath.Join(dir, name, descriptor_name)
 	} else {
-		//repo exists; just pull latest version
-		os.Chdir(pacdir)
-		git_pull(p.Branch)
+		//assume root package is in current folder
+		cwd, _ := os.Getwd()
+		_, name = filepath.Split(cwd)
+		descriptor = filepath.Join(cwd, descriptor_name)
+	}
+	return
+}
+
+// Return package folder
+func package_dir(p *PacUnit) string {
+	if p.path != "" {
+		return p.path
 	}
+	return filepath.Join(devroot, p.Name)
 }
 
-// Fetch a package and all its dependents
+// Fetch a package and all its dependents. Packages are fetched level by
+// level: all newly discovered packages of a level are fetched in parallel
+// and their descriptors are then read to discover the next level.
 func fetch_all(p *PacUnit) {
-	pacdir := filepath.Join(devroot, p.Name)
-	if !*local_flag {
-		fetch(p) //fetch top package
+	pool := new_job_pool(fetch_jobs)
+	level := []*PacUnit{p}
+	for len(level) != 0 {
+		var wg sync.WaitGroup
+		for _, q := range level {
+			wg.Add(1)
+			go func(q *PacUnit) {
+				defer wg.Done()
+				pool.acquire()
+				defer pool.release()
+				fetch_package(q)
+			}(q)
+		}
+		wg.Wait()
+
+		var next []*PacUnit
+		for _, q := range level {
+			next = append(next, add_dependencies(q)...)
+		}
+		level = drop_unreachable(next)
+		if len(level) == 0 && group_filter() && !groups_resolved {
+			//packages postponed by fetch_package are fetched if selected
+			groups_resolved = true
+			compute_groups()
+			for _, q := range all_packs {
+				if q.deferred && group_selected(q) {
+					q.Depends, q.Build, q.Builds = nil, nil, nil
+					level = append(level, q)
+				}
+			}
+		}
+	}
+	compute_groups()
+
+	if violations := visibility_violations(); len(violations) != 0 {
+		log.Fatalf("Fatal - %s", strings.Join(violations, "\n"))
+	}
+	for _, q := range all_packs {
+		verify_checkout(q)
+		setup_links(q)
+	}
+}
+
+// Bring a package in the development tree
+func fetch_package(p *PacUnit) {
+	pacdir := package_dir(p)
+	progress_phase(p, "fetch")
+	defer progress_done(p, "fetched")
+	open_build_log(p)
+	defer close_build_log(p)
+	if p.path != "" {
+		//local package is never fetched
+		fetch(p)
+	} else if group_filter() && p != all_packs[0] && !groups_resolved {
+		if _, err := os.Stat(pacdir); err != nil {
+			fetch(p)
+		} else {
+			Verbosef("Package %s - fetch postponed until groups are known\n", p.Name)
+			p.deferred = true
+			p.fetched = true
+			return
+		}
+	} else if !group_selected(p) {
+		if _, err := os.Stat(pacdir); err != nil {
+			fetch(p)
+		} else {
+			Verbosef("Package %s - not in selected groups. Fetch skipped\n", p.Name)
+			p.fetched = true
+			return
+		}
+	} else if !*local_flag {
+		fetch(p)
 	} else {
-		if os.Chdir(pacdir) != nil {
+		if _, err := os.Stat(pacdir); err != nil {
 			log.Fatalf("Fatal - local-only mode and %s does not exist", pacdir)
 		}
 	}
-	cwd, _ := os.Getwd()
+	if *locked_flag && p != all_packs[0] && p.path == "" && p.archive == "" && p.provider == "" {
+		checkout_locked(p)
+	}
+	p.fetched = true
+}
+
+// Read descriptor of a package and add its dependencies to the list of all
+// packages. Returns the packages that were not known before.
+func add_dependencies(p *PacUnit) []*PacUnit {
+	pacdir := package_dir(p)
 	if len(p.Branch) == 0 {
-		Verbosef("Setting up %s in %s\n", p.Name, cwd)
+		Verbosef("Setting up %s in %s\n", p.Name, pacdir)
 	} else {
-		Verbosef("Setting up %s@%s in %s\n", p.Name, p.Branch, cwd)
+		Verbosef("Setting up %s@%s in %s\n", p.Name, p.Branch, pacdir)
 	}
 
-	Symlink(filepath.Join(devroot, "lib"), "lib")
-
-	data, err := os.ReadFile(descriptor_name)
+	fname := filepath.Join(pacdir, descriptor_name)
+	if p == all_packs[0] && (*root_alternate != "" || workspace) {
+		fname = root_source(root_descriptor)
+	}
+	p.descriptor = fname
+	data, err := load_descriptor(fname)
 	if err != nil {
-		Verbosef(" %s\\%s file not found. Assuming no dependencies\n", cwd, descriptor_name)
+		if !os.IsNotExist(err) {
+			log.Fatalf("cannot read %s - %v", fname, err)
+		}
+		Verbosef(" %s file not found. Assuming no dependencies\n", fname)
 	} else {
 		if err = json.Unmarshal(data, &p); err != nil {
-			log.Fatalf("cannot parse %s - %v", descriptor_name, err)
+			log.Fatalf("cannot parse %s - %v", fname, err)
 		}
+		filter_dependencies(p)
 	}
+	if p == all_packs[0] {
+		add_members(p)
+	}
+	override_build(p)
+
+	var added []*PacUnit
+	for i := range p.Depends {
+		var v *PacUnit
+		var idx int
+
+		apply_override(p, &p.Depends[i])
+		check_dependency(p, &p.Depends[i])
+		prebuilt := select_prebuilt(p, &p.Depends[i])
+		if p.Depends[i].Version != "" && p.Depends[i].Path == "" && prebuilt == nil {
+			if p.Depends[i].Branch != "" {
+				log.Fatalf("Package %s - dependency %s cannot have both branch and version", p.Name, p.Depends[i].Name)
+			}
+			p.Depends[i].Branch = resolve_version(&p.Depends[i], filepath.Join(devroot, p.Depends[i].Name))
+		}
 
-	if p.Depends != nil {
-		//setup all dependent packages
-		for i := range p.Depends {
-			var v *PacUnit
-			var idx int
-
-			//search if already setup
-			found := false
-			for idx, v = range all_packs {
-				if v.Name == p.Depends[i].Name {
-					if v.Branch != p.Depends[i].Branch {
-						b1 := v.Branch
-						if len(b1) == 0 {
-							b1 = "HEAD"
+		//search if already setup
+		found := false
+		for idx, v = range all_packs {
+			if v.Name == p.Depends[i].Name {
+				if v.Branch != p.Depends[i].Branch {
+					branch := resolve_conflict(v, p, p.Depends[i].Branch)
+					if branch != v.Branch {
+						//tags selected by version constraints are checked out detached
+						tagged := v.version != "" || p.Depends[i].Version != ""
+						v.Branch, v.version = branch, ""
+						if _, ok := parse_version(branch); ok && tagged {
+							v.version = branch
 						}
-						b2 := p.Depends[i].Branch
-						if len(b2) == 0 {
-							b2 = "HEAD"
+						if v.fetched {
+							added = append(added, refetch(v)...)
 						}
-						log.Fatalf("Package %s - cannot switch to %s branch. Branch %s has already been configured", v.Name, b1, b2)
 					}
-					found = true
-					break
+					p.Depends[i].Branch = branch
 				}
+				found = true
+				break
+			}
+		}
+		if !found {
+			//add new package
+			d := new(PacUnit)
+			d.Name = p.Depends[i].Name
+			d.Git = p.Depends[i].Git
+			d.Https = p.Depends[i].Https
+			d.Hg = p.Depends[i].Hg
+			d.Svn = p.Depends[i].Svn
+			d.P4Port = p.Depends[i].P4Port
+			d.Depot = p.Depends[i].Depot
+			d.changelist = p.Depends[i].Changelist
+			d.Branch = p.Depends[i].Branch
+			if p.Depends[i].Version != "" {
+				d.version = d.Branch
 			}
-			if !found {
-				//add new package
-				d := new(PacUnit)
-				d.Name = p.Depends[i].Name
-				d.Git = p.Depends[i].Git
-				d.Https = p.Depends[i].Https
-				d.Branch = p.Depends[i].Branch
-				all_packs = append(all_packs, d)
-				fetch_all(d)
-				p.Depends[i].pack = d
-			} else {
-				p.Depends[i].pack = all_packs[idx]
-				Verbosef("Package %s has already been configured\n", p.Depends[i].Name)
+			d.path = dependency_path(pacdir, &p.Depends[i])
+			d.depth = dependency_depth(&p.Depends[i])
+			d.sparse = p.Depends[i].SparsePaths
+			d.commit = p.Depends[i].Commit
+			d.tree = p.Depends[i].Tree
+			d.archive = p.Depends[i].Archive
+			if p.Depends[i].Repository != "" {
+				d.archive = artifact_url(&p.Depends[i])
+				d.repository, d.artifact = p.Depends[i].Repository, p.Depends[i].Artifact
 			}
+			d.sha256 = p.Depends[i].Sha256
+			d.registry = p.Depends[i].Registry
+			d.provider, d.source = p.Depends[i].Provider, p.Depends[i].Source
+			if prebuilt != nil {
+				d.prebuilt, d.archive, d.sha256 = prebuilt, prebuilt.Url, prebuilt.Sha256
+			}
+			add_group(d, p.Depends[i].Group)
+			d.requested_by = p.Name
+			all_packs = append(all_packs, d)
+			added = append(added, d)
+			p.Depends[i].pack = d
+		} else {
+			p.Depends[i].pack = all_packs[idx]
+			add_group(all_packs[idx], p.Depends[i].Group)
+			check_expected(all_packs[idx], &p.Depends[i])
+			check_cycle(p, &p.Depends[i])
+			Verbosef("Package %s has already been configured\n", p.Depends[i].Name)
 		}
-		incdir := filepath.Join(cwd, "include")
-		if os.Chdir(incdir) != nil {
-			os.Mkdir(incdir, 0755)
-			os.Chdir(incdir)
+	}
+	return added
+}
+
+// Create symlinks to the lib folder and to include folders of dependencies
+func setup_links(p *PacUnit) {
+	if workspace && p == all_packs[0] {
+		//workspace folder is the development tree root
+		return
+	}
+	pacdir := package_dir(p)
+	Symlink(lib_dir(), filepath.Join(pacdir, "lib"))
+	if len(p.Depends) == 0 {
+		return
+	}
+
+	incdir := filepath.Join(pacdir, "include")
+	if _, err := os.Stat(incdir); err != nil {
+		os.Mkdir(incdir, 0755)
+		record_dir(incdir)
+	}
+
+	//create symlinks to dependents
+	users := make(map[string]string) //include folder -> dependency
+	linked := make(map[string]bool)  //names linked in include folder
+	for i := range p.Depends {
+		dep := &p.Depends[i]
+		name := include_name(dep)
+		if other, ok := users[strings.ToLower(name)]; ok && len(dep.Modules) == 0 {
+			log.Fatalf("Fatal - Package %s - dependencies %s and %s use the same include folder %s", p.Name, other, dep.Name, name)
+		}
+		users[strings.ToLower(name)] = dep.Name
+		for _, n := range link_includes(incdir, dep) {
+			linked[strings.ToLower(n)] = true
+		}
+	}
+
+	//include folders of public dependencies of dependencies
+	for _, dep := range propagated_includes(p) {
+		name := include_name(dep)
+		link := filepath.Join(incdir, name)
+		if other, ok := users[strings.ToLower(name)]; ok {
+			Verbosef("Package %s - include folder %s of %s not propagated (used by %s)\n", p.Name, name, dep.Name, other)
+			continue
 		}
+		if _, err := os.Lstat(link); err == nil && !is_owned(link) {
+			Verbosef("Package %s - include folder %s of %s not propagated (%s exists)\n", p.Name, name, dep.Name, link)
+			continue
+		}
+		users[strings.ToLower(name)] = dep.Name
+		for _, n := range link_includes(incdir, dep) {
+			linked[strings.ToLower(n)] = true
+		}
+	}
+
+	//links to modules that disappeared and copies of modules not linked in
+	//this run
+	entries, _ := os.ReadDir(incdir)
+	for _, e := range entries {
+		link := filepath.Join(incdir, e.Name())
+		if !is_owned(link) {
+			continue
+		}
+		if e.Type()&fs.ModeSymlink == 0 {
+			if !linked[strings.ToLower(e.Name())] {
+				warn("dangling-module", "In '%s' - %s is not included by any dependency", incdir, e.Name())
+			}
+		} else if _, err := os.Stat(link); err != nil {
+			target, _ := os.Readlink(link)
+			warn("dangling-module", "In '%s' - link %s points to missing %s", incdir, e.Name(), target)
+		}
+	}
+}
 
-		//create symlinks to dependents
-		for _, dep := range p.Depends {
-			var target string
-			if len(dep.Modules) != 0 {
-				for _, m := range dep.Modules {
-					target = filepath.Join(devroot, dep.Name, "include", m)
-					Verbosef("In '%s' - creating symlink %s --> %s\n", cwd, target, m)
-					Symlink(target, m)
+// Create in folder incdir the symlinks (or mirror folder) to the include
+// folder of a dependency. Returns the names of the objects created in incdir.
+func link_includes(incdir string, dep *DependencyDescriptor) []string {
+	name := include_name(dep)
+	link := filepath.Join(incdir, name)
+	if dep.Headers != "" {
+		src := filepath.Join(package_dir(dep.pack), dep.Headers)
+		Verbosef("In '%s' - mirroring headers %s --> %s\n", incdir, src, name)
+		mirror_headers(src, link, dep.Flatten, dep.CopyHeaders)
+	} else if len(dep.Modules) != 0 {
+		var names []string
+		for _, m := range expand_modules(dep) {
+			names = append(names, strings.Split(m, "/")[0])
+			target := filepath.Join(package_dir(dep.pack), "include", filepath.FromSlash(m))
+			link := filepath.Join(incdir, filepath.FromSlash(m))
+			//parent folders of nested modules
+			if parent := path.Dir(m); parent != "." {
+				dir := incdir
+				for _, name := range strings.Split(parent, "/") {
+					dir = filepath.Join(dir, name)
+					if _, err := os.Lstat(dir); err != nil {
+						os.Mkdir(dir, 0755)
+						record_dir(dir)
+					}
 				}
-			} else {
-				target = filepath.Join(devroot, dep.Name, "include", dep.Name)
-				Verbosef("In '%s' - creating symlink %s --> %[3]s\n", cwd, target, dep.Name)
-				Symlink(target, dep.Name)
 			}
+			Verbosef("In '%s' - creating symlink %s --> %s\n", incdir, target, m)
+			Symlink(target, link)
+		}
+		return names
+	} else {
+		//headers of the dependency can already be in a folder named like the link
+		target := filepath.Join(package_dir(dep.pack), "include", name)
+		if _, err := os.Stat(target); err != nil {
+			target = filepath.Join(package_dir(dep.pack), "include", dep.Name)
+		}
+		Verbosef("In '%s' - creating symlink %s --> %[3]s\n", incdir, target, name)
+		Symlink(target, link)
+	}
+	return []string{name}
+}
+
+// Return the public dependencies of the dependencies of a package, direct or
+// indirect. Their include folders are propagated to the package because
+// headers of its dependencies can include them. Private dependencies and
+// their own dependencies are not propagated.
+func propagated_includes(p *PacUnit) []*DependencyDescriptor {
+	seen := map[*PacUnit]bool{p: true}
+	for _, d := range p.Depends {
+		seen[d.pack] = true
+	}
+	var deps []*DependencyDescriptor
+	var walk func(q *PacUnit)
+	walk = func(q *PacUnit) {
+		for i := range q.Depends {
+			d := &q.Depends[i]
+			if d.Private || d.pack == nil || seen[d.pack] {
+				continue
+			}
+			seen[d.pack] = true
+			deps = append(deps, d)
+			walk(d.pack)
+		}
+	}
+	for _, d := range p.Depends {
+		if d.pack != nil {
+			walk(d.pack)
 		}
 	}
+	return deps
 }
 
-// Build a packge after first having built its dependents
+// Return name of the include folder of a dependency in its consumers
+func include_name(d *DependencyDescriptor) string {
+	if d.IncludeAs != "" {
+		return d.IncludeAs
+	}
+	return d.Name
+}
+
+// Return module names of a dependency matching the module patterns in
+// its descriptor. Modules are folders of the include folder of the
+// dependency, at any depth, named by their relative path, like 'net/serial'.
+// Fails if a module doesn't exist.
+func expand_modules(dep *DependencyDescriptor) []string {
+	incdir := filepath.Join(package_dir(dep.pack), "include")
+	var available []string
+	filepath.WalkDir(incdir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == incdir {
+			return nil
+		}
+		if d.IsDir() || d.Type()&fs.ModeSymlink != 0 {
+			rel, _ := filepath.Rel(incdir, path)
+			available = append(available, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+
+	var modules, missing []string
+	for _, pattern := range dep.Modules {
+		found := false
+		pattern = strings.Trim(filepath.ToSlash(pattern), "/")
+		for _, m := range available {
+			if ok, _ := path.Match(pattern, m); ok {
+				found = true
+				if !slices.Contains(modules, m) {
+					modules = append(modules, m)
+				}
+			}
+		}
+		if !found {
+			missing = append(missing, pattern)
+		}
+	}
+	if len(missing) != 0 {
+		log.Fatalf("Package %s - module(s) %s not found in %s\n Available modules: %s",
+			dep.Name, strings.Join(missing, ", "), incdir, strings.Join(available, ", "))
+	}
+	return modules
+}
+
+// Return absolute path of a path dependency declared by the package in
+// folder dir or an empty string if dependency is not a path dependency
+func dependency_path(dir string, d *DependencyDescriptor) string {
+	if d.Path == "" {
+		return ""
+	}
+	if filepath.IsAbs(d.Path) {
+		return filepath.Clean(d.Path)
+	}
+	return filepath.Join(dir, d.Path)
+}
+
+// Build a packge after first having built its dependents. Packages that
+// don't depend on each other are built in parallel.
 func build(p *PacUnit) {
-	if p.built {
+	var order []*PacUnit
+	build_order(p, &order)
+	setup_envs(order)
+
+	if build_jobs <= 1 {
+		for _, q := range order {
+			if !skip_blocked(q) {
+				build_package(q, compiler_cache != "")
+			}
+		}
+		return
+	}
+
+	var stats CacheStats
+	if compiler_cache != "" {
+		//per-package statistics are not available for parallel builds
+		stats = compiler_cache_stats()
+	}
+
+	//number of dependencies not yet built and dependent packages
+	pending := make(map[*PacUnit]int)
+	dependents := make(map[*PacUnit][]*PacUnit)
+	for _, q := range order {
+		for _, d := range q.Depends {
+			if !d.FetchOnly && !d.pack.built {
+				pending[q]++
+				dependents[d.pack] = append(dependents[d.pack], q)
+			}
+		}
+	}
+
+	pool := new_job_pool(build_jobs)
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var start func(q *PacUnit)
+	start = func(q *PacUnit) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !skip_blocked(q) {
+				pool.acquire()
+				build_package(q, false)
+				pool.release()
+			}
+
+			//dependents of a package that was not built are skipped when started
+			var ready []*PacUnit
+			mutex.Lock()
+			for _, r := range dependents[q] {
+				if pending[r]--; pending[r] == 0 {
+					ready = append(ready, r)
+				}
+			}
+			mutex.Unlock()
+			for _, r := range ready {
+				start(r)
+			}
+		}()
+	}
+	var ready []*PacUnit
+	for _, q := range order {
+		if pending[q] == 0 {
+			ready = append(ready, q)
+		}
+	}
+	for _, q := range ready {
+		start(q)
+	}
+	wg.Wait()
+
+	if compiler_cache != "" {
+		record_cache_stats("all packages", stats)
+	}
+}
+
+// Append to order the packages that have to be built for package p, each
+// package after its dependencies. Fails if there is a dependency cycle.
+func build_order(p *PacUnit, order *[]*PacUnit) {
+	if p.built || slices.Contains(*order, p) {
 		Verboseln("Package", p.Name, "has already been built")
 		return
 	}
@@ -341,51 +1184,132 @@ func build(p *PacUnit) {
 
 	//keep track of packeges that are in process to avoid dependency cycles
 	inprocess = append(inprocess, p.Name)
-	pacdir := filepath.Join(devroot, p.Name)
-	os.Chdir(pacdir) //that should be ok. Package has been fetched already
-	cwd, _ := os.Getwd()
-	Verbosef("Building %s in %s \n", p.Name, cwd)
-
-	//First, build all dependent packages
-	if p.Depends != nil {
-		var d DependencyDescriptor
-		for _, d = range p.Depends {
-			if !d.FetchOnly {
-				build(d.pack)
-				if len(d.Post) != 0 {
-					Verboseln("Executing post commands...")
-					if ret, err := exec_commands(d.Post); ret != 0 {
-						log.Fatalf("Build aborted - %v\n", err)
-					}
-					Verboseln("...finished post commands")
-				}
-			} else {
-				Verbosef("Package %s - skipped build\n", d.Name)
-			}
+	for _, d := range p.Depends {
+		if !d.FetchOnly {
+			build_order(d.pack, order)
+		} else {
+			Verbosef("Package %s - skipped build\n", d.Name)
 		}
-		os.Chdir(cwd)
 	}
+	inprocess = inprocess[:len(inprocess)-1]
+	*order = append(*order, p)
+}
 
-	// then build self
-	if len(p.Build) != 0 {
-		if ret, err := exec_commands(p.Build); ret != 0 {
-			log.Fatalf("Build aborted - %v\n", err)
+// Build one package after running post-build commands of its dependencies.
+// If cache_stats is true, compiler cache statistics of the build are
+// recorded. If the build fails, CPM stops unless '--keep-going' is selected.
+func build_package(p *PacUnit, cache_stats bool) {
+	if workspace && p == all_packs[0] {
+		p.built = true
+		return
+	}
+	status := "built"
+	progress_phase(p, "build")
+	defer func() { progress_done(p, status) }()
+	if !group_selected(p) {
+		Verbosef("Package %s - not in selected groups. Build skipped\n", p.Name)
+		status = "skipped"
+		return
+	}
+	if p.prebuilt != nil {
+		install_prebuilt(p)
+		p.built = true
+		status = "prebuilt"
+		return
+	}
+	if build_unchanged(p) {
+		Verbosef("Package %s - inputs unchanged. Build skipped\n", p.Name)
+		status = "unchanged"
+		generate_bindings(p)
+		generate_pkgconfig(p)
+		p.built = true
+		return
+	}
+	pacdir := package_dir(p)
+	Verbosef("Building %s in %s \n", p.Name, pacdir)
+
+	for _, d := range p.Depends {
+		if !d.FetchOnly && len(d.Post) != 0 {
+			Verboseln("Executing post commands...")
+			if ret, err := exec_commands(package_dir(d.pack), d.Post, package_envs[d.pack], nil); ret != 0 {
+				build_failure(p, err)
+				return
+			}
+			Verboseln("...finished post commands")
 		}
+	}
+
+	libdir := filepath.Join(pacdir, "lib")
+	cache_libdir := lib_dir()
+	var lib_stamps map[string]file_stamp
+	if lib_synced() {
+		//lib folder is a copy of the shared one
+		lib_stamps = sync_lib_in(libdir)
+		cache_libdir = libdir
 	} else {
-		Verboseln("No build command found!")
+		lib_stamps = folder_stamps(cache_libdir)
 	}
 
-	inprocess = inprocess[:len(inprocess)-1]
+	compiled := false
+	if commands := build_commands(p); len(commands) != 0 && restore_build(p, cache_libdir) {
+		record_build_status(p, true)
+		status = "cached"
+	} else if len(commands) != 0 {
+		open_build_log(p)
+		defer close_build_log(p)
+		var stats CacheStats
+		if cache_stats {
+			stats = compiler_cache_stats()
+		}
+		if l := build_limits(p); l != nil {
+			package_limits.Store(pacdir, l)
+			defer package_limits.Delete(pacdir)
+		}
+		build_start := time.Now()
+		var peak uint64
+		if ret, err := exec_commands(pacdir, commands, package_envs[p], &peak); ret != 0 {
+			record_build_status(p, false)
+			build_failure(p, err)
+			return
+		}
+		if err := check_warning_budget(p); err != nil {
+			record_build_status(p, false)
+			build_failure(p, err)
+			return
+		}
+		record_build_status(p, true)
+		record_history(p.Name, BuildHistory{peak, time.Since(build_start)})
+		report_build(p, time.Since(build_start))
+		if cache_stats {
+			record_cache_stats(p.Name, stats)
+		}
+		compiled = true
+	} else if has_build_files(pacdir) {
+		warn("no-build", "package %s has no build commands", p.Name)
+	} else {
+		Verbosef("Package %s - no build commands (header-only)\n", p.Name)
+	}
+	if lib_synced() {
+		sync_lib_out(libdir, lib_stamps)
+	}
+	if compiled {
+		store_build(p, cache_libdir, lib_stamps)
+	}
+	generate_bindings(p)
+	generate_pkgconfig(p)
+	record_build_state(p)
 	p.built = true
 }
 
 /*
-Execute a list of commands.
+Execute a list of commands in folder dir.
 
 Executes only commands that apply to current OS envirnoment or generic ones
-(os set to "any" or "")
+(os set to "any" or "") and whose condition is true. Env has the
+environment variables of the package. If peak is not nil, it is set to the
+peak memory used by the commands.
 */
-func exec_commands(commands []Command) (int, error) {
+func exec_commands(dir string, commands []Command, env map[string]string, peak *uint64) (int, error) {
 	var ret int
 	var err error
 
@@ -395,13 +1319,26 @@ func exec_commands(commands []Command) (int, error) {
 		}
 		oses := strings.Fields(c.Os)
 		for _, an_os := range oses {
-			if an_os == "any" || an_os == runtime.GOOS {
+			if an_os == "any" || an_os == target_os() {
+				vars := command_vars(env, &c)
+				if !when_true("In "+dir+" - command "+c.Cmd, c.When, vars) {
+					continue
+				}
 				var exparg []string
 				for _, a := range c.Args {
-					exparg = append(exparg, os.ExpandEnv(a))
+					exparg = append(exparg, expand_env(a, vars))
 				}
 				Verbosef("OS: %s cmd: %s %v\n", an_os, c.Cmd, exparg)
-				if ret, err = Run(c.Cmd, exparg); ret != 0 {
+				prog, args, shell_env := c.Cmd, exparg, []string(nil)
+				if c.Shell != "" {
+					prog, args, shell_env = shell_command(c.Shell, c.Cmd, exparg)
+				}
+				var mem uint64
+				ret, mem, err = run_in(dir, prog, args, append(env_list(vars), shell_env...))
+				if peak != nil && mem > *peak {
+					*peak = mem
+				}
+				if ret != 0 {
 					return ret, err
 				}
 			}
@@ -410,31 +1347,107 @@ func exec_commands(commands []Command) (int, error) {
 	return ret, err
 }
 
-// Builtin CMD commands executed by spawning a CMD instance
-var cmd_builtins = [...]string{"attrib", "copy", "del", "echo", "md", "mkdir", "mklink", "rd", "ren", "rename", "replace", "rmdir"}
+// Builtin CMD commands executed by spawning a CMD instance. More commands
+// can be added with the 'cmd.builtins' setting.
+var cmd_builtins = []string{"assoc", "attrib", "copy", "del", "dir", "echo", "erase", "md", "mkdir", "mklink", "move", "rd", "ren", "rename", "replace", "rmdir", "type"}
+
+// Return true if prog is a CMD builtin command
+func is_cmd_builtin(prog string) bool {
+	prog = strings.ToLower(prog)
+	return slices.Contains(cmd_builtins, prog) || slices.Contains(strings.Fields(strings.ToLower(config_get("cmd.builtins", ""))), prog)
+}
 
 /*
 Run a program with arguments.
 GO 1.19 doesn't allow relative paths. Here however we allow those.
 */
 func Run(prog string, args []string) (int, error) {
+	return run_for("", prog, args)
+}
+
+// Run a program in current folder, writing its output to the log of the
+// package in folder pacdir, if any
+func run_for(pacdir string, prog string, args []string) (int, error) {
+	ret, _, err := run_tee("", pacdir, prog, args, nil, nil)
+	return ret, err
+}
 
-	if runtime.GOOS == "windows" && slices.Contains(cmd_builtins[:], strings.ToLower(prog)) {
-		args = slices.Insert(args, 0, "/c")
-		args = slices.Insert(args, 1, prog)
-		prog = "cmd"
+// Run a program in folder dir (or in current folder if dir is empty) with
+// additional environment variables. Returns also the peak memory used by the
+// process or 0 if unknown.
+//
+// On Windows, CMD builtins and batch files are run by CMD. Arguments of CMD
+// are passed verbatim; they must be already quoted.
+func run_in(dir string, prog string, args []string, env []string) (int, uint64, error) {
+	return run_tee(dir, dir, prog, args, env, nil)
+}
+
+// Run a program like run_in, writing its output to the log of the package in
+// folder pacdir, if any, and copying it also to tee if not nil
+func run_tee(dir string, pacdir string, prog string, args []string, env []string, tee io.Writer) (int, uint64, error) {
+	if runtime.GOOS == "windows" {
+		builtin := is_cmd_builtin(prog)
+		if !builtin && dir != "" && !strings.ContainsAny(prog, "\\/") {
+			//Windows searches programs in current folder first
+			if path, err := exec.LookPath(filepath.Join(dir, prog)); err == nil {
+				prog = path
+			}
+		}
+		if builtin || is_batch_file(prog) {
+			words := []string{cmd_quote(prog)}
+			for _, a := range args {
+				words = append(words, cmd_quote(a))
+			}
+			prog, args = cmd_exe(), []string{"/d", "/s", "/c", `"` + strings.Join(words, " ") + `"`}
+		}
 	}
 	cmd := exec.Command(prog, args...)
 	if errors.Is(cmd.Err, exec.ErrDot) && runtime.GOOS == "windows" {
 		cmd.Err = nil
 	}
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd.Dir = dir
+	if runtime.GOOS == "windows" && prog == cmd_exe() {
+		line := strings.Join(args, " ")
+		if is_unc(dir) {
+			//CMD cannot start in a UNC folder; pushd maps it to a drive
+			line = strings.Replace(line, `/c "`, `/c "pushd `+cmd_quote(dir)+` && `, 1)
+			cmd.Dir = ""
+		}
+		set_cmdline(cmd, line)
+	}
+	if env != nil {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	cmd.Stdout, cmd.Stderr = command_output(pacdir)
+	if tee != nil {
+		cmd.Stdout, cmd.Stderr = io.MultiWriter(cmd.Stdout, tee), io.MultiWriter(cmd.Stderr, tee)
+	}
 	cmd.Stdin = os.Stdin
-	if err := cmd.Run(); err != nil {
-		return -1, err
+	cmd_start := time.Now()
+	err := run_command(cmd, dir)
+	var peak uint64
+	if cmd.ProcessState != nil {
+		peak = process_peak_mem(cmd.ProcessState)
+	}
+	if err != nil {
+		report_command(dir, prog, args, cmd.ProcessState.ExitCode(), time.Since(cmd_start), err)
+		record_failure(dir, prog, args)
+		return -1, peak, err
+	}
+	clear_failure(dir)
+	report_command(dir, prog, args, cmd.ProcessState.ExitCode(), time.Since(cmd_start), nil)
+	return cmd.ProcessState.ExitCode(), peak, nil
+}
+
+// Run a program and return its standard output
+func Output(prog string, args ...string) (string, error) {
+	cmd := exec.Command(prog, args...)
+	if errors.Is(cmd.Err, exec.ErrDot) && runtime.GOOS == "windows" {
+		cmd.Err = nil
 	}
-	return cmd.ProcessState.ExitCode(), nil
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	return string(out), err
 }
 
 // Clone a repo
@@ -442,23 +1455,7 @@ func git_clone(p *PacUnit) {
 	fullpath := filepath.Join(devroot, p.Name)
 	Verbosef("Cloning: %s in %s\n", p.Name, fullpath)
 
-	// Find URL for cloning
-	var uri string
-	if *proto_flag == "https" {
-		if p.Https == "" {
-			Verboseln("  -- missing https URI")
-			uri = p.Git
-		} else {
-			uri = p.Https
-		}
-	} else {
-		if p.Git == "" {
-			Verboseln("  -- missing git URI")
-			uri = p.Https
-		} else {
-			uri = p.Git
-		}
-	}
+	uri := package_uri(p.Git, p.Https)
 	if uri == "" {
 		log.Fatal("Missing package location.")
 	}
@@ -466,45 +1463,93 @@ func git_clone(p *PacUnit) {
 	//Build git command
 	var args []string
 	args = append(args, "clone")
+	args = append(args, clone_options()...)
 	if p.Branch != "" {
 		args = append(args, "-b", p.Branch)
 	}
+	args = append(args, shallow_clone_args(p)...)
+	if mirror := mirror_dir(uri); mirror_exists(mirror) {
+		Verboseln("Using mirror", mirror)
+		args = append(args, "--reference-if-able", mirror)
+		if !*cache_flag {
+			args = append(args, "--dissociate")
+		}
+	}
 	args = append(args, uri, fullpath)
 	Verboseln("git ", args)
 
 	//Clone
-	if stat, err := Run("git", args); err != nil || stat != 0 {
+	if stat, err := run_network(fullpath, "Package "+p.Name+" - cloning", "git", args); err != nil || stat != 0 {
 		log.Fatalf("Cloning failed \nStatus %d Error: %v\n", stat, err)
 	}
+	setup_sparse(p, fullpath, true)
 }
 
-// Pull latest version from repo.
-// If branch is not empty, stwitches to that branch
-func git_pull(branch string) {
-	var args []string
+// Return package URL for the preferred download protocol
+func package_uri(git string, https string) string {
+	if git == "" && https == "" {
+		return ""
+	}
+	if *proto_flag == "https" {
+		if https == "" {
+			return git
+		}
+		return https
+	}
+	if git == "" {
+		return https
+	}
+	return git
+}
+
+// Warn if a git package doesn't have a URL for the preferred protocol
+func check_protocol(p *PacUnit) {
+	switch {
+	case p.Git == "" && p.Https == "":
+	case *proto_flag == "https" && p.Https == "":
+		warn("missing-https", "missing https URI for %s", p.Git)
+	case *proto_flag != "https" && p.Git == "":
+		warn("missing-git", "missing git URI for %s", p.Https)
+	}
+}
 
+// Pull latest version from repo.
+// If branch is not empty, stwitches to that branch. Options are passed to
+// git pull.
+func git_pull(dir string, branch string, options ...string) {
 	if len(branch) != 0 {
-		git_switch(branch)
+		git_switch(dir, branch)
 	}
-	args = append(args, "pull", "origin")
-	args = append(args, branch)
+	args := append([]string{"-C", dir, "pull"}, options...)
+	args = append(args, "origin", branch)
 	Verboseln("Running git ", args)
-	if stat, err := Run("git", args); err != nil || stat != 0 {
+	if stat, err := run_network(dir, "Pulling "+dir, "git", args); err != nil || stat != 0 {
 		log.Fatalf("Pulling failed \nStatus %d Error: %v\n", stat, err)
 	}
 }
 
-func git_switch(branch string) {
-	var args []string
-
-	args = append(args, "switch")
+func git_switch(dir string, branch string) {
+	args := []string{"-C", dir, "switch"}
 	if *force_flag {
 		args = append(args, "-f")
 	}
 	args = append(args, branch)
 	Verboseln("Running git ", args)
-	if stat, err := Run("git", args); err != nil || stat != 0 {
-		log.Fatalf("Switching to branch %s failed \nStatus %d Error: %v\n", *branch_flag, stat, err)
+	if stat, err := run_for(dir, "git", args); err != nil || stat != 0 {
+		log.Fatalf("Switching to branch %s failed \nStatus %d Error: %v\n", branch, stat, err)
+	}
+}
+
+// Check out a tag or commit in detached HEAD mode
+func git_detach(dir string, ref string) {
+	args := []string{"-C", dir, "checkout", "--detach"}
+	if *force_flag {
+		args = append(args, "-f")
+	}
+	args = append(args, ref)
+	Verboseln("Running git ", args)
+	if stat, err := run_for(dir, "git", args); err != nil || stat != 0 {
+		log.Fatalf("Checking out %s failed \nStatus %d Error: %v\n", ref, stat, err)
 	}
 }
 
@@ -527,17 +1572,33 @@ func Verbosef(f string, a ...interface{}) {
 //	target - destination
 //	link   - symlink name
 func Symlink(target string, link string) {
+	if link_mode() != "symlink" {
+		materialize_link(target, link)
+		return
+	}
 	wd, _ := os.Getwd()
 
-	if _, err := os.Stat(link); os.IsNotExist(err) {
-		err = os.Symlink(target, link)
+	//a dangling link (e.g. to a removed downstream tree) exists too
+	if _, err := os.Lstat(link); os.IsNotExist(err) {
+		err = make_symlink(target, link)
 		if err != nil {
 			le := err.(*os.LinkError)
-			log.Fatalf("Fatal - In '%s' - cannot create symlink %s <---> %s", wd, le.Old, le.New)
+			log.Fatalf("Fatal - In '%s' - cannot create symlink %s <---> %s - %v", wd, le.Old, le.New, le.Err)
 		}
+		record_link(link)
 	} else {
 		link_stat, _ := os.Lstat(link)
 		tgt_stat, _ := os.Stat(target)
+		if ls, _ := os.Stat(link); !os.SameFile(ls, tgt_stat) && is_owned(link) {
+			//object created by CPM; replace it
+			Verbosef("In '%s' - replacing '%s' with symlink to '%s'\n", wd, link, target)
+			if err := remove_all(link); err != nil {
+				log.Fatalf("Fatal - In '%s' - cannot remove '%s' - %v", wd, link, err)
+			}
+			forget_created(link)
+			Symlink(target, link)
+			return
+		}
 		if link_stat.Mode()&fs.ModeSymlink == 0 {
 			log.Fatalf("Fatal - In '%s' - '%s' already exists and is not a symlink to '%s'", wd, link, target)
 		}
@@ -547,5 +1608,6 @@ func Symlink(target string, link string) {
 		}
 
 		Verbosef("In '%s' - link already exists '%s' <---> '%s\n", wd, link, target)
+		record_link(link)
 	}
 }
@@ -0,0 +1,84 @@
+package main
+
+/*
+  Dependency cycles.
+
+  Cycles are detected while fetching, as soon as the descriptor that closes
+  a cycle is read. A cycle of build dependencies stops CPM because the
+  packages cannot be built in order. A cycle that goes through a fetch-only
+  dependency produces a 'fetch-cycle' warning.
+
+  The diagnostic shows the complete cycle and, for every dependency in it,
+  the descriptor or overlay file that declared it or, for dependencies added
+  by a selected profile, the descriptor and the profile:
+
+    Fatal - dependency cycle: app -> cool_A -> utils -> app
+      app -> cool_A       declared in /dev/app/cpm.json
+      cool_A -> utils     declared in /dev/cool_A/cpm.json
+      utils -> app        declared in /dev/utils/cpm.local.json
+*/
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Check that a new dependency of package p doesn't close a dependency cycle.
+// Called before fetching the next level of packages.
+func check_cycle(p *PacUnit, dep *DependencyDescriptor) {
+	closing := chain_edge{p, dep}
+	if !dep.FetchOnly {
+		if chain := find_chain(dep.pack, p, true); chain != nil {
+			log.Fatalf("Fatal - %s", cycle_message(append(chain, closing)))
+		}
+	}
+	if chain := find_chain(dep.pack, p, false); chain != nil {
+		warn("fetch-cycle", "%s", cycle_message(append(chain, closing)))
+	}
+}
+
+// Return description of a dependency cycle
+func cycle_message(cycle []chain_edge) string {
+	return "dependency cycle: " + chain_names(cycle) + "\n" + chain_details(cycle, "  ")
+}
+
+// Return file declaring a dependency of package p: the package descriptor,
+// the overlay if only the overlay declares it or, if only a selected profile
+// declares it, the descriptor and the profile
+func edge_source(p *PacUnit, name string) string {
+	fname := p.descriptor
+	if fname == "" {
+		fname = filepath.Join(package_dir(p), descriptor_name)
+	}
+	var desc map[string]any
+	if data, err := os.ReadFile(fname); err == nil && json.Unmarshal(data, &desc) == nil && declares_dependency(desc, name) {
+		return fname
+	}
+	ovname := filepath.Join(filepath.Dir(fname), overlay_name)
+	var over map[string]any
+	if data, err := os.ReadFile(ovname); err == nil && json.Unmarshal(data, &over) == nil && declares_dependency(over, name) {
+		return ovname
+	}
+	defs, _ := desc[object_key(desc, "profiles")].(map[string]any)
+	for _, profile := range selected_profiles() {
+		if def, ok := defs[object_key(defs, profile)].(map[string]any); ok && declares_dependency(def, name) {
+			return fname + " (profile " + profile + ")"
+		}
+	}
+	return fname
+}
+
+// Return true if a parsed descriptor has a dependency with given name
+func declares_dependency(desc map[string]any, name string) bool {
+	deps, _ := desc[object_key(desc, "depends")].([]any)
+	for _, d := range deps {
+		dep, _ := d.(map[string]any)
+		if n, _ := dep[object_key(dep, "name")].(string); strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
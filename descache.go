@@ -0,0 +1,182 @@
+package main
+
+/*
+  Descriptor cache.
+
+  Descriptors merged with their overlays and selected profiles, after
+  validation against the schema, are kept in
+  '<devroot>/.cpm/descriptor-cache.json', keyed by a hash of the descriptor,
+  its overlay and the selected profiles. Descriptors with unknown attributes
+  are not cached, so their warnings are shown on every run.
+
+  In local-only mode, the tags that satisfy version constraints are also
+  cached, keyed by a hash of the tag references of the repository. When
+  fetching, versions are always resolved against the remote tags.
+
+  Repeated runs on an unchanged tree, like builds started from an IDE, don't
+  have to validate descriptors or list tags again. The cache file can be
+  deleted at any time.
+*/
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Cached descriptor
+type CachedDescriptor struct {
+	Key      string
+	Data     json.RawMessage
+	Profiles []string `json:",omitempty"` //profiles defined by the descriptor
+}
+
+// Cached version resolution
+type CachedVersion struct {
+	Key string
+	Tag string
+}
+
+var descriptor_cache struct {
+	Version     string
+	Descriptors map[string]CachedDescriptor //descriptor file -> content
+	Versions    map[string]CachedVersion    //URI and constraint -> tag
+}
+var descriptor_cache_once sync.Once
+var descriptor_cache_mutex sync.Mutex
+var descriptor_cache_dirty bool
+
+func descriptor_cache_file() string {
+	return filepath.Join(devroot, ".cpm", "descriptor-cache.json")
+}
+
+// Read descriptor cache. A cache written by another CPM version is
+// discarded.
+func load_descriptor_cache() {
+	descriptor_cache_once.Do(func() {
+		if data, err := os.ReadFile(descriptor_cache_file()); err == nil {
+			json.Unmarshal(data, &descriptor_cache)
+		}
+		if descriptor_cache.Version != Version {
+			descriptor_cache.Version = Version
+			descriptor_cache.Descriptors = nil
+			descriptor_cache.Versions = nil
+		}
+		if descriptor_cache.Descriptors == nil {
+			descriptor_cache.Descriptors = make(map[string]CachedDescriptor)
+		}
+		if descriptor_cache.Versions == nil {
+			descriptor_cache.Versions = make(map[string]CachedVersion)
+		}
+	})
+}
+
+// Write descriptor cache if it has changed
+func save_descriptor_cache() {
+	descriptor_cache_mutex.Lock()
+	defer descriptor_cache_mutex.Unlock()
+	if !descriptor_cache_dirty {
+		return
+	}
+	data, _ := json.Marshal(&descriptor_cache)
+	os.MkdirAll(filepath.Dir(descriptor_cache_file()), 0755)
+	if err := os.WriteFile(descriptor_cache_file(), data, 0644); err != nil {
+		Verbosef("Cannot save descriptor cache - %v\n", err)
+	}
+	descriptor_cache_dirty = false
+}
+
+// Return hash of strings
+func cache_key(parts ...string) string {
+	h := sha256.New()
+	for _, s := range parts {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Return cached descriptor of file fname if its key matches
+func cached_descriptor(fname string, key string) ([]byte, bool) {
+	load_descriptor_cache()
+	descriptor_cache_mutex.Lock()
+	defer descriptor_cache_mutex.Unlock()
+	c, ok := descriptor_cache.Descriptors[fname]
+	if !ok || c.Key != key {
+		return nil, false
+	}
+	for _, name := range c.Profiles {
+		defined_profiles[name] = true
+	}
+	Verboseln("Using cached descriptor", fname)
+	return c.Data, true
+}
+
+// Save descriptor of file fname in cache
+func cache_descriptor(fname string, key string, data []byte) {
+	var desc map[string]any
+	json.Unmarshal(data, &desc)
+	profiles := descriptor_profiles(desc)
+	load_descriptor_cache()
+	descriptor_cache_mutex.Lock()
+	defer descriptor_cache_mutex.Unlock()
+	descriptor_cache.Descriptors[fname] = CachedDescriptor{key, data, profiles}
+	descriptor_cache_dirty = true
+}
+
+// Return hash of tag references of the Git repository in folder dir or an
+// empty string if they cannot be read
+func tags_key(dir string) string {
+	gitdir := filepath.Join(dir, ".git")
+	if fi, err := os.Stat(gitdir); err != nil || !fi.IsDir() {
+		return ""
+	}
+	parts := []string{dir}
+	if data, err := os.ReadFile(filepath.Join(gitdir, "packed-refs")); err == nil {
+		parts = append(parts, string(data))
+	}
+	tags := filepath.Join(gitdir, "refs", "tags")
+	filepath.WalkDir(tags, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			parts = append(parts, path)
+			if data, err := os.ReadFile(path); err == nil {
+				parts = append(parts, string(data))
+			}
+		}
+		return nil
+	})
+	return cache_key(parts...)
+}
+
+// Return cached tag for a version constraint of the repository in folder dir
+func cached_version(name string, dir string) (string, bool) {
+	key := tags_key(dir)
+	if key == "" {
+		return "", false
+	}
+	load_descriptor_cache()
+	descriptor_cache_mutex.Lock()
+	defer descriptor_cache_mutex.Unlock()
+	c, ok := descriptor_cache.Versions[name]
+	if !ok || c.Key != key {
+		return "", false
+	}
+	return c.Tag, true
+}
+
+// Save tag resolved for a version constraint of the repository in folder dir
+func cache_version(name string, dir string, tag string) {
+	key := tags_key(dir)
+	if key == "" {
+		return
+	}
+	load_descriptor_cache()
+	descriptor_cache_mutex.Lock()
+	defer descriptor_cache_mutex.Unlock()
+	descriptor_cache.Versions[name] = CachedVersion{key, tag}
+	descriptor_cache_dirty = true
+}
@@ -0,0 +1,299 @@
+package main
+
+/*
+  Editing of descriptor files preserving their formatting.
+
+  A descriptor is parsed into a tree of JSON nodes that keep track of their
+  position in the file. Edits replace, insert or delete only the affected
+  bytes; everything else in the file remains unchanged.
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// A JSON value and its position in the document
+type JNode struct {
+	start, end int      //value is data[start:end]
+	kind       byte     //'{' object, '[' array, '"' string, 0 other
+	keys       []string //object member names
+	key_pos    []int    //positions of member names
+	items      []*JNode //object member values or array elements
+}
+
+type json_parser struct {
+	data []byte
+	pos  int
+}
+
+// Parse a JSON document into a tree of nodes
+func parse_jnodes(data []byte) (*JNode, error) {
+	jp := &json_parser{data: data}
+	n, err := jp.value()
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func (jp *json_parser) skip_ws() {
+	for jp.pos < len(jp.data) && strings.IndexByte(" \t\r\n", jp.data[jp.pos]) >= 0 {
+		jp.pos++
+	}
+}
+
+func (jp *json_parser) errorf(msg string) error {
+	return fmt.Errorf("%s at offset %d", msg, jp.pos)
+}
+
+func (jp *json_parser) value() (*JNode, error) {
+	jp.skip_ws()
+	if jp.pos >= len(jp.data) {
+		return nil, jp.errorf("unexpected end of input")
+	}
+	n := &JNode{start: jp.pos}
+	switch c := jp.data[jp.pos]; c {
+	case '{', '[':
+		n.kind = c
+		closing := byte('}')
+		if c == '[' {
+			closing = ']'
+		}
+		jp.pos++
+		jp.skip_ws()
+		if jp.pos < len(jp.data) && jp.data[jp.pos] == closing {
+			jp.pos++
+			break
+		}
+		for {
+			jp.skip_ws()
+			if c == '{' {
+				key, err := jp.value()
+				if err != nil {
+					return nil, err
+				}
+				if key.kind != '"' {
+					return nil, jp.errorf("expected member name")
+				}
+				var name string
+				json.Unmarshal(jp.data[key.start:key.end], &name)
+				n.keys = append(n.keys, name)
+				n.key_pos = append(n.key_pos, key.start)
+				jp.skip_ws()
+				if jp.pos >= len(jp.data) || jp.data[jp.pos] != ':' {
+					return nil, jp.errorf("expected ':'")
+				}
+				jp.pos++
+			}
+			item, err := jp.value()
+			if err != nil {
+				return nil, err
+			}
+			n.items = append(n.items, item)
+			jp.skip_ws()
+			if jp.pos >= len(jp.data) {
+				return nil, jp.errorf("unexpected end of input")
+			}
+			if jp.data[jp.pos] == closing {
+				jp.pos++
+				break
+			}
+			if jp.data[jp.pos] != ',' {
+				return nil, jp.errorf("expected ','")
+			}
+			jp.pos++
+		}
+	case '"':
+		n.kind = '"'
+		for jp.pos++; jp.pos < len(jp.data) && jp.data[jp.pos] != '"'; jp.pos++ {
+			if jp.data[jp.pos] == '\\' {
+				jp.pos++
+			}
+		}
+		if jp.pos >= len(jp.data) {
+			return nil, jp.errorf("unterminated string")
+		}
+		jp.pos++
+	default:
+		for jp.pos < len(jp.data) && strings.IndexByte(" \t\r\n,]}", jp.data[jp.pos]) < 0 {
+			jp.pos++
+		}
+		if jp.pos == n.start {
+			return nil, jp.errorf("expected value")
+		}
+	}
+	n.end = jp.pos
+	return n, nil
+}
+
+// Return index of an object member (names are case-insensitive, as for
+// json.Unmarshal) or -1 if not found
+func (n *JNode) member(key string) int {
+	for i, k := range n.keys {
+		if strings.EqualFold(k, key) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Return value of an object member or nil if not found
+func (n *JNode) get(key string) *JNode {
+	if i := n.member(key); i >= 0 {
+		return n.items[i]
+	}
+	return nil
+}
+
+// Return string value of a node
+func (n *JNode) str(data []byte) string {
+	var s string
+	if n != nil && n.kind == '"' {
+		json.Unmarshal(data[n.start:n.end], &s)
+	}
+	return s
+}
+
+// Return the indentation of the line containing position pos
+func indentation(data []byte, pos int) string {
+	line := bytes.LastIndexByte(data[:pos], '\n') + 1
+	end := line
+	for end < pos && (data[end] == ' ' || data[end] == '\t') {
+		end++
+	}
+	return string(data[line:end])
+}
+
+// Separator placed before a new item added after the last one of an
+// object or array
+func item_separator(data []byte, n *JNode) string {
+	last := n.items[len(n.items)-1]
+	first_pos := last.start
+	if n.kind == '{' {
+		first_pos = n.key_pos[len(n.key_pos)-1]
+	}
+	prev_end := n.start + 1
+	if len(n.items) > 1 {
+		prev_end = n.items[len(n.items)-2].end + 1
+	}
+	if bytes.ContainsRune(data[prev_end:first_pos], '\n') {
+		return ",\n" + indentation(data, first_pos)
+	}
+	return ", "
+}
+
+func replace_bytes(data []byte, start int, end int, with string) []byte {
+	out := make([]byte, 0, len(data)+len(with))
+	out = append(out, data[:start]...)
+	out = append(out, with...)
+	return append(out, data[end:]...)
+}
+
+// Marshal a value for insertion in a descriptor
+func marshal_value(v any) string {
+	out, _ := json.Marshal(v)
+	return string(out)
+}
+
+// Set value of an object member, adding it if needed
+func set_member(data []byte, obj *JNode, key string, v any) []byte {
+	val := marshal_value(v)
+	if i := obj.member(key); i >= 0 {
+		return replace_bytes(data, obj.items[i].start, obj.items[i].end, val)
+	}
+	member := fmt.Sprintf("%q: %s", key, val)
+	if len(obj.items) == 0 {
+		return replace_bytes(data, obj.start+1, obj.end-1, member)
+	}
+	pos := obj.items[len(obj.items)-1].end
+	return replace_bytes(data, pos, pos, item_separator(data, obj)+member)
+}
+
+// Remove an item (array element or object member) from its container
+func remove_item(data []byte, n *JNode, i int) []byte {
+	start := func(k int) int {
+		if n.kind == '{' {
+			return n.key_pos[k]
+		}
+		return n.items[k].start
+	}
+	switch {
+	case i < len(n.items)-1:
+		return replace_bytes(data, start(i), start(i+1), "")
+	case i > 0:
+		return replace_bytes(data, n.items[i-1].end, n.items[i].end, "")
+	}
+	return replace_bytes(data, n.start+1, n.end-1, "")
+}
+
+// Member of an object to set
+type json_member struct {
+	key   string
+	value any
+}
+
+// Set and remove members of an object. Members are edited from the end of
+// the object, so the positions of the members still to edit stay valid and
+// the object doesn't have to be parsed again after each edit.
+func edit_members(data []byte, obj *JNode, set []json_member, remove []string) []byte {
+	edits := make(map[int]*json_member) //member index -> new value or nil to remove
+	var added []string
+	for i := range set {
+		if j := obj.member(set[i].key); j >= 0 {
+			edits[j] = &set[i]
+		} else {
+			added = append(added, fmt.Sprintf("%q: %s", set[i].key, marshal_value(set[i].value)))
+		}
+	}
+	for _, key := range remove {
+		if j := obj.member(key); j >= 0 {
+			edits[j] = nil
+		}
+	}
+	if len(added) != 0 {
+		if len(obj.items) == 0 {
+			data = replace_bytes(data, obj.start+1, obj.end-1, strings.Join(added, ", "))
+		} else {
+			sep := item_separator(data, obj)
+			pos := obj.items[len(obj.items)-1].end
+			data = replace_bytes(data, pos, pos, sep+strings.Join(added, sep))
+		}
+	}
+	for j := len(obj.items) - 1; j >= 0; j-- {
+		if m, ok := edits[j]; !ok {
+			continue
+		} else if m != nil {
+			data = replace_bytes(data, obj.items[j].start, obj.items[j].end, marshal_value(m.value))
+		} else {
+			data = remove_item(data, obj, j)
+		}
+	}
+	return data
+}
+
+// Append an element to an array
+func append_element(data []byte, arr *JNode, v any) []byte {
+	val := marshal_value(v)
+	if len(arr.items) == 0 {
+		return replace_bytes(data, arr.start+1, arr.end-1, val)
+	}
+	pos := arr.items[len(arr.items)-1].end
+	return replace_bytes(data, pos, pos, item_separator(data, arr)+val)
+}
+
+// Find the descriptor of a dependency. Returns the 'depends' array node, the
+// index of the dependency in the array and the dependency node.
+func find_dependency_node(data []byte, root *JNode, name string) (deps *JNode, idx int, dep *JNode) {
+	if deps = root.get("depends"); deps == nil || deps.kind != '[' {
+		return nil, -1, nil
+	}
+	for i, d := range deps.items {
+		if d.kind == '{' && strings.EqualFold(d.get("name").str(data), name) {
+			return deps, i, d
+		}
+	}
+	return deps, -1, nil
+}
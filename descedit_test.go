@@ -0,0 +1,124 @@
+package main
+
+import "testing"
+
+// Return the first dependency node of a descriptor
+func first_dependency(t *testing.T, data []byte) *JNode {
+	t.Helper()
+	root, err := parse_jnodes(data)
+	if err != nil {
+		t.Fatalf("cannot parse %s - %v", data, err)
+	}
+	deps := root.get("depends")
+	if deps == nil || len(deps.items) == 0 {
+		t.Fatalf("no dependency in %s", data)
+	}
+	return deps.items[0]
+}
+
+func TestParseJnodes(t *testing.T) {
+	data := []byte(`{"name": "app", "Depends": [{"name": "zlib", "git": "x"}], "n": 1.5}`)
+	root, err := parse_jnodes(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := root.get("name").str(data); got != "app" {
+		t.Errorf("name = %q, want app", got)
+	}
+	if root.get("depends") == nil {
+		t.Errorf("member names must not be case sensitive")
+	}
+	if n := root.get("n"); string(data[n.start:n.end]) != "1.5" {
+		t.Errorf("n = %q, want 1.5", data[n.start:n.end])
+	}
+	_, idx, dep := find_dependency_node(data, root, "ZLIB")
+	if idx != 0 || dep.get("git").str(data) != "x" {
+		t.Errorf("dependency zlib not found")
+	}
+	for _, bad := range []string{`{"a": }`, `{"a": 1`, `["a" "b"]`, `{"a" 1}`, ``} {
+		if _, err := parse_jnodes([]byte(bad)); err == nil {
+			t.Errorf("%q parsed without error", bad)
+		}
+	}
+}
+
+func TestSetMember(t *testing.T) {
+	tests := []struct {
+		in, key string
+		value   any
+		want    string
+	}{
+		{`{"depends": [{"name": "a", "git": "x"}]}`, "git", "y",
+			`{"depends": [{"name": "a", "git": "y"}]}`},
+		{`{"depends": [{"name": "a"}]}`, "branch", "dev",
+			`{"depends": [{"name": "a", "branch": "dev"}]}`},
+		{`{"depends": [{}]}`, "name", "a",
+			`{"depends": [{"name": "a"}]}`},
+		{"{\"depends\": [{\n  \"name\": \"a\",\n  \"git\": \"x\"\n}]}", "branch", "dev",
+			"{\"depends\": [{\n  \"name\": \"a\",\n  \"git\": \"x\",\n  \"branch\": \"dev\"\n}]}"},
+	}
+	for _, tt := range tests {
+		data := []byte(tt.in)
+		if got := string(set_member(data, first_dependency(t, data), tt.key, tt.value)); got != tt.want {
+			t.Errorf("set %s in %s\n got %s\nwant %s", tt.key, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRemoveMember(t *testing.T) {
+	tests := []struct {
+		in, key, want string
+	}{
+		{`{"depends": [{"name": "a", "git": "x", "branch": "b"}]}`, "name",
+			`{"depends": [{"git": "x", "branch": "b"}]}`},
+		{`{"depends": [{"name": "a", "git": "x", "branch": "b"}]}`, "git",
+			`{"depends": [{"name": "a", "branch": "b"}]}`},
+		{`{"depends": [{"name": "a", "git": "x", "branch": "b"}]}`, "branch",
+			`{"depends": [{"name": "a", "git": "x"}]}`},
+		{`{"depends": [{"name": "a"}]}`, "name",
+			`{"depends": [{}]}`},
+		{`{"depends": [{"name": "a"}]}`, "git",
+			`{"depends": [{"name": "a"}]}`},
+		{"{\"depends\": [{\n  \"name\": \"a\",\n  \"git\": \"x\"\n}]}", "git",
+			"{\"depends\": [{\n  \"name\": \"a\"\n}]}"},
+	}
+	for _, tt := range tests {
+		data := []byte(tt.in)
+		if got := string(edit_members(data, first_dependency(t, data), nil, []string{tt.key})); got != tt.want {
+			t.Errorf("remove %s from %s\n got %s\nwant %s", tt.key, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestEditMembers(t *testing.T) {
+	tests := []struct {
+		in     string
+		set    []json_member
+		remove []string
+		want   string
+	}{
+		//dependency with both URLs exported to an HTTPS repository
+		{`{"depends": [{"name": "a", "git": "old", "https": "old", "branch": "b"}]}`,
+			[]json_member{{"https", "new"}, {"branch", "main"}}, []string{"git", "path"},
+			`{"depends": [{"name": "a", "https": "new", "branch": "main"}]}`},
+		{`{"depends": [{"name": "a", "https": "old", "git": "old"}]}`,
+			[]json_member{{"git", "new"}, {"branch", "main"}}, []string{"https", "path"},
+			`{"depends": [{"name": "a", "git": "new", "branch": "main"}]}`},
+		{`{"depends": [{"name": "a", "path": "../a"}]}`,
+			[]json_member{{"git", "new"}, {"branch", "main"}}, []string{"https", "path"},
+			`{"depends": [{"name": "a", "git": "new", "branch": "main"}]}`},
+		{"{\"depends\": [{\n  \"name\": \"a\",\n  \"git\": \"old\"\n}]}",
+			[]json_member{{"path", "../a"}}, []string{"git", "https", "branch"},
+			"{\"depends\": [{\n  \"name\": \"a\",\n  \"path\": \"../a\"\n}]}"},
+	}
+	for _, tt := range tests {
+		data := []byte(tt.in)
+		got := edit_members(data, first_dependency(t, data), tt.set, tt.remove)
+		if string(got) != tt.want {
+			t.Errorf("edit %s\n got %s\nwant %s", tt.in, got, tt.want)
+		}
+		if _, err := parse_jnodes(got); err != nil {
+			t.Errorf("edit of %s is not valid JSON - %v", tt.in, err)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+/*
+  Impact preview of descriptor changes.
+
+  'cpm diff-plan [--base <revision>] [--format text|json] [<package>]'
+  resolves the dependency tree twice, without fetching anything: once with
+  the committed descriptors, at the base revision (HEAD by default) for the
+  root package and at HEAD for the other packages, and once with the
+  descriptors in the working copies.
+  It then shows the packages that would be added or removed, the packages
+  whose repository, branch, version or commit changes and the packages that
+  would be rebuilt: the packages whose descriptor or pin changes and all
+  packages depending on them. Version constraints are resolved to tags as
+  in a build, so a constraint change that selects another tag shows up.
+  With '--format json', warnings go to the standard error.
+
+  Descriptors of packages that are not in the development tree are read
+  from the mirror cache (see mirror.go); when there is no mirror, the
+  dependencies of such a package are unknown and the package is flagged.
+*/
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Package in a resolution plan
+type plan_package struct {
+	pack       *PacUnit
+	uri        string
+	pin        string
+	by         string //package that requested it
+	descriptor string //descriptor file or empty if not in development tree
+	data       string //descriptor content
+	unknown    bool   //descriptor not available
+}
+
+// Resolved dependency tree
+type resolution struct {
+	packs map[string]*plan_package //lowercase name -> package
+	order []string                 //lowercase names in resolution order
+}
+
+// Change of a package between two resolutions
+type PlanChange struct {
+	Name        string
+	Change      string //added, removed or changed
+	Old         string `json:",omitempty"`
+	New         string `json:",omitempty"`
+	RequestedBy string `json:",omitempty"`
+	Unknown     bool   `json:",omitempty"` //dependencies unknown
+}
+
+// Result of 'diff-plan' command
+type ResolutionPlan struct {
+	Base        string
+	Descriptors []string //descriptors changed since base
+	Packages    []PlanChange
+	Rebuild     []string
+}
+
+// Return the content of a descriptor in folder dir at a git revision or,
+// if revision is empty or dir isn't a git working copy, in the working copy.
+// Returns nil if the descriptor doesn't exist.
+func plan_descriptor(dir string, fname string, revision string) []byte {
+	if revision != "" {
+		if v := folder_vcs(dir); v != nil && v.Name() == "git" {
+			out, err := exec.Command("git", "-C", dir, "show", revision+":./"+fname).Output()
+			if err != nil {
+				return nil
+			}
+			return out
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(dir, fname))
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// Parse a descriptor merged with its local overlay
+func parse_plan_descriptor(fname string, data []byte, p *PacUnit) error {
+	ovname := filepath.Join(filepath.Dir(fname), overlay_name)
+	overlay, ov_err := os.ReadFile(ovname)
+	data, err := merge_descriptor(fname, data, ovname, overlay, ov_err)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(data, p); err != nil {
+		return err
+	}
+	filter_dependencies(p)
+	return nil
+}
+
+// Return repository or archive URL of a dependency
+func dependency_uri(d *DependencyDescriptor) string {
+	switch {
+	case d.Archive != "":
+		return d.Archive
+	case d.Hg != "":
+		return d.Hg
+	case d.Svn != "":
+		return d.Svn
+	case d.Depot != "":
+		return d.P4Port + d.Depot
+	case d.Path != "":
+		return d.Path
+	}
+	return package_uri(d.Git, d.Https)
+}
+
+// Resolve the dependency tree of the root package with its descriptor at a
+// git revision and descriptors of other packages at HEAD, or with the
+// descriptors in the working copies if revision is empty
+func resolve_plan(name string, revision string) *resolution {
+	source := root_source(root_descriptor)
+	root := new(PacUnit)
+	data := plan_descriptor(filepath.Dir(source), filepath.Base(source), revision)
+	if data == nil {
+		if revision == "" {
+			log.Fatalf("cannot open '%s' file", source)
+		}
+		Verbosef("%s doesn't exist in %s\n", source, revision)
+	} else if err := parse_plan_descriptor(source, data, root); err != nil {
+		log.Fatalf("cannot parse %s - %v", source, err)
+	}
+	if name != "" {
+		root.Name = name
+	}
+	if workspace {
+		if root.Name == "" {
+			root.Name = "workspace"
+		}
+		root.path = devroot
+		add_members(root)
+	}
+	//overrides of the root package apply to all dependencies
+	all_packs = []*PacUnit{root}
+
+	res := &resolution{packs: make(map[string]*plan_package)}
+	key := strings.ToLower(root.Name)
+	res.packs[key] = &plan_package{pack: root, descriptor: source, data: string(data)}
+	res.order = append(res.order, key)
+	load_dependencies(root, func(p *PacUnit, d *DependencyDescriptor) error {
+		pp := &plan_package{pack: d.pack, uri: dependency_uri(d), pin: dependency_pin(d), by: p.Name}
+		key := strings.ToLower(d.Name)
+		res.packs[key] = pp
+		res.order = append(res.order, key)
+		dir := package_dir(d.pack)
+		branch := d.Branch
+		_, dir_err := os.Stat(dir)
+		if d.Version != "" && d.Path == "" && d.pack.prebuilt == nil && (!*local_flag || dir_err == nil) {
+			branch = resolve_version(d, dir)
+			pp.pin += " (" + branch + ")"
+		}
+		fname := filepath.Join(dir, descriptor_name)
+		if _, err := os.Stat(fname); err == nil {
+			pp.descriptor = fname
+			rev := revision
+			if rev != "" {
+				rev = "HEAD"
+			}
+			data := plan_descriptor(dir, descriptor_name, rev)
+			pp.data = string(data)
+			if data == nil {
+				return fmt.Errorf("%s doesn't exist in %s", fname, rev)
+			}
+			err = parse_plan_descriptor(fname, data, d.pack)
+			d.pack.Name = d.Name
+			if err != nil {
+				fmt.Printf("WARNING - cannot parse %s - %v\n", fname, err)
+			}
+			return err
+		}
+		if d.Git != "" || d.Https != "" {
+			if mirror_exists(mirror_dir(pp.uri)) {
+				if mp := mirror_descriptor(pp.uri, branch); mp != nil {
+					d.pack.Depends = mp.Depends
+					filter_dependencies(d.pack)
+					return nil
+				}
+			}
+		} else if d.Archive != "" {
+			return fmt.Errorf("archive not fetched")
+		}
+		pp.unknown = true
+		return fmt.Errorf("descriptor not available")
+	})
+	return res
+}
+
+// Return the packages that must be rebuilt when packages in the changed set
+// change: the changed packages and all packages depending on them
+func rebuild_scope(res *resolution, changed map[string]bool) []string {
+	for grown := true; grown; {
+		grown = false
+		for _, key := range res.order {
+			if changed[key] {
+				continue
+			}
+			for _, d := range res.packs[key].pack.Depends {
+				if changed[strings.ToLower(d.Name)] {
+					changed[key] = true
+					grown = true
+					break
+				}
+			}
+		}
+	}
+	var list []string
+	for i := len(res.order) - 1; i >= 0; i-- {
+		if key := res.order[i]; changed[key] {
+			list = append(list, res.packs[key].pack.Name)
+		}
+	}
+	return list
+}
+
+// Implementation of 'cpm diff-plan [--base <revision>] [--format text|json] [<package>]' command
+func diff_plan(args []string) {
+	flags := flag.NewFlagSet("diff-plan", flag.ExitOnError)
+	base := flags.String("base", "HEAD", "git revision of the descriptors compared with the working copies")
+	format := flags.String("format", "text", "output format (text or json)")
+	pos := parse_interspersed(flags, args)
+	if len(pos) > 1 || *base == "" || *format != "text" && *format != "json" {
+		log.Fatal("Usage: cpm diff-plan [--base <revision>] [--format text|json] [<package>]")
+	}
+	pkg := ""
+	if len(pos) == 1 {
+		pkg = pos[0]
+	}
+	//warnings don't mix with JSON output
+	out := os.Stdout
+	if *format == "json" {
+		os.Stdout = os.Stderr
+	}
+	name, descriptor := find_root(pkg)
+	root_descriptor = descriptor
+	setup_profiles()
+	before := resolve_plan(name, *base)
+	after := resolve_plan(name, "")
+	save_descriptor_cache()
+
+	plan := ResolutionPlan{Base: *base, Descriptors: []string{}, Packages: []PlanChange{}}
+	changed := make(map[string]bool)
+	for _, key := range after.order {
+		a := after.packs[key]
+		b := before.packs[key]
+		switch {
+		case b == nil:
+			plan.Packages = append(plan.Packages, PlanChange{Name: a.pack.Name, Change: "added", New: a.pin,
+				RequestedBy: a.by, Unknown: a.unknown})
+			changed[key] = true
+		case a.uri != b.uri:
+			plan.Packages = append(plan.Packages, PlanChange{Name: a.pack.Name, Change: "changed", Old: b.uri, New: a.uri,
+				RequestedBy: a.by, Unknown: a.unknown})
+			changed[key] = true
+		case a.pin != b.pin:
+			plan.Packages = append(plan.Packages, PlanChange{Name: a.pack.Name, Change: "changed", Old: b.pin, New: a.pin,
+				RequestedBy: a.by, Unknown: a.unknown})
+			changed[key] = true
+		}
+		if b != nil && a.descriptor != "" && a.data != b.data {
+			fname := a.descriptor
+			if rel, err := filepath.Rel(devroot, fname); err == nil && filepath.IsLocal(rel) {
+				fname = filepath.ToSlash(rel)
+			}
+			plan.Descriptors = append(plan.Descriptors, fname)
+			changed[key] = true
+		}
+	}
+	for _, key := range before.order {
+		if b := before.packs[key]; after.packs[key] == nil {
+			plan.Packages = append(plan.Packages, PlanChange{Name: b.pack.Name, Change: "removed", Old: b.pin, RequestedBy: b.by})
+		}
+	}
+	plan.Rebuild = rebuild_scope(after, changed)
+	if plan.Rebuild == nil {
+		plan.Rebuild = []string{}
+	}
+
+	if *format == "json" {
+		data, _ := json.MarshalIndent(plan, "", "  ")
+		fmt.Fprintln(out, string(data))
+		return
+	}
+	if len(plan.Descriptors) == 0 && len(plan.Packages) == 0 {
+		fmt.Printf("No descriptor changes since %s\n", *base)
+		return
+	}
+	if len(plan.Descriptors) != 0 {
+		fmt.Printf("Descriptors changed since %s:\n", *base)
+		for _, fname := range plan.Descriptors {
+			fmt.Printf("  %s\n", fname)
+		}
+	}
+	if len(plan.Packages) == 0 {
+		fmt.Println("No changes in resolved packages")
+	} else {
+		fmt.Println("Resolved packages:")
+		width := 0
+		for _, c := range plan.Packages {
+			if len(c.Name) > width {
+				width = len(c.Name)
+			}
+		}
+		for _, c := range plan.Packages {
+			var line string
+			switch c.Change {
+			case "added":
+				line = fmt.Sprintf("  + %-*s  %s (requested by %s)", width, c.Name, c.New, c.RequestedBy)
+			case "removed":
+				line = fmt.Sprintf("  - %-*s  %s", width, c.Name, c.Old)
+			default:
+				line = fmt.Sprintf("  ~ %-*s  %s -> %s", width, c.Name, c.Old, c.New)
+			}
+			if c.Unknown {
+				line += " - not fetched, dependencies unknown"
+			}
+			fmt.Println(line)
+		}
+	}
+	if slices.ContainsFunc(plan.Packages, func(c PlanChange) bool { return c.Unknown }) {
+		fmt.Println("Run 'cpm prefetch' to read descriptors of packages that are not fetched from the mirror cache")
+	}
+	fmt.Printf("Packages to rebuild (%d): %s\n", len(plan.Rebuild), strings.Join(plan.Rebuild, ", "))
+}
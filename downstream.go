@@ -0,0 +1,186 @@
+package main
+
+/*
+  Downstream testing.
+
+  'cpm try-downstream [--branch <branch>] [--name <name>] <consumer-repo> [<package>]'
+  lets the author of a library check local changes against a consumer of
+  the library before pushing them. The consumer is cloned (or updated) in
+  a separate development tree, '<devroot>/.cpm/downstream', together with
+  a copy of the working copy of the library (the package in the current
+  folder or the given package), '<library>.local', with its uncommitted
+  changes. A local overlay ('cpm.local.json') of the consumer replaces its
+  dependency on the library with that copy. CPM then fetches and builds the
+  consumer in that tree, with the '--profile' option given to
+  try-downstream, and runs the test commands of the consumer ('cpm test').
+
+  The working copy of the library is never built or changed: the copy is
+  refreshed on each run, keeping the build outputs of the previous run.
+*/
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Return the folder of the development tree used for downstream tests
+func downstream_root() string {
+	return filepath.Join(devroot, ".cpm", "downstream")
+}
+
+// Update folder dst with the files of a package folder: tracked and
+// untracked files of a git repository, with their local changes, or all
+// files not created by CPM. Files copied before that are no longer in the
+// package are removed; build outputs in dst are kept.
+func copy_package_files(src string, dst string) {
+	list := filepath.Join(dst, ".cpm", "copied-files")
+	var before []string
+	if data, err := os.ReadFile(list); err == nil {
+		before = strings.Split(string(data), "\n")
+	}
+	m := load_manifest(src)
+	var files []string
+	for _, rel := range package_files(src) {
+		path := filepath.Join(src, rel)
+		fi, err := os.Lstat(path)
+		if err != nil || slices.Contains(m.Links, rel) || slices.Contains(m.Copies, rel) {
+			//deleted or created by CPM
+			continue
+		}
+		target := filepath.Join(dst, rel)
+		os.MkdirAll(long_path(filepath.Dir(target)), 0755)
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			link, _ := os.Readlink(path)
+			if old, err := os.Readlink(target); err != nil || old != link {
+				remove_file(target)
+				if err := os.Symlink(link, target); err != nil {
+					log.Fatalf("Fatal - cannot create link %s - %v", target, err)
+				}
+			}
+		} else {
+			copy_if_changed(path, target)
+		}
+		files = append(files, filepath.ToSlash(rel))
+	}
+	for _, rel := range before {
+		if rel != "" && !slices.Contains(files, rel) {
+			Verbosef("Removing %s\n", filepath.Join(dst, rel))
+			remove_file(filepath.Join(dst, filepath.FromSlash(rel)))
+		}
+	}
+	os.MkdirAll(filepath.Dir(list), 0755)
+	if err := os.WriteFile(list, []byte(strings.Join(files, "\n")), 0644); err != nil {
+		log.Fatalf("Fatal - cannot write %s - %v", list, err)
+	}
+}
+
+// Implementation of 'cpm try-downstream' command
+func try_downstream(args []string) {
+	flags := flag.NewFlagSet("try-downstream", flag.ExitOnError)
+	branch := flags.String("branch", "", "branch of the consumer")
+	name := flags.String("name", "", "package name of the consumer (default is the repository name)")
+	pos := parse_interspersed(flags, args)
+	if len(pos) < 1 || len(pos) > 2 {
+		log.Fatal("Usage: cpm try-downstream [--branch <branch>] [--name <name>] <consumer-repo> [<package>]")
+	}
+	uri := pos[0]
+	pkg := ""
+	if len(pos) == 2 {
+		pkg = pos[1]
+	}
+
+	//library under test
+	lib_name, descriptor := find_root(pkg)
+	if workspace {
+		log.Fatal("Fatal - try-downstream needs a package, not a workspace")
+	}
+	lib := new(PacUnit)
+	if err := read_descriptor(descriptor, lib); err != nil {
+		log.Fatalf("cannot read %s - %v", descriptor, err)
+	}
+	if lib.Name == "" {
+		lib.Name = lib_name
+	}
+	lib_dir := filepath.Dir(descriptor)
+
+	if *name == "" {
+		_, repo := split_uri(uri)
+		*name = path.Base(repo)
+	}
+	tree := downstream_root()
+	dir := filepath.Join(tree, *name)
+	os.MkdirAll(tree, 0755)
+	if _, err := os.Stat(dir); err != nil {
+		clone := []string{"clone"}
+		if *branch != "" {
+			clone = append(clone, "-b", *branch)
+		}
+		if stat, err := run_network(dir, "Package "+*name+" - cloning", "git", append(clone, uri, dir)); err != nil || stat != 0 {
+			log.Fatalf("Fatal - cannot clone %s - status %d error %v", uri, stat, err)
+		}
+	} else {
+		if *branch != "" {
+			Run("git", []string{"-C", dir, "checkout", "--quiet", *branch})
+		}
+		if stat, err := run_network(dir, "Package "+*name+" - pulling", "git", []string{"-C", dir, "pull", "--ff-only"}); err != nil || stat != 0 {
+			fmt.Printf("WARNING - cannot update %s - status %d error %v\n", dir, stat, err)
+		}
+	}
+
+	consumer := new(PacUnit)
+	if err := read_descriptor(filepath.Join(dir, descriptor_name), consumer); err != nil {
+		log.Fatalf("Fatal - %s is not a CPM package - %v", uri, err)
+	}
+	if !slices.ContainsFunc(consumer.Depends, func(d DependencyDescriptor) bool { return strings.EqualFold(d.Name, lib.Name) }) {
+		fmt.Printf("WARNING - %s doesn't depend directly on %s\n", *name, lib.Name)
+	}
+
+	//overlay replacing the library with a copy of its working copy
+	lib_copy := filepath.Join(tree, lib.Name+".local")
+	copy_package_files(lib_dir, lib_copy)
+	overlay := map[string]any{"replace": map[string]string{lib.Name: lib_copy}}
+	data, _ := json.MarshalIndent(overlay, "", "  ")
+	if err := os.WriteFile(filepath.Join(dir, overlay_name), data, 0644); err != nil {
+		log.Fatalf("Fatal - cannot write %s - %v", filepath.Join(dir, overlay_name), err)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatalf("Fatal - cannot find CPM executable - %v", err)
+	}
+	cmd_args := []string{"-r", tree}
+	if *profile_flag != "" {
+		cmd_args = append(cmd_args, "--profile", *profile_flag)
+	}
+	if *background_flag {
+		cmd_args = append(cmd_args, "--background")
+	}
+	fmt.Printf("Building %s with %s from %s\n", *name, lib.Name, lib_dir)
+	cmd := exec.Command(exe, append(cmd_args, *name)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err = cmd.Run(); err != nil {
+		log.Fatalf("Fatal - %s failed with local %s - %v", *name, lib.Name, err)
+	}
+	if len(consumer.Tests) == 0 {
+		fmt.Printf("WARNING - %s has no test commands. Only the build was checked\n", *name)
+		fmt.Printf("%s builds with local %s\n", *name, lib.Name)
+		return
+	}
+	cmd = exec.Command(exe, "-r", tree, "test", *name)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err = cmd.Run(); err != nil {
+		log.Fatalf("Fatal - tests of %s failed with local %s - %v", *name, lib.Name, err)
+	}
+	fmt.Printf("%s builds and passes its tests with local %s\n", *name, lib.Name)
+}
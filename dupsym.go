@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Static library extensions scanned for duplicate symbols
+var static_lib_extensions = []string{".a", ".lib"}
+
+/*
+Scan static libraries in the shared lib folder and warn about symbols
+defined in more than one package.
+
+Libraries are grouped by folder because different folders usually hold
+different flavors (debug, release, ...) that are never linked together.
+Weak and COMDAT symbols are legitimately defined in many libraries and are
+ignored.
+*/
+func check_duplicate_symbols() {
+	libdir := lib_dir()
+
+	//folder -> package -> library files
+	folders := make(map[string]map[string][]string)
+	filepath.WalkDir(libdir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if !slices.Contains(static_lib_extensions, strings.ToLower(filepath.Ext(path))) {
+			return nil
+		}
+		dir := filepath.Dir(path)
+		if folders[dir] == nil {
+			folders[dir] = make(map[string][]string)
+		}
+		pkg := lib_package(d.Name())
+		folders[dir][pkg] = append(folders[dir][pkg], path)
+		return nil
+	})
+
+	for dir, packs := range folders {
+		if len(packs) < 2 {
+			continue
+		}
+
+		//symbol -> packages defining it
+		owners := make(map[string][]string)
+		for pkg, libs := range packs {
+			for _, lib := range libs {
+				syms, err := lib_symbols(lib, true)
+				if errors.Is(err, exec.ErrNotFound) {
+					Verbosef("Cannot list symbols of %s - %v. Duplicate symbols check skipped\n", lib, err)
+					return
+				} else if err != nil {
+					fmt.Printf("Cannot list symbols of %s - %v. Library skipped in duplicate symbols check\n", lib, err)
+					continue
+				}
+				for _, s := range syms {
+					if !slices.Contains(owners[s], pkg) {
+						owners[s] = append(owners[s], pkg)
+					}
+				}
+			}
+		}
+
+		//packages collision -> symbols
+		collisions := make(map[string][]string)
+		for s, pkgs := range owners {
+			if len(pkgs) > 1 {
+				slices.Sort(pkgs)
+				key := strings.Join(pkgs, ", ")
+				collisions[key] = append(collisions[key], s)
+			}
+		}
+
+		keys := make([]string, 0, len(collisions))
+		for k := range collisions {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			syms := collisions[k]
+			slices.Sort(syms)
+			msg := fmt.Sprintf("In '%s' - packages %s define the same %d symbol(s). Possible ODR violation.", dir, k, len(syms))
+			for i, s := range syms {
+				if i == 5 && !*verbose_flag {
+					msg += "\n    ... (use -v to see all)"
+					break
+				}
+				msg += "\n    " + s
+			}
+			warn("duplicate-symbol", "%s", msg)
+		}
+	}
+}
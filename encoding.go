@@ -0,0 +1,100 @@
+package main
+
+/*
+  Encoding of command output.
+
+  Build tools don't always write UTF-8: MSVC and other Windows tools use the
+  console or OEM code page, which may be localized. Before command output is
+  written to logs or to JSON reports, lines that are not valid UTF-8 are
+  transcoded from the code page (on Windows) or have their invalid bytes
+  tagged as \xNN, so these files remain valid UTF-8.
+
+  On Windows, the 'log.codepage' setting selects the code page of command
+  output, if it is not the console output code page.
+*/
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Return s as valid UTF-8. Each line that is not valid UTF-8 is transcoded
+// or has its invalid bytes tagged; valid lines are kept.
+func to_utf8(s string) string {
+	if utf8.ValidString(s) {
+		return s
+	}
+	var out strings.Builder
+	for s != "" {
+		line := s
+		if i := strings.IndexByte(s, '\n'); i >= 0 {
+			line = s[:i+1]
+		}
+		s = s[len(line):]
+		out.WriteString(line_to_utf8(line))
+	}
+	return out.String()
+}
+
+// Return a line as valid UTF-8, transcoding or tagging invalid bytes
+func line_to_utf8(s string) string {
+	if utf8.ValidString(s) {
+		return s
+	}
+	if t, ok := decode_codepage([]byte(s)); ok {
+		return t
+	}
+	var out strings.Builder
+	for s != "" {
+		r, size := utf8.DecodeRuneInString(s)
+		if r == utf8.RuneError && size == 1 {
+			fmt.Fprintf(&out, "\\x%02X", s[0])
+		} else {
+			out.WriteString(s[:size])
+		}
+		s = s[size:]
+	}
+	return out.String()
+}
+
+// Writer that converts each line written to it to UTF-8. Only complete
+// lines are converted, so multi-byte sequences are never split.
+type utf8_writer struct {
+	w     io.Writer
+	mutex sync.Mutex
+	buf   []byte //incomplete line
+}
+
+func new_utf8_writer(w io.Writer) *utf8_writer {
+	return &utf8_writer{w: w}
+}
+
+func (u *utf8_writer) Write(p []byte) (int, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.buf = append(u.buf, p...)
+	if i := bytes.LastIndexByte(u.buf, '\n'); i >= 0 {
+		lines := u.buf[:i+1]
+		u.buf = append([]byte(nil), u.buf[i+1:]...)
+		if _, err := io.WriteString(u.w, to_utf8(string(lines))); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Write incomplete last line
+func (u *utf8_writer) Flush() error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if len(u.buf) == 0 {
+		return nil
+	}
+	_, err := io.WriteString(u.w, to_utf8(string(u.buf)))
+	u.buf = nil
+	return err
+}
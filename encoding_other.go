@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+// Transcode text in the code page of command output to UTF-8. Code pages
+// are used only on Windows.
+func decode_codepage(data []byte) (string, bool) {
+	return "", false
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestToUtf8(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"", ""},
+		{"plain text\n", "plain text\n"},
+		{"caf\u00e9 \u2713\n", "caf\u00e9 \u2713\n"},
+		//only lines with invalid bytes are changed
+		{"ok \u00e9\nbad \xe9\n", "ok \u00e9\nbad \\xE9\n"},
+		{"a\xff\xfeb", "a\\xFF\\xFEb"},
+		{"\xe2\x9c\n\xe2\x9c\x93", "\\xE2\\x9C\n\u2713"},
+	}
+	for _, tt := range tests {
+		got := to_utf8(tt.in)
+		if !utf8.ValidString(got) {
+			t.Errorf("to_utf8(%q) = %q is not valid UTF-8", tt.in, got)
+		}
+		if _, ok := decode_codepage([]byte("\xe9")); ok {
+			//invalid lines are transcoded from the code page of the console
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("to_utf8(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestUtf8Writer(t *testing.T) {
+	var out bytes.Buffer
+	w := new_utf8_writer(&out)
+	//multi-byte character split between writes
+	for _, s := range []string{"caf\xc3", "\xa9\nnext", " line\n", "partial"} {
+		w.Write([]byte(s))
+	}
+	if want := "caf\u00e9\nnext line\n"; out.String() != want {
+		t.Errorf("utf8_writer wrote %q, want %q", out.String(), want)
+	}
+}
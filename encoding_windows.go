@@ -0,0 +1,45 @@
+package main
+
+import (
+	"unicode/utf16"
+	"unsafe"
+)
+
+var proc_multibyte_to_widechar = kernel32.NewProc("MultiByteToWideChar")
+var proc_get_console_output_cp = kernel32.NewProc("GetConsoleOutputCP")
+var proc_get_oemcp = kernel32.NewProc("GetOEMCP")
+
+const cp_utf8 = 65001
+
+// Return code page of command output
+func output_codepage() uint32 {
+	if cp := config_int("log.codepage", 0); cp != 0 {
+		return uint32(cp)
+	}
+	if cp, _, _ := proc_get_console_output_cp.Call(); cp != 0 {
+		return uint32(cp)
+	}
+	cp, _, _ := proc_get_oemcp.Call()
+	return uint32(cp)
+}
+
+// Transcode text in the code page of command output to UTF-8
+func decode_codepage(data []byte) (string, bool) {
+	cp := output_codepage()
+	if cp == cp_utf8 || len(data) == 0 {
+		return "", false
+	}
+	n, _, _ := proc_multibyte_to_widechar.Call(uintptr(cp), 0,
+		uintptr(unsafe.Pointer(&data[0])), uintptr(len(data)), 0, 0)
+	if n == 0 {
+		return "", false
+	}
+	wide := make([]uint16, n)
+	n, _, _ = proc_multibyte_to_widechar.Call(uintptr(cp), 0,
+		uintptr(unsafe.Pointer(&data[0])), uintptr(len(data)),
+		uintptr(unsafe.Pointer(&wide[0])), n)
+	if n == 0 {
+		return "", false
+	}
+	return string(utf16.Decode(wide[:n])), true
+}
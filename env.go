@@ -0,0 +1,100 @@
+package main
+
+/*
+  Build environment.
+
+  Environment variables for builds can be set with 'env' objects in:
+  - a package descriptor: variables used to build the package. They are
+    inherited by its dependencies, unless these set them too;
+  - a dependency descriptor: variables used to build that dependency, set
+    by the package that depends on it;
+  - a command: variables used only for that command.
+  Values can refer to other variables as ${VAR} or $VAR; a value can extend
+  an inherited one, like "CFLAGS": "${CFLAGS} -O2". Descriptor profiles can
+  set environment variables like any other attribute.
+*/
+
+import (
+	"os"
+	"sort"
+)
+
+// Environment variables of package builds
+var package_envs = make(map[*PacUnit]map[string]string)
+
+// Expand ${VAR} and $VAR references using variables in env or, if not
+// found, in the process environment
+func expand_env(s string, env map[string]string) string {
+	return os.Expand(s, func(name string) string {
+		if v, ok := env[name]; ok {
+			return v
+		}
+		return os.Getenv(name)
+	})
+}
+
+// Set variables from vars in env, expanding their values
+func merge_env(env map[string]string, vars map[string]string) {
+	//sorted names give stable results when values refer to each other
+	var names []string
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		env[name] = expand_env(vars[name], env)
+	}
+}
+
+// Compute build environments of packages in build order (each package after
+// its dependencies)
+func setup_envs(order []*PacUnit) {
+	for i := len(order) - 1; i >= 0; i-- {
+		p := order[i]
+		env := make(map[string]string)
+		var overrides []map[string]string
+		//consumers come after p in build order
+		for _, c := range order[i+1:] {
+			for _, d := range c.Depends {
+				if d.pack != p || d.FetchOnly {
+					continue
+				}
+				for name, v := range package_envs[c] {
+					if _, ok := env[name]; !ok {
+						env[name] = v
+					}
+				}
+				overrides = append(overrides, d.Env)
+			}
+		}
+		merge_env(env, p.Env)
+		for _, vars := range overrides {
+			merge_env(env, vars)
+		}
+		package_envs[p] = env
+	}
+}
+
+// Return environment variables of a command given the environment of its
+// package
+func command_vars(env map[string]string, c *Command) map[string]string {
+	if len(c.Env) == 0 {
+		return env
+	}
+	cenv := make(map[string]string, len(env)+len(c.Env))
+	for name, v := range env {
+		cenv[name] = v
+	}
+	merge_env(cenv, c.Env)
+	return cenv
+}
+
+// Return environment variables as a list of NAME=value strings
+func env_list(env map[string]string) []string {
+	var list []string
+	for name, v := range env {
+		list = append(list, name+"="+v)
+	}
+	sort.Strings(list)
+	return list
+}
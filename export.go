@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// Return true if URL uses HTTP(S) protocol
+func is_http_uri(uri string) bool {
+	uri = strings.ToLower(uri)
+	return strings.HasPrefix(uri, "https://") || strings.HasPrefix(uri, "http://")
+}
+
+// Implementation of 'cpm export-package' command
+func export_package(args []string) {
+	flags := flag.NewFlagSet("export-package", flag.ExitOnError)
+	to := flags.String("to", "", "URL of new repository")
+	history := flags.Bool("history", false, "keep git history of package")
+	branch := flags.String("branch", "main", "branch created in new repository")
+	pos := parse_interspersed(flags, args)
+	if len(pos) != 1 || *to == "" {
+		log.Fatal("Usage: cpm export-package <package> --to <url> [--history] [--branch <name>]")
+	}
+	pkg := pos[0]
+
+	//find package folder
+	consumers := find_consumers(pkg)
+	src := filepath.Join(devroot, pkg)
+	for _, c := range consumers {
+		if c.Dep.Path != "" {
+			src = dependency_path(filepath.Dir(c.Descriptor), &c.Dep)
+			break
+		}
+	}
+	out, err := Output("git", "-C", src, "rev-parse", "--show-toplevel", "--show-prefix")
+	if err != nil {
+		log.Fatalf("Package %s - %s is not in a git repository", pkg, src)
+	}
+	f := strings.Split(out, "\n")
+	top, prefix := f[0], strings.TrimSuffix(f[1], "/")
+	Verbosef("Exporting %s from %s (prefix '%s')\n", pkg, top, prefix)
+
+	var commit string
+	if *history {
+		if prefix == "" {
+			commit = "HEAD"
+		} else {
+			out, err = Output("git", "-C", top, "subtree", "split", "--prefix="+prefix)
+			if err != nil {
+				log.Fatalf("Cannot split history of %s - %v", prefix, err)
+			}
+			commit = strings.TrimSpace(out)
+		}
+	} else {
+		out, err = Output("git", "-C", top, "rev-parse", "HEAD:"+prefix)
+		if err != nil {
+			log.Fatalf("Cannot find %s in %s - %v", prefix, top, err)
+		}
+		out, err = Output("git", "-C", top, "commit-tree", strings.TrimSpace(out), "-m", "Export of "+pkg)
+		if err != nil {
+			log.Fatalf("Cannot create commit - %v", err)
+		}
+		commit = strings.TrimSpace(out)
+	}
+
+	if stat, err := Run("git", []string{"-C", top, "push", *to, commit + ":refs/heads/" + *branch}); err != nil || stat != 0 {
+		log.Fatalf("Pushing to %s failed \nStatus %d Error: %v\n", *to, stat, err)
+	}
+
+	//point consumers to new repository; the URL of the other protocol
+	//would still lead to the old one
+	key, other := "git", "https"
+	if is_http_uri(*to) {
+		key, other = "https", "git"
+	}
+	for _, c := range consumers {
+		err := edit_dependency(c.Descriptor, pkg, func(data []byte, deps *JNode, idx int) []byte {
+			return edit_members(data, deps.items[idx], []json_member{{key, *to}, {"branch", *branch}}, []string{other, "path"})
+		})
+		if err != nil {
+			fmt.Printf("WARNING - cannot update %s - %v\n", c.Descriptor, err)
+			continue
+		}
+		fmt.Printf("Updated %s\n", c.Descriptor)
+	}
+
+	fmt.Printf("Package %s exported to %s (branch %s)\n", pkg, *to, *branch)
+	if prefix != "" {
+		fmt.Printf("Folder %s can now be removed from %s\n", prefix, top)
+	}
+}
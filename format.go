@@ -0,0 +1,170 @@
+package main
+
+/*
+  Source formatting.
+
+  'cpm fmt [--check] [<package>...]' runs clang-format over the C/C++ source
+  and header files of the given packages. Without package names, it formats
+  the members of the workspace or, if the root package is not a workspace,
+  the root package; dependencies are formatted only if named.
+
+  Each file is formatted with the configuration clang-format discovers for
+  it: the '.clang-format' file of the package or, if the package has none,
+  the one in the root of the development tree. The '--style <file>' option
+  uses the same configuration for all packages. Files without a
+  configuration are not changed.
+
+  With '--check', files are not changed: CPM lists the files that are not
+  formatted and fails if there are any. The program is 'clang-format' or the
+  one given by the 'fmt.clang-format' configuration setting.
+*/
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const format_batch = 50 //files formatted by one clang-format command
+
+// Return full paths of the source and header files of a package
+func format_files(p *PacUnit) []string {
+	dir := package_dir(p)
+	var files []string
+	for _, rel := range package_files(dir) {
+		ext := strings.ToLower(filepath.Ext(rel))
+		if !slices.Contains(header_extensions, ext) && !slices.Contains(source_extensions, ext) {
+			continue
+		}
+		if fi, err := os.Lstat(filepath.Join(dir, rel)); err != nil || fi.Mode()&fs.ModeSymlink != 0 || !fi.Mode().IsRegular() {
+			continue
+		}
+		files = append(files, filepath.Join(dir, rel))
+	}
+	return files
+}
+
+// Implementation of 'cpm fmt' command
+func format_sources(args []string) {
+	flags := flag.NewFlagSet("fmt", flag.ExitOnError)
+	check := flags.Bool("check", false, "list files that are not formatted, without changing them")
+	style := flags.String("style", "", "clang-format configuration file used for all packages")
+	names := parse_interspersed(flags, args)
+
+	root := load_tree("")
+	var packs []*PacUnit
+	for _, name := range names {
+		p := find_pack(name)
+		if p == nil {
+			log.Fatalf("Fatal - package %s is not in the development tree", name)
+		}
+		packs = append(packs, p)
+	}
+	if len(names) == 0 && workspace {
+		for _, name := range root.Packages {
+			if p := find_pack(name); p != nil {
+				packs = append(packs, p)
+			}
+		}
+	} else if len(names) == 0 {
+		packs = []*PacUnit{root}
+	}
+
+	prog := config_get("fmt.clang-format", "clang-format")
+	if _, err := exec.LookPath(prog); err != nil {
+		log.Fatalf("Fatal - %s not found", prog)
+	}
+	cmd_args := []string{"--fallback-style=none"}
+	if *style != "" {
+		fname, _ := filepath.Abs(*style)
+		if !is_regular(fname) {
+			log.Fatalf("Fatal - clang-format configuration %s not found", *style)
+		}
+		cmd_args = append(cmd_args, "--style=file:"+fname)
+	}
+	if *check {
+		cmd_args = append(cmd_args, "--dry-run", "--Werror")
+	} else {
+		cmd_args = append(cmd_args, "-i")
+	}
+
+	pool := new_job_pool(build_jobs)
+	var wg sync.WaitGroup
+	var failed []string
+	var mutex sync.Mutex
+	for _, p := range packs {
+		files := format_files(p)
+		if len(files) == 0 {
+			Verbosef("Package %s - no source files\n", p.Name)
+			continue
+		}
+		if !*check {
+			fmt.Printf("Formatting %s (%d files)\n", p.Name, len(files))
+		}
+		for len(files) != 0 {
+			n := len(files)
+			if n > format_batch {
+				n = format_batch
+			}
+			batch := files[:n]
+			files = files[n:]
+			wg.Add(1)
+			pool.acquire()
+			go func(p *PacUnit, batch []string) {
+				defer wg.Done()
+				defer pool.release()
+				out, err := exec.Command(prog, append(slices.Clone(cmd_args), batch...)...).CombinedOutput()
+				for _, line := range strings.Split(normalize_output(string(out)), "\n") {
+					match_problem(p.Name, line)
+				}
+				//with --check, clang-format fails when it finds violations
+				violations := *check && strings.Contains(string(out), "clang-format-violations")
+				if err != nil && !violations {
+					mutex.Lock()
+					failed = append(failed, fmt.Sprintf("%s - %v\n%s", p.Name, err, strings.TrimSpace(string(out))))
+					mutex.Unlock()
+				}
+			}(p, batch)
+		}
+	}
+	wg.Wait()
+	if len(failed) != 0 {
+		log.Fatalf("Fatal - %s failed:\n%s", prog, strings.Join(failed, "\n"))
+	}
+	if !*check {
+		return
+	}
+
+	//list files with violations
+	unformatted := make(map[string][]string)
+	nfiles := 0
+	for _, p := range packs {
+		seen := make(map[string]bool)
+		for _, q := range package_problems[p.Name] {
+			if q.File != "" && !seen[q.File] {
+				seen[q.File] = true
+				unformatted[p.Name] = append(unformatted[p.Name], q.File)
+			}
+		}
+		sort.Strings(unformatted[p.Name])
+		nfiles += len(unformatted[p.Name])
+	}
+	if nfiles == 0 {
+		fmt.Println("All files are formatted")
+		return
+	}
+	for _, p := range packs {
+		for _, f := range unformatted[p.Name] {
+			fmt.Printf("%-20s %s\n", p.Name, f)
+		}
+	}
+	log.Fatalf("Fatal - %d files in %d packages are not formatted. Run 'cpm fmt' to format them", nfiles, len(unformatted))
+}
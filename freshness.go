@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Dependency freshness policy set in root descriptor
+type FreshnessPolicy struct {
+	MaxAge    int  //maximum age of checked-out commit in months
+	MaxBehind int  //maximum number of releases behind latest version tag
+	Fail      bool //fail instead of warning
+}
+
+// Check that all dependencies satisfy the freshness policy of the root
+// package
+func check_freshness(root *PacUnit) {
+	policy := root.Freshness
+	stale := 0
+	for _, p := range all_packs {
+		if p == root || p.archive != "" || p.provider != "" || package_vcs(p).Name() != "git" {
+			continue
+		}
+		dir := package_dir(p)
+		if policy.MaxAge > 0 {
+			out, err := Output("git", "-C", dir, "log", "-1", "--format=%ct", "HEAD")
+			if ts, perr := strconv.ParseInt(strings.TrimSpace(out), 10, 64); err == nil && perr == nil {
+				commit := time.Unix(ts, 0)
+				if commit.AddDate(0, policy.MaxAge, 0).Before(time.Now()) {
+					fmt.Printf("WARNING - Package %s - commit from %s is older than %d months\n",
+						p.Name, commit.Format("2006-01-02"), policy.MaxAge)
+					stale++
+				}
+			}
+		}
+
+		if policy.MaxBehind > 0 && !*local_flag {
+			//current version is the highest version tag reachable from HEAD
+			out, _ := Output("git", "-C", dir, "tag", "--merged", "HEAD")
+			merged := version_tags(strings.Fields(out))
+			if len(merged) == 0 {
+				Verbosef("Package %s - no version tag. Skipped releases check\n", p.Name)
+				continue
+			}
+			current := merged[len(merged)-1]
+			behind := 0
+			latest := current
+			for _, t := range version_tags(remote_tags(package_uri(p.Git, p.Https))) {
+				if compare_versions(t, current) > 0 {
+					behind++
+					latest = t
+				}
+			}
+			if behind > policy.MaxBehind {
+				fmt.Printf("WARNING - Package %s - version %s is %d releases behind latest version %s\n",
+					p.Name, current, behind, latest)
+				stale++
+			}
+		}
+	}
+
+	if stale != 0 && policy.Fail {
+		log.Fatalf("%d dependencies don't satisfy freshness policy", stale)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+/*
+  Retries of file system operations.
+
+  On Windows, deleting, renaming or linking a file fails while another
+  process (often an antivirus or the search indexer) keeps it open. These
+  failures are transient: the operations below are retried with increasing
+  delays and, if the file remains locked, the processes locking it are
+  reported.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+)
+
+// Delays between attempts of a file system operation
+var lock_retry_delays = []time.Duration{
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	400 * time.Millisecond,
+	800 * time.Millisecond,
+	1600 * time.Millisecond,
+}
+
+// Run a file system operation on path, retrying it while the path is locked
+// by another process
+func retry_locked(op string, path string, f func() error) error {
+	err := f()
+	for _, delay := range lock_retry_delays {
+		if err == nil || !is_lock_error(err) {
+			return err
+		}
+		Verbosef("Cannot %s %s - %v. Retrying in %v\n", op, path, err, delay)
+		time.Sleep(delay)
+		err = f()
+	}
+	if err != nil && is_lock_error(err) {
+		//report the file that is actually locked
+		locked := path
+		var perr *fs.PathError
+		if errors.As(err, &perr) {
+			locked = perr.Path
+		}
+		if procs := locking_processes(locked); len(procs) != 0 {
+			fmt.Printf("WARNING - %s is locked by %s\n", locked, strings.Join(procs, ", "))
+		}
+	}
+	return err
+}
+
+func remove_file(path string) error {
+	return retry_locked("remove", path, func() error { return os.Remove(path) })
+}
+
+func remove_all(path string) error {
+	return retry_locked("remove", path, func() error { return os.RemoveAll(path) })
+}
+
+func rename_file(from string, to string) error {
+	return retry_locked("rename", from, func() error { return os.Rename(from, to) })
+}
+
+func make_symlink(target string, link string) error {
+	return retry_locked("create symlink", link, func() error { return os.Symlink(target, link) })
+}
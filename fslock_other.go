@@ -0,0 +1,12 @@
+//go:build !windows
+
+package main
+
+// Files are not locked on this system
+func is_lock_error(err error) bool {
+	return false
+}
+
+func locking_processes(path string) []string {
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+var rstrtmgr = syscall.NewLazyDLL("rstrtmgr.dll")
+var proc_rm_start_session = rstrtmgr.NewProc("RmStartSession")
+var proc_rm_end_session = rstrtmgr.NewProc("RmEndSession")
+var proc_rm_register_resources = rstrtmgr.NewProc("RmRegisterResources")
+var proc_rm_get_list = rstrtmgr.NewProc("RmGetList")
+
+// Windows errors caused by files open in other processes
+var lock_errors = []syscall.Errno{
+	5,  //ERROR_ACCESS_DENIED
+	32, //ERROR_SHARING_VIOLATION
+	33, //ERROR_LOCK_VIOLATION
+}
+
+// Return true if error is caused by a file locked by another process
+func is_lock_error(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	for _, e := range lock_errors {
+		if errno == e {
+			return true
+		}
+	}
+	return false
+}
+
+// RM_PROCESS_INFO structure
+type rm_process_info struct {
+	ProcessId        uint32
+	ProcessStartTime syscall.Filetime
+	AppName          [256]uint16
+	ServiceShortName [64]uint16
+	ApplicationType  uint32
+	AppStatus        uint32
+	TSSessionId      uint32
+	Restartable      int32
+}
+
+// Return names and ids of processes that have a file open, using the
+// Restart Manager
+func locking_processes(path string) []string {
+	if rstrtmgr.Load() != nil {
+		return nil
+	}
+	var session uint32
+	var key [33]uint16
+	if r, _, _ := proc_rm_start_session.Call(uintptr(unsafe.Pointer(&session)), 0, uintptr(unsafe.Pointer(&key[0]))); r != 0 {
+		return nil
+	}
+	defer proc_rm_end_session.Call(uintptr(session))
+
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil
+	}
+	if r, _, _ := proc_rm_register_resources.Call(uintptr(session), 1, uintptr(unsafe.Pointer(&name)), 0, 0, 0, 0); r != 0 {
+		return nil
+	}
+	var needed, reasons uint32
+	var infos [16]rm_process_info
+	count := uint32(len(infos))
+	if r, _, _ := proc_rm_get_list.Call(uintptr(session), uintptr(unsafe.Pointer(&needed)), uintptr(unsafe.Pointer(&count)),
+		uintptr(unsafe.Pointer(&infos[0])), uintptr(unsafe.Pointer(&reasons))); r != 0 {
+		return nil
+	}
+	var procs []string
+	for _, info := range infos[:count] {
+		procs = append(procs, fmt.Sprintf("%s (PID %d)", syscall.UTF16ToString(info.AppName[:]), info.ProcessId))
+	}
+	return procs
+}
@@ -0,0 +1,198 @@
+package main
+
+/*
+  Queries about remote repositories (tags, default branch).
+
+  For repositories hosted on GitHub the REST API is used. Responses are
+  cached in '$CPM_HOME/cache/github' together with their ETag and are
+  revalidated with conditional requests that don't count against the rate
+  limit. When the rate limit is exhausted, or the API is not available,
+  queries fall back to plain git operations.
+
+  A GitHub token can be provided in the GITHUB_TOKEN environment variable
+  or the 'github.token' configuration setting.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const github_api = "https://api.github.com/"
+
+var errRateLimited = errors.New("GitHub API rate limit exceeded")
+
+var github_blocked_until time.Time //time when rate limit is reset
+var github_mutex sync.Mutex
+
+// Cached API response
+type github_cache_entry struct {
+	ETag string
+	Body json.RawMessage
+}
+
+// Return owner and repository name if URL refers to a GitHub repository
+func github_repo(uri string) (owner string, repo string, ok bool) {
+	host, path := split_uri(uri)
+	if host != "github.com" {
+		return "", "", false
+	}
+	owner, repo, ok = strings.Cut(path, "/")
+	return
+}
+
+func github_cache_file(path string) string {
+	name := strings.NewReplacer("/", "_", "?", "_", "&", "_", "=", "_").Replace(path)
+	return filepath.Join(cpm_home(), "cache", "github", name+".json")
+}
+
+// Issue a GET request to GitHub API and decode the JSON response into v
+func github_get(path string, v any) error {
+	var cached github_cache_entry
+	fname := github_cache_file(path)
+	if data, err := os.ReadFile(fname); err == nil {
+		json.Unmarshal(data, &cached)
+	}
+
+	github_mutex.Lock()
+	blocked := time.Now().Before(github_blocked_until)
+	github_mutex.Unlock()
+	if blocked {
+		if cached.Body != nil {
+			return json.Unmarshal(cached.Body, v)
+		}
+		return errRateLimited
+	}
+
+	req, _ := http.NewRequest("GET", github_api+path, nil)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	if token := config_get("github.token", os.Getenv("GITHUB_TOKEN")); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if cached.ETag != "" {
+		req.Header.Set("If-None-Match", cached.ETag)
+	}
+	resp, err := http_client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		reset, _ := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+		github_mutex.Lock()
+		if github_blocked_until.IsZero() {
+			fmt.Printf("WARNING - GitHub API rate limit exceeded until %s. Using git operations instead.\n",
+				time.Unix(reset, 0).Format(time.Kitchen))
+		}
+		github_blocked_until = time.Unix(reset, 0)
+		github_mutex.Unlock()
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		Verboseln("GitHub API", path, "not modified")
+		return json.Unmarshal(cached.Body, v)
+
+	case resp.StatusCode == http.StatusOK:
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		cached = github_cache_entry{ETag: resp.Header.Get("ETag"), Body: body}
+		data, _ := json.Marshal(&cached)
+		os.MkdirAll(filepath.Dir(fname), 0755)
+		os.WriteFile(fname, data, 0644)
+		return json.Unmarshal(body, v)
+
+	case (resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusTooManyRequests) &&
+		resp.Header.Get("X-RateLimit-Remaining") == "0":
+		if cached.Body != nil {
+			return json.Unmarshal(cached.Body, v)
+		}
+		return errRateLimited
+	}
+	return fmt.Errorf("GitHub API %s - %s", path, resp.Status)
+}
+
+// Return tags of a remote repository
+func remote_tags(uri string) []string {
+	var tags []string
+	if owner, repo, ok := github_repo(uri); ok {
+		var page []struct{ Name string }
+		var err error
+		for n := 1; ; n++ {
+			page = nil
+			err = github_get(fmt.Sprintf("repos/%s/%s/tags?per_page=100&page=%d", owner, repo, n), &page)
+			if err != nil {
+				break
+			}
+			for _, t := range page {
+				tags = append(tags, t.Name)
+			}
+			if len(page) < 100 {
+				return tags
+			}
+		}
+		Verbosef("Cannot list tags of %s using GitHub API - %v\n", uri, err)
+		tags = nil
+	}
+
+	out, err := Output("git", "ls-remote", "--tags", "--refs", uri)
+	if err != nil {
+		fmt.Printf("WARNING - cannot list tags of %s - %v\n", uri, err)
+		return nil
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if f := strings.Fields(line); len(f) == 2 {
+			tags = append(tags, strings.TrimPrefix(f[1], "refs/tags/"))
+		}
+	}
+	return tags
+}
+
+// Return default branch of a remote repository
+func default_branch(uri string) string {
+	if owner, repo, ok := github_repo(uri); ok {
+		var info struct{ Default_branch string }
+		err := github_get(fmt.Sprintf("repos/%s/%s", owner, repo), &info)
+		if err == nil {
+			return info.Default_branch
+		}
+		Verbosef("Cannot get default branch of %s using GitHub API - %v\n", uri, err)
+	}
+
+	out, err := Output("git", "ls-remote", "--symref", uri, "HEAD")
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(out, "\n") {
+		//Format is: ref: refs/heads/main	HEAD
+		if f := strings.Fields(line); len(f) == 3 && f[0] == "ref:" {
+			return strings.TrimPrefix(f[1], "refs/heads/")
+		}
+	}
+	return ""
+}
+
+// Return tags that are version numbers in ascending order
+func version_tags(tags []string) []string {
+	var vt []string
+	for _, t := range tags {
+		if _, ok := parse_version(t); ok {
+			vt = append(vt, t)
+		}
+	}
+	slices.SortFunc(vt, compare_versions)
+	return vt
+}
@@ -0,0 +1,126 @@
+package main
+
+/*
+  Dependency graph validation.
+
+  The 'cpm check-graph' command checks the dependency graph of a package
+  against the rules in the 'graphRules' object of its descriptor:
+  - 'maxDepth': maximum length of a dependency chain starting at the package;
+  - 'forbidden': list of {"from": <pattern>, "to": <pattern>} layering
+    constraints; a package matching 'from' must not depend, directly or
+    indirectly, on a package matching 'to'. Patterns are globs matched
+    against package names;
+  - 'allowDuplicates': if false (the default), the same repository must not
+    appear under different package names.
+  Dependencies that are not visible to their consumers (see visibility.go)
+  are also reported. The exit status is non-zero if any rule is violated, so
+  the command can be used in CI.
+*/
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// Dependency graph rules set in root descriptor
+type GraphRules struct {
+	MaxDepth        int
+	Forbidden       []ForbiddenDependency
+	AllowDuplicates bool
+}
+
+// Layering constraint: packages matching From must not depend on packages
+// matching To
+type ForbiddenDependency struct {
+	From string
+	To   string
+}
+
+// Return true if package name matches a glob pattern (case insensitive)
+func name_matches(pattern string, name string) bool {
+	ok, err := filepath.Match(strings.ToLower(pattern), strings.ToLower(name))
+	if err != nil {
+		log.Fatalf("Invalid pattern %s - %v", pattern, err)
+	}
+	return ok
+}
+
+// Implementation of 'cpm check-graph' command
+func check_graph(args []string) {
+	flags := flag.NewFlagSet("check-graph", flag.ExitOnError)
+	pos := parse_interspersed(flags, args)
+	if len(pos) > 1 {
+		log.Fatal("Usage: cpm check-graph [<package>]")
+	}
+	pkg := ""
+	if len(pos) == 1 {
+		pkg = pos[0]
+	}
+	root := load_tree(pkg)
+	rules := root.GraphRules
+	if rules == nil {
+		rules = &GraphRules{AllowDuplicates: true}
+	}
+
+	violations := 0
+	if rules.MaxDepth > 0 {
+		if chain := longest_chain(root); len(chain) > rules.MaxDepth {
+			fmt.Printf("Depth %d exceeds maximum depth %d: %s\n", len(chain), rules.MaxDepth, chain_names(chain))
+			violations++
+		}
+	}
+
+	lengths := make(map[*PacUnit]map[*PacUnit]int) //chain lengths to each package
+	for _, rule := range rules.Forbidden {
+		for _, from := range all_packs {
+			if !name_matches(rule.From, from.Name) {
+				continue
+			}
+			for _, to := range all_packs {
+				if to == from || !name_matches(rule.To, to.Name) {
+					continue
+				}
+				if lengths[to] == nil {
+					lengths[to] = chain_lengths(to, false)
+				}
+				if chain := shortest_chain(from, lengths[to], false); chain != nil {
+					fmt.Printf("Forbidden dependency (%s must not depend on %s): %s\n", rule.From, rule.To, chain_names(chain))
+					violations++
+				}
+			}
+		}
+	}
+
+	if !rules.AllowDuplicates {
+		owners := make(map[string]string) //repository --> package name
+		for _, p := range all_packs {
+			for _, uri := range []string{p.Git, p.Https, p.Hg, p.Svn, p4_vcs{}.Uri(p)} {
+				if uri == "" {
+					continue
+				}
+				host, path := split_uri(uri)
+				key := strings.ToLower(host + "/" + path)
+				if other, ok := owners[key]; ok && other != p.Name {
+					fmt.Printf("Duplicate library: packages %s and %s use the same repository %s\n", other, p.Name, uri)
+					violations++
+					break
+				}
+				owners[key] = p.Name
+			}
+		}
+	}
+
+	for _, v := range visibility_violations() {
+		fmt.Println(v)
+		violations++
+	}
+
+	if violations != 0 {
+		fmt.Printf("%d graph rule violations\n", violations)
+		exit_failed("graph rule violations")
+	}
+	fmt.Printf("Dependency graph of %s satisfies all rules\n", root.Name)
+}
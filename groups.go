@@ -0,0 +1,93 @@
+package main
+
+/*
+  Dependency groups.
+
+  A dependency can be tagged with a 'group' attribute, like "third-party" or
+  "internal". A package belongs to the groups given by all its consumers.
+  The '--group' option limits fetching and building to packages in the
+  named groups; '--skip-group' excludes packages in the named groups. The
+  root package is always included.
+
+  Packages that are excluded are not pulled or built, but their descriptors
+  are still read. If the folder of an excluded package doesn't exist, the
+  package is cloned anyway.
+
+  Groups of a package are known only when all its consumers are known.
+  With '--group' or '--skip-group', packages already in the development
+  tree are not pulled while the dependency graph is resolved; when it is
+  complete, groups are computed and the selected packages are pulled, and
+  their dependencies resolved again.
+*/
+
+import (
+	"flag"
+	"slices"
+	"strings"
+)
+
+var group_flag = flag.String("group", "", "fetch and build only packages in these groups (comma separated)")
+var skip_group_flag = flag.String("skip-group", "", "don't fetch or build packages in these groups (comma separated)")
+
+// Return list of lowercase names from a comma separated list
+func group_names(list string) []string {
+	var names []string
+	for _, g := range strings.Split(list, ",") {
+		if g = strings.TrimSpace(g); g != "" {
+			names = append(names, strings.ToLower(g))
+		}
+	}
+	return names
+}
+
+var groups_resolved bool //groups computed from the whole dependency graph
+
+// Return true if the '--group' or '--skip-group' option is used
+func group_filter() bool {
+	return *group_flag != "" || *skip_group_flag != ""
+}
+
+// Compute groups of all packages from the dependencies of the packages
+// reachable from the root package
+func compute_groups() {
+	for _, p := range all_packs {
+		p.groups = nil
+	}
+	seen := make(map[*PacUnit]bool)
+	var visit func(p *PacUnit)
+	visit = func(p *PacUnit) {
+		if seen[p] {
+			return
+		}
+		seen[p] = true
+		for i := range p.Depends {
+			if d := &p.Depends[i]; d.pack != nil {
+				add_group(d.pack, d.Group)
+				visit(d.pack)
+			}
+		}
+	}
+	visit(all_packs[0])
+}
+
+// Add group of a dependency to the groups of its package
+func add_group(p *PacUnit, group string) {
+	if group = strings.ToLower(group); group != "" && !slices.Contains(p.groups, group) {
+		p.groups = append(p.groups, group)
+	}
+}
+
+// Return true if package p is selected by the '--group' and '--skip-group'
+// options
+func group_selected(p *PacUnit) bool {
+	if p == all_packs[0] {
+		return true
+	}
+	in := func(list string) bool {
+		return slices.ContainsFunc(group_names(list), func(g string) bool { return slices.Contains(p.groups, g) })
+	}
+	if *group_flag != "" && !in(*group_flag) {
+		return false
+	}
+	return *skip_group_flag == "" || !in(*skip_group_flag)
+}
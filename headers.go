@@ -0,0 +1,127 @@
+package main
+
+/*
+  Mirroring of nested header trees.
+
+  Some packages keep their public headers in a nested folder structure mixed
+  with other files (for instance in the 'src' folder). For such dependencies,
+  instead of a single symlink, CPM creates in the 'include/<package>' folder
+  of the consumer a mirror of the header files: one symlink (or copy) for
+  each header. The folder hierarchy can be preserved or flattened.
+*/
+
+import (
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Extensions of files considered headers
+var header_extensions = []string{".h", ".hh", ".hpp", ".hxx", ".h++", ".inl", ".ipp", ".tcc"}
+
+// Mirror header files from src folder into dst folder. If flatten is true,
+// all headers are placed directly in dst. If copy is true, headers are copied
+// instead of being linked; copies are refreshed when the source changes.
+// Files in dst that are no longer in src are removed.
+func mirror_headers(src string, dst string, flatten bool, copy bool) {
+	if st, err := os.Lstat(dst); err == nil && st.Mode()&fs.ModeSymlink != 0 {
+		//previously linked as a whole
+		os.Remove(dst)
+	}
+
+	//mirrored file -> source file
+	files := make(map[string]string)
+	err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !slices.Contains(header_extensions, strings.ToLower(filepath.Ext(path))) {
+			return nil
+		}
+		rel, _ := filepath.Rel(src, path)
+		if flatten {
+			rel = filepath.Base(rel)
+		}
+		if prev, ok := files[rel]; ok {
+			log.Fatalf("Fatal - cannot flatten headers; %s and %s have the same name", prev, path)
+		}
+		files[rel] = path
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("Fatal - cannot read headers in %s - %v", src, err)
+	}
+
+	os.MkdirAll(dst, 0755)
+	record_dir(dst)
+	for rel, path := range files {
+		target := filepath.Join(dst, rel)
+		os.MkdirAll(filepath.Dir(target), 0755)
+		if copy {
+			copy_if_changed(path, target)
+			record_copy(target)
+		} else {
+			Symlink(path, target)
+		}
+	}
+
+	//remove stale files and empty folders
+	var dirs []string
+	filepath.WalkDir(dst, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == dst {
+			return nil
+		}
+		if d.IsDir() {
+			dirs = append(dirs, path)
+			return nil
+		}
+		rel, _ := filepath.Rel(dst, path)
+		if _, ok := files[rel]; !ok {
+			Verbosef("Removing stale header %s\n", path)
+			os.Remove(path)
+		}
+		return nil
+	})
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Remove(dirs[i]) //fails if not empty
+	}
+}
+
+// Copy a file if destination is missing or differs in size or modification
+// time from source
+func copy_if_changed(src string, dst string) {
+	lsrc, ldst := long_path(src), long_path(dst)
+	src_stat, err := os.Stat(lsrc)
+	if err != nil {
+		log.Fatalf("Fatal - cannot read %s - %v", src, err)
+	}
+	if dst_stat, err := os.Lstat(ldst); err == nil {
+		if dst_stat.Mode().IsRegular() && dst_stat.Size() == src_stat.Size() &&
+			dst_stat.ModTime().Equal(src_stat.ModTime()) {
+			return
+		}
+		if err := remove_file(ldst); err != nil {
+			log.Fatalf("Fatal - cannot replace %s - %v", dst, err)
+		}
+	}
+
+	Verbosef("Copying %s --> %s\n", src, dst)
+	in, err := os.Open(lsrc)
+	if err != nil {
+		log.Fatalf("Fatal - cannot read %s - %v", src, err)
+	}
+	defer in.Close()
+	out, err := os.Create(ldst)
+	if err != nil {
+		log.Fatalf("Fatal - cannot create %s - %v", dst, err)
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		log.Fatalf("Fatal - cannot copy %s to %s - %v", src, dst, err)
+	}
+	out.Close()
+	os.Chtimes(ldst, src_stat.ModTime(), src_stat.ModTime())
+}
@@ -0,0 +1,243 @@
+package main
+
+/*
+  History of dependency changes.
+
+  'cpm history [--dependency <name>] [--format text|json] [<package>]'
+  walks the git history of the descriptor and lockfile of the root package
+  (and, in a workspace, of the descriptors of its members) and shows every
+  commit that added or removed a dependency or changed how it is pinned:
+  its version constraint, branch, commit or archive in a descriptor, or its
+  locked commit in a lockfile. Locked commits are shown with their version
+  tag when the dependency is in the development tree:
+
+    2024-03-01  4f2a9c1  Jane Doe  app/cpm.lock  zlib  v1.2.13 (04f42ce) -> v1.3 (09155ea)
+*/
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Change of a dependency in a descriptor or lockfile
+type HistoryEvent struct {
+	Date       string
+	Commit     string
+	Author     string
+	File       string
+	Dependency string
+	Old        string `json:",omitempty"`
+	New        string `json:",omitempty"`
+	time       int64
+}
+
+// Return how a dependency is pinned in a descriptor
+func dependency_pin(d *DependencyDescriptor) string {
+	var parts []string
+	if d.Version != "" {
+		parts = append(parts, "version "+d.Version)
+	}
+	if d.Branch != "" {
+		parts = append(parts, "branch "+d.Branch)
+	}
+	if d.Commit != "" {
+		parts = append(parts, "commit "+short_hash(d.Commit))
+	}
+	if d.Changelist != 0 {
+		parts = append(parts, "changelist "+strconv.Itoa(d.Changelist))
+	}
+	if d.Archive != "" {
+		parts = append(parts, archive_file_name(d.Archive))
+	}
+	if len(parts) == 0 {
+		return "default branch"
+	}
+	return strings.Join(parts, ", ")
+}
+
+func short_hash(commit string) string {
+	if len(commit) > 7 {
+		return commit[:7]
+	}
+	return commit
+}
+
+// Return the pins of all dependencies in a version of a descriptor or
+// lockfile
+func file_pins(data []byte, lockfile bool, tags func(name string, commit string) string) map[string]string {
+	pins := make(map[string]string)
+	if lockfile {
+		var l Lockfile
+		if json.Unmarshal(data, &l) != nil {
+			return nil
+		}
+		for _, e := range l.Packages {
+			pin := short_hash(e.Commit)
+			if tag := tags(e.Name, e.Commit); tag != "" {
+				pin = tag + " (" + pin + ")"
+			}
+			pins[e.Name] = pin
+		}
+		return pins
+	}
+	var p PacUnit
+	if json.Unmarshal(data, &p) != nil {
+		return nil
+	}
+	for i := range p.Depends {
+		pins[p.Depends[i].Name] = dependency_pin(&p.Depends[i])
+	}
+	return pins
+}
+
+// Return changes of dependencies in the git history of a descriptor or
+// lockfile
+func file_history(fname string, lockfile bool, tags func(name string, commit string) string) []HistoryEvent {
+	dir, base := filepath.Split(fname)
+	out, err := Output("git", "-C", dir, "log", "--reverse", "--format=%H%x1f%ct%x1f%ad%x1f%an", "--date=short", "--", base)
+	if err != nil {
+		Verbosef("No git history of %s - %v\n", fname, err)
+		return nil
+	}
+	display := fname
+	if rel, err := filepath.Rel(devroot, fname); err == nil && filepath.IsLocal(rel) {
+		display = filepath.ToSlash(rel)
+	}
+
+	var events []HistoryEvent
+	prev := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		f := strings.Split(line, "\x1f")
+		if len(f) != 4 {
+			continue
+		}
+		//the file doesn't exist in the commit that removed it
+		data, err := exec.Command("git", "-C", dir, "show", f[0]+":./"+base).Output()
+		var pins map[string]string
+		if err == nil {
+			if pins = file_pins(data, lockfile, tags); pins == nil {
+				Verbosef("Cannot parse %s in commit %s. Skipped\n", fname, f[0])
+				continue
+			}
+		}
+		ts, _ := strconv.ParseInt(f[1], 10, 64)
+		event := HistoryEvent{Date: f[2], Commit: short_hash(f[0]), Author: f[3], File: display, time: ts}
+		var names []string
+		for name := range prev {
+			names = append(names, name)
+		}
+		for name := range pins {
+			if _, ok := prev[name]; !ok {
+				names = append(names, name)
+			}
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			if prev[name] != pins[name] {
+				event.Dependency, event.Old, event.New = name, prev[name], pins[name]
+				events = append(events, event)
+			}
+		}
+		prev = pins
+	}
+	return events
+}
+
+// Implementation of 'cpm history [--dependency <name>] [--format text|json] [<package>]' command
+func cmd_history(args []string) {
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	dependency := flags.String("dependency", "", "show only changes of this dependency")
+	format := flags.String("format", "text", "output format (text or json)")
+	pos := parse_interspersed(flags, args)
+	if len(pos) > 1 || *format != "text" && *format != "json" {
+		log.Fatal("Usage: cpm history [--dependency <name>] [--format text|json] [<package>]")
+	}
+	pkg := ""
+	if len(pos) == 1 {
+		pkg = pos[0]
+	}
+	root := load_tree(pkg)
+
+	//version tags of locked commits
+	tag_cache := make(map[string]string)
+	tags := func(name string, commit string) string {
+		tag, ok := tag_cache[commit]
+		if !ok {
+			if p := find_pack(name); p != nil {
+				out, _ := Output("git", "-C", package_dir(p), "tag", "--points-at", commit)
+				if t := version_tags(strings.Fields(out)); len(t) != 0 {
+					tag = t[len(t)-1]
+				}
+			}
+			tag_cache[commit] = tag
+		}
+		return tag
+	}
+
+	events := file_history(root_descriptor, false, tags)
+	events = append(events, file_history(root_lockfile(), true, tags)...)
+	if workspace {
+		for _, name := range root.Packages {
+			if p := find_pack(name); p != nil {
+				events = append(events, file_history(filepath.Join(package_dir(p), descriptor_name), false, tags)...)
+			}
+		}
+	}
+	if *dependency != "" {
+		events = slices.DeleteFunc(events, func(e HistoryEvent) bool { return !strings.EqualFold(e.Dependency, *dependency) })
+	}
+	slices.SortStableFunc(events, func(a, b HistoryEvent) int {
+		switch {
+		case a.time < b.time:
+			return -1
+		case a.time > b.time:
+			return 1
+		}
+		return 0
+	})
+
+	if *format == "json" {
+		if events == nil {
+			events = []HistoryEvent{}
+		}
+		data, _ := json.MarshalIndent(events, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+	if len(events) == 0 {
+		fmt.Println("No dependency changes found in git history")
+		return
+	}
+	author_width, file_width, dep_width := 0, 0, 0
+	for _, e := range events {
+		if len(e.Author) > author_width {
+			author_width = len(e.Author)
+		}
+		if len(e.File) > file_width {
+			file_width = len(e.File)
+		}
+		if len(e.Dependency) > dep_width {
+			dep_width = len(e.Dependency)
+		}
+	}
+	for _, e := range events {
+		var change string
+		switch {
+		case e.Old == "":
+			change = "added: " + e.New
+		case e.New == "":
+			change = "removed (was " + e.Old + ")"
+		default:
+			change = e.Old + " -> " + e.New
+		}
+		fmt.Printf("%s  %s  %-*s  %-*s  %-*s  %s\n", e.Date, e.Commit, author_width, e.Author,
+			file_width, e.File, dep_width, e.Dependency, change)
+	}
+}
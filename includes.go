@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+var include_re = regexp.MustCompile(`(?m)^[ \t]*#[ \t]*include[ \t]*[<"]([^/<>"]+)/`)
+
+// Implementation of 'cpm check-includes [<package>]' command
+func check_includes(args []string) {
+	flags := flag.NewFlagSet("check-includes", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() > 1 {
+		log.Fatal("Usage: cpm check-includes [<package>]")
+	}
+	load_tree(flags.Arg(0))
+
+	//include folder name -> package providing it
+	providers := make(map[string]*PacUnit)
+	for _, p := range all_packs {
+		providers[p.Name] = p
+		entries, _ := os.ReadDir(filepath.Join(package_dir(p), "include"))
+		for _, e := range entries {
+			if e.IsDir() && !is_owned(filepath.Join(package_dir(p), "include", e.Name())) {
+				providers[e.Name()] = p
+			}
+		}
+	}
+	for _, p := range all_packs {
+		for _, d := range p.Depends {
+			if d.IncludeAs != "" && d.pack != nil && providers[d.IncludeAs] == nil {
+				providers[d.IncludeAs] = d.pack
+			}
+		}
+	}
+
+	problems := 0
+	for _, p := range all_packs {
+		if _, err := os.Stat(package_dir(p)); err != nil {
+			Verbosef("Package %s not found. Skipped\n", p.Name)
+			continue
+		}
+		//included package -> first file including it
+		used := make(map[*PacUnit]string)
+		for fname, folders := range scan_includes(package_dir(p)) {
+			for _, f := range folders {
+				if q := providers[f]; q != nil && q != p && used[q] == "" {
+					used[q] = fname
+				}
+			}
+		}
+
+		var names []string
+		for q := range used {
+			names = append(names, q.Name)
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			q := find_pack(name)
+			fname := used[q]
+			declared := slices.ContainsFunc(p.Depends, func(d DependencyDescriptor) bool {
+				return strings.EqualFold(d.Name, q.Name)
+			})
+			if !declared {
+				fmt.Printf("Package %s - includes headers of %s (in %s) but doesn't depend on it\n", p.Name, q.Name, fname)
+				problems++
+			}
+		}
+		for _, d := range p.Depends {
+			if d.pack != nil && used[d.pack] == "" {
+				fmt.Printf("Package %s - depends on %s but doesn't include any of its headers\n", p.Name, d.Name)
+				problems++
+			}
+		}
+	}
+
+	if problems != 0 {
+		fmt.Printf("%d problem(s) found\n", problems)
+		exit_failed("include problems")
+	}
+	fmt.Println("All dependencies match include directives")
+}
+
+// Return the include folders ('#include <folder/...>') used by each header or
+// source file in a package folder. Files created by CPM are not scanned.
+func scan_includes(dir string) map[string][]string {
+	result := make(map[string][]string)
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if d.Name() == ".git" || d.Name() == ".cpm" || path != dir && is_owned(path) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		ext := strings.ToLower(filepath.Ext(path))
+		if !d.Type().IsRegular() || !slices.Contains(header_extensions, ext) && !slices.Contains(source_extensions, ext) {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+		for _, m := range include_re.FindAllSubmatch(data, -1) {
+			if f := string(m[1]); !slices.Contains(result[path], f) {
+				result[path] = append(result[path], f)
+			}
+		}
+		return nil
+	})
+	return result
+}
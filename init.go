@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+// Starter descriptor generated by 'cpm init'
+type InitDescriptor struct {
+	Name    string        `json:"name"`
+	Git     string        `json:"git,omitempty"`
+	Https   string        `json:"https,omitempty"`
+	Depends []interface{} `json:"depends"`
+	Build   []InitCommand `json:"build"`
+}
+
+type InitCommand struct {
+	Os   string   `json:"os"`
+	Cmd  string   `json:"cmd"`
+	Args []string `json:"args,omitempty"`
+}
+
+// Matches SSH URLs of git hosts: git@host:path or ssh://git@host[:port]/path
+var ssh_remote = regexp.MustCompile(`^(?:ssh://git@([^:/]+)(?::\d+)?/|git@([^:/]+):)(.+)$`)
+
+// Matches HTTPS URLs: https://host/path
+var https_remote = regexp.MustCompile(`^https://(?:[^@/]+@)?([^/]+)/(.+)$`)
+
+// Return git and https URLs of a repository given one of them
+func remote_urls(uri string) (string, string) {
+	if m := ssh_remote.FindStringSubmatch(uri); m != nil {
+		return uri, "https://" + m[1] + m[2] + "/" + m[3]
+	}
+	if m := https_remote.FindStringSubmatch(uri); m != nil {
+		return "git@" + m[1] + ":" + m[2], "https://" + m[1] + "/" + m[2]
+	}
+	return uri, ""
+}
+
+// Files of build systems. Packages without them are header-only.
+var build_files = []string{"CMakeLists.txt", "Makefile", "makefile", "GNUmakefile", "meson.build", "configure", "*.sln", "*.vcxproj"}
+
+// Return true if folder dir has files of a build system
+func has_build_files(dir string) bool {
+	for _, pattern := range build_files {
+		if matches, _ := filepath.Glob(filepath.Join(dir, pattern)); len(matches) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Return sample build commands for package in dir, based on the build
+// files found there
+func sample_build(dir string, name string) []InitCommand {
+	exists := func(pattern string) string {
+		matches, _ := filepath.Glob(filepath.Join(dir, pattern))
+		if len(matches) == 0 {
+			return ""
+		}
+		return filepath.Base(matches[0])
+	}
+	host := runtime.GOOS
+	switch {
+	case exists("CMakeLists.txt") != "":
+		return []InitCommand{
+			{host, "cmake", []string{"-S", ".", "-B", "build"}},
+			{host, "cmake", []string{"--build", "build"}},
+		}
+	case host == "windows" && exists("*.sln") != "":
+		return []InitCommand{{host, "msbuild", []string{exists("*.sln"), "/p:Configuration=Release"}}}
+	case exists("Makefile") != "":
+		return []InitCommand{{host, "make", nil}}
+	case host == "windows":
+		return []InitCommand{{host, "msbuild", []string{name + ".sln"}}}
+	}
+	return []InitCommand{{host, "make", nil}}
+}
+
+// Implementation of 'cpm init' command
+func init_package(args []string) {
+	flags := flag.NewFlagSet("init", flag.ExitOnError)
+	force := flags.Bool("force", false, "overwrite existing descriptor")
+	pos := parse_interspersed(flags, args)
+	if len(pos) > 1 {
+		log.Fatal("Usage: cpm init [--force] [<name>]")
+	}
+
+	dir, _ := os.Getwd()
+	name := filepath.Base(dir)
+	if len(pos) == 1 {
+		name = pos[0]
+	}
+	fname := filepath.Join(dir, descriptor_name)
+	if _, err := os.Stat(fname); err == nil && !*force {
+		log.Fatalf("%s already exists. Use --force to overwrite it.", fname)
+	}
+
+	desc := InitDescriptor{Name: name, Depends: []interface{}{}, Build: sample_build(dir, name)}
+	if out, err := Output("git", "-C", dir, "remote", "get-url", "origin"); err == nil {
+		desc.Git, desc.Https = remote_urls(strings.TrimSpace(out))
+	} else {
+		warn("no-remote", "no 'origin' remote found. Add package URLs to descriptor.")
+	}
+	data, _ := json.MarshalIndent(desc, "", "  ")
+	if err := os.WriteFile(fname, append(data, '\n'), 0644); err != nil {
+		log.Fatalf("Cannot write %s - %v", fname, err)
+	}
+	fmt.Printf("Created %s\n", fname)
+}
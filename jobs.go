@@ -0,0 +1,157 @@
+package main
+
+/*
+  Parallelism settings.
+
+  The '-j' (or '--jobs') option sets the number of parallel fetch and build
+  jobs. With '-j auto' the number of jobs is derived from the number of CPUs,
+  the available memory and the peak memory used by package builds in previous
+  runs (recorded in '<devroot>/.cpm/history.json'). Job pools created in
+  auto mode hold back new jobs while the machine is swapping.
+*/
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var jobs_flag string //number of parallel jobs or 'auto'
+
+var fetch_jobs = 1 //number of parallel fetch jobs
+var build_jobs = 1 //number of parallel build jobs
+
+// Maximum number of parallel fetch jobs in auto mode. Fetching is network
+// bound and more jobs than CPUs are useful, but servers don't like too many
+// simultaneous connections.
+const max_auto_fetch_jobs = 8
+
+// Resource usage of a package build
+type BuildHistory struct {
+	PeakMem  uint64 //bytes
+	Duration time.Duration
+}
+
+var history struct {
+	Packages map[string]BuildHistory
+}
+var history_mutex sync.Mutex
+
+// Set number of fetch and build jobs from '-j' option
+func setup_jobs() {
+	load_history()
+	if jobs_flag != "auto" {
+		n, err := strconv.Atoi(jobs_flag)
+		if err != nil || n < 1 {
+			log.Fatalf("Invalid number of jobs '%s'. Must be a positive number or 'auto'", jobs_flag)
+		}
+		fetch_jobs, build_jobs = n, n
+		return
+	}
+
+	ncpu := runtime.NumCPU()
+	fetch_jobs = 2 * ncpu
+	if fetch_jobs > max_auto_fetch_jobs {
+		fetch_jobs = max_auto_fetch_jobs
+	}
+
+	build_jobs = ncpu
+	var peak uint64
+	for _, h := range history.Packages {
+		if h.PeakMem > peak {
+			peak = h.PeakMem
+		}
+	}
+	if avail := available_memory(); avail != 0 && peak != 0 {
+		if n := int(avail / peak); n < build_jobs {
+			build_jobs = n
+		}
+	}
+	if build_jobs < 1 {
+		build_jobs = 1
+	}
+	Verbosef("Parallel jobs: fetch %d, build %d\n", fetch_jobs, build_jobs)
+}
+
+// Limits the number of concurrently running jobs
+type JobPool struct {
+	slots chan struct{}
+}
+
+func new_job_pool(n int) *JobPool {
+	return &JobPool{slots: make(chan struct{}, n)}
+}
+
+// Wait for a free job slot. In auto mode, while the machine is swapping,
+// no new job is started as long as another one is still running.
+func (jp *JobPool) acquire() {
+	if jobs_flag == "auto" {
+		for len(jp.slots) > 0 && swapping() {
+			Verboseln("System is swapping. Waiting for running jobs...")
+			time.Sleep(2 * time.Second)
+		}
+	}
+	jp.slots <- struct{}{}
+}
+
+func (jp *JobPool) release() {
+	<-jp.slots
+}
+
+// Per-host connection slots
+var host_slots = make(map[string]chan struct{})
+var host_mutex sync.Mutex
+
+// Wait until a new connection to the host of a repository URL is allowed
+// and return the function that releases the connection. The maximum number
+// of connections to a host is given by the 'hosts.<host>.max-connections'
+// configuration setting.
+func acquire_host(uri string) (release func()) {
+	host, _ := split_uri(uri)
+	host_mutex.Lock()
+	slots, ok := host_slots[host]
+	if !ok {
+		if n := config_int("hosts."+host+".max-connections", 0); n > 0 {
+			slots = make(chan struct{}, n)
+		}
+		host_slots[host] = slots
+	}
+	host_mutex.Unlock()
+
+	if slots == nil {
+		return func() {}
+	}
+	slots <- struct{}{}
+	return func() { <-slots }
+}
+
+func history_file() string {
+	return filepath.Join(devroot, ".cpm", "history.json")
+}
+
+func load_history() {
+	history.Packages = make(map[string]BuildHistory)
+	if data, err := os.ReadFile(history_file()); err == nil {
+		json.Unmarshal(data, &history)
+	}
+}
+
+// Record resource usage of a package build
+func record_history(pkg string, h BuildHistory) {
+	history_mutex.Lock()
+	defer history_mutex.Unlock()
+	history.Packages[pkg] = h
+}
+
+func save_history() {
+	data, _ := json.MarshalIndent(&history, "", "  ")
+	os.MkdirAll(filepath.Dir(history_file()), 0755)
+	if err := os.WriteFile(history_file(), data, 0644); err != nil {
+		Verbosef("Cannot save build history - %v\n", err)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+/*
+  Continue after build failures.
+
+  With the '--keep-going' option, a package whose build fails doesn't stop
+  CPM. Packages that depend on it, directly or through other packages, are
+  skipped, and packages in independent branches of the dependency graph are
+  still built. At the end CPM prints the packages that were built, failed or
+  skipped and exits with an error.
+*/
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+var keep_going = flag.Bool("keep-going", false, "continue building independent packages after a failure")
+
+// Build results of packages that failed or were skipped
+var build_failed = make(map[*PacUnit]string)  //package -> error
+var build_skipped = make(map[*PacUnit]string) //package -> failed dependency
+var keep_going_mutex sync.Mutex
+
+// Handle the build failure of a package: stop CPM or, with '--keep-going',
+// record the failure.
+func build_failure(p *PacUnit, err error) {
+	progress_done(p, "failed")
+	if !*keep_going {
+		log.Fatalf("Build aborted - %v\n", err)
+	}
+	fmt.Fprintf(os.Stderr, "Package %s - build failed - %v\n", p.Name, err)
+	keep_going_mutex.Lock()
+	build_failed[p] = fmt.Sprint(err)
+	keep_going_mutex.Unlock()
+}
+
+// Return the failed or skipped dependency because of which package p cannot
+// be built, or an empty string if all its dependencies have been built
+func blocked_by(p *PacUnit) string {
+	keep_going_mutex.Lock()
+	defer keep_going_mutex.Unlock()
+	for _, d := range p.Depends {
+		if d.FetchOnly {
+			continue
+		}
+		if _, failed := build_failed[d.pack]; failed {
+			return d.Name
+		}
+		if _, skipped := build_skipped[d.pack]; skipped {
+			return d.Name
+		}
+	}
+	return ""
+}
+
+// Skip package p if one of its dependencies failed or was skipped. Returns
+// true if the package is skipped.
+func skip_blocked(p *PacUnit) bool {
+	dep := blocked_by(p)
+	if dep == "" {
+		return false
+	}
+	fmt.Fprintf(os.Stderr, "Package %s - skipped because %s was not built\n", p.Name, dep)
+	keep_going_mutex.Lock()
+	build_skipped[p] = dep
+	keep_going_mutex.Unlock()
+	return true
+}
+
+// Print build results and stop if any package failed
+func check_build_results() {
+	if len(build_failed) == 0 {
+		return
+	}
+	w := os.Stderr
+	fmt.Fprintf(w, "\n======== Build results ========\n")
+	var built []string
+	for _, p := range all_packs {
+		if p.built {
+			built = append(built, p.Name)
+		}
+	}
+	if len(built) != 0 {
+		fmt.Fprintf(w, "Built:   %s\n", strings.Join(built, ", "))
+	}
+	for _, p := range all_packs {
+		if err, ok := build_failed[p]; ok {
+			fmt.Fprintf(w, "Failed:  %s - %s\n", p.Name, err)
+		}
+	}
+	for _, p := range all_packs {
+		if dep, ok := build_skipped[p]; ok {
+			fmt.Fprintf(w, "Skipped: %s (needs %s)\n", p.Name, dep)
+		}
+	}
+	log.Fatalf("Fatal - %d package(s) failed to build, %d skipped", len(build_failed), len(build_skipped))
+}
@@ -0,0 +1,116 @@
+package main
+
+/*
+  License policy.
+
+  The root descriptor can restrict the licenses of dependencies:
+    "licenses": {"allow": ["MIT", "BSD-*", "Apache-2.0"], "deny": ["GPL-*", "AGPL-*"], "unknown": "deny"}
+  Patterns are SPDX identifiers with the usual wildcards, not case
+  sensitive. A dependency satisfies the policy if its license matches no
+  'deny' pattern and, when 'allow' is given, matches an 'allow' pattern.
+  For license expressions, one of the alternatives joined by OR must
+  satisfy the policy with all its licenses joined by AND. Dependencies
+  without a recognized license are accepted, reported ('warn', the default)
+  or rejected, depending on 'unknown'.
+
+  The license of a package is given by the 'license' attribute of its
+  descriptor or detected from its license file (see report.go). After
+  fetching, if the root package has a policy, CPM stops when a direct or
+  indirect dependency doesn't satisfy it, before the lockfile is updated;
+  licenses are then recorded in the lockfile.
+*/
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Allowed and denied licenses of dependencies
+type LicensePolicy struct {
+	Allow   []string //allowed licenses (patterns)
+	Deny    []string //denied licenses (patterns)
+	Unknown string   //allow, warn or deny dependencies without recognized license
+}
+
+var license_or_re = regexp.MustCompile(`(?i)\s+OR\s+`)
+var license_and_re = regexp.MustCompile(`(?i)\s+AND\s+`)
+
+// Return license of a package: the 'license' attribute of its descriptor
+// or the SPDX identifier detected from its license file
+func package_license(p *PacUnit) string {
+	if p.License != "" {
+		return p.License
+	}
+	return detect_license(package_dir(p))
+}
+
+// Return true if a license identifier satisfies the policy
+func license_id_allowed(id string, policy *LicensePolicy) bool {
+	matches := func(pattern string) bool { return name_matches(pattern, id) }
+	if slices.ContainsFunc(policy.Deny, matches) {
+		return false
+	}
+	return len(policy.Allow) == 0 || slices.ContainsFunc(policy.Allow, matches)
+}
+
+// Return true if a license expression satisfies the policy
+func license_allowed(expr string, policy *LicensePolicy) bool {
+	expr = strings.NewReplacer("(", " ", ")", " ").Replace(expr)
+	for _, alt := range license_or_re.Split(strings.TrimSpace(expr), -1) {
+		ok := true
+		for _, term := range license_and_re.Split(alt, -1) {
+			//'GPL-2.0 WITH Classpath-exception-2.0' is licensed as GPL-2.0
+			if f := strings.Fields(term); len(f) == 0 || !license_id_allowed(f[0], policy) {
+				ok = false
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Check licenses of all dependencies against the license policy of the root
+// package
+func check_license_policy(root *PacUnit) {
+	policy := root.Licenses
+	switch policy.Unknown {
+	case "", "warn", "allow", "deny":
+	default:
+		log.Fatalf("Fatal - invalid 'unknown' license policy '%s'. Must be 'allow', 'warn' or 'deny'", policy.Unknown)
+	}
+	violations := 0
+	for _, p := range all_packs {
+		if p == root {
+			continue
+		}
+		by := ""
+		if p.requested_by != "" {
+			by = " (required by " + p.requested_by + ")"
+		}
+		license := package_license(p)
+		switch {
+		case license == "" || license == "unknown":
+			switch policy.Unknown {
+			case "deny":
+				fmt.Printf("Package %s%s - license is unknown and denied by license policy\n", p.Name, by)
+				violations++
+			case "allow":
+			default:
+				fmt.Printf("WARNING - Package %s%s - license is unknown\n", p.Name, by)
+			}
+		case !license_allowed(license, policy):
+			fmt.Printf("Package %s%s - license %s is not allowed by license policy\n", p.Name, by, license)
+			violations++
+		default:
+			Verbosef("Package %s - license %s\n", p.Name, license)
+		}
+	}
+	if violations != 0 {
+		log.Fatalf("Fatal - %d dependencies don't satisfy the license policy", violations)
+	}
+}
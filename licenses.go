@@ -0,0 +1,113 @@
+package main
+
+/*
+  License environment of proprietary build tools.
+
+  Proprietary compilers and tools often need a license server, usually
+  indicated by an environment variable (like 'LM_LICENSE_FILE' for FLEXlm).
+  A package lists the license environment its build needs in the
+  'licenseEnv' attribute of its descriptor. Before starting any build, CPM
+  checks that, for every requirement, one of the listed variables is set,
+  in the build environment of the package (see env.go) or in the process
+  environment, and that at least one license file or server in its value
+  is available.
+*/
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// License environment required to build a package
+type LicenseEnv struct {
+	Name string   //name of licensed tool
+	Os   string   //OS-es or targets to which requirement applies
+	Env  []string //environment variables; one of them must be set
+}
+
+// Matches license servers: port@host
+var license_server_re = regexp.MustCompile(`^(\d*)@([^@]+)$`)
+
+// Time allowed to connect to a license server
+const license_timeout = 3 * time.Second
+
+// Check if a license source (file or port@host server) is available
+func license_available(src string) error {
+	if m := license_server_re.FindStringSubmatch(src); m != nil {
+		port := m[1]
+		if port == "" {
+			port = "27000" //FLEXlm default port
+		}
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(m[2], port), license_timeout)
+		if err != nil {
+			return fmt.Errorf("license server %s is not reachable", src)
+		}
+		conn.Close()
+		return nil
+	}
+	if _, err := os.Stat(src); err != nil {
+		return fmt.Errorf("license file %s not found", src)
+	}
+	return nil
+}
+
+// Check license environment of a requirement. Variables are looked up in the
+// build environment of the package, env, and then in the process
+// environment. Returns an error describing the problem.
+func check_license_env(req LicenseEnv, env map[string]string) error {
+	var problems []string
+	for _, name := range req.Env {
+		value, ok := env[name]
+		if !ok {
+			value = os.Getenv(name)
+		}
+		if value == "" {
+			continue
+		}
+		//list of sources separated by path list separator
+		for _, src := range strings.Split(value, string(os.PathListSeparator)) {
+			src = strings.TrimSpace(src)
+			if src == "" {
+				continue
+			}
+			err := license_available(src)
+			if err == nil {
+				return nil
+			}
+			problems = append(problems, name+": "+err.Error())
+		}
+	}
+	if len(problems) == 0 {
+		return fmt.Errorf("none of the environment variables %s is set", strings.Join(req.Env, ", "))
+	}
+	return fmt.Errorf("%s", strings.Join(problems, "; "))
+}
+
+// Check license environment of all packages to be built. Returns the number
+// of unsatisfied requirements.
+func check_licenses() int {
+	//variables can be set by 'env' attributes of descriptors
+	var order []*PacUnit
+	build_order(all_packs[0], &order)
+	setup_envs(order)
+
+	failed := 0
+	for _, p := range all_packs {
+		for _, req := range p.LicenseEnv {
+			if oses := strings.Fields(req.Os); len(oses) != 0 && !slices.Contains(oses, "any") && !slices.Contains(oses, target_os()) {
+				continue
+			}
+			Verbosef("Checking license environment %s of %s\n", req.Name, p.Name)
+			if err := check_license_env(req, package_envs[p]); err != nil {
+				fmt.Printf("Package %s - license for %s not available - %v\n", p.Name, req.Name, err)
+				failed++
+			}
+		}
+	}
+	return failed
+}
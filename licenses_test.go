@@ -0,0 +1,25 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLicenseEnvFromBuildEnvironment(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "license.dat")
+	os.WriteFile(fname, []byte("SERVER"), 0644)
+	req := LicenseEnv{Name: "compiler", Env: []string{"CPM_TEST_LICENSE_FILE"}}
+	os.Unsetenv("CPM_TEST_LICENSE_FILE")
+
+	if err := check_license_env(req, nil); err == nil {
+		t.Errorf("license available without environment variable")
+	}
+	if err := check_license_env(req, map[string]string{"CPM_TEST_LICENSE_FILE": fname}); err != nil {
+		t.Errorf("license in build environment not found - %v", err)
+	}
+	missing := filepath.Join(filepath.Dir(fname), "missing.dat")
+	if err := check_license_env(req, map[string]string{"CPM_TEST_LICENSE_FILE": missing}); err == nil {
+		t.Errorf("missing license file %s accepted", missing)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+/*
+  Resource limits.
+
+  The build commands of a package can be limited in CPU and memory, so a
+  memory-hungry package doesn't exhaust the machine during parallel builds.
+  Limits are given by the 'limits' attribute of the package descriptor:
+    "limits": {"cpus": 2, "memory": "6G"}
+  or, for all packages, by the '--max-cpus' and '--max-memory' options. When
+  both are given, the smaller limit applies. 'cpus' is a number of
+  processors (it can be fractional); 'memory' is a number of bytes with an
+  optional K, M, G or T suffix.
+
+  On Linux, each build command runs in its own cgroup (cgroup v2), created
+  under the 'limits.cgroup' configuration setting or, by default, under the
+  cgroup of CPM; if CPM cannot create cgroups there, commands run in a
+  transient systemd scope ('systemd-run --scope'). Controllers can be
+  enabled for the children of a cgroup only if the cgroup has no processes
+  (except the root cgroup), so the cgroup of CPM, which has at least CPM
+  itself, can be used only in the root cgroup, like in some containers. In
+  other cases, commands run in systemd scopes unless 'limits.cgroup' names
+  a delegated cgroup without processes. On Windows, commands are started
+  suspended and run in a job object, so all processes they start are
+  limited. A command that exceeds the memory limit is stopped and
+  the build of the package fails. On other platforms, or if none of these
+  mechanisms is available, limits are not enforced and CPM shows a warning.
+*/
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var max_cpus_flag = flag.Float64("max-cpus", 0, "maximum number of processors used by a package build")
+var max_memory_flag = flag.String("max-memory", "", "maximum memory used by a package build (like 4G)")
+
+// Resource limits of a package build
+type ResourceLimits struct {
+	Cpus   float64 //number of processors
+	Memory string  //bytes with optional K, M, G or T suffix
+}
+
+// Limits applied to build commands
+type command_limits struct {
+	pack   string
+	cpus   float64
+	memory uint64 //bytes
+}
+
+var package_limits sync.Map //package folder -> *command_limits
+var limits_warn_once sync.Once
+
+// Parse a memory size like 512M or 4G
+func parse_memory(s string) (uint64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+	mult := uint64(1)
+	if i := strings.IndexAny(s, "KMGT"); i >= 0 && i == len(s)-1 {
+		mult = uint64(1) << (10 * (strings.IndexByte("KMGT", s[i]) + 1))
+		s = s[:i]
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid memory size")
+	}
+	return uint64(n * float64(mult)), nil
+}
+
+// Return resource limits of the build commands of a package or nil if the
+// package has no limits
+func build_limits(p *PacUnit) *command_limits {
+	l := &command_limits{pack: p.Name, cpus: *max_cpus_flag}
+	if *max_memory_flag != "" {
+		m, err := parse_memory(*max_memory_flag)
+		if err != nil {
+			log.Fatalf("Fatal - invalid --max-memory option '%s'", *max_memory_flag)
+		}
+		l.memory = m
+	}
+	if r := p.Limits; r != nil {
+		if r.Cpus < 0 {
+			log.Fatalf("Fatal - Package %s - invalid CPU limit %g", p.Name, r.Cpus)
+		}
+		if r.Cpus > 0 && (l.cpus == 0 || r.Cpus < l.cpus) {
+			l.cpus = r.Cpus
+		}
+		if r.Memory != "" {
+			m, err := parse_memory(r.Memory)
+			if err != nil {
+				log.Fatalf("Fatal - Package %s - invalid memory limit '%s'", p.Name, r.Memory)
+			}
+			if l.memory == 0 || m < l.memory {
+				l.memory = m
+			}
+		}
+	}
+	if l.cpus <= 0 && l.memory == 0 {
+		return nil
+	}
+	Verbosef("Package %s - limits: %g CPUs, %d bytes of memory\n", p.Name, l.cpus, l.memory)
+	return l
+}
+
+// Run a command with the resource limits of the package in folder dir, if
+// the package has limits
+func run_command(cmd *exec.Cmd, dir string) error {
+	l, ok := package_limits.Load(dir)
+	if !ok {
+		return run_process(cmd)
+	}
+	return run_limited(cmd, l.(*command_limits))
+}
+
+// Show once that limits cannot be enforced
+func limits_unsupported(reason string) {
+	limits_warn_once.Do(func() {
+		fmt.Printf("WARNING - resource limits are not enforced - %s\n", reason)
+	})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+const cgroup_root = "/sys/fs/cgroup"
+const cpu_period = 100000 //microseconds
+
+var cgroup_count atomic.Int64
+var systemd_scope_once sync.Once
+var systemd_run string //path of systemd-run if transient scopes work
+
+// Return cgroup under which CPM creates cgroups of build commands
+func cgroup_parent() string {
+	if dir := config_get("limits.cgroup", ""); dir != "" {
+		return dir
+	}
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if path, ok := strings.CutPrefix(line, "0::"); ok {
+			//hybrid systems mount the cgroup v2 hierarchy in 'unified'
+			if _, err := os.Stat(filepath.Join(cgroup_root, "cgroup.controllers")); err != nil {
+				return filepath.Join(cgroup_root, "unified", path)
+			}
+			return filepath.Join(cgroup_root, path)
+		}
+	}
+	return ""
+}
+
+// Create a cgroup with the given limits. Returns the cgroup folder.
+func create_cgroup(l *command_limits) (string, error) {
+	parent := cgroup_parent()
+	if parent == "" {
+		return "", fmt.Errorf("cgroup v2 not available")
+	}
+	needed := []string{"memory", "cpu"}
+	//controllers must be enabled for children of the parent; this fails
+	//if the parent has processes, unless it's the root cgroup
+	data, err := os.ReadFile(filepath.Join(parent, "cgroup.subtree_control"))
+	if err != nil {
+		return "", err
+	}
+	enabled := strings.Fields(string(data))
+	for _, c := range needed {
+		if !slices.Contains(enabled, c) {
+			if err = os.WriteFile(filepath.Join(parent, "cgroup.subtree_control"), []byte("+"+c), 0644); err != nil {
+				return "", fmt.Errorf("cannot enable %s controller in %s - %v", c, parent, err)
+			}
+		}
+	}
+	dir := filepath.Join(parent, fmt.Sprintf("cpm-%s-%d-%d", l.pack, os.Getpid(), cgroup_count.Add(1)))
+	if err = os.Mkdir(dir, 0755); err != nil {
+		return "", err
+	}
+	if l.cpus > 0 {
+		quota := fmt.Sprintf("%d %d", int64(l.cpus*cpu_period), cpu_period)
+		err = os.WriteFile(filepath.Join(dir, "cpu.max"), []byte(quota), 0644)
+	}
+	if err == nil && l.memory > 0 {
+		err = os.WriteFile(filepath.Join(dir, "memory.max"), []byte(strconv.FormatUint(l.memory, 10)), 0644)
+	}
+	if err != nil {
+		os.Remove(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// Stop remaining processes of a cgroup and remove it. Returns true if
+// processes were killed for exceeding the memory limit.
+func remove_cgroup(dir string) bool {
+	oom := false
+	if data, err := os.ReadFile(filepath.Join(dir, "memory.events")); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if f := strings.Fields(line); len(f) == 2 && f[0] == "oom_kill" && f[1] != "0" {
+				oom = true
+			}
+		}
+	}
+	os.WriteFile(filepath.Join(dir, "cgroup.kill"), []byte("1"), 0644)
+	if err := os.Remove(dir); err != nil {
+		Verbosef("Cannot remove cgroup %s - %v\n", dir, err)
+	}
+	return oom
+}
+
+// Return path of systemd-run if it can start transient scopes
+func systemd_scope() string {
+	systemd_scope_once.Do(func() {
+		path, err := exec.LookPath("systemd-run")
+		if err != nil {
+			return
+		}
+		if err = exec.Command(path, append(scope_args(), "true")...).Run(); err != nil {
+			Verbosef("systemd-run cannot start scopes - %v\n", err)
+			return
+		}
+		systemd_run = path
+	})
+	return systemd_run
+}
+
+// Return arguments of systemd-run that start a transient scope
+func scope_args() []string {
+	args := []string{"--scope", "--quiet", "--collect"}
+	if os.Getuid() != 0 {
+		args = append([]string{"--user"}, args...)
+	}
+	return args
+}
+
+// Run a command in a cgroup with resource limits or, if CPM cannot create
+// cgroups, in a systemd scope
+func run_limited(cmd *exec.Cmd, l *command_limits) error {
+	dir, err := create_cgroup(l)
+	if err == nil {
+		f, err := os.Open(dir)
+		if err != nil {
+			remove_cgroup(dir)
+			return err
+		}
+		cmd.SysProcAttr = &syscall.SysProcAttr{UseCgroupFD: true, CgroupFD: int(f.Fd())}
+		err = cmd.Run()
+		f.Close()
+		if remove_cgroup(dir) {
+			fmt.Printf("WARNING - Package %s - command stopped for exceeding the memory limit of %d bytes\n", l.pack, l.memory)
+		}
+		return err
+	}
+	Verbosef("Cannot create cgroup - %v\n", err)
+
+	if path := systemd_scope(); path != "" {
+		args := scope_args()
+		if l.cpus > 0 {
+			args = append(args, fmt.Sprintf("--property=CPUQuota=%d%%", int(l.cpus*100)))
+		}
+		if l.memory > 0 {
+			args = append(args, fmt.Sprintf("--property=MemoryMax=%d", l.memory))
+		}
+		cmd.Args = append(append([]string{path}, args...), append([]string{"--", cmd.Path}, cmd.Args[1:]...)...)
+		cmd.Path = path
+		return cmd.Run()
+	}
+	limits_unsupported("cannot create cgroups or systemd scopes")
+	return cmd.Run()
+}
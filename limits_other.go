@@ -0,0 +1,14 @@
+//go:build !linux && !windows
+
+package main
+
+import (
+	"os/exec"
+	"runtime"
+)
+
+// Resource limits are not available on this platform
+func run_limited(cmd *exec.Cmd, l *command_limits) error {
+	limits_unsupported("not available on " + runtime.GOOS)
+	return cmd.Run()
+}
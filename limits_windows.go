@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+var proc_create_job_object = kernel32.NewProc("CreateJobObjectW")
+var proc_set_information_job_object = kernel32.NewProc("SetInformationJobObject")
+var proc_assign_process_to_job_object = kernel32.NewProc("AssignProcessToJobObject")
+var proc_nt_resume_process = syscall.NewLazyDLL("ntdll.dll").NewProc("NtResumeProcess")
+
+const (
+	job_object_extended_limit_information   = 9
+	job_object_cpu_rate_control_information = 15
+	job_object_limit_job_memory             = 0x200
+	job_object_limit_kill_on_job_close      = 0x2000
+	job_object_cpu_rate_control_enable      = 0x1
+	job_object_cpu_rate_control_hard_cap    = 0x4
+	process_set_quota                       = 0x100
+	process_terminate                       = 0x1
+	process_suspend_resume                  = 0x800
+	create_suspended                        = 0x4
+)
+
+// JOBOBJECT_EXTENDED_LIMIT_INFORMATION structure
+type job_limit_information struct {
+	PerProcessUserTimeLimit int64
+	PerJobUserTimeLimit     int64
+	LimitFlags              uint32
+	MinimumWorkingSetSize   uintptr
+	MaximumWorkingSetSize   uintptr
+	ActiveProcessLimit      uint32
+	Affinity                uintptr
+	PriorityClass           uint32
+	SchedulingClass         uint32
+	IoCounters              [6]uint64
+	ProcessMemoryLimit      uintptr
+	JobMemoryLimit          uintptr
+	PeakProcessMemoryUsed   uintptr
+	PeakJobMemoryUsed       uintptr
+}
+
+// JOBOBJECT_CPU_RATE_CONTROL_INFORMATION structure
+type job_cpu_rate_information struct {
+	ControlFlags uint32
+	CpuRate      uint32 //percentage of processor cycles times 100
+}
+
+// Create a job object with the given limits. Processes are stopped when
+// the job is closed.
+func create_job(l *command_limits) (syscall.Handle, error) {
+	h, _, err := proc_create_job_object.Call(0, 0)
+	if h == 0 {
+		return 0, err
+	}
+	job := syscall.Handle(h)
+	info := job_limit_information{LimitFlags: job_object_limit_kill_on_job_close}
+	if l.memory > 0 {
+		info.LimitFlags |= job_object_limit_job_memory
+		info.JobMemoryLimit = uintptr(l.memory)
+	}
+	if r, _, err := proc_set_information_job_object.Call(h, job_object_extended_limit_information,
+		uintptr(unsafe.Pointer(&info)), unsafe.Sizeof(info)); r == 0 {
+		syscall.CloseHandle(job)
+		return 0, err
+	}
+	if l.cpus > 0 {
+		rate := uint32(l.cpus * 10000 / float64(runtime.NumCPU()))
+		if rate < 1 {
+			rate = 1
+		}
+		if rate > 10000 {
+			rate = 10000
+		}
+		cpu := job_cpu_rate_information{job_object_cpu_rate_control_enable | job_object_cpu_rate_control_hard_cap, rate}
+		if r, _, err := proc_set_information_job_object.Call(h, job_object_cpu_rate_control_information,
+			uintptr(unsafe.Pointer(&cpu)), unsafe.Sizeof(cpu)); r == 0 {
+			syscall.CloseHandle(job)
+			return 0, err
+		}
+	}
+	return job, nil
+}
+
+// Run a command in a job object with resource limits. The command is
+// started suspended and resumed once it belongs to the job, so processes it
+// starts belong to the same job.
+func run_limited(cmd *exec.Cmd, l *command_limits) error {
+	job, err := create_job(l)
+	if err != nil {
+		limits_unsupported(fmt.Sprintf("cannot create job object - %v", err))
+		return run_process(cmd)
+	}
+	defer syscall.CloseHandle(job)
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.CreationFlags |= create_suspended
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	ph, err := syscall.OpenProcess(process_set_quota|process_terminate|process_suspend_resume|
+		process_query_limited_information|process_vm_read, false, uint32(cmd.Process.Pid))
+	if err != nil {
+		//a suspended process cannot be resumed without its handle
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("cannot open process - %v", err)
+	}
+	defer syscall.CloseHandle(ph)
+	if r, _, e := proc_assign_process_to_job_object.Call(uintptr(job), uintptr(ph)); r == 0 {
+		limits_unsupported(fmt.Sprintf("cannot assign process to job object - %v", e))
+	}
+	if status, _, _ := proc_nt_resume_process.Call(uintptr(ph)); status != 0 {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("cannot resume process - status 0x%x", status)
+	}
+	return wait_process(cmd, ph)
+}
@@ -0,0 +1,263 @@
+package main
+
+/*
+  Link modes.
+
+  By default, include folders of dependencies and the 'lib' folder are
+  linked using symbolic links. On Windows, creating symbolic links requires
+  Developer Mode or administrator rights, and many network shares don't
+  allow them. The '--link-mode' option selects another way to materialize
+  these links:
+  - 'junction': folders are linked with directory junctions (Windows only;
+    on other systems it is the same as 'symlink') and files with hard links;
+  - 'hardlink': folders are recreated and their files are hard linked;
+  - 'copy': files and folders are copied.
+  Hard links and copies are refreshed on every run if their source changes.
+  In 'hardlink' and 'copy' modes, the 'lib' folder of each package is a real
+  folder: before the package is built, it receives the files of the shared
+  'lib' folder and, after the build, only the files the build created or
+  changed are copied back, so that parallel builds don't overwrite each
+  other's libraries with stale copies.
+
+  If symbolic links cannot be created in DEV_ROOT, 'symlink' mode falls back
+  to 'copy' mode.
+*/
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sync"
+	"time"
+)
+
+var link_mode_flag = flag.String("link-mode", "symlink", "link mode (symlink, junction, hardlink or copy)")
+
+var link_modes = []string{"symlink", "junction", "hardlink", "copy"}
+
+var link_mode_value string
+var link_mode_once sync.Once
+
+// Return the link mode used in this run
+func link_mode() string {
+	link_mode_once.Do(func() {
+		link_mode_value = *link_mode_flag
+		if !slices.Contains(link_modes, link_mode_value) {
+			log.Fatalf("Unknown link mode %s. Valid modes are: symlink, junction, hardlink, copy", link_mode_value)
+		}
+		if link_mode_value == "junction" && runtime.GOOS != "windows" {
+			link_mode_value = "symlink"
+		}
+		if link_mode_value == "symlink" && !can_symlink() {
+			fmt.Println("WARNING - using copies instead of symbolic links")
+			link_mode_value = "copy"
+		}
+		Verboseln("Link mode", link_mode_value)
+	})
+	return link_mode_value
+}
+
+// Return true if the 'lib' folder of packages is a copy of the shared one
+func lib_synced() bool {
+	mode := link_mode()
+	return mode == "copy" || mode == "hardlink"
+}
+
+// Size and modification time of a file
+type file_stamp struct {
+	size  int64
+	mtime time.Time
+}
+
+// Serializes synchronizations with the shared 'lib' folder
+var lib_sync_lock sync.Mutex
+
+// Return the stamps of all files in folder dir, by path relative to dir
+func folder_stamps(dir string) map[string]file_stamp {
+	stamps := make(map[string]file_stamp)
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if fi, err := d.Info(); err == nil {
+			rel, _ := filepath.Rel(dir, path)
+			stamps[rel] = file_stamp{fi.Size(), fi.ModTime()}
+		}
+		return nil
+	})
+	return stamps
+}
+
+// Return the files of folder dir, relative to dir, that are not in stamps
+// 'before' or whose size or modification time changed
+func changed_files(dir string, before map[string]file_stamp) []string {
+	var files []string
+	for rel, st := range folder_stamps(dir) {
+		if b, ok := before[rel]; !ok || b.size != st.size || !b.mtime.Equal(st.mtime) {
+			files = append(files, rel)
+		}
+	}
+	slices.Sort(files)
+	return files
+}
+
+// Bring new and changed files of the shared 'lib' folder in the 'lib'
+// folder of a package before it is built. Returns the stamps of the package
+// files, used by sync_lib_out to find the files the build produced.
+func sync_lib_in(libdir string) map[string]file_stamp {
+	lib_sync_lock.Lock()
+	defer lib_sync_lock.Unlock()
+	os.MkdirAll(libdir, 0755)
+	sync_tree(lib_dir(), libdir, false)
+	return folder_stamps(libdir)
+}
+
+// Copy to the shared 'lib' folder the files of the 'lib' folder of a
+// package that were created or changed since sync_lib_in. Files of other
+// packages, that may be stale copies, are left alone.
+func sync_lib_out(libdir string, before map[string]file_stamp) {
+	lib_sync_lock.Lock()
+	defer lib_sync_lock.Unlock()
+	for _, rel := range changed_files(libdir, before) {
+		dst := filepath.Join(lib_dir(), rel)
+		os.MkdirAll(long_path(filepath.Dir(dst)), 0755)
+		refresh_file(filepath.Join(libdir, rel), dst)
+	}
+}
+
+// Return true if symbolic links can be created in the development tree
+func can_symlink() bool {
+	dir := filepath.Join(devroot, ".cpm")
+	os.MkdirAll(dir, 0755)
+	link := filepath.Join(dir, "symlink-test")
+	os.Remove(link)
+	if err := os.Symlink(dir, link); err != nil {
+		fmt.Printf("WARNING - cannot create symbolic links in %s - %v\n", devroot, err)
+		return false
+	}
+	os.Remove(link)
+	return true
+}
+
+// Materialize a link to target using the current link mode, other than
+// 'symlink'
+func materialize_link(target string, link string) {
+	mode := link_mode()
+	st, err := os.Stat(target)
+	if err != nil {
+		log.Fatalf("Fatal - cannot link %s - %v", target, err)
+	}
+
+	if lst, err := os.Lstat(link); err == nil {
+		//keep objects of the right kind; replace other objects owned by CPM
+		keep := false
+		if st.IsDir() && mode == "junction" {
+			ls, _ := os.Stat(link)
+			keep = os.SameFile(ls, st)
+		} else {
+			keep = lst.Mode().IsDir() == st.IsDir() && lst.Mode()&fs.ModeSymlink == 0
+		}
+		if !keep {
+			if !is_owned(link) {
+				log.Fatalf("Fatal - '%s' already exists and is not a link to '%s'", link, target)
+			}
+			Verbosef("Replacing '%s' with %s of '%s'\n", link, mode, target)
+			if err := remove_all(link); err != nil {
+				log.Fatalf("Fatal - cannot remove '%s' - %v", link, err)
+			}
+			forget_created(link)
+		}
+	}
+
+	switch {
+	case st.IsDir() && mode == "junction":
+		if _, err := os.Lstat(link); err != nil {
+			Verbosef("Creating junction %s --> %s\n", link, target)
+			if stat, err := Run("mklink", []string{"/J", link, target}); err != nil || stat != 0 {
+				log.Fatalf("Fatal - cannot create junction %s --> %s \nStatus %d Error: %v\n", link, target, stat, err)
+			}
+		}
+		record_link(link)
+	case st.IsDir():
+		os.MkdirAll(link, 0755)
+		record_dir(link)
+		sync_tree(target, link, true)
+	default:
+		refresh_file(target, link)
+		record_copy(link)
+	}
+}
+
+// Hard link or copy a file, according to link mode, if destination is
+// missing or out of date
+func refresh_file(src string, dst string) {
+	if link_mode() == "copy" {
+		copy_if_changed(src, dst)
+		return
+	}
+	lsrc, ldst := long_path(src), long_path(dst)
+	src_stat, _ := os.Stat(lsrc)
+	if dst_stat, err := os.Lstat(ldst); err == nil {
+		if os.SameFile(src_stat, dst_stat) {
+			return
+		}
+		//source was replaced or destination is a copy
+		if err := remove_file(ldst); err != nil {
+			log.Fatalf("Fatal - cannot replace %s - %v", dst, err)
+		}
+	}
+	Verbosef("Linking %s --> %s\n", src, dst)
+	if err := os.Link(lsrc, ldst); err != nil {
+		//different volumes
+		Verbosef("Cannot create hard link %s - %v. Copying\n", dst, err)
+		copy_if_changed(src, dst)
+	}
+}
+
+// Hard link or copy new and changed files from folder src to folder dst. If
+// prune is true, files in dst that are not in src are removed.
+func sync_tree(src string, dst string, prune bool) {
+	err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, path)
+		if d.IsDir() {
+			os.MkdirAll(long_path(filepath.Join(dst, rel)), 0755)
+			return nil
+		}
+		refresh_file(path, filepath.Join(dst, rel))
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("Fatal - cannot copy %s to %s - %v", src, dst, err)
+	}
+	if !prune {
+		return
+	}
+	var dirs []string
+	filepath.WalkDir(dst, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == dst {
+			return nil
+		}
+		rel, _ := filepath.Rel(dst, path)
+		if _, err := os.Lstat(filepath.Join(src, rel)); err == nil {
+			return nil
+		}
+		if d.IsDir() {
+			dirs = append(dirs, path)
+			return nil
+		}
+		Verbosef("Removing stale file %s\n", path)
+		remove_file(path)
+		return nil
+	})
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Remove(dirs[i]) //fails if not empty
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+/*
+  Lockfile support.
+
+  After fetching, CPM records in the 'cpm.lock' file, next to the descriptor
+  of the root package, the exact commit checked out for every dependency.
+  With the '--locked' option, dependencies are checked out at the recorded
+  commits instead of pulling the latest version of their branches. The
+  license of every dependency is recorded too (see licensepolicy.go).
+
+  When the root package uses an alternate descriptor, like 'cpm-min.json',
+  its lockfile has the same name with the '.lock' extension ('cpm-min.lock')
+  so the lockfile of the full dependency set is not changed.
+*/
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const lockfile_name = "cpm.lock"
+
+var locked_flag = flag.Bool("locked", false, "check out commits recorded in lockfile")
+
+// Commit of a dependency recorded in lockfile
+type LockEntry struct {
+	Name    string
+	Uri     string
+	Commit  string
+	License string `json:",omitempty"` //detected license
+}
+
+type Lockfile struct {
+	Packages []LockEntry
+}
+
+var root_lock *Lockfile //lockfile of root package
+var root_lock_once sync.Once
+
+// Read a lockfile. Returns nil if the file doesn't exist.
+func read_lockfile(fname string) (*Lockfile, error) {
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	l := new(Lockfile)
+	if err = json.Unmarshal(data, l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Write a lockfile
+func write_lockfile(fname string, l *Lockfile) error {
+	slices.SortFunc(l.Packages, func(a, b LockEntry) int { return strings.Compare(a.Name, b.Name) })
+	data, _ := json.MarshalIndent(l, "", "  ")
+	return os.WriteFile(fname, append(data, '\n'), 0644)
+}
+
+// Return path of lockfile of root package
+func root_lockfile() string {
+	dir := filepath.Dir(root_descriptor)
+	if *root_alternate == "" {
+		return filepath.Join(dir, lockfile_name)
+	}
+	base := filepath.Base(*root_alternate)
+	return filepath.Join(dir, strings.TrimSuffix(base, filepath.Ext(base))+".lock")
+}
+
+// Return lockfile entry of a package or nil if not found
+func (l *Lockfile) find(name string) *LockEntry {
+	if l == nil {
+		return nil
+	}
+	for i := range l.Packages {
+		if strings.EqualFold(l.Packages[i].Name, name) {
+			return &l.Packages[i]
+		}
+	}
+	return nil
+}
+
+// Remove entry of a package. Returns true if entry was found.
+func (l *Lockfile) remove(name string) bool {
+	n := len(l.Packages)
+	l.Packages = slices.DeleteFunc(l.Packages, func(e LockEntry) bool { return strings.EqualFold(e.Name, name) })
+	return len(l.Packages) != n
+}
+
+// Return commit of a package recorded in the lockfile of the root package
+func locked_commit(p *PacUnit) string {
+	root_lock_once.Do(func() {
+		fname := root_lockfile()
+		l, err := read_lockfile(fname)
+		if err != nil {
+			log.Fatalf("Fatal - cannot read %s - %v", fname, err)
+		}
+		if l == nil {
+			log.Fatalf("Fatal - locked mode and %s does not exist", fname)
+		}
+		root_lock = l
+	})
+	e := root_lock.find(p.Name)
+	if e == nil {
+		log.Fatalf("Fatal - package %s is not in lockfile. Run CPM without --locked option to update it.", p.Name)
+	}
+	return e.Commit
+}
+
+// Check out the commit of a package recorded in lockfile
+func checkout_locked(p *PacUnit) {
+	package_vcs(p).Checkout(package_dir(p), locked_commit(p))
+}
+
+// Record commits of all dependencies in the lockfile of the root package.
+// Local packages are part of another repository and are not recorded;
+// archives are pinned by their URL and hash. Revisions of packages fetched
+// by external providers are unknown.
+func update_lockfile(root *PacUnit) {
+	l := new(Lockfile)
+	for _, p := range all_packs {
+		if p == root || p.path != "" || p.archive != "" || p.provider != "" {
+			continue
+		}
+		vcs := package_vcs(p)
+		commit, err := vcs.Revision(package_dir(p))
+		if err != nil {
+			Verbosef("Cannot find commit of %s - %v\n", p.Name, err)
+			continue
+		}
+		l.Packages = append(l.Packages, LockEntry{p.Name, vcs.Uri(p), commit, package_license(p)})
+	}
+	fname := root_lockfile()
+	if err := write_lockfile(fname, l); err != nil {
+		fmt.Printf("WARNING - cannot write %s - %v\n", fname, err)
+	}
+}
+
+// Apply an edit to the lockfiles of all packages in the development tree,
+// the workspace lockfile and the lockfile of the root package, which can be
+// an alternate '<name>.lock' file. The edit function returns true if the
+// lockfile was changed.
+func edit_lockfiles(edit func(l *Lockfile) bool) {
+	fnames := []string{filepath.Join(devroot, lockfile_name)}
+	entries, _ := os.ReadDir(devroot)
+	for _, e := range entries {
+		fnames = append(fnames, filepath.Join(devroot, e.Name(), lockfile_name))
+	}
+	if root_descriptor != "" {
+		if fname, err := filepath.Abs(root_lockfile()); err == nil && !slices.Contains(fnames, fname) {
+			fnames = append(fnames, fname)
+		}
+	}
+	for _, fname := range fnames {
+		l, err := read_lockfile(fname)
+		if err != nil || l == nil || !edit(l) {
+			continue
+		}
+		if err = write_lockfile(fname, l); err != nil {
+			fmt.Printf("WARNING - cannot update %s - %v\n", fname, err)
+			continue
+		}
+		Verboseln("Updated", fname)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEditLockfiles(t *testing.T) {
+	saved_root, saved_descriptor, saved_alternate := devroot, root_descriptor, *root_alternate
+	defer func() { devroot, root_descriptor, *root_alternate = saved_root, saved_descriptor, saved_alternate }()
+	devroot = t.TempDir()
+	os.MkdirAll(filepath.Join(devroot, "app"), 0755)
+	root_descriptor = filepath.Join(devroot, "app", descriptor_name)
+	*root_alternate = "ci.json"
+
+	//workspace lockfile, package lockfile and alternate root lockfile
+	fnames := []string{
+		filepath.Join(devroot, lockfile_name),
+		filepath.Join(devroot, "app", lockfile_name),
+		filepath.Join(devroot, "app", "ci.lock"),
+	}
+	for _, fname := range fnames {
+		l := &Lockfile{Packages: []LockEntry{{Name: "utils"}, {Name: "zlib"}}}
+		if err := write_lockfile(fname, l); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	edit_lockfiles(func(l *Lockfile) bool { return l.remove("utils") })
+
+	for _, fname := range fnames {
+		l, err := read_lockfile(fname)
+		if err != nil || l == nil {
+			t.Fatalf("cannot read %s - %v", fname, err)
+		}
+		if len(l.Packages) != 1 || l.Packages[0].Name != "zlib" {
+			t.Errorf("%s - packages %v, want only zlib", fname, l.Packages)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+/*
+  Scheduled maintenance.
+
+  'cpm maintain' is meant to be run periodically by cron or Task Scheduler,
+  usually with the '--background' option. It performs the following tasks,
+  selected by configuration settings. The first two tasks run unless they
+  are turned off:
+    maintain.prefetch = false       don't update mirrors of all dependencies
+                                    of the packages in the development tree
+    maintain.mirrors = false        don't update all other mirrors in the
+                                    mirror cache or compact them
+                                    ('git gc --auto')
+    maintain.cache-days = 30        remove artifacts of a folder build cache
+                                    not used for this many days (0 keeps them)
+    maintain.build = app, tools     fetch and build these packages, like
+                                    'cpm <package>'
+  The result is written to '<devroot>/.cpm/maintenance.json' and the output
+  of each build to '<devroot>/.cpm/maintain-<package>.log'. Interactive runs
+  of CPM and the 'status' command show when the tree was last verified or
+  which tasks failed.
+*/
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Result of a maintenance task
+type MaintenanceTask struct {
+	Name    string
+	Ok      bool
+	Details string
+	Log     string `json:",omitempty"`
+}
+
+// Content of maintenance status file
+type MaintenanceStatus struct {
+	Started  time.Time
+	Finished time.Time
+	Tasks    []MaintenanceTask
+}
+
+func maintenance_file() string {
+	return filepath.Join(devroot, ".cpm", "maintenance.json")
+}
+
+// Implementation of 'cpm maintain' command
+func maintain(args []string) {
+	flags := flag.NewFlagSet("maintain", flag.ExitOnError)
+	if pos := parse_interspersed(flags, args); len(pos) != 0 {
+		log.Fatal("Usage: cpm maintain")
+	}
+	st := MaintenanceStatus{Started: time.Now()}
+
+	seen := make(map[string]bool)
+	if !strings.EqualFold(config_get("maintain.prefetch", ""), "false") {
+		fmt.Println("Prefetching dependencies")
+		var failed int
+		seen, failed = prefetch_packages(nil)
+		st.Tasks = append(st.Tasks, MaintenanceTask{Name: "prefetch", Ok: failed == 0,
+			Details: fmt.Sprintf("%d repositories, %d failed", len(seen), failed)})
+	}
+	if !strings.EqualFold(config_get("maintain.mirrors", ""), "false") {
+		fmt.Println("Updating mirror cache")
+		st.Tasks = append(st.Tasks, maintain_mirrors(seen))
+	}
+	if days := config_int("maintain.cache-days", 30); days > 0 {
+		if task, ok := collect_build_cache(days); ok {
+			st.Tasks = append(st.Tasks, task)
+		}
+	}
+	for _, name := range strings.FieldsFunc(config_get("maintain.build", ""), func(r rune) bool {
+		return r == ',' || r == ' '
+	}) {
+		fmt.Printf("Building %s\n", name)
+		st.Tasks = append(st.Tasks, maintenance_build(name))
+	}
+	st.Finished = time.Now()
+
+	failed := 0
+	for _, t := range st.Tasks {
+		status := "OK"
+		if !t.Ok {
+			status = "FAILED"
+			failed++
+		}
+		fmt.Printf("%-20s %-7s %s\n", t.Name, status, t.Details)
+	}
+	os.MkdirAll(filepath.Dir(maintenance_file()), 0755)
+	data, _ := json.MarshalIndent(st, "", "  ")
+	if err := os.WriteFile(maintenance_file(), data, 0644); err != nil {
+		fmt.Printf("WARNING - cannot write %s - %v\n", maintenance_file(), err)
+	}
+	fmt.Println("Maintenance finished in", time.Since(st.Started).Round(time.Millisecond))
+	if failed != 0 {
+		log.Fatalf("Fatal - %d maintenance tasks failed", failed)
+	}
+}
+
+// Update mirrors in the mirror cache that are not in the seen set and compact
+// all mirrors
+func maintain_mirrors(seen map[string]bool) MaintenanceTask {
+	var mirrors []string
+	filepath.WalkDir(filepath.Join(cpm_home(), "mirrors"), func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() && mirror_exists(path) {
+			mirrors = append(mirrors, path)
+			return filepath.SkipDir
+		}
+		return nil
+	})
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	updated, failed := 0, 0
+	pool := new_job_pool(fetch_jobs)
+	for _, dir := range mirrors {
+		wg.Add(1)
+		go func(dir string) {
+			defer wg.Done()
+			pool.acquire()
+			defer pool.release()
+			uri, err := Output("git", "--git-dir", dir, "config", "--get", "remote.origin.url")
+			uri = strings.TrimSpace(uri)
+			if err == nil && uri != "" && !seen[uri] {
+				Verbosef("Updating mirror of %s\n", uri)
+				err = update_mirror(uri)
+				mutex.Lock()
+				if err != nil {
+					fmt.Printf("WARNING - cannot update mirror of %s - %v\n", uri, err)
+					failed++
+				} else {
+					updated++
+				}
+				mutex.Unlock()
+			}
+			Run("git", []string{"--git-dir", dir, "gc", "--auto", "--quiet"})
+		}(dir)
+	}
+	wg.Wait()
+	return MaintenanceTask{Name: "mirrors", Ok: failed == 0,
+		Details: fmt.Sprintf("%d mirrors, %d updated, %d failed", len(mirrors), updated, failed)}
+}
+
+// Remove artifacts of a folder build cache not used for the given number of
+// days. Returns false if there is no folder build cache.
+func collect_build_cache(days int) (MaintenanceTask, bool) {
+	cache, ok := build_cache().(dir_cache)
+	if !ok {
+		return MaintenanceTask{}, false
+	}
+	fmt.Printf("Removing build artifacts not used for %d days from %s\n", days, cache.dir)
+	cutoff := time.Now().AddDate(0, 0, -days)
+	entries, err := os.ReadDir(cache.dir)
+	if err != nil {
+		return MaintenanceTask{Name: "build-cache", Details: err.Error()}, true
+	}
+	removed, kept := 0, 0
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() || !strings.HasSuffix(e.Name(), ".tar.gz") {
+			continue
+		}
+		if info.ModTime().After(cutoff) {
+			kept++
+		} else if err = os.Remove(filepath.Join(cache.dir, e.Name())); err != nil {
+			Verbosef("Cannot remove %s - %v\n", e.Name(), err)
+			kept++
+		} else {
+			removed++
+		}
+	}
+	return MaintenanceTask{Name: "build-cache", Ok: true,
+		Details: fmt.Sprintf("%d artifacts removed, %d kept", removed, kept)}, true
+}
+
+// Fetch and build a package in a separate CPM process, writing its output
+// to a log file
+func maintenance_build(name string) MaintenanceTask {
+	task := MaintenanceTask{Name: "build " + name}
+	task.Log = filepath.Join(devroot, ".cpm", "maintain-"+name+".log")
+	out, err := os.Create(task.Log)
+	if err != nil {
+		task.Details = err.Error()
+		return task
+	}
+	defer out.Close()
+	exe, err := os.Executable()
+	if err != nil {
+		task.Details = err.Error()
+		return task
+	}
+	args := []string{"-r", devroot}
+	if *background_flag {
+		args = append(args, "--background")
+	}
+	cmd := exec.Command(exe, append(args, name)...)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	start := time.Now()
+	err = cmd.Run()
+	elapsed := time.Since(start).Round(time.Second)
+	if err != nil {
+		task.Details = fmt.Sprintf("failed after %v (see %s)", elapsed, task.Log)
+		return task
+	}
+	task.Ok = true
+	task.Details = fmt.Sprintf("built in %v", elapsed)
+	return task
+}
+
+// Return a rough description of the time elapsed since t, like "6h ago"
+func time_ago(t time.Time) string {
+	d := time.Since(t)
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh ago", int(d.Hours()))
+	}
+	return fmt.Sprintf("%d days ago", int(d.Hours()/24))
+}
+
+// Return a one line summary of the last scheduled maintenance or an empty
+// string if 'cpm maintain' never ran in the development tree
+func maintenance_summary() string {
+	data, err := os.ReadFile(maintenance_file())
+	if err != nil {
+		return ""
+	}
+	var st MaintenanceStatus
+	if err = json.Unmarshal(data, &st); err != nil {
+		Verbosef("Cannot parse %s - %v\n", maintenance_file(), err)
+		return ""
+	}
+	var failed []string
+	built := false
+	for _, t := range st.Tasks {
+		if !t.Ok {
+			failed = append(failed, t.Name)
+		}
+		built = built || strings.HasPrefix(t.Name, "build ")
+	}
+	switch {
+	case len(failed) != 0:
+		return fmt.Sprintf("WARNING - maintenance %s failed: %s", time_ago(st.Finished), strings.Join(failed, ", "))
+	case built:
+		return "Tree last verified " + time_ago(st.Finished)
+	}
+	return "Tree last maintained " + time_ago(st.Finished)
+}
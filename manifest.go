@@ -0,0 +1,159 @@
+package main
+
+/*
+  Manifest of file system objects created by CPM.
+
+  Every symlink, copied file and folder that CPM creates in a package is
+  recorded in the '.cpm/manifest.json' file of that package. Commands that
+  remove or recreate these objects use the manifest to tell them apart from
+  objects created by the user.
+*/
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Objects owned by CPM in a package. Paths are relative to package folder.
+type Manifest struct {
+	Links  []string //symbolic links
+	Copies []string //copied files
+	Dirs   []string //folders
+}
+
+// Manifests of packages set up in this run, keyed by package folder
+var manifests = make(map[string]*Manifest)
+var manifest_mutex sync.Mutex
+
+const manifest_name = ".cpm/manifest.json"
+
+// Read manifest of package in dir. Returns an empty manifest if there is none.
+func load_manifest(dir string) *Manifest {
+	m := new(Manifest)
+	if data, err := os.ReadFile(filepath.Join(dir, manifest_name)); err == nil {
+		json.Unmarshal(data, m)
+	}
+	return m
+}
+
+// Write manifest of package in dir. Objects that no longer exist are dropped.
+func save_manifest(dir string, m *Manifest) error {
+	exists := func(rel string) bool {
+		_, err := os.Lstat(filepath.Join(dir, rel))
+		return err == nil
+	}
+	for _, list := range []*[]string{&m.Links, &m.Copies, &m.Dirs} {
+		*list = slices.DeleteFunc(*list, func(rel string) bool { return !exists(rel) })
+		slices.Sort(*list)
+	}
+	fname := filepath.Join(dir, manifest_name)
+	os.MkdirAll(filepath.Dir(fname), 0755)
+	data, _ := json.MarshalIndent(m, "", "  ")
+	return os.WriteFile(fname, data, 0644)
+}
+
+// Return folder of the package that contains path (absolute) or an empty
+// string if path is not in a known package
+func owner_dir(path string) string {
+	owner := ""
+	for _, p := range all_packs {
+		dir := package_dir(p)
+		if strings.HasPrefix(path, dir+string(filepath.Separator)) && len(dir) > len(owner) {
+			owner = dir
+		}
+	}
+	return owner
+}
+
+// Record an object created by CPM. The object belongs to the package whose
+// folder contains it.
+func record_created(list func(m *Manifest) *[]string, path string) {
+	path, _ = filepath.Abs(path)
+	owner := owner_dir(path)
+	if owner == "" {
+		return
+	}
+	rel, _ := filepath.Rel(owner, path)
+
+	manifest_mutex.Lock()
+	defer manifest_mutex.Unlock()
+	m, ok := manifests[owner]
+	if !ok {
+		m = load_manifest(owner)
+		manifests[owner] = m
+	}
+	if l := list(m); !slices.Contains(*l, rel) {
+		*l = append(*l, rel)
+	}
+}
+
+func record_link(path string) {
+	record_created(func(m *Manifest) *[]string { return &m.Links }, path)
+}
+
+func record_copy(path string) {
+	record_created(func(m *Manifest) *[]string { return &m.Copies }, path)
+}
+
+func record_dir(path string) {
+	record_created(func(m *Manifest) *[]string { return &m.Dirs }, path)
+}
+
+// Remove an object from the manifest of its package
+func forget_created(path string) {
+	path, _ = filepath.Abs(path)
+	owner := owner_dir(path)
+	if owner == "" {
+		return
+	}
+	rel, _ := filepath.Rel(owner, path)
+
+	manifest_mutex.Lock()
+	defer manifest_mutex.Unlock()
+	m, ok := manifests[owner]
+	if !ok {
+		m = load_manifest(owner)
+		manifests[owner] = m
+	}
+	for _, list := range []*[]string{&m.Links, &m.Copies, &m.Dirs} {
+		*list = slices.DeleteFunc(*list, func(s string) bool {
+			return s == rel || strings.HasPrefix(s, rel+string(filepath.Separator))
+		})
+	}
+}
+
+// Write manifests of all packages set up in this run
+func save_manifests() {
+	for dir, m := range manifests {
+		if err := save_manifest(dir, m); err != nil {
+			Verbosef("Cannot save manifest of %s - %v\n", dir, err)
+		}
+	}
+}
+
+// Return true if path is owned by CPM according to the manifest of the
+// package that contains it
+func is_owned(path string) bool {
+	path, _ = filepath.Abs(path)
+	dir := owner_dir(path)
+	if dir == "" {
+		return false
+	}
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+
+	manifest_mutex.Lock()
+	defer manifest_mutex.Unlock()
+	m, ok := manifests[dir]
+	if !ok {
+		m = load_manifest(dir)
+		manifests[dir] = m
+	}
+	return slices.Contains(m.Links, rel) || slices.Contains(m.Copies, rel) || slices.Contains(m.Dirs, rel)
+}
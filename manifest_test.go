@@ -0,0 +1,29 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsOwnedBeforeSave(t *testing.T) {
+	saved_root, saved_packs, saved_manifests := devroot, all_packs, manifests
+	defer func() { devroot, all_packs, manifests = saved_root, saved_packs, saved_manifests }()
+	devroot = t.TempDir()
+	all_packs = []*PacUnit{{Name: "app"}}
+	manifests = make(map[string]*Manifest)
+
+	dir := filepath.Join(devroot, "app", "include")
+	os.MkdirAll(dir, 0755)
+	link := filepath.Join(dir, "utils")
+	if is_owned(link) {
+		t.Fatalf("%s owned before it was recorded", link)
+	}
+	record_link(link)
+	if !is_owned(link) {
+		t.Errorf("recorded link %s not owned before manifest is saved", link)
+	}
+	if _, err := os.Stat(filepath.Join(devroot, "app", manifest_name)); err == nil {
+		t.Errorf("manifest saved by is_owned")
+	}
+}
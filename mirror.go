@@ -0,0 +1,224 @@
+package main
+
+/*
+  Local mirror cache.
+
+  Bare mirrors of package repositories are kept in '~/.cpm/mirrors' (or
+  '$CPM_HOME/mirrors'). When a mirror exists, clones borrow objects from it
+  and pulls are preceded by a fetch from the mirror, so that only the most
+  recent changes are downloaded from the remote repository.
+
+  The 'cpm prefetch' command updates the mirrors for all dependencies of
+  one or more packages without touching the development tree. It is meant
+  to be run periodically by cron or Task Scheduler.
+
+  With the '--cache' option, the mirrors become a global package cache
+  shared by all development trees: mirrors are created and updated while
+  fetching and clones keep borrowing objects from them instead of copying
+  them. Objects are never pruned from such mirrors.
+*/
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var cache_flag = flag.Bool("cache", false, "use mirrors as global package cache")
+
+// Return CPM home folder
+func cpm_home() string {
+	if h := os.Getenv("CPM_HOME"); h != "" {
+		return h
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = devroot
+	}
+	return filepath.Join(home, ".cpm")
+}
+
+// Matches scp-like git URLs: [user@]host:path
+var scp_url = regexp.MustCompile(`^(?:[^@/]+@)?([^:/]+):(.*)$`)
+
+// Split repository URL in host and path
+func split_uri(uri string) (host string, path string) {
+	if i := strings.Index(uri, "://"); i >= 0 {
+		rest := uri[i+3:]
+		if j := strings.Index(rest, "@"); j >= 0 && j < strings.Index(rest+"/", "/") {
+			rest = rest[j+1:]
+		}
+		host, path, _ = strings.Cut(rest, "/")
+		if h, _, found := strings.Cut(host, ":"); found {
+			host = h
+		}
+	} else if m := scp_url.FindStringSubmatch(uri); m != nil {
+		host, path = m[1], m[2]
+	} else {
+		path = uri
+	}
+	path = strings.TrimSuffix(strings.Trim(path, "/"), ".git")
+	return strings.ToLower(host), path
+}
+
+// Return mirror folder for a repository URL
+func mirror_dir(uri string) string {
+	host, path := split_uri(uri)
+	if host == "" {
+		host = "local"
+	}
+	path = strings.NewReplacer(":", "_", "..", "_").Replace(path)
+	return filepath.Join(cpm_home(), "mirrors", host, filepath.FromSlash(path)+".git")
+}
+
+func mirror_exists(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, "HEAD"))
+	return err == nil
+}
+
+// Create or update the mirror of a repository
+func update_mirror(uri string) error {
+	dir := mirror_dir(uri)
+	var args []string
+	if mirror_exists(dir) {
+		args = []string{"--git-dir", dir, "remote", "update", "--prune"}
+	} else {
+		os.MkdirAll(filepath.Dir(dir), 0755)
+		args = []string{"clone", "--quiet", "--mirror", uri, dir}
+	}
+	Verboseln("Running git ", args)
+	release := acquire_host(uri)
+	defer release()
+	if stat, err := run_network("", "Updating mirror of "+uri, "git", args); err != nil || stat != 0 {
+		return fmt.Errorf("status %d error %v", stat, err)
+	}
+	return nil
+}
+
+// Create or update the mirror of a repository used as global package cache.
+// Clones that borrow objects from the mirror break if the objects are pruned.
+func cache_mirror(uri string) {
+	dir := mirror_dir(uri)
+	if err := update_mirror(uri); err != nil {
+		fmt.Printf("WARNING - cannot update mirror of %s - %v\n", uri, err)
+		return
+	}
+	Run("git", []string{"--git-dir", dir, "config", "gc.pruneExpire", "never"})
+}
+
+// Update remote tracking branches of repository in folder repo from its
+// mirror, if there is one
+func fetch_from_mirror(repo string, uri string) {
+	dir := mirror_dir(uri)
+	if !mirror_exists(dir) {
+		return
+	}
+	Verboseln("Fetching from mirror", dir)
+	Run("git", []string{"-C", repo, "fetch", "--quiet", dir, "+refs/heads/*:refs/remotes/origin/*", "+refs/tags/*:refs/tags/*"})
+}
+
+// Read the package descriptor of a branch from its mirror
+func mirror_descriptor(uri string, branch string) *PacUnit {
+	if branch == "" {
+		branch = "HEAD"
+	}
+	out, err := Output("git", "--git-dir", mirror_dir(uri), "show", branch+":"+descriptor_name)
+	if err != nil {
+		return nil
+	}
+	p := new(PacUnit)
+	if err = json.Unmarshal([]byte(out), p); err != nil {
+		fmt.Printf("WARNING - cannot parse %s descriptor from %s - %v\n", branch, uri, err)
+		return nil
+	}
+	return p
+}
+
+// Implementation of 'cpm prefetch' command
+func prefetch(args []string) {
+	start := time.Now()
+	seen, failed := prefetch_packages(args)
+	fmt.Printf("Prefetched %d repositories (%d failed) in %v\n", len(seen), failed, time.Since(start).Round(time.Millisecond))
+	if failed != 0 {
+		exit_failed("prefetch failed")
+	}
+}
+
+// Update mirrors of all direct and indirect dependencies of packages in the
+// development tree (all packages if names is empty). Returns the URLs of
+// the repositories and the number of mirrors that could not be updated.
+func prefetch_packages(names []string) (map[string]bool, int) {
+	if len(names) == 0 {
+		//all packages in development tree
+		entries, _ := os.ReadDir(devroot)
+		for _, e := range entries {
+			if _, err := os.Stat(filepath.Join(devroot, e.Name(), descriptor_name)); err == nil {
+				names = append(names, e.Name())
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	seen := make(map[string]bool)
+	failed := 0
+	pool := new_job_pool(fetch_jobs)
+
+	var visit func(deps []DependencyDescriptor)
+	visit = func(deps []DependencyDescriptor) {
+		for _, d := range deps {
+			if d.Archive != "" {
+				continue
+			}
+			uri := package_uri(d.Git, d.Https)
+			mutex.Lock()
+			if uri == "" || seen[uri] {
+				mutex.Unlock()
+				continue
+			}
+			seen[uri] = true
+			mutex.Unlock()
+
+			wg.Add(1)
+			go func(d DependencyDescriptor, uri string) {
+				defer wg.Done()
+				pool.acquire()
+				fmt.Printf("Updating mirror of %s\n", uri)
+				err := update_mirror(uri)
+				pool.release()
+				if err != nil {
+					fmt.Printf("WARNING - cannot update mirror of %s - %v\n", uri, err)
+					mutex.Lock()
+					failed++
+					mutex.Unlock()
+					return
+				}
+				if p := mirror_descriptor(uri, d.Branch); p != nil {
+					visit(p.Depends)
+				}
+			}(d, uri)
+		}
+	}
+
+	for _, name := range names {
+		fname := filepath.Join(devroot, name, descriptor_name)
+		data, err := os.ReadFile(fname)
+		if err != nil {
+			log.Fatalf("cannot open '%s' file", fname)
+		}
+		p := new(PacUnit)
+		if err = json.Unmarshal(data, p); err != nil {
+			log.Fatalf("cannot parse %s - %v", fname, err)
+		}
+		visit(p.Depends)
+	}
+	wg.Wait()
+	return seen, failed
+}
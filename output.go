@@ -0,0 +1,159 @@
+package main
+
+/*
+  Machine-readable output.
+
+  With '--output json', CPM writes a JSON report of the run to standard
+  output when it finishes or fails: packages resolved with their checked-out
+  commits, commands run with their exit codes and durations, build durations,
+  compiler cache statistics and the error that stopped CPM, if any. All
+  other messages, including the output of commands, go to standard error.
+  Strings in the report are converted to UTF-8 (see encoding.go).
+*/
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var output_flag = flag.String("output", "text", "output format (text or json)")
+
+// Report of a CPM run
+type RunReport struct {
+	Version  string          `json:"version"`
+	Args     []string        `json:"args"`
+	DevRoot  string          `json:"devRoot"`
+	Success  bool            `json:"success"`
+	Error    string          `json:"error,omitempty"`
+	Duration float64         `json:"duration"` //seconds
+	Packages []PackageReport `json:"packages"`
+	Commands []CommandReport `json:"commands"`
+	Problems []Problem       `json:"problems"` //diagnostics found in build output
+
+	CompilerCache *CacheReport `json:"compilerCache,omitempty"` //compiler cache statistics
+}
+
+// Package in run report
+type PackageReport struct {
+	Name          string  `json:"name"`
+	Folder        string  `json:"folder"`
+	Branch        string  `json:"branch"` //checked out branch or version tag
+	Commit        string  `json:"commit"`
+	Version       string  `json:"version,omitempty"` //version selected by constraint
+	Built         bool    `json:"built"`
+	BuildDuration float64 `json:"buildDuration,omitempty"` //seconds
+}
+
+// Command in run report
+type CommandReport struct {
+	Dir      string   `json:"dir"`
+	Command  string   `json:"command"`
+	Args     []string `json:"args"`
+	ExitCode int      `json:"exitCode"`
+	Duration float64  `json:"duration"` //seconds
+	Error    string   `json:"error,omitempty"`
+}
+
+var run_report RunReport
+var build_durations = make(map[string]time.Duration)
+var report_mutex sync.Mutex
+var report_out *os.File //standard output, reserved for JSON report
+
+// Return true if the run report is written to standard output
+func json_output() bool {
+	return report_out != nil
+}
+
+// Set up output according to '--output' option
+func setup_output() {
+	log.SetFlags(0)
+	log.SetOutput(fatal_writer{})
+	switch *output_flag {
+	case "text":
+	case "json":
+		report_out = os.Stdout
+		os.Stdout = os.Stderr
+	default:
+		log.Fatalf("Unknown output format %s. Valid formats are: text, json", *output_flag)
+	}
+}
+
+// Write the run report of a command that failed without a fatal error and
+// exit with status 1
+func exit_failed(failure string) {
+	write_run_report(failure)
+	os.Exit(1)
+}
+
+// Log writer that writes the run report and the failure summary before CPM
+// exits. All log messages are fatal errors.
+type fatal_writer struct{}
+
+func (fatal_writer) Write(msg []byte) (int, error) {
+	stop_progress()
+	os.Stderr.WriteString(time.Now().Format("2006/01/02 15:04:05 "))
+	n, err := os.Stderr.Write(msg)
+	write_run_report(strings.TrimSpace(string(msg)))
+	print_failure_summary(strings.TrimSpace(string(msg)))
+	return n, err
+}
+
+// Record a command run by CPM
+func report_command(dir string, prog string, args []string, code int, duration time.Duration, err error) {
+	if !json_output() {
+		return
+	}
+	c := CommandReport{Dir: to_utf8(dir), Command: to_utf8(prog), ExitCode: code, Duration: duration.Seconds()}
+	for _, a := range args {
+		c.Args = append(c.Args, to_utf8(a))
+	}
+	if err != nil {
+		c.Error = to_utf8(err.Error())
+	}
+	report_mutex.Lock()
+	run_report.Commands = append(run_report.Commands, c)
+	report_mutex.Unlock()
+}
+
+// Record the build duration of a package
+func report_build(p *PacUnit, duration time.Duration) {
+	report_mutex.Lock()
+	build_durations[p.Name] = duration
+	report_mutex.Unlock()
+}
+
+// Write the run report if JSON output is selected. Failure is the message of
+// the error that stopped CPM or empty if CPM finished successfully.
+func write_run_report(failure string) {
+	if !json_output() {
+		return
+	}
+	report_mutex.Lock()
+	defer report_mutex.Unlock()
+	r := run_report
+	r.Version = Version
+	r.Args = os.Args[1:]
+	r.DevRoot = devroot
+	r.Success = failure == ""
+	r.Error = to_utf8(failure)
+	r.Duration = time.Since(start_time).Seconds()
+	r.Packages = []PackageReport{}
+	for _, p := range all_packs {
+		pr := PackageReport{Name: p.Name, Folder: package_dir(p), Version: p.version, Built: p.built}
+		pr.Branch, pr.Commit = checked_out(pr.Folder)
+		pr.BuildDuration = build_durations[p.Name].Seconds()
+		r.Packages = append(r.Packages, pr)
+	}
+	r.Problems = sorted_problems()
+	r.CompilerCache = compiler_cache_report()
+	if r.Commands == nil {
+		r.Commands = []CommandReport{}
+	}
+	data, _ := json.MarshalIndent(r, "", "  ")
+	report_out.Write(append(data, '\n'))
+}
@@ -0,0 +1,137 @@
+package main
+
+/*
+  Machine-specific descriptor overlays.
+
+  An optional 'cpm.local.json' file next to 'cpm.json' is merged over the
+  descriptor. It holds personal settings that should not be committed: it
+  should be ignored by Git. Objects are merged recursively and other values
+  (including arrays) are replaced, except the 'depends' array whose entries
+  are merged with the dependencies having the same name. New dependencies
+  are appended. For example:
+
+    {"depends": [{"name": "utils", "path": "../../my/utils"}]}
+
+  makes 'utils' a local package, keeping all other dependency attributes.
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const overlay_name = "cpm.local.json"
+
+// Read a package descriptor merged with the selected profiles and with the
+// overlay next to it, if any. Unchanged descriptors are taken from the
+// descriptor cache.
+func load_descriptor(fname string) ([]byte, error) {
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	ovname := filepath.Join(filepath.Dir(fname), overlay_name)
+	overlay, ov_err := os.ReadFile(ovname)
+	key := cache_key(fname, string(data), string(overlay), *profile_flag)
+	if cached, ok := cached_descriptor(fname, key); ok {
+		return cached, nil
+	}
+	if data, err = merge_descriptor(fname, data, ovname, overlay, ov_err); err != nil {
+		return nil, err
+	}
+	if !unknown_attributes[fname] && !unknown_attributes[ovname] {
+		cache_descriptor(fname, key, data)
+	}
+	return data, nil
+}
+
+// Validate a descriptor and merge it with the selected profiles and with its
+// overlay. Ov_err is the error reading the overlay.
+func merge_descriptor(fname string, data []byte, ovname string, overlay []byte, ov_err error) ([]byte, error) {
+	if err := check_descriptor(fname, data); err != nil {
+		return nil, err
+	}
+	if ov_err == nil {
+		if err := check_descriptor(ovname, overlay); err != nil {
+			return nil, err
+		}
+	} else if *profile_flag == "" {
+		return data, nil
+	}
+
+	var desc map[string]any
+	if err := json.Unmarshal(data, &desc); err != nil {
+		return nil, err
+	}
+	record_profiles(desc)
+	apply_profiles(desc)
+	if overlay != nil {
+		Verboseln("Applying overlay", ovname)
+		var over map[string]any
+		if err := json.Unmarshal(overlay, &over); err != nil {
+			return nil, fmt.Errorf("cannot parse %s - %v", ovname, err)
+		}
+		merge_objects(desc, over)
+	}
+	return json.Marshal(desc)
+}
+
+// Return key of an object that matches name ignoring case, like JSON
+// unmarshalling does, or name if there is none
+func object_key(obj map[string]any, name string) string {
+	for k := range obj {
+		if strings.EqualFold(k, name) {
+			return k
+		}
+	}
+	return name
+}
+
+// Merge object over into object base
+func merge_objects(base map[string]any, over map[string]any) {
+	for name, v := range over {
+		key := object_key(base, name)
+		switch ov := v.(type) {
+		case map[string]any:
+			if bv, ok := base[key].(map[string]any); ok {
+				merge_objects(bv, ov)
+				continue
+			}
+		case []any:
+			if bv, ok := base[key].([]any); ok && strings.EqualFold(name, "depends") {
+				base[key] = merge_depends(bv, ov)
+				continue
+			}
+		}
+		delete(base, key)
+		base[name] = v
+	}
+}
+
+// Merge dependencies with the same name; append other dependencies
+func merge_depends(base []any, over []any) []any {
+	name := func(d any) string {
+		if obj, ok := d.(map[string]any); ok {
+			s, _ := obj[object_key(obj, "name")].(string)
+			return s
+		}
+		return ""
+	}
+	for _, od := range over {
+		found := false
+		for _, bd := range base {
+			if n := name(bd); n != "" && strings.EqualFold(n, name(od)) {
+				merge_objects(bd.(map[string]any), od.(map[string]any))
+				found = true
+				break
+			}
+		}
+		if !found {
+			base = append(base, od)
+		}
+	}
+	return base
+}
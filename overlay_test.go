@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestMergeObjects(t *testing.T) {
+	tests := []struct {
+		base, over, want string
+	}{
+		//scalars and arrays are replaced
+		{`{"name": "app", "tests": ["a"]}`, `{"tests": ["b", "c"]}`,
+			`{"name": "app", "tests": ["b", "c"]}`},
+		//objects are merged recursively
+		{`{"env": {"A": "1", "B": "2"}}`, `{"env": {"B": "3", "C": "4"}}`,
+			`{"env": {"A": "1", "B": "3", "C": "4"}}`},
+		//names don't depend on case
+		{`{"Env": {"A": "1"}}`, `{"env": {"a": "2"}}`,
+			`{"Env": {"a": "2"}}`},
+		{`{"env": "x"}`, `{"env": {"A": "1"}}`,
+			`{"env": {"A": "1"}}`},
+		//dependencies are merged by name, new ones appended
+		{`{"depends": [{"name": "utils", "git": "u", "branch": "dev"}, {"name": "zlib", "git": "z"}]}`,
+			`{"Depends": [{"name": "UTILS", "path": "../utils", "branch": "main"}, {"name": "png", "git": "p"}]}`,
+			`{"depends": [{"name": "UTILS", "git": "u", "branch": "main", "path": "../utils"}, {"name": "zlib", "git": "z"}, {"name": "png", "git": "p"}]}`},
+		{`{"name": "app"}`, `{"depends": [{"name": "a"}]}`,
+			`{"name": "app", "depends": [{"name": "a"}]}`},
+	}
+	decode := func(s string) map[string]any {
+		var m map[string]any
+		if err := json.Unmarshal([]byte(s), &m); err != nil {
+			t.Fatalf("cannot parse %s - %v", s, err)
+		}
+		return m
+	}
+	for _, tt := range tests {
+		base := decode(tt.base)
+		merge_objects(base, decode(tt.over))
+		if want := decode(tt.want); !reflect.DeepEqual(base, want) {
+			got, _ := json.Marshal(base)
+			t.Errorf("merge %s over %s\n got %s\nwant %s", tt.over, tt.base, got, tt.want)
+		}
+	}
+}
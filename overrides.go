@@ -0,0 +1,156 @@
+package main
+
+/*
+  Dependency overrides.
+
+  The 'overrides' object of the root descriptor replaces attributes of any
+  dependency, wherever it is declared in the dependency graph. It maps
+  package names to the replaced attributes:
+    "overrides": {
+      "utpp": {"git": "git@github.com:me/utpp.git", "branch": "fix-leak"},
+      "zlib": {"build": [{"cmd": "make", "args": ["-j4"]}]}
+    }
+  - 'git' or 'https': repository URL. Other repository attributes of the
+    dependency (hg, svn, archive, artifact, Perforce depot) are dropped;
+  - 'branch': branch or tag. Version constraints are dropped;
+  - 'build': build commands, used instead of the commands in the package
+    descriptor.
+  Expected commit and tree hashes are dropped when the repository or branch
+  is overridden.
+
+  When the repository of a package is overridden, the 'origin' remote of an
+  existing clone is changed to the new URL. It is changed back when the
+  override is removed.
+
+  The 'replace' object of the root descriptor maps package names to local
+  folders, relative to the root package folder, like Go's 'replace'
+  directive:
+    "replace": {"utpp": "../utpp-fix"}
+  Replaced packages become local packages (like dependencies with a 'path'
+  attribute): they are taken from the folder and never fetched.
+*/
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Attributes of a dependency replaced by the root package
+type PackageOverride struct {
+	Git    string
+	Https  string
+	Branch string
+	Build  []Command
+}
+
+// Return override of a package or nil if it is not overridden
+func find_override(name string) *PackageOverride {
+	if len(all_packs) == 0 {
+		return nil
+	}
+	for n, o := range all_packs[0].Overrides {
+		if strings.EqualFold(n, name) {
+			return &o
+		}
+	}
+	return nil
+}
+
+// Return local folder replacing a package or "" if it is not replaced
+func find_replace(name string) string {
+	if len(all_packs) == 0 {
+		return ""
+	}
+	for n, dir := range all_packs[0].Replace {
+		if strings.EqualFold(n, name) && dir != "" {
+			if !filepath.IsAbs(dir) {
+				dir = filepath.Join(package_dir(all_packs[0]), dir)
+			}
+			return filepath.Clean(dir)
+		}
+	}
+	return ""
+}
+
+// Descriptor attributes of a dependency cleared by clear_repository
+var repository_attributes = []string{"git", "https", "hg", "svn", "path", "archive", "sha256", "repository",
+	"artifact", "registry", "provider", "source", "p4port", "depot", "changelist", "commit", "tree"}
+
+// Clear repository attributes of a dependency
+func clear_repository(d *DependencyDescriptor) {
+	d.Git, d.Https, d.Hg, d.Svn, d.Path = "", "", "", "", ""
+	d.Archive, d.Sha256, d.Repository, d.Artifact = "", "", "", ""
+	d.Registry, d.Provider, d.Source = "", "", ""
+	d.P4Port, d.Depot, d.Changelist = "", "", 0
+	d.Commit, d.Tree = "", ""
+}
+
+// Replace attributes of dependency d of package p with those from the
+// root overrides and replacements
+func apply_override(p *PacUnit, d *DependencyDescriptor) {
+	if strings.EqualFold(d.Name, all_packs[0].Name) {
+		return
+	}
+	if dir := find_replace(d.Name); dir != "" {
+		Verbosef("Package %s - dependency %s - replaced by %s\n", p.Name, d.Name, dir)
+		clear_repository(d)
+		d.Path, d.Branch, d.Version = dir, "", ""
+		return
+	}
+	o := find_override(d.Name)
+	if o == nil {
+		return
+	}
+	if o.Git != "" || o.Https != "" {
+		Verbosef("Package %s - dependency %s - repository overridden by root package\n", p.Name, d.Name)
+		clear_repository(d)
+		d.Git, d.Https = o.Git, o.Https
+	}
+	if o.Branch != "" {
+		Verbosef("Package %s - dependency %s - branch %s from root overrides\n", p.Name, d.Name, o.Branch)
+		d.Branch, d.Version = o.Branch, ""
+		d.Commit, d.Tree = "", ""
+	}
+}
+
+// Replace build commands of a package with those from the root overrides
+func override_build(p *PacUnit) {
+	if p == all_packs[0] {
+		return
+	}
+	if o := find_override(p.Name); o != nil && len(o.Build) != 0 {
+		Verbosef("Package %s - build commands overridden by root package\n", p.Name)
+		p.Build, p.Builds = o.Build, nil
+	}
+}
+
+// Point the 'origin' remote of a git clone to the overridden repository
+// or restore it after the override was removed. Branches of the overridden
+// repository are fetched so that they can be switched to.
+func sync_origin(p *PacUnit, dir string) {
+	uri := package_uri(p.Git, p.Https)
+	out, err := Output("git", "-C", dir, "remote", "get-url", "origin")
+	if err != nil || uri == "" {
+		return
+	}
+	origin := strings.TrimSpace(out)
+	marked, _ := Output("git", "-C", dir, "config", "--get", "cpm.override")
+	o := find_override(p.Name)
+	if o != nil && (o.Git != "" || o.Https != "") {
+		if origin != uri {
+			fmt.Printf("Package %s - origin changed to %s (root overrides)\n", p.Name, uri)
+			Run("git", []string{"-C", dir, "remote", "set-url", "origin", uri})
+			Run("git", []string{"-C", dir, "config", "cpm.override", "true"})
+		}
+	} else if strings.TrimSpace(marked) == "true" {
+		if origin != uri {
+			fmt.Printf("Package %s - origin restored to %s\n", p.Name, uri)
+			Run("git", []string{"-C", dir, "remote", "set-url", "origin", uri})
+		}
+		Run("git", []string{"-C", dir, "config", "--unset", "cpm.override"})
+	} else {
+		return
+	}
+	vcs_fetch(dir, "git", "Fetching "+dir, "-C", dir, "fetch", "origin")
+}
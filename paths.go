@@ -0,0 +1,51 @@
+package main
+
+/*
+  Development trees on network shares and long paths.
+
+  DEV_ROOT can be a UNC path (\\server\share\dev) or a folder on a mapped
+  network drive. Such shares often don't allow symbolic links; if so, CPM
+  falls back to copies (see links.go).
+
+  On Windows, Git repositories are cloned with 'core.longpaths' enabled so
+  that files with paths longer than 260 characters can be checked out.
+  Files that CPM copies or links itself use the extended-length form of
+  their paths ('\\?\' prefix) when they are too long. The Go runtime does
+  it for local paths, but not for UNC paths.
+*/
+
+import (
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Longest path usable without the extended-length prefix. Folders cannot
+// use the last 12 characters of MAX_PATH (260).
+const max_short_path = 248
+
+// Return true if path is a UNC path
+func is_unc(path string) bool {
+	return runtime.GOOS == "windows" && (strings.HasPrefix(path, `\\`) || strings.HasPrefix(path, "//"))
+}
+
+// Git options used when cloning
+func clone_options() []string {
+	if runtime.GOOS == "windows" {
+		return []string{"--config", "core.longpaths=true"}
+	}
+	return nil
+}
+
+// Return the extended-length form of an absolute path that is too long for
+// Windows file functions. Other paths are returned unchanged.
+func long_path(path string) string {
+	if runtime.GOOS != "windows" || len(path) < max_short_path || strings.HasPrefix(path, `\\?\`) || !filepath.IsAbs(path) {
+		return path
+	}
+	path = filepath.Clean(path)
+	if strings.HasPrefix(path, `\\`) {
+		return `\\?\UNC\` + path[2:]
+	}
+	return `\\?\` + path
+}
@@ -0,0 +1,190 @@
+package main
+
+/*
+  Perforce (Helix Core) packages.
+
+  A dependency with 'p4Port' and 'depot' attributes is synced from a
+  Perforce server instead of being cloned:
+    {"name": "zlib", "p4Port": "ssl:perforce:1666", "depot": "//3rdparty/zlib",
+     "changelist": 12345}
+  CPM creates a client workspace rooted in the package folder, with a view
+  mapping the depot path, and syncs it to the changelist given by the
+  'changelist' attribute or to the head revision. The workspace is named
+  'cpm_<host>_<package>_<hash>', where the hash comes from the package
+  folder, so that development trees on the same host don't share it.
+  The server and client name are kept in the '.p4' file of the package
+  folder, used as P4CONFIG file, so that p4 commands run in the folder use
+  the workspace.
+
+  The lockfile records the changelist of Perforce packages. Authentication
+  uses the usual P4USER, P4PASSWD or ticket settings. The 'p4' program must
+  be in the path.
+*/
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const p4_config = ".p4" //P4CONFIG file of package workspaces
+
+type p4_vcs struct{}
+
+// Provider of Perforce packages
+type p4_provider struct {
+	vcs_provider
+}
+
+// Stop if a Perforce dependency has attributes of other repositories
+func (p4_provider) Check(p *PacUnit, d *DependencyDescriptor) {
+	if d.P4Port == "" && d.Depot == "" {
+		if d.Changelist != 0 {
+			log.Fatalf("Package %s - dependency %s has a changelist but no Perforce depot", p.Name, d.Name)
+		}
+		return
+	}
+	if d.P4Port == "" || d.Depot == "" {
+		log.Fatalf("Package %s - dependency %s must have both p4Port and depot attributes", p.Name, d.Name)
+	}
+	if d.Git != "" || d.Https != "" || d.Hg != "" || d.Svn != "" || d.Archive != "" {
+		log.Fatalf("Package %s - dependency %s has more than one repository", p.Name, d.Name)
+	}
+	if d.Branch != "" || d.Version != "" || d.Commit != "" || d.Tree != "" || d.Shallow || d.Depth != 0 || len(d.SparsePaths) != 0 {
+		log.Fatalf("Package %s - dependency %s - branch, version, commit, tree, shallow, depth and sparsePaths attributes are not available for Perforce depots",
+			p.Name, d.Name)
+	}
+	if !strings.HasPrefix(d.Depot, "//") {
+		log.Fatalf("Package %s - dependency %s - depot path %s must start with //", p.Name, d.Name, d.Depot)
+	}
+}
+
+// Return name of client workspace of a package
+func p4_client(p *PacUnit) string {
+	host, _ := os.Hostname()
+	dir, _ := filepath.Abs(package_dir(p))
+	sum := sha256.Sum256([]byte(dir))
+	name := regexp.MustCompile(`[^A-Za-z0-9_.-]`).ReplaceAllString(host+"_"+p.Name, "_")
+	return "cpm_" + name + "_" + hex.EncodeToString(sum[:4])
+}
+
+// Return environment for p4 commands run in a package folder
+func p4_env() []string {
+	return []string{"P4CONFIG=" + p4_config}
+}
+
+// Run p4 in folder dir and stop if it fails. Network operations are retried
+// after failures.
+func p4_run(dir string, what string, network bool, args ...string) {
+	Verboseln("p4", args)
+	op := func() (bool, error) {
+		stat, _, err := run_in(dir, "p4", args, p4_env())
+		if err == nil && stat != 0 {
+			err = fmt.Errorf("exit status %d", stat)
+		}
+		return network, err
+	}
+	var err error
+	if network {
+		err = with_retries(what, op)
+	} else {
+		_, err = op()
+	}
+	if err != nil {
+		log.Fatalf("%s failed \nError: %v\n", what, err)
+	}
+}
+
+// Run p4 in folder dir and return its standard output
+func p4_output(dir string, args ...string) (string, error) {
+	cmd := exec.Command("p4", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), p4_env()...)
+	out, err := cmd.Output()
+	return string(out), err
+}
+
+// Write P4CONFIG file and client specification of a package workspace
+func p4_setup(p *PacUnit, dir string) {
+	client := p4_client(p)
+	config := fmt.Sprintf("P4PORT=%s\nP4CLIENT=%s\n", p.P4Port, client)
+	if err := os.WriteFile(filepath.Join(dir, p4_config), []byte(config), 0644); err != nil {
+		log.Fatalf("Package %s - cannot write %s - %v", p.Name, filepath.Join(dir, p4_config), err)
+	}
+	spec := fmt.Sprintf("Client: %s\nRoot: %s\nOptions: allwrite clobber nocompress unlocked nomodtime rmdir\nLineEnd: local\nView:\n\t%s/... //%s/...\n",
+		client, dir, strings.TrimSuffix(p.Depot, "/"), client)
+	Verbosef("Package %s - client workspace %s\n", p.Name, client)
+	cmd := exec.Command("p4", "client", "-i")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), p4_env()...)
+	cmd.Stdin = strings.NewReader(spec)
+	cmd.Stdout, cmd.Stderr = command_output(dir)
+	if err := cmd.Run(); err != nil {
+		log.Fatalf("Package %s - cannot create client workspace %s - %v", p.Name, client, err)
+	}
+}
+
+// Return revision specifier of a package: its changelist or head revision
+func p4_revision(p *PacUnit) string {
+	if p.changelist != 0 {
+		return "...@" + strconv.Itoa(p.changelist)
+	}
+	return "...#head"
+}
+
+func (p4_vcs) Name() string { return "p4" }
+
+func (p4_vcs) Uri(p *PacUnit) string { return p.P4Port + p.Depot }
+
+func (p4_vcs) Clone(p *PacUnit, dir string) {
+	Verbosef("Syncing: %s in %s\n", p.Name, dir)
+	p4_setup(p, dir)
+	p4_run(dir, "Package "+p.Name+" - syncing", true, "sync", p4_revision(p))
+}
+
+func (p4_vcs) Update(p *PacUnit, dir string) {
+	p4_setup(p, dir)
+	if *locked_flag && p != all_packs[0] {
+		//changelist from lockfile is synced later
+		return
+	}
+	args := []string{"sync"}
+	if *force_flag {
+		args = append(args, "-f")
+	}
+	p4_run(dir, "Syncing "+dir, true, append(args, p4_revision(p))...)
+}
+
+func (p4_vcs) Revision(dir string) (string, error) {
+	out, err := p4_output(dir, "changes", "-m1", "...#have")
+	if err != nil {
+		return "", err
+	}
+	//output is like: Change 12345 on 2024/01/31 by user@client 'description'
+	fields := strings.Fields(out)
+	if len(fields) < 2 || fields[0] != "Change" {
+		return "", fmt.Errorf("no changelist synced in %s", dir)
+	}
+	return fields[1], nil
+}
+
+func (p4_vcs) Branch(dir string) string { return "" }
+
+func (p4_vcs) Checkout(dir string, rev string) {
+	if *local_flag {
+		log.Fatalf("Fatal - local-only mode and %s cannot be synced to changelist %s", dir, rev)
+	}
+	p4_run(dir, "Syncing "+dir+" to changelist "+rev, true, "sync", "...@"+rev)
+}
+
+func (p4_vcs) Modified(dir string) bool {
+	out, _ := p4_output(dir, "reconcile", "-n", "-m", "...")
+	return out != ""
+}
@@ -0,0 +1,103 @@
+package main
+
+/*
+  pkg-config files.
+
+  If a descriptor has a 'pkgConfig' object, after the package is built CPM
+  writes a '<package>.pc' file in the 'pkgconfig' subfolder of the shared
+  'lib' folder. Autotools and Meson projects can then find the package with
+  PKG_CONFIG_PATH set to that folder.
+
+  The file has the include folder of the package and, if the package has a
+  library in the 'lib' folder, a '-l<package>' flag. Additional flags come
+  from the 'cflags' and 'libs' attributes. Dependencies that also have
+  pkg-config files are listed as required packages ('Requires.private' for
+  private dependencies).
+*/
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// pkg-config metadata of a package
+type PkgConfig struct {
+	Description string
+	Version     string
+	Cflags      []string
+	Libs        []string
+}
+
+// Return folder of generated pkg-config files
+func pkgconfig_dir() string {
+	return filepath.Join(lib_dir(), "pkgconfig")
+}
+
+// Write pkg-config file of a package. The file is rewritten only if its
+// content changes.
+func generate_pkgconfig(p *PacUnit) {
+	if p.PkgConfig == nil {
+		return
+	}
+	dir := package_dir(p)
+	pc := p.PkgConfig
+	version := pc.Version
+	if version == "" {
+		version = strings.TrimPrefix(package_version(dir), "v")
+	}
+	if version == "" {
+		version = "0"
+	}
+	description := pc.Description
+	if description == "" {
+		description = p.Name + " package"
+	}
+	var requires, private []string
+	for _, d := range p.Depends {
+		if d.FetchOnly || d.pack == nil || d.pack.PkgConfig == nil {
+			continue
+		}
+		if d.Private {
+			private = append(private, d.Name)
+		} else {
+			requires = append(requires, d.Name)
+		}
+	}
+	libs := []string{"-L${libdir}"}
+	if len(package_libs(lib_dir(), p.Name)) != 0 {
+		libs = append(libs, "-l"+p.Name)
+	}
+	libs = append(libs, pc.Libs...)
+	cflags := append([]string{"-I${includedir}"}, pc.Cflags...)
+
+	var b bytes.Buffer
+	b.WriteString("# Generated by CPM - do not edit\n")
+	fmt.Fprintf(&b, "prefix=%s\n", filepath.ToSlash(dir))
+	b.WriteString("includedir=${prefix}/include\n")
+	fmt.Fprintf(&b, "libdir=%s\n\n", filepath.ToSlash(lib_dir()))
+	fmt.Fprintf(&b, "Name: %s\n", p.Name)
+	fmt.Fprintf(&b, "Description: %s\n", description)
+	fmt.Fprintf(&b, "Version: %s\n", version)
+	if len(requires) != 0 {
+		fmt.Fprintf(&b, "Requires: %s\n", strings.Join(requires, ", "))
+	}
+	if len(private) != 0 {
+		fmt.Fprintf(&b, "Requires.private: %s\n", strings.Join(private, ", "))
+	}
+	fmt.Fprintf(&b, "Libs: %s\n", strings.Join(libs, " "))
+	fmt.Fprintf(&b, "Cflags: %s\n", strings.Join(cflags, " "))
+
+	fname := filepath.Join(pkgconfig_dir(), p.Name+".pc")
+	if old, err := os.ReadFile(fname); err == nil && bytes.Equal(old, b.Bytes()) {
+		return
+	}
+	os.MkdirAll(pkgconfig_dir(), 0755)
+	if err := os.WriteFile(fname, b.Bytes(), 0644); err != nil {
+		warn("generated-file", "cannot write %s - %v", fname, err)
+		return
+	}
+	Verboseln("Generated", fname)
+}
@@ -0,0 +1,79 @@
+package main
+
+/*
+  External providers.
+
+  Packages kept in systems CPM doesn't know can be fetched by external
+  programs, loaded at run time like plugins. A dependency with a 'provider'
+  attribute names a provider set up in the configuration file and its
+  'source' attribute tells the program what to fetch:
+    {"name": "zlib", "provider": "vault", "source": "3rdparty/zlib@1.3.1"}
+  with:
+    provider.vault.command = /opt/vault/cpm-fetch
+  To fetch the package, CPM runs:
+    <command> fetch <source> <package folder>
+  with the CPM_PACKAGE environment variable set to the package name and
+  CPM_BRANCH to its 'branch' attribute, if any. The program creates or
+  updates the package folder and must exit with status 0. Its output goes
+  to the package log.
+
+  CPM doesn't know the revision of these packages: they are not recorded in
+  the lockfile or in bundles and are fetched again on every run.
+*/
+
+import (
+	"log"
+	"os"
+)
+
+// Provider of packages fetched by an external program
+type plugin_provider struct{}
+
+func (plugin_provider) Name() string { return "plugin" }
+
+func (plugin_provider) Handles(p *PacUnit) bool { return p.provider != "" }
+
+// Stop if a dependency fetched by an external program has other repository
+// attributes or if the program is not configured
+func (plugin_provider) Check(p *PacUnit, d *DependencyDescriptor) {
+	if d.Provider == "" {
+		if d.Source != "" {
+			log.Fatalf("Package %s - dependency %s has a source but no provider", p.Name, d.Name)
+		}
+		return
+	}
+	if d.Source == "" {
+		log.Fatalf("Package %s - dependency %s must have both provider and source attributes", p.Name, d.Name)
+	}
+	if d.Git != "" || d.Https != "" || d.Hg != "" || d.Svn != "" || d.P4Port != "" || d.Depot != "" ||
+		d.Archive != "" || d.Path != "" || d.Repository != "" || d.Registry != "" {
+		log.Fatalf("Package %s - dependency %s has more than one repository", p.Name, d.Name)
+	}
+	if d.Version != "" || d.Commit != "" || d.Tree != "" || d.Shallow || d.Depth != 0 || len(d.SparsePaths) != 0 {
+		log.Fatalf("Package %s - dependency %s - version, commit, tree, shallow, depth and sparsePaths attributes are not available for external providers",
+			p.Name, d.Name)
+	}
+	plugin_command(d.Provider)
+}
+
+// Run the program of the provider to fetch a package in folder dir
+func (plugin_provider) Fetch(p *PacUnit, dir string) {
+	prog := plugin_command(p.provider)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Fatalf("Fatal - cannot create folder %s - %v", dir, err)
+	}
+	env := []string{"CPM_PACKAGE=" + p.Name, "CPM_BRANCH=" + p.Branch}
+	Verbosef("Package %s - fetching %s with %s\n", p.Name, p.source, prog)
+	if stat, _, err := run_in(dir, prog, []string{"fetch", p.source, dir}, env); err != nil || stat != 0 {
+		log.Fatalf("Fatal - Package %s - provider %s failed. Status %d Error: %v", p.Name, p.provider, stat, err)
+	}
+}
+
+// Return program of a configured external provider
+func plugin_command(name string) string {
+	prog := config_get("provider."+name+".command", "")
+	if prog == "" {
+		log.Fatalf("Fatal - provider %s is not configured. Set 'provider.%s.command' in the configuration file", name, name)
+	}
+	return prog
+}
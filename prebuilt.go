@@ -0,0 +1,151 @@
+package main
+
+/*
+  Prebuilt binaries.
+
+  A dependency can list prebuilt binaries for some platforms in its
+  'prebuilt' attribute. Platforms are named '<os>-<arch>' or '<os>', using
+  Go names (linux-amd64, darwin-arm64, windows), or '<target>[-<variant>]'
+  when a build target is selected (see target.go):
+    {"name": "zlib", "git": "https://github.com/madler/zlib.git", "branch": "v1.3.1",
+     "prebuilt": {
+       "linux-amd64": {"url": "https://example.com/zlib-1.3.1-linux-x64.tar.gz", "sha256": "..."},
+       "windows": {"url": "https://example.com/zlib-1.3.1-win64.zip", "sha256": "...",
+                   "include": "sdk/include", "lib": "sdk/lib/x64"}}}
+  If there is a binary for the current platform, CPM downloads and verifies
+  the archive, extracts it in '<devroot>/.cpm/prebuilt/<name>' and installs
+  it instead of fetching and building the sources: the package folder gets
+  an 'include' link to the headers folder of the archive ('include' by
+  default) and, when the package would be built, the files in the libraries
+  folder of the archive ('lib' by default) are copied to the 'lib' folder.
+  Packages without a binary for the platform, or all packages with the
+  '--no-prebuilt' option, are fetched and built from sources as usual.
+
+  A prebuilt package has no descriptor; its own dependencies, if any, must
+  be declared by its consumers.
+*/
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+var no_prebuilt = flag.Bool("no-prebuilt", false, "build all packages from sources")
+
+// Prebuilt binaries of a package for a platform
+type PrebuiltBinary struct {
+	Url     string
+	Sha256  string
+	Include string //headers folder in the archive
+	Lib     string //libraries folder in the archive
+}
+
+// Provider of packages installed from prebuilt binaries
+type prebuilt_provider struct{}
+
+func (prebuilt_provider) Name() string { return "prebuilt" }
+
+func (prebuilt_provider) Handles(p *PacUnit) bool { return p.prebuilt != nil }
+
+// Stop if a prebuilt binary doesn't have an URL or has an invalid layout
+func (prebuilt_provider) Check(p *PacUnit, d *DependencyDescriptor) {
+	for platform, b := range d.Prebuilt {
+		if b.Url == "" {
+			log.Fatalf("Package %s - dependency %s - prebuilt binary for %s has no url", p.Name, d.Name, platform)
+		}
+		for _, dir := range []string{b.Include, b.Lib} {
+			if dir != "" && (filepath.IsAbs(dir) || !filepath.IsLocal(dir)) {
+				log.Fatalf("Package %s - dependency %s - prebuilt binary for %s - folder %s must be relative to the archive",
+					p.Name, d.Name, platform, dir)
+			}
+		}
+	}
+}
+
+// Download and extract the binaries and link the headers folder in the
+// package folder
+func (prebuilt_provider) Fetch(p *PacUnit, dir string) {
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) != 0 && load_archive_state(dir) == nil {
+		log.Fatalf("Fatal - Package %s - folder %s exists and was not installed from prebuilt binaries. Remove it or use the '--no-prebuilt' option",
+			p.Name, dir)
+	}
+	b := p.prebuilt
+	src := prebuilt_dir(p)
+	os.MkdirAll(filepath.Dir(src), 0755)
+	fetch_archive(&PacUnit{Name: p.Name, path: src, archive: b.Url, sha256: b.Sha256})
+
+	os.MkdirAll(filepath.Join(dir, ".cpm"), 0755)
+	if include := filepath.Join(src, prebuilt_folder(b.Include, "include")); is_dir(include) {
+		Symlink(include, filepath.Join(dir, "include"))
+	} else {
+		Verbosef("Package %s - prebuilt binaries don't have headers\n", p.Name)
+	}
+	//record the archive, like for archive packages
+	if st := load_archive_state(src); st != nil {
+		data, _ := json.MarshalIndent(st, "", "  ")
+		os.WriteFile(filepath.Join(dir, archive_state_name), data, 0644)
+	}
+}
+
+// Return folder where the prebuilt binaries of a package are extracted
+func prebuilt_dir(p *PacUnit) string {
+	return filepath.Join(devroot, ".cpm", "prebuilt", p.Name)
+}
+
+// Return a layout folder of prebuilt binaries or def if it is not given
+func prebuilt_folder(dir string, def string) string {
+	if dir == "" {
+		return def
+	}
+	return filepath.FromSlash(dir)
+}
+
+// Return true if path is a folder
+func is_dir(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.IsDir()
+}
+
+// Return platforms of prebuilt binaries usable in this run, most specific
+// first
+func prebuilt_platforms() []string {
+	if target_name != "" {
+		if target_variant != "" {
+			return []string{target_name + "-" + target_variant, target_name}
+		}
+		return []string{target_name}
+	}
+	return []string{runtime.GOOS + "-" + runtime.GOARCH, runtime.GOOS}
+}
+
+// Return prebuilt binaries of a dependency for this platform or nil if the
+// dependency must be built from sources
+func select_prebuilt(p *PacUnit, d *DependencyDescriptor) *PrebuiltBinary {
+	if *no_prebuilt || len(d.Prebuilt) == 0 {
+		return nil
+	}
+	for _, platform := range prebuilt_platforms() {
+		if b, ok := d.Prebuilt[platform]; ok {
+			Verbosef("Package %s - dependency %s - using prebuilt binaries for %s\n", p.Name, d.Name, platform)
+			return &b
+		}
+	}
+	Verbosef("Package %s - dependency %s - no prebuilt binaries for %s. Building from sources\n", p.Name, d.Name, prebuilt_platforms()[0])
+	return nil
+}
+
+// Copy libraries of a prebuilt package to the lib folder
+func install_prebuilt(p *PacUnit) {
+	src := filepath.Join(prebuilt_dir(p), prebuilt_folder(p.prebuilt.Lib, "lib"))
+	if !is_dir(src) {
+		Verbosef("Package %s - prebuilt binaries don't have libraries\n", p.Name)
+		return
+	}
+	Verbosef("Package %s - installing prebuilt libraries from %s\n", p.Name, src)
+	os.MkdirAll(lib_dir(), 0755)
+	sync_tree(src, lib_dir(), false)
+}
@@ -0,0 +1,270 @@
+package main
+
+/*
+  Problem matchers.
+
+  Build output written to package logs is normalized: color escape
+  sequences are removed, CR-LF line endings become LF and, for lines
+  rewritten with carriage returns (like progress indicators), only the
+  final text is kept.
+
+  Diagnostics of well-known compilers and linkers are then parsed from the
+  output into problems with file, line, column, severity, code and message:
+  - GCC and Clang: 'file:line:col: error: message', 'gcc: fatal error: ...';
+  - GNU ld and LLD: 'ld: error: message', '/usr/bin/ld: file.o: undefined
+    reference to ...';
+  - MSVC compiler and linker: 'file(line,col): error C2065: message',
+    'file.obj : error LNK2019: message'.
+  Warning options and clang-tidy checks at the end of GCC and Clang messages,
+  like '[-Wunused-variable]' or '[bugprone-use-after-move]', are used as
+  problem codes. The same problem reported by several commands or packages,
+  like a warning in a shared header, is listed once. Problems are included
+  in the JSON report (see output.go) and summarized at the end of the run or
+  in the failure summary.
+*/
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const summary_problems = 50 //problems shown in summaries
+
+// Diagnostic found in build output
+type Problem struct {
+	Package  string `json:"package"` //package where the problem was first seen
+	File     string `json:"file,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+	Severity string `json:"severity"` //"error" or "warning"
+	Code     string `json:"code,omitempty"`
+	Message  string `json:"message"`
+	Count    int    `json:"count"` //times the problem was reported
+}
+
+// Pattern of a diagnostic. Indexes of submatches are 0 if not present.
+type problem_matcher struct {
+	re                                 *regexp.Regexp
+	file, line, column, severity, code int
+	message                            int
+}
+
+var problem_matchers = []problem_matcher{
+	//MSVC compiler: main.cpp(12,5): error C2065: 'x': undeclared identifier
+	{regexp.MustCompile(`^\s*(.+?)\((\d+)(?:,(\d+))?\)\s*:\s+(fatal error|error|warning)\s+([A-Z]+\d+)\s*:\s*(.*)$`), 1, 2, 3, 4, 5, 6},
+	//MSVC linker and tools: main.obj : error LNK2019: unresolved external symbol
+	{regexp.MustCompile(`^\s*(.+?)\s*:\s+(?:Command line )?(fatal error|error|warning)\s+([A-Z]+\d+)\s*:\s*(.*)$`), 1, 0, 0, 2, 3, 4},
+	//GCC and Clang: main.c:12:5: error: 'x' undeclared
+	{regexp.MustCompile(`^(.+?):(\d+):(?:(\d+):)?\s+(fatal error|error|warning):\s+(.*)$`), 1, 2, 3, 4, 0, 5},
+	//GCC and Clang drivers: gcc: fatal error: no input files
+	{regexp.MustCompile(`^(?:\S*[/\\])?(?:gcc|g\+\+|cc|c\+\+|cc1|cc1plus|clang|clang\+\+)(?:-[\d.]+)?(?:\.exe)?: (fatal error|error|warning): (.*)$`), 0, 0, 0, 1, 0, 2},
+	//GNU ld and LLD: /usr/bin/ld: main.o: undefined reference to `foo'
+	{regexp.MustCompile(`^(?:\S*[/\\])?(?:ld|ld\.bfd|ld\.gold|ld\.lld|lld|lld-link)(?:\.exe)?: (?:(error|warning): )?(.*)$`), 0, 0, 0, 1, 0, 2},
+}
+
+var problem_code = regexp.MustCompile(`^(.*?)\s+\[([-\w.,=+]+)\]$`)
+
+var ansi_escape = regexp.MustCompile(`\x1b\[[0-9;?]*[A-Za-z]`)
+
+var problems []*Problem
+var problem_index = make(map[string]*Problem)               //deduplication key -> problem
+var package_problems = make(map[string]map[string]*Problem) //package -> problems in its build output
+var problems_mutex sync.Mutex
+
+// Writer that normalizes build output of a package and collects the
+// problems in it. It receives complete lines, except for the last one.
+type problem_writer struct {
+	w    io.Writer
+	pack string
+}
+
+func (pw *problem_writer) Write(p []byte) (int, error) {
+	text := normalize_output(string(p))
+	for _, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		match_problem(pw.pack, line)
+	}
+	if _, err := io.WriteString(pw.w, text); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Remove color escape sequences and carriage returns from command output
+func normalize_output(s string) string {
+	s = ansi_escape.ReplaceAllString(s, "")
+	if !strings.Contains(s, "\r") {
+		return s
+	}
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		line = strings.TrimRight(line, "\r")
+		if n := strings.LastIndexByte(line, '\r'); n >= 0 {
+			line = line[n+1:]
+		}
+		lines[i] = line
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Record the problem in a line of build output of package pack, if any
+func match_problem(pack string, line string) {
+	for _, m := range problem_matchers {
+		sub := m.re.FindStringSubmatch(line)
+		if sub == nil {
+			continue
+		}
+		p := &Problem{Package: pack, Message: strings.TrimSpace(sub[m.message])}
+		p.Severity = "error"
+		if m.severity != 0 && sub[m.severity] == "warning" {
+			p.Severity = "warning"
+		}
+		if m.file != 0 {
+			p.File = problem_file(pack, sub[m.file])
+		}
+		if m.line != 0 {
+			p.Line, _ = strconv.Atoi(sub[m.line])
+		}
+		if m.column != 0 {
+			p.Column, _ = strconv.Atoi(sub[m.column])
+		}
+		if m.code != 0 {
+			p.Code = sub[m.code]
+		} else if c := problem_code.FindStringSubmatch(p.Message); c != nil {
+			//GCC, Clang and clang-tidy append the warning option or check name
+			p.Message, p.Code = c[1], c[2]
+		}
+		//MSBuild appends the project to diagnostics
+		if i := strings.LastIndex(p.Message, " ["); i > 0 && strings.HasSuffix(p.Message, "proj]") {
+			p.Message = p.Message[:i]
+		}
+		//context lines, like "in function 'main':", are not problems
+		if p.Message == "" || strings.HasSuffix(p.Message, ":") && m.line == 0 && m.code == 0 {
+			return
+		}
+		add_problem(p)
+		return
+	}
+}
+
+// Return file name of a problem, relative to the development tree if the
+// file is in it. Relative names are relative to the folder of package pack,
+// where its build commands run.
+func problem_file(pack string, fname string) string {
+	fname = strings.TrimSpace(fname)
+	if p := find_pack(pack); p != nil && !filepath.IsAbs(fname) {
+		fname = filepath.Join(package_dir(p), fname)
+	}
+	if filepath.IsAbs(fname) {
+		if rel, err := filepath.Rel(devroot, fname); err == nil && !strings.HasPrefix(rel, "..") {
+			return rel
+		}
+	}
+	return fname
+}
+
+// Record a problem or count it again if it was already recorded
+func add_problem(p *Problem) {
+	key := fmt.Sprintf("%s|%s|%d|%d|%s|%s", p.Severity, p.File, p.Line, p.Column, p.Code, p.Message)
+	problems_mutex.Lock()
+	defer problems_mutex.Unlock()
+	if package_problems[p.Package] == nil {
+		package_problems[p.Package] = make(map[string]*Problem)
+	}
+	if q, ok := problem_index[key]; ok {
+		q.Count++
+		package_problems[p.Package][key] = q
+		return
+	}
+	p.Count = 1
+	problem_index[key] = p
+	package_problems[p.Package][key] = p
+	problems = append(problems, p)
+}
+
+// Return the distinct warnings found in the build output of a package,
+// sorted by file and line
+func package_warnings(pack string) []Problem {
+	problems_mutex.Lock()
+	defer problems_mutex.Unlock()
+	list := []Problem{}
+	for _, p := range package_problems[pack] {
+		if p.Severity == "warning" {
+			list = append(list, *p)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].File != list[j].File {
+			return list[i].File < list[j].File
+		}
+		if list[i].Line != list[j].Line {
+			return list[i].Line < list[j].Line
+		}
+		return list[i].Message < list[j].Message
+	})
+	return list
+}
+
+// Return recorded problems, errors first
+func sorted_problems() []Problem {
+	problems_mutex.Lock()
+	defer problems_mutex.Unlock()
+	list := make([]Problem, 0, len(problems))
+	for _, p := range problems {
+		list = append(list, *p)
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Severity == "error" && list[j].Severity != "error" })
+	return list
+}
+
+// Return a problem formatted like a compiler diagnostic
+func (p Problem) String() string {
+	var s strings.Builder
+	if p.File != "" {
+		s.WriteString(p.File)
+		if p.Line != 0 {
+			fmt.Fprintf(&s, ":%d", p.Line)
+			if p.Column != 0 {
+				fmt.Fprintf(&s, ":%d", p.Column)
+			}
+		}
+		s.WriteString(": ")
+	}
+	s.WriteString(p.Severity)
+	if p.Code != "" {
+		s.WriteString(" " + p.Code)
+	}
+	fmt.Fprintf(&s, ": %s (%s", p.Message, p.Package)
+	if p.Count > 1 {
+		fmt.Fprintf(&s, ", %d times", p.Count)
+	}
+	s.WriteString(")")
+	return s.String()
+}
+
+// Print the problems found in build output
+func print_problems(w io.Writer) {
+	list := sorted_problems()
+	if len(list) == 0 {
+		return
+	}
+	nerr := 0
+	for _, p := range list {
+		if p.Severity == "error" {
+			nerr++
+		}
+	}
+	fmt.Fprintf(w, "Problems: %d errors, %d warnings\n", nerr, len(list)-nerr)
+	for i, p := range list {
+		if i == summary_problems {
+			fmt.Fprintf(w, "  ... and %d more in the package logs\n", len(list)-i)
+			break
+		}
+		fmt.Fprintf(w, "  %s\n", p)
+	}
+}
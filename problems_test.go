@@ -0,0 +1,36 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestRelativeProblemsOfPackages(t *testing.T) {
+	saved_root, saved_packs := devroot, all_packs
+	saved_problems, saved_index, saved_package := problems, problem_index, package_problems
+	defer func() {
+		devroot, all_packs = saved_root, saved_packs
+		problems, problem_index, package_problems = saved_problems, saved_index, saved_package
+	}()
+	devroot = t.TempDir()
+	all_packs = []*PacUnit{{Name: "app"}, {Name: "utils"}}
+	problems, problem_index, package_problems = nil, make(map[string]*Problem), make(map[string]map[string]*Problem)
+
+	line := "src/main.c:10:5: warning: unused variable 'x' [-Wunused-variable]"
+	match_problem("app", line)
+	match_problem("utils", line)
+	match_problem("utils", line)
+
+	for _, pkg := range []string{"app", "utils"} {
+		w := package_warnings(pkg)
+		if len(w) != 1 {
+			t.Fatalf("package %s - warnings %v, want 1", pkg, w)
+		}
+		if want := filepath.Join(pkg, "src", "main.c"); w[0].File != want || w[0].Package != pkg {
+			t.Errorf("package %s - warning in %s of %s, want %s", pkg, w[0].File, w[0].Package, want)
+		}
+	}
+	if len(problems) != 2 || problems[1].Count != 2 {
+		t.Errorf("problems %v, want 2 with the second reported twice", problems)
+	}
+}
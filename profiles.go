@@ -0,0 +1,113 @@
+package main
+
+/*
+  Descriptor profiles.
+
+  A descriptor can define named profiles in its 'profiles' object. Each
+  profile is a partial descriptor merged over the descriptor, like a local
+  overlay, when the profile is selected with the '--profile' option. Profiles
+  can change dependencies, branches or build commands. For example:
+
+    "profiles": {
+      "asan": {"build": [{"cmd": "cmake", "args": ["-DSANITIZE=address", "."]}]},
+      "ci": {"depends": [{"name": "utils", "branch": "develop"}]}
+    }
+
+  Several profiles can be selected, separated by commas; they are applied in
+  order. Build commands can find the selected profiles in the CPM_PROFILE
+  environment variable.
+
+  Build profiles are named sets of build commands in the 'builds' object of a
+  descriptor, like:
+
+    "builds": {
+      "debug": [{"cmd": "cmake", "args": ["--build", "build", "--config", "Debug"]}],
+      "release": [{"cmd": "cmake", "args": ["--build", "build", "--config", "Release"]}]
+    }
+
+  Selecting a profile applies to all packages: each package is built with
+  the commands of the first selected profile found in its 'builds' object or,
+  if there is none, with its 'build' commands.
+*/
+
+import (
+	"flag"
+	"os"
+	"strings"
+)
+
+var profile_flag = flag.String("profile", "", "descriptor profiles (comma separated)")
+
+// Return selected profiles
+func selected_profiles() []string {
+	var profiles []string
+	for _, name := range strings.Split(*profile_flag, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			profiles = append(profiles, name)
+		}
+	}
+	return profiles
+}
+
+// Merge selected profiles over a parsed descriptor
+func apply_profiles(desc map[string]any) {
+	defs, _ := desc[object_key(desc, "profiles")].(map[string]any)
+	for _, name := range selected_profiles() {
+		profile, ok := defs[object_key(defs, name)].(map[string]any)
+		if ok {
+			merge_objects(desc, profile)
+		}
+	}
+}
+
+// Names of profiles defined by the descriptors read so far (lowercase)
+var defined_profiles = make(map[string]bool)
+
+// Record profiles and build profiles defined by a parsed descriptor
+func record_profiles(desc map[string]any) {
+	for _, name := range descriptor_profiles(desc) {
+		defined_profiles[name] = true
+	}
+}
+
+// Return names of profiles and build profiles defined by a parsed descriptor
+// (lowercase)
+func descriptor_profiles(desc map[string]any) []string {
+	var names []string
+	for _, attr := range []string{"profiles", "builds"} {
+		defs, _ := desc[object_key(desc, attr)].(map[string]any)
+		for name := range defs {
+			names = append(names, strings.ToLower(name))
+		}
+	}
+	return names
+}
+
+// Set up environment for selected profiles
+func setup_profiles() {
+	if *profile_flag != "" {
+		os.Setenv("CPM_PROFILE", strings.Join(selected_profiles(), ","))
+	}
+}
+
+// Check that selected profiles are defined by at least one package
+func check_profiles() {
+	for _, name := range selected_profiles() {
+		if !defined_profiles[strings.ToLower(name)] {
+			warn("undefined-profile", "profile %s is not defined by any package", name)
+		}
+	}
+}
+
+// Return build commands of a package for the selected profiles
+func build_commands(p *PacUnit) []Command {
+	for _, name := range selected_profiles() {
+		for key, commands := range p.Builds {
+			if strings.EqualFold(key, name) {
+				Verbosef("Package %s - using %s build commands\n", p.Name, key)
+				return commands
+			}
+		}
+	}
+	return p.Build
+}
@@ -0,0 +1,245 @@
+package main
+
+/*
+  Progress display.
+
+  When standard output is a terminal, CPM shows one status line for each
+  package being fetched or built, with the phase, the elapsed time and a
+  spinner, instead of the interleaved output of the commands it runs:
+
+    / zlib      build   12.4s
+    - libpng    fetch    1.2s
+
+  When a package is done, its final status replaces the spinner line and
+  scrolls up with the other messages of CPM (warnings, errors), which are
+  printed above the status lines. The output of the commands run for a
+  package, during fetch and build, goes only to the package log,
+  '<devroot>/.cpm/logs/<package>.log' (see summary.go), and the failure
+  summary shows its last lines.
+
+  The '--progress' option selects the display: 'auto' (default) uses it
+  when standard output is a terminal that supports it, CPM is not verbose,
+  the JSON report is not selected and the CI environment variable is not
+  set; 'on' and 'off' force it.
+*/
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var progress_flag = flag.String("progress", "auto", "progress display (auto, on or off)")
+
+const progress_interval = 100 * time.Millisecond
+
+var spinner = []string{"|", "/", "-", "\\"}
+
+// Status line of a package
+type progress_line struct {
+	name  string
+	phase string
+	start time.Time
+}
+
+var progress struct {
+	sync.Mutex
+	active   bool
+	terminal *os.File         //standard output
+	stderr   *os.File         //standard error
+	pipe     *os.File         //write end of pipe replacing standard output and error
+	lines    []*progress_line //packages in progress
+	drawn    int              //status lines on screen
+	tick     int
+	stop     chan struct{}
+	done     sync.WaitGroup
+}
+
+// Return true if the progress display is used
+func progress_enabled() bool {
+	switch *progress_flag {
+	case "on":
+		return true
+	case "off":
+		return false
+	}
+	//auto
+	return !*verbose_flag && !json_output() && os.Getenv("CI") == "" && os.Getenv("TERM") != "dumb" &&
+		is_terminal(os.Stdout)
+}
+
+// Start the progress display if enabled. Standard output and error are
+// redirected to a pipe whose content is printed above the status lines.
+func start_progress() {
+	if !progress_enabled() {
+		return
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		Verbosef("Cannot start progress display - %v\n", err)
+		return
+	}
+	progress.Lock()
+	progress.active = true
+	progress.terminal, progress.stderr, progress.pipe = os.Stdout, os.Stderr, w
+	progress.stop = make(chan struct{})
+	progress.Unlock()
+	os.Stdout, os.Stderr = w, w
+
+	progress.done.Add(2)
+	go func() {
+		defer progress.done.Done()
+		rd := bufio.NewReader(r)
+		for {
+			line, err := rd.ReadString('\n')
+			if line != "" {
+				progress_print(line)
+			}
+			if err != nil {
+				r.Close()
+				return
+			}
+		}
+	}()
+	go func() {
+		defer progress.done.Done()
+		ticker := time.NewTicker(progress_interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-progress.stop:
+				return
+			case <-ticker.C:
+				progress.Lock()
+				progress.tick++
+				progress_redraw()
+				progress.Unlock()
+			}
+		}
+	}()
+}
+
+// Stop the progress display and restore standard output and error. Packages
+// still in progress are shown with their last phase.
+func stop_progress() {
+	progress.Lock()
+	if !progress.active {
+		progress.Unlock()
+		return
+	}
+	progress.active = false
+	os.Stdout, os.Stderr = progress.terminal, progress.stderr
+	close(progress.stop)
+	progress.pipe.Close()
+	progress.Unlock()
+	progress.done.Wait()
+
+	progress.Lock()
+	defer progress.Unlock()
+	progress_clear()
+	for _, l := range progress.lines {
+		fmt.Fprintf(progress.terminal, "  %-20s %-7s %s (interrupted)\n", l.name, l.phase, progress_elapsed(l.start))
+	}
+	progress.lines = nil
+}
+
+// Return the writers of the output of a command run for a package: the
+// package log only while the progress display is used
+func progress_output(w io.Writer) (io.Writer, io.Writer) {
+	progress.Lock()
+	active := progress.active
+	progress.Unlock()
+	if active {
+		return w, w
+	}
+	return io.MultiWriter(os.Stdout, w), io.MultiWriter(os.Stderr, w)
+}
+
+// Show that package p entered a phase (fetch, build...)
+func progress_phase(p *PacUnit, phase string) {
+	progress.Lock()
+	defer progress.Unlock()
+	if !progress.active {
+		return
+	}
+	for _, l := range progress.lines {
+		if l.name == p.Name {
+			l.phase, l.start = phase, time.Now()
+			return
+		}
+	}
+	progress.lines = append(progress.lines, &progress_line{p.Name, phase, time.Now()})
+	progress_redraw()
+}
+
+// Show the final status of a phase of package p, like 'fetched' or 'built'
+func progress_done(p *PacUnit, status string) {
+	progress.Lock()
+	defer progress.Unlock()
+	if !progress.active {
+		return
+	}
+	for i, l := range progress.lines {
+		if l.name == p.Name {
+			progress.lines = append(progress.lines[:i], progress.lines[i+1:]...)
+			progress_clear()
+			fmt.Fprintf(progress.terminal, "  %-20s %-7s %s\n", l.name, status, progress_elapsed(l.start))
+			progress_redraw()
+			return
+		}
+	}
+}
+
+// Print a line of output above the status lines
+func progress_print(line string) {
+	progress.Lock()
+	defer progress.Unlock()
+	progress_clear()
+	io.WriteString(progress.terminal, strings.TrimSuffix(line, "\n")+"\n")
+	progress_redraw()
+}
+
+// Erase status lines. Must be called with progress locked.
+func progress_clear() {
+	if progress.drawn != 0 {
+		fmt.Fprintf(progress.terminal, "\x1b[%dA\x1b[J", progress.drawn)
+		progress.drawn = 0
+	}
+}
+
+// Draw status lines again. Must be called with progress locked.
+func progress_redraw() {
+	if !progress.active {
+		return
+	}
+	var sb strings.Builder
+	if progress.drawn != 0 {
+		fmt.Fprintf(&sb, "\x1b[%dA", progress.drawn)
+	}
+	for i, l := range progress.lines {
+		name := l.name
+		if len(name) > 20 {
+			name = name[:17] + "..."
+		}
+		fmt.Fprintf(&sb, "\x1b[2K%s %-20s %-7s %s\n", spinner[(progress.tick+i)%len(spinner)], name, l.phase, progress_elapsed(l.start))
+	}
+	if len(progress.lines) < progress.drawn {
+		sb.WriteString("\x1b[J")
+	}
+	progress.drawn = len(progress.lines)
+	io.WriteString(progress.terminal, sb.String())
+}
+
+// Return time elapsed since t, like '12.4s'
+func progress_elapsed(t time.Time) string {
+	d := time.Since(t)
+	if d < time.Minute {
+		return fmt.Sprintf("%5.1fs", d.Seconds())
+	}
+	return d.Round(time.Second).String()
+}
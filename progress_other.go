@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import "os"
+
+// Return true if f is a terminal
+func is_terminal(f *os.File) bool {
+	st, err := f.Stat()
+	return err == nil && st.Mode()&os.ModeCharDevice != 0
+}
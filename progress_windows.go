@@ -0,0 +1,27 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var proc_get_console_mode = kernel32.NewProc("GetConsoleMode")
+var proc_set_console_mode = kernel32.NewProc("SetConsoleMode")
+
+const enable_virtual_terminal_processing = 0x0004
+
+// Return true if f is a console that accepts terminal escape sequences.
+// Virtual terminal processing is enabled if needed.
+func is_terminal(f *os.File) bool {
+	var mode uint32
+	handle := syscall.Handle(f.Fd())
+	if r, _, _ := proc_get_console_mode.Call(uintptr(handle), uintptr(unsafe.Pointer(&mode))); r == 0 {
+		return false
+	}
+	if mode&enable_virtual_terminal_processing != 0 {
+		return true
+	}
+	r, _, _ := proc_set_console_mode.Call(uintptr(handle), uintptr(mode|enable_virtual_terminal_processing))
+	return r != 0
+}
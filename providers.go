@@ -0,0 +1,166 @@
+package main
+
+/*
+  Fetch providers.
+
+  Packages are brought in the development tree by providers. Each provider
+  recognizes the packages it fetches by their attributes. Providers are
+  tried in this order:
+  - 'registry': packages located through a registry index; they are
+    fetched by the provider of the location given by the registry (see
+    registry.go);
+  - 'plugin': packages fetched by external programs (see plugins.go);
+  - 'prebuilt': packages installed from prebuilt binaries (see
+    prebuilt.go);
+  - 'artifact': archives from artifact repositories (see artifact.go);
+  - 'p4': packages in Perforce depots (see perforce.go);
+  - 'path': local packages (dependencies with a 'path' attribute), which
+    are never fetched; the provider only checks that the folder exists;
+  - 'archive': packages extracted from release archives (see archive.go);
+  - 'hg' and 'svn': packages in Mercurial or Subversion repositories (see
+    vcs.go);
+  - 'git': all other packages.
+  Prebuilt binaries and artifacts set the archive URL of their packages, so
+  their providers come before the archive provider.
+
+  Other providers can be compiled in by calling register_provider from an
+  init function; they are tried before the built-in ones. A provider also
+  checks the attributes of the dependencies it handles, before they are
+  fetched.
+*/
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Source of packages
+type Provider interface {
+	Name() string
+	Handles(p *PacUnit) bool                   //true if provider fetches package p
+	Check(p *PacUnit, d *DependencyDescriptor) //stop if dependency d of package p has invalid attributes
+	Fetch(p *PacUnit, dir string)              //bring package p in folder dir
+}
+
+var providers []Provider //providers compiled in
+
+// Built-in providers, in the order they are tried
+var builtin_providers = []Provider{
+	registry_provider{},
+	plugin_provider{},
+	prebuilt_provider{},
+	artifact_provider{},
+	p4_provider{vcs_provider{p4_vcs{}}},
+	path_provider{},
+	archive_provider{},
+	vcs_provider{hg_vcs{}},
+	vcs_provider{svn_vcs{}},
+}
+
+// Add a provider. Providers are tried in registration order, before the
+// built-in ones; Git is used for packages no provider handles.
+func register_provider(pr Provider) {
+	providers = append(providers, pr)
+}
+
+// Return all providers in the order they are tried
+func all_providers() []Provider {
+	return append(slices.Clone(providers), builtin_providers...)
+}
+
+// Return provider of a package
+func package_provider(p *PacUnit) Provider {
+	return provider_of(p, "")
+}
+
+// Return provider of a package other than the provider named skip
+func provider_of(p *PacUnit, skip string) Provider {
+	for _, pr := range all_providers() {
+		if pr.Name() != skip && pr.Handles(p) {
+			return pr
+		}
+	}
+	if v := folder_vcs(filepath.Join(devroot, p.Name)); v != nil && p.Git == "" && p.Https == "" {
+		//root package without URL
+		return vcs_provider{v}
+	}
+	return vcs_provider{git_vcs{}}
+}
+
+// Check dependency attributes with all providers
+func check_dependency(p *PacUnit, d *DependencyDescriptor) {
+	for _, pr := range all_providers() {
+		pr.Check(p, d)
+	}
+	if d.IncludeAs != "" && (strings.ContainsAny(d.IncludeAs, `/\`) || !filepath.IsLocal(d.IncludeAs)) {
+		log.Fatalf("Package %s - dependency %s - includeAs '%s' must be a folder name", p.Name, d.Name, d.IncludeAs)
+	}
+}
+
+// Bring a package in the development tree
+func fetch(p *PacUnit) {
+	pr := package_provider(p)
+	Verbosef("Package %s - fetching with %s provider\n", p.Name, pr.Name())
+	pr.Fetch(p, package_dir(p))
+}
+
+// Provider of local packages
+type path_provider struct{}
+
+func (path_provider) Name() string { return "path" }
+
+func (path_provider) Handles(p *PacUnit) bool { return p.path != "" }
+
+func (path_provider) Check(p *PacUnit, d *DependencyDescriptor) {}
+
+func (path_provider) Fetch(p *PacUnit, dir string) {
+	if _, err := os.Stat(dir); err != nil {
+		log.Fatalf("Fatal - local package folder %s does not exist", dir)
+	}
+}
+
+// Provider of packages extracted from archives
+type archive_provider struct{}
+
+func (archive_provider) Name() string { return "archive" }
+
+func (archive_provider) Handles(p *PacUnit) bool { return p.archive != "" }
+
+func (archive_provider) Check(p *PacUnit, d *DependencyDescriptor) { check_archive_dependency(p, d) }
+
+func (archive_provider) Fetch(p *PacUnit, dir string) { fetch_archive(p) }
+
+// Provider of packages in version control repositories
+type vcs_provider struct {
+	Vcs
+}
+
+func (pr vcs_provider) Handles(p *PacUnit) bool { return package_vcs(p).Name() == pr.Name() }
+
+func (pr vcs_provider) Check(p *PacUnit, d *DependencyDescriptor) {
+	if (pr.Name() == "hg" && d.Hg != "") || (pr.Name() == "svn" && d.Svn != "") {
+		check_vcs_dependency(p, d)
+	}
+}
+
+func (pr vcs_provider) Fetch(p *PacUnit, dir string) {
+	release := acquire_host(pr.Uri(p))
+	defer release()
+
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		//package directory doesn't exist; create it and clone repo
+		if err := os.Mkdir(dir, 0764); err != nil {
+			log.Fatalf("error %d - cannot create folder %s", err, dir)
+		}
+		pr.Clone(p, dir)
+	} else if _, err := os.Stat(filepath.Join(dir, "."+pr.Name())); os.IsNotExist(err) {
+		//package directory exists but no repo here; clone repo
+		pr.Clone(p, dir)
+	} else {
+		//repo exists; just pull latest version
+		pr.Update(p, dir)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+/*
+  Bandwidth limiting for fetch operations.
+
+  When the '--limit-rate' option is used, CPM starts a local proxy that
+  throttles all traffic going through it. Git is directed to use this proxy
+  for HTTP(S) transfers through the 'http_proxy'/'https_proxy' environment
+  variables and for SSH transfers through an SSH 'ProxyCommand' that invokes
+  'cpm proxy-connect'. HTTP downloads made by CPM itself use the same proxy.
+*/
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var limit_rate string //value of '--limit-rate' option
+var proxy_url *url.URL
+var transferred int64 //total bytes transferred through proxy
+
+type RateLimiter struct {
+	mu   sync.Mutex
+	rate float64   //bytes per second
+	next time.Time //time when next transfer may start
+}
+
+var limiter *RateLimiter
+
+// Transport used by proxy to forward plain HTTP requests. It must not use
+// the proxy environment variables which point back to the proxy.
+var proxy_transport = &http.Transport{}
+
+// Parse a transfer rate like '500k' or '2M' (bytes per second)
+func parse_rate(rate string) (float64, error) {
+	if rate == "" {
+		return 0, fmt.Errorf("empty transfer rate")
+	}
+	s := rate
+	mult := 1.0
+	switch strings.ToLower(s[len(s)-1:]) {
+	case "k":
+		mult = 1024
+	case "m":
+		mult = 1024 * 1024
+	case "g":
+		mult = 1024 * 1024 * 1024
+	}
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || !(v > 0) || math.IsInf(v, 1) {
+		return 0, fmt.Errorf("invalid transfer rate '%s'", rate)
+	}
+	return v * mult, nil
+}
+
+// Wait until n bytes can be transferred
+func (rl *RateLimiter) wait(n int) {
+	rl.mu.Lock()
+	now := time.Now()
+	if rl.next.Before(now) {
+		rl.next = now
+	}
+	delay := rl.next.Sub(now)
+	rl.next = rl.next.Add(time.Duration(float64(n) / rl.rate * float64(time.Second)))
+	rl.mu.Unlock()
+	time.Sleep(delay)
+}
+
+// Copy data from src to dst observing the rate limit
+func throttled_copy(dst io.Writer, src io.Reader) {
+	buf := make([]byte, 16*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			limiter.wait(n)
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return
+			}
+			atomic.AddInt64(&transferred, int64(n))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Start throttling proxy and direct git to it
+func setup_rate_limit() {
+	rate, err := parse_rate(limit_rate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	limiter = &RateLimiter{rate: rate}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatalf("Cannot start rate limiting proxy - %v", err)
+	}
+	proxy_url = &url.URL{Scheme: "http", Host: ln.Addr().String()}
+	go http.Serve(ln, http.HandlerFunc(proxy_handler))
+	Verbosef("Transfer rate limited to %.0f bytes/sec through proxy %s\n", rate, proxy_url)
+
+	if os.Getenv("https_proxy") != "" || os.Getenv("HTTPS_PROXY") != "" {
+		fmt.Println("WARNING - HTTPS proxy already configured. HTTPS transfers are not rate limited.")
+	} else {
+		os.Setenv("https_proxy", proxy_url.String())
+		os.Setenv("http_proxy", proxy_url.String())
+	}
+
+	if os.Getenv("GIT_SSH_COMMAND") != "" {
+		fmt.Println("WARNING - GIT_SSH_COMMAND already set. SSH transfers are not rate limited.")
+	} else {
+		exe, _ := os.Executable()
+		exe = strings.ReplaceAll(exe, "\\", "/")
+		os.Setenv("GIT_SSH_COMMAND", fmt.Sprintf(`ssh -o ProxyCommand="'%s' proxy-connect %s %%h %%p"`, exe, proxy_url.Host))
+	}
+}
+
+func proxy_handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		//plain HTTP request
+		r.RequestURI = ""
+		resp, err := proxy_transport.RoundTrip(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(resp.StatusCode)
+		throttled_copy(w, resp.Body)
+		return
+	}
+
+	dst, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		dst.Close()
+		return
+	}
+	src, buf, err := hj.Hijack()
+	if err != nil {
+		dst.Close()
+		return
+	}
+	src.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	go func() {
+		throttled_copy(dst, buf)
+		dst.Close()
+	}()
+	throttled_copy(src, dst)
+	src.Close()
+}
+
+// Implementation of 'cpm proxy-connect <proxy> <host> <port>' used as SSH
+// ProxyCommand. Connects stdin/stdout to host:port through the proxy.
+func proxy_connect(args []string) {
+	if len(args) != 3 {
+		log.Fatal("Usage: cpm proxy-connect <proxy> <host> <port>")
+	}
+	conn, err := net.Dial("tcp", args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	target := net.JoinHostPort(args[1], args[2])
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	rd := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(rd, &http.Request{Method: http.MethodConnect})
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Fatalf("Proxy cannot connect to %s", target)
+	}
+	go func() {
+		io.Copy(conn, os.Stdin)
+		conn.Close()
+	}()
+	io.Copy(os.Stdout, rd)
+}
+
+// HTTP client for downloads. Goes through rate limiting proxy if needed.
+func http_client() *http.Client {
+	if proxy_url == nil {
+		return http.DefaultClient
+	}
+	return &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxy_url)}}
+}
+
+// Print total amount of data transferred through proxy
+func print_transfer_summary() {
+	if limiter == nil {
+		return
+	}
+	fmt.Printf("Transferred %.1f MB\n", float64(atomic.LoadInt64(&transferred))/(1024*1024))
+}
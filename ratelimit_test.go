@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		rate string
+		want float64
+	}{
+		{"100", 100},
+		{"1.5", 1.5},
+		{"500k", 500 * 1024},
+		{"500K", 500 * 1024},
+		{"2M", 2 * 1024 * 1024},
+		{"0.5m", 512 * 1024},
+		{"1g", 1024 * 1024 * 1024},
+	}
+	for _, tt := range tests {
+		got, err := parse_rate(tt.rate)
+		if err != nil {
+			t.Errorf("parse_rate(%q) - %v", tt.rate, err)
+		} else if got != tt.want {
+			t.Errorf("parse_rate(%q) = %v, want %v", tt.rate, got, tt.want)
+		}
+	}
+	for _, bad := range []string{"", "k", "0", "-5k", "10x", "1 M", "NaN", "Inf", "1e400"} {
+		if _, err := parse_rate(bad); err == nil {
+			t.Errorf("parse_rate(%q) succeeded", bad)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+/*
+  Package registries.
+
+  A registry is an index of package locations, so descriptors can name
+  dependencies without knowing where they are kept. A dependency with a
+  'registry' attribute names a registry set up in the configuration file:
+    {"name": "zlib", "registry": "corp", "version": "^1.3"}
+  with:
+    registry.corp.url = https://example.com/cpm/index.json
+  The index is a JSON object giving the location attributes of each
+  package, as in a dependency:
+    {"zlib": {"git": "https://github.com/madler/zlib.git"},
+     "fmt": {"archive": "https://example.com/fmt-11.0.2.zip", "sha256": "..."}}
+  Entries can have 'git', 'https', 'hg', 'svn', 'archive' and 'sha256'
+  attributes. The URL can also be a 'file://' URL or a file name. Indexes
+  are read once per run; credentials of artifact repositories are sent with
+  downloads from their URLs (see artifact.go).
+
+  The registry provider checks dependencies before the other providers:
+  the location of registry dependencies is completed from the index and
+  they are then fetched by the provider of that location.
+*/
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Location of a package in a registry index
+type RegistryEntry struct {
+	Git     string
+	Https   string
+	Hg      string
+	Svn     string
+	Archive string
+	Sha256  string
+}
+
+var registry_indexes = make(map[string]map[string]RegistryEntry) //registry name --> index
+var registry_mutex sync.Mutex
+
+// Provider of packages located through a registry
+type registry_provider struct{}
+
+func (registry_provider) Name() string { return "registry" }
+
+func (registry_provider) Handles(p *PacUnit) bool { return p.registry != "" }
+
+// Stop if a registry dependency has location attributes or is not in the
+// registry; otherwise complete its location from the registry
+func (registry_provider) Check(p *PacUnit, d *DependencyDescriptor) {
+	if d.Registry == "" {
+		return
+	}
+	e := registry_entry(d.Registry, d.Name)
+	if d.Git == e.Git && d.Https == e.Https && d.Hg == e.Hg && d.Svn == e.Svn && d.Archive == e.Archive {
+		//already completed
+		return
+	}
+	if d.Git != "" || d.Https != "" || d.Hg != "" || d.Svn != "" || d.P4Port != "" || d.Depot != "" ||
+		d.Archive != "" || d.Path != "" || d.Repository != "" || d.Provider != "" {
+		log.Fatalf("Package %s - dependency %s has a registry and a repository", p.Name, d.Name)
+	}
+	d.Git, d.Https, d.Hg, d.Svn, d.Archive = e.Git, e.Https, e.Hg, e.Svn, e.Archive
+	if d.Sha256 == "" {
+		d.Sha256 = e.Sha256
+	}
+}
+
+// Fetch a package with the provider of the location given by the registry
+func (registry_provider) Fetch(p *PacUnit, dir string) {
+	pr := provider_of(p, "registry")
+	Verbosef("Package %s - from registry %s, fetching with %s provider\n", p.Name, p.registry, pr.Name())
+	pr.Fetch(p, dir)
+}
+
+// Return location of a package in a registry
+func registry_entry(registry string, pkg string) RegistryEntry {
+	for name, e := range registry_index(registry) {
+		if strings.EqualFold(name, pkg) {
+			return e
+		}
+	}
+	log.Fatalf("Fatal - package %s not found in registry %s", pkg, registry)
+	return RegistryEntry{}
+}
+
+// Return index of a configured registry
+func registry_index(name string) map[string]RegistryEntry {
+	registry_mutex.Lock()
+	defer registry_mutex.Unlock()
+	if index, ok := registry_indexes[name]; ok {
+		return index
+	}
+	uri := config_get("registry."+name+".url", "")
+	if uri == "" {
+		log.Fatalf("Fatal - registry %s is not configured. Set 'registry.%s.url' in the configuration file", name, name)
+	}
+	Verbosef("Reading registry %s from %s\n", name, uri)
+	data, err := read_registry(uri)
+	var index map[string]RegistryEntry
+	if err == nil {
+		err = json.Unmarshal(data, &index)
+	}
+	if err != nil {
+		log.Fatalf("Fatal - cannot read registry %s from %s - %v", name, uri, err)
+	}
+	for pkg, e := range index {
+		if e.Git == "" && e.Https == "" && e.Hg == "" && e.Svn == "" && e.Archive == "" {
+			log.Fatalf("Fatal - registry %s - package %s has no location", name, pkg)
+		}
+	}
+	registry_indexes[name] = index
+	return index
+}
+
+// Read a registry index from an URL or a file
+func read_registry(uri string) ([]byte, error) {
+	u, err := url.Parse(uri)
+	switch {
+	case err == nil && (u.Scheme == "http" || u.Scheme == "https"):
+		var data []byte
+		err := with_retries("Reading "+uri, func() (bool, error) {
+			resp, err := http_get(uri)
+			if err == nil {
+				defer resp.Body.Close()
+				if resp.StatusCode != 200 {
+					err = http_status_error{resp.StatusCode, resp.Status}
+				} else {
+					data, err = io.ReadAll(resp.Body)
+				}
+			}
+			return transient_download(err), err
+		})
+		return data, err
+	case err == nil && u.Scheme == "file":
+		return os.ReadFile(u.Path)
+	}
+	return os.ReadFile(uri)
+}
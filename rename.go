@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Extensions of source files searched for include directives
+var source_extensions = []string{".c", ".cc", ".cpp", ".cxx", ".c++", ".m", ".mm"}
+
+// Implementation of 'cpm rename' command
+func rename(args []string) {
+	flags := flag.NewFlagSet("rename", flag.ExitOnError)
+	includes := flags.Bool("includes", false, "rewrite include directives")
+	dry_run := flags.Bool("dry-run", false, "show changes without making them")
+	pos := parse_interspersed(flags, args)
+	if len(pos) != 2 {
+		log.Fatal("Usage: cpm rename <old> <new> [--includes] [--dry-run]")
+	}
+	from, to := pos[0], pos[1]
+	olddir := filepath.Join(devroot, from)
+	newdir := filepath.Join(devroot, to)
+	if st, err := os.Stat(olddir); err != nil || !st.IsDir() {
+		log.Fatalf("Package folder %s not found", olddir)
+	}
+	if _, err := os.Lstat(newdir); err == nil {
+		log.Fatalf("Folder %s already exists", newdir)
+	}
+	consumers := find_consumers(from)
+	for _, c := range consumers {
+		if c.Dep.Path != "" {
+			log.Fatalf("Package %s is a local package of %s. Rename its folder in that repository.", from, c.Name)
+		}
+	}
+	if *dry_run {
+		fmt.Println("Dry run - nothing is changed")
+	}
+
+	//include directives
+	if *includes {
+		dirs := []string{olddir}
+		for _, c := range consumers {
+			dirs = append(dirs, filepath.Dir(c.Descriptor))
+		}
+		for _, dir := range dirs {
+			rewrite_includes(dir, from, to, *dry_run)
+		}
+	}
+
+	//headers folder of the package
+	if st, err := os.Stat(filepath.Join(olddir, "include", from)); err == nil && st.IsDir() {
+		fmt.Printf("Renaming %s to %s\n", filepath.Join(olddir, "include", from), filepath.Join("include", to))
+		if !*dry_run {
+			status, err := Run("git", []string{"-C", olddir, "mv", "include/" + from, "include/" + to})
+			if err != nil || status != 0 {
+				if err = rename_file(filepath.Join(olddir, "include", from), filepath.Join(olddir, "include", to)); err != nil {
+					log.Fatalf("Cannot rename headers folder - %v", err)
+				}
+			}
+		}
+	}
+
+	fmt.Printf("Renaming %s to %s\n", olddir, newdir)
+	if !*dry_run {
+		if err := rename_file(olddir, newdir); err != nil {
+			log.Fatalf("Cannot rename %s - %v", olddir, err)
+		}
+	}
+
+	//package own descriptor
+	fname := filepath.Join(newdir, descriptor_name)
+	if *dry_run {
+		fname = filepath.Join(olddir, descriptor_name)
+	}
+	if data, err := os.ReadFile(fname); err == nil {
+		if root, err := parse_jnodes(data); err == nil && root.get("name") != nil {
+			fmt.Printf("Updating %s\n", fname)
+			if !*dry_run {
+				os.WriteFile(fname, set_member(data, root, "name", to), 0644)
+			}
+		}
+	}
+
+	for _, c := range consumers {
+		fmt.Printf("Updating %s\n", c.Descriptor)
+		if *dry_run {
+			continue
+		}
+		err := edit_dependency(c.Descriptor, from, func(data []byte, deps *JNode, idx int) []byte {
+			return set_member(data, deps.items[idx], "name", to)
+		})
+		if err != nil {
+			fmt.Printf("WARNING - cannot update %s - %v\n", c.Descriptor, err)
+			continue
+		}
+		relink_dependency(filepath.Dir(c.Descriptor), from, to, olddir, newdir)
+	}
+
+	//indirect consumers have links to the propagated include folder
+	entries, _ := os.ReadDir(devroot)
+	for _, e := range entries {
+		dir := filepath.Join(devroot, e.Name())
+		direct := slices.ContainsFunc(consumers, func(c Consumer) bool { return filepath.Dir(c.Descriptor) == dir })
+		if direct || dir == olddir || dir == newdir || !links_into(dir, olddir) {
+			continue
+		}
+		fmt.Printf("Updating links in %s\n", dir)
+		if !*dry_run {
+			relink_dependency(dir, from, to, olddir, newdir)
+		}
+	}
+	if !*dry_run {
+		edit_lockfiles(func(l *Lockfile) bool {
+			e := l.find(from)
+			if e != nil {
+				e.Name = to
+			}
+			return e != nil
+		})
+	}
+
+	if !*includes && !*dry_run {
+		fmt.Printf("Include directives were not changed. Use --includes to replace '%s/' with '%s/'.\n", from, to)
+	}
+	if !*dry_run {
+		fmt.Printf("Package %s renamed to %s. Descriptor changes are not committed.\n", from, to)
+	}
+}
+
+// Replace '#include <from/...>' with '#include <to/...>' in all source files
+// in a folder. Symlinked folders are not followed.
+func rewrite_includes(dir string, from string, to string, dry_run bool) {
+	re := regexp.MustCompile(`(?m)^([ \t]*#[ \t]*include[ \t]*[<"])` + regexp.QuoteMeta(from) + `/`)
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if d.Name() == ".git" || d.Name() == ".cpm" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		ext := strings.ToLower(filepath.Ext(path))
+		if !d.Type().IsRegular() || !slices.Contains(header_extensions, ext) && !slices.Contains(source_extensions, ext) {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil || !re.Match(data) {
+			return nil
+		}
+		repl := []byte("${1}" + to + "/")
+		for n, line := range bytes.Split(data, []byte("\n")) {
+			if re.Match(line) {
+				fmt.Printf("%s:%d: %s\n   --> %s\n", path, n+1, bytes.TrimSpace(line),
+					bytes.TrimSpace(re.ReplaceAll(line, repl)))
+			}
+		}
+		if !dry_run {
+			if err = os.WriteFile(path, re.ReplaceAll(data, repl), 0644); err != nil {
+				fmt.Printf("WARNING - cannot update %s - %v\n", path, err)
+			}
+		}
+		return nil
+	})
+}
+
+// Return true if the manifest of package in dir has links to objects in
+// folder target
+func links_into(dir string, target string) bool {
+	for _, rel := range load_manifest(dir).Links {
+		t, err := os.Readlink(filepath.Join(dir, rel))
+		if err == nil && strings.HasPrefix(t, target+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Update objects created by CPM in a consumer package after a dependency was
+// renamed from 'from' (in olddir) to 'to' (in newdir)
+func relink_dependency(dir string, from string, to string, olddir string, newdir string) {
+	m := load_manifest(dir)
+	oldinc := filepath.Join("include", from)
+	newinc := filepath.Join("include", to)
+	moved := func(rel string) string {
+		if rel == oldinc || strings.HasPrefix(rel, oldinc+string(filepath.Separator)) {
+			return newinc + rel[len(oldinc):]
+		}
+		return rel
+	}
+
+	//mirrored headers folder
+	if slices.Contains(m.Dirs, oldinc) {
+		Verboseln("Renaming folder", filepath.Join(dir, oldinc))
+		os.Rename(filepath.Join(dir, oldinc), filepath.Join(dir, newinc))
+		for _, list := range []*[]string{&m.Links, &m.Copies, &m.Dirs} {
+			for i := range *list {
+				(*list)[i] = moved((*list)[i])
+			}
+		}
+	}
+
+	oldpkginc := filepath.Join(olddir, oldinc)
+	for i, rel := range m.Links {
+		link := filepath.Join(dir, rel)
+		t, err := os.Readlink(link)
+		if err != nil || !strings.HasPrefix(t, olddir+string(filepath.Separator)) {
+			continue
+		}
+		if t == oldpkginc || strings.HasPrefix(t, oldpkginc+string(filepath.Separator)) {
+			t = filepath.Join(newdir, newinc) + t[len(oldpkginc):]
+		} else {
+			t = newdir + t[len(olddir):]
+		}
+		m.Links[i] = moved(rel)
+		newlink := filepath.Join(dir, m.Links[i])
+		Verbosef("Relinking %s --> %s\n", newlink, t)
+		remove_file(link)
+		os.MkdirAll(filepath.Dir(newlink), 0755)
+		if err = make_symlink(t, newlink); err != nil {
+			fmt.Printf("WARNING - cannot create symlink %s - %v\n", newlink, err)
+		}
+	}
+	save_manifest(dir, m)
+}
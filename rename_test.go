@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestRenameRelinksIndirectConsumers(t *testing.T) {
+	saved_root := devroot
+	defer func() { devroot = saved_root }()
+	devroot = t.TempDir()
+
+	//A depends on B, B depends on C; A has a propagated link to C
+	descriptor := func(name string, deps ...string) {
+		p := PacUnit{Name: name}
+		for _, d := range deps {
+			p.Depends = append(p.Depends, DependencyDescriptor{Name: d})
+		}
+		data, _ := json.Marshal(p)
+		os.MkdirAll(filepath.Join(devroot, name, "include", name), 0755)
+		os.WriteFile(filepath.Join(devroot, name, descriptor_name), data, 0644)
+	}
+	descriptor("A", "B")
+	descriptor("B", "C")
+	descriptor("C")
+	link := func(pkg string, dep string) {
+		rel := filepath.Join("include", dep)
+		if err := os.Symlink(filepath.Join(devroot, dep, rel), filepath.Join(devroot, pkg, rel)); err != nil {
+			t.Skipf("cannot create symlinks - %v", err)
+		}
+		dir := filepath.Join(devroot, pkg)
+		m := load_manifest(dir)
+		m.Links = append(m.Links, rel)
+		save_manifest(dir, m)
+	}
+	link("A", "B")
+	link("A", "C")
+	link("B", "C")
+
+	rename([]string{"C", "D"})
+
+	want := filepath.Join(devroot, "D", "include", "D")
+	for _, pkg := range []string{"A", "B"} {
+		dir := filepath.Join(devroot, pkg)
+		if _, err := os.Lstat(filepath.Join(dir, "include", "C")); err == nil {
+			t.Errorf("package %s - link include/C not removed", pkg)
+		}
+		got, err := os.Readlink(filepath.Join(dir, "include", "D"))
+		if err != nil || got != want {
+			t.Errorf("package %s - include/D --> %q, want %q (%v)", pkg, got, want, err)
+		}
+		if m := load_manifest(dir); !slices.Contains(m.Links, filepath.Join("include", "D")) {
+			t.Errorf("package %s - manifest links %v don't have include/D", pkg, m.Links)
+		}
+	}
+	if got, _ := os.Readlink(filepath.Join(devroot, "A", "include", "B")); got != filepath.Join(devroot, "B", "include", "B") {
+		t.Errorf("link to B changed to %q", got)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+/*
+  Dependency report.
+
+  With the '--report <file>' option, CPM generates after fetching a file
+  listing all dependencies of the root package with their version, commit
+  and license. If the file name has the '.h' extension, the report is a C
+  header; otherwise it is a JSON file. Applications can use it to show
+  third-party attributions.
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var report_flag = flag.String("report", "", "generate dependency report file (.h or .json)")
+
+// Dependency information in report
+type DependencyInfo struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Commit  string `json:"commit"`
+	License string `json:"license"`
+}
+
+// Files that may contain the license of a package
+var license_files = []string{"LICENSE", "LICENSE.txt", "LICENSE.md", "COPYING", "COPYING.txt", "LICENCE", "LICENCE.txt"}
+
+// Patterns identifying common licenses, in order of testing
+var license_patterns = []struct {
+	id string
+	re *regexp.Regexp
+}{
+	{"Apache-2.0", regexp.MustCompile(`(?i)apache license,?\s+version 2\.0`)},
+	{"AGPL-3.0", regexp.MustCompile(`(?i)gnu affero general public license\s+version 3`)},
+	{"LGPL-3.0", regexp.MustCompile(`(?i)gnu lesser general public license\s+version 3`)},
+	{"LGPL-2.1", regexp.MustCompile(`(?i)gnu lesser general public license\s+version 2\.1`)},
+	{"LGPL-2.0", regexp.MustCompile(`(?i)gnu library general public license\s+version 2`)},
+	{"GPL-3.0", regexp.MustCompile(`(?i)gnu general public license\s+version 3`)},
+	{"GPL-2.0", regexp.MustCompile(`(?i)gnu general public license\s+version 2`)},
+	{"GPL-1.0", regexp.MustCompile(`(?i)gnu general public license\s+version 1`)},
+	{"MPL-2.0", regexp.MustCompile(`(?i)mozilla public license,?\s+v(ersion)?\.?\s*2\.0`)},
+	{"BSL-1.0", regexp.MustCompile(`(?i)boost software license`)},
+	{"Unlicense", regexp.MustCompile(`(?i)this is free and unencumbered software`)},
+	{"Zlib", regexp.MustCompile(`(?i)altered source versions must be plainly marked`)},
+	{"BSD-3-Clause", regexp.MustCompile(`(?i)neither the name of`)},
+	{"BSD-2-Clause", regexp.MustCompile(`(?i)redistributions in binary form must reproduce`)},
+	{"MIT", regexp.MustCompile(`(?i)permission is hereby granted, free of charge`)},
+}
+
+// Return SPDX identifier of the license of package in dir or an empty string
+// if it cannot be determined
+func detect_license(dir string) string {
+	for _, name := range license_files {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		for _, l := range license_patterns {
+			if l.re.Match(data) {
+				return l.id
+			}
+		}
+		return "unknown"
+	}
+	return ""
+}
+
+// Return current version of package in dir: the highest version tag of the
+// checked-out commit or an empty string if there is none
+func package_version(dir string) string {
+	if _, ok := folder_vcs(dir).(git_vcs); !ok {
+		return ""
+	}
+	out, _ := Output("git", "-C", dir, "tag", "--points-at", "HEAD")
+	tags := version_tags(strings.Fields(out))
+	if len(tags) == 0 {
+		return ""
+	}
+	return tags[len(tags)-1]
+}
+
+// Generate dependency report of root package
+func generate_report(root *PacUnit) {
+	var deps []DependencyInfo
+	for _, p := range all_packs {
+		if p == root {
+			continue
+		}
+		dir := package_dir(p)
+		if p.archive != "" {
+			deps = append(deps, DependencyInfo{Name: p.Name, Version: archive_file_name(p.archive), License: detect_license(dir)})
+			continue
+		}
+		commit, _ := package_vcs(p).Revision(dir)
+		deps = append(deps, DependencyInfo{
+			Name:    p.Name,
+			Version: package_version(dir),
+			Commit:  commit,
+			License: detect_license(dir),
+		})
+	}
+
+	fname := *report_flag
+	if !filepath.IsAbs(fname) {
+		fname = filepath.Join(filepath.Dir(root_descriptor), fname)
+	}
+	var data []byte
+	if strings.EqualFold(filepath.Ext(fname), ".h") {
+		data = report_header(deps)
+	} else {
+		data, _ = json.MarshalIndent(deps, "", "  ")
+		data = append(data, '\n')
+	}
+
+	//don't touch file if unchanged to avoid needless rebuilds
+	if old, err := os.ReadFile(fname); err == nil && bytes.Equal(old, data) {
+		Verboseln("Dependency report", fname, "is up to date")
+		return
+	}
+	if err := os.WriteFile(fname, data, 0644); err != nil {
+		fmt.Printf("WARNING - cannot write dependency report %s - %v\n", fname, err)
+		return
+	}
+	Verboseln("Generated dependency report", fname)
+}
+
+// Format dependency report as a C header
+func report_header(deps []DependencyInfo) []byte {
+	c_string := func(s string) string {
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+	}
+	var b bytes.Buffer
+	b.WriteString(`/*
+  Dependencies report generated by CPM - do not edit
+*/
+#pragma once
+
+struct cpm_dependency {
+  const char *name;
+  const char *version;
+  const char *commit;
+  const char *license;
+};
+
+`)
+	fmt.Fprintf(&b, "#define CPM_DEPENDENCY_COUNT %d\n\n", len(deps))
+	b.WriteString("static const struct cpm_dependency cpm_dependencies[] = {\n")
+	for _, d := range deps {
+		fmt.Fprintf(&b, "  {%s, %s, %s, %s},\n", c_string(d.Name), c_string(d.Version), c_string(d.Commit), c_string(d.License))
+	}
+	if len(deps) == 0 {
+		b.WriteString("  {0, 0, 0, 0}\n")
+	}
+	b.WriteString("};\n")
+	return b.Bytes()
+}
@@ -0,0 +1,139 @@
+package main
+
+/*
+  Build prerequisites.
+
+  A package lists the tools its build needs in the 'requires' attribute of
+  its descriptor, with a version constraint and, optionally, the probe
+  command that shows the tool version:
+    "requires": [
+      {"name": "cmake", "version": ">=3.25"},
+      {"name": "MSVC", "version": ">=19.30", "probe": ["cl"], "os": "windows"}
+    ]
+  The default probe is '<name> --version'. The version is the first number
+  like '1.2' or '1.2.3' in the output of the probe.
+
+  Before starting any build, CPM runs the probes of all packages to be
+  built, after placing installed tools (see tools.go) in the PATH, and
+  shows all missing prerequisites in one report. The 'tools' of the root
+  package are checked too, with their 'versionArgs', so they don't have to
+  be listed again in 'requires'.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Tool required to build a package
+type Requirement struct {
+	Name    string
+	Version string   //version constraint
+	Probe   []string //command showing tool version
+	Os      string   //OS-es or targets to which requirement applies
+}
+
+var tool_version_pattern = regexp.MustCompile(`\d+\.\d+(\.\d+)?`)
+
+// Run a probe command and return the version it shows
+func probe_version(probe []string) (string, error) {
+	out, err := exec.Command(probe[0], probe[1:]...).CombinedOutput()
+	if err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return "", fmt.Errorf("%s not found", probe[0])
+		}
+		if _, ok := err.(*exec.ExitError); !ok {
+			return "", err
+		}
+		//some tools, like cl, show their version with a non-zero exit code
+	}
+	v := tool_version_pattern.FindString(string(out))
+	if v == "" {
+		return "", fmt.Errorf("cannot find version in output of '%s'", strings.Join(probe, " "))
+	}
+	return v, nil
+}
+
+// Check that version v satisfies a version constraint
+func check_constraint(v string, constraint string) error {
+	if constraint == "" {
+		return nil
+	}
+	vc, err := parse_constraint(constraint)
+	if err != nil {
+		return fmt.Errorf("invalid version constraint '%s' - %v", constraint, err)
+	}
+	if sv, _ := parse_version(v); !vc.match(sv) {
+		return fmt.Errorf("version %s doesn't satisfy '%s'", v, constraint)
+	}
+	return nil
+}
+
+// Return the tools of the root package as requirements. Installed tools
+// are found in the PATH (see setup_tools).
+func tool_requirements(root *PacUnit) []Requirement {
+	var reqs []Requirement
+	for _, t := range root.Tools {
+		args := t.VersionArgs
+		if len(args) == 0 {
+			args = []string{"--version"}
+		}
+		reqs = append(reqs, Requirement{Name: t.Name, Version: t.Version, Probe: append([]string{t.Name}, args...)})
+	}
+	return reqs
+}
+
+// Check prerequisites of all packages to be built and report those that
+// are missing. Returns the number of unsatisfied requirements.
+func check_requirements() int {
+	type check struct {
+		req      Requirement
+		packages []string
+	}
+	var checks []*check
+	for _, p := range all_packs {
+		if !group_selected(p) {
+			continue
+		}
+		reqs := p.Requires
+		if p == all_packs[0] {
+			reqs = append(tool_requirements(p), reqs...)
+		}
+		for _, req := range reqs {
+			if oses := strings.Fields(req.Os); len(oses) != 0 && !slices.Contains(oses, "any") && !slices.Contains(oses, target_os()) {
+				continue
+			}
+			if len(req.Probe) == 0 {
+				req.Probe = []string{req.Name, "--version"}
+			}
+			idx := slices.IndexFunc(checks, func(c *check) bool {
+				return c.req.Name == req.Name && c.req.Version == req.Version && slices.Equal(c.req.Probe, req.Probe)
+			})
+			if idx < 0 {
+				checks = append(checks, &check{req: req})
+				idx = len(checks) - 1
+			}
+			checks[idx].packages = append(checks[idx].packages, p.Name)
+		}
+	}
+
+	var missing []string
+	for _, c := range checks {
+		Verbosef("Checking %s %s\n", c.req.Name, c.req.Version)
+		v, err := probe_version(c.req.Probe)
+		if err == nil {
+			err = check_constraint(v, c.req.Version)
+		}
+		if err != nil {
+			missing = append(missing, fmt.Sprintf("%s %s (required by %s) - %v", c.req.Name, c.req.Version, strings.Join(c.packages, ", "), err))
+		}
+	}
+	if len(missing) != 0 {
+		fmt.Printf("Missing prerequisites:\n  %s\n", strings.Join(missing, "\n  "))
+	}
+	return len(missing)
+}
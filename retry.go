@@ -0,0 +1,101 @@
+package main
+
+/*
+  Retries of network operations.
+
+  Clones, pulls, fetches and downloads that fail with an error that can be
+  transient (like a dropped connection) are retried with exponential
+  backoff. The number of retries is given by the 'network.retries' setting
+  (default 3) and the delay before the first retry, in seconds, by the
+  'network.backoff' setting (default 2); the delay doubles after every
+  attempt, up to one minute.
+
+  Git, Mercurial and Subversion report network errors with the same exit
+  status as other fatal errors (128, 255 and 1), so CPM retries these
+  failures only if the output of the program reports a network error, like
+  a host that cannot be resolved, a connection reset or timed out or a
+  server error. Other failures, like authentication errors, missing
+  repositories or merge conflicts, are not retried.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"sync"
+	"time"
+)
+
+var network_failure string //operation that failed after all retries
+var network_mutex sync.Mutex
+
+// Exit status of version control programs for errors that can be transient
+var transient_status = map[string]int{"git": 128, "hg": 255, "svn": 1}
+
+// Messages of version control programs for network errors
+var transient_output = regexp.MustCompile(`(?i)could not resolve|temporary failure in name resolution|` +
+	`connection (reset|refused|timed out|closed)|timed out|network is unreachable|early eof|` +
+	`remote end hung up|unexpected disconnect|rpc failed|gnutls|ssl_error|ssl routines|tls handshake|` +
+	`error: 5\d\d|returned error: (5\d\d|429)|http 5\d\d|too many requests|` +
+	`svn: e(170013|175002|000110|000104|000111|120108)`)
+
+// Last bytes written, enough to hold the error messages of a program
+type output_tail struct {
+	data []byte
+}
+
+func (t *output_tail) Write(b []byte) (int, error) {
+	const size = 4096
+	t.data = append(t.data, b...)
+	if len(t.data) > size {
+		t.data = t.data[len(t.data)-size:]
+	}
+	return len(b), nil
+}
+
+// Run an operation that uses the network, retrying it while it fails with a
+// transient error. What describes the operation in messages.
+func with_retries(what string, op func() (transient bool, err error)) error {
+	retries := config_int("network.retries", 3)
+	delay := time.Duration(config_int("network.backoff", 2)) * time.Second
+	for attempt := 0; ; attempt++ {
+		transient, err := op()
+		if err == nil || !transient {
+			return err
+		}
+		if attempt >= retries {
+			if retries != 0 {
+				network_mutex.Lock()
+				network_failure = fmt.Sprintf("%s failed after %d attempts - %v", what, attempt+1, err)
+				network_mutex.Unlock()
+			}
+			return err
+		}
+		fmt.Printf("WARNING - %s failed (attempt %d of %d) - %v. Retrying in %v\n", what, attempt+1, retries+1, err, delay)
+		time.Sleep(delay)
+		if delay *= 2; delay > time.Minute {
+			delay = time.Minute
+		}
+	}
+}
+
+// Run a version control program that uses the network, retrying it after
+// transient failures. Output goes to the log of the package in folder pacdir.
+func run_network(pacdir string, what string, prog string, args []string) (int, error) {
+	var stat int
+	err := with_retries(what, func() (bool, error) {
+		var err error
+		var out output_tail
+		stat, _, err = run_tee("", pacdir, prog, args, nil, &out)
+		code := stat
+		var exit *exec.ExitError
+		if errors.As(err, &exit) {
+			code = exit.ExitCode()
+		} else if err == nil && stat != 0 {
+			err = fmt.Errorf("exit status %d", stat)
+		}
+		return code == transient_status[prog] && transient_output.Match(out.data), err
+	})
+	return stat, err
+}
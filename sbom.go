@@ -0,0 +1,400 @@
+package main
+
+/*
+  Software bill of materials.
+
+  'cpm sbom [--format cyclonedx|spdx] [--output <file>] [<package>]' writes
+  a software bill of materials of a package and all its dependencies, as a
+  CycloneDX 1.5 or SPDX 2.3 JSON document. For every package it gives the
+  name, the version (version tag, archive file name or Perforce
+  changelist), the checked-out commit, the repository URL and the license.
+  The license is the SPDX expression in the 'license' attribute of the
+  package descriptor or, if there is none, the license detected from the
+  license file of the package (see report.go). A 'license' attribute that
+  is not an SPDX expression is given as a license name in CycloneDX
+  documents and as a license comment in SPDX documents. The dependency
+  graph is included too.
+*/
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Package information in a bill of materials
+type sbom_package struct {
+	pack    *PacUnit
+	id      string //unique identifier in the document
+	version string
+	commit  string
+	source  string //repository or archive URL
+	vcs     string //version control system
+	license string //SPDX expression or empty if unknown
+	depends []*PacUnit
+}
+
+// Matches characters not allowed in SPDX identifiers
+var spdx_id_re = regexp.MustCompile(`[^A-Za-z0-9.-]`)
+
+// SPDX license identifiers accepted in 'license' attributes, besides the
+// ones detected from license files
+var spdx_licenses = []string{"0BSD", "AGPL-3.0-only", "AGPL-3.0-or-later", "Artistic-2.0", "BSD-1-Clause",
+	"BSD-4-Clause", "CC-BY-4.0", "CC0-1.0", "curl", "EPL-1.0", "EPL-2.0", "FTL", "GPL-2.0-only", "GPL-2.0-or-later",
+	"GPL-3.0-only", "GPL-3.0-or-later", "ICU", "IJG", "ISC", "LGPL-2.1-only", "LGPL-2.1-or-later", "LGPL-3.0-only",
+	"LGPL-3.0-or-later", "Libpng", "libpng-2.0", "MIT-0", "MPL-1.1", "NCSA", "OpenSSL", "PostgreSQL", "Python-2.0",
+	"Unicode-3.0", "Unicode-DFS-2016", "WTFPL", "X11"}
+
+// Return true if a license identifier is a known SPDX license, possibly
+// followed by '+', or a license reference
+func spdx_license(id string) bool {
+	if ref, ok := strings.CutPrefix(id, "LicenseRef-"); ok {
+		return ref != "" && !spdx_id_re.MatchString(ref)
+	}
+	id = strings.TrimSuffix(id, "+")
+	for _, l := range license_patterns {
+		if strings.EqualFold(l.id, id) {
+			return true
+		}
+	}
+	return slices.ContainsFunc(spdx_licenses, func(l string) bool { return strings.EqualFold(l, id) })
+}
+
+// Return true if a license is a valid SPDX license expression
+func spdx_expression(lic string) bool {
+	tokens := strings.Fields(strings.NewReplacer("(", " ( ", ")", " ) ").Replace(lic))
+	depth := 0
+	operand := true //expecting a license or an opening parenthesis
+	for i := 0; i < len(tokens); i++ {
+		switch t := tokens[i]; {
+		case operand && t == "(":
+			depth++
+		case operand && spdx_license(t):
+			operand = false
+		case !operand && t == ")" && depth > 0:
+			depth--
+		case !operand && (t == "AND" || t == "OR"):
+			operand = true
+		case !operand && t == "WITH" && i+1 < len(tokens) && !spdx_id_re.MatchString(tokens[i+1]):
+			//license exception like "Classpath-exception-2.0"
+			i++
+		default:
+			return false
+		}
+	}
+	return !operand && depth == 0
+}
+
+// Return a random UUID (version 4)
+func new_uuid() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// Collect bill of materials information of all packages
+func sbom_packages() []*sbom_package {
+	var list []*sbom_package
+	for i, p := range all_packs {
+		sp := &sbom_package{pack: p, id: fmt.Sprintf("%s-%d", spdx_id_re.ReplaceAllString(p.Name, "-"), i)}
+		dir := package_dir(p)
+		switch {
+		case p.archive != "":
+			sp.source, sp.version = p.archive, archive_file_name(p.archive)
+		case p.path != "":
+			sp.version = package_version(dir)
+		case p.provider != "":
+			sp.source = p.source
+		default:
+			v := package_vcs(p)
+			sp.vcs = v.Name()
+			sp.commit, _ = v.Revision(dir)
+			switch {
+			case p.Hg != "":
+				sp.source = p.Hg
+			case p.Svn != "":
+				sp.source = p.Svn
+			case p.Depot != "":
+				sp.source = "p4://" + p.P4Port + "/" + strings.TrimPrefix(p.Depot, "//")
+				sp.version = "CL" + sp.commit
+			default:
+				sp.source = package_uri(p.Git, p.Https)
+				sp.version = p.version
+				if sp.version == "" {
+					sp.version = package_version(dir)
+				}
+			}
+		}
+		if sp.source == "" {
+			sp.source, _ = Output("git", "-C", dir, "config", "--get", "remote.origin.url")
+			sp.source = strings.TrimSpace(sp.source)
+		}
+		if sp.license = package_license(p); sp.license == "unknown" {
+			sp.license = ""
+		}
+		for _, d := range p.Depends {
+			if d.pack != nil && !slices.Contains(sp.depends, d.pack) {
+				sp.depends = append(sp.depends, d.pack)
+			}
+		}
+		list = append(list, sp)
+	}
+	return list
+}
+
+// Return URL of a repository in the form used by package URLs and SPDX
+// download locations: SSH URLs of git hosts are converted to HTTPS URLs
+func vcs_url(uri string) string {
+	if _, https := remote_urls(uri); https != "" {
+		return https
+	}
+	return uri
+}
+
+// Return package URL (purl) of a package
+func purl(sp *sbom_package) string {
+	version := sp.version
+	if version == "" {
+		version = sp.commit
+	}
+	s := "pkg:generic/" + url.PathEscape(sp.pack.Name)
+	if version != "" {
+		s += "@" + url.PathEscape(version)
+	}
+	if sp.source != "" {
+		q := url.Values{}
+		if sp.vcs != "" {
+			loc := sp.vcs + "+" + vcs_url(sp.source)
+			if sp.commit != "" && sp.vcs != "p4" {
+				loc += "@" + sp.commit
+			}
+			q.Set("vcs_url", loc)
+		} else {
+			q.Set("download_url", sp.source)
+		}
+		s += "?" + q.Encode()
+	}
+	return s
+}
+
+// Return CycloneDX document
+func cyclonedx_sbom(list []*sbom_package) any {
+	type license struct {
+		Id   string `json:"id,omitempty"`
+		Name string `json:"name,omitempty"`
+	}
+	type license_choice struct {
+		License    *license `json:"license,omitempty"`
+		Expression string   `json:"expression,omitempty"`
+	}
+	type reference struct {
+		Type string `json:"type"`
+		Url  string `json:"url"`
+	}
+	type property struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+	type component struct {
+		Type       string           `json:"type"`
+		Ref        string           `json:"bom-ref"`
+		Name       string           `json:"name"`
+		Version    string           `json:"version,omitempty"`
+		Licenses   []license_choice `json:"licenses,omitempty"`
+		Purl       string           `json:"purl"`
+		References []reference      `json:"externalReferences,omitempty"`
+		Properties []property       `json:"properties,omitempty"`
+	}
+	type dependency struct {
+		Ref       string   `json:"ref"`
+		DependsOn []string `json:"dependsOn"`
+	}
+	type tool struct {
+		Type    string `json:"type"`
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+	type metadata struct {
+		Timestamp string            `json:"timestamp"`
+		Tools     map[string][]tool `json:"tools"`
+		Component component         `json:"component"`
+	}
+	type document struct {
+		Format       string       `json:"bomFormat"`
+		SpecVersion  string       `json:"specVersion"`
+		SerialNumber string       `json:"serialNumber"`
+		Version      int          `json:"version"`
+		Metadata     metadata     `json:"metadata"`
+		Components   []component  `json:"components"`
+		Dependencies []dependency `json:"dependencies"`
+	}
+
+	ids := make(map[*PacUnit]string)
+	for _, sp := range list {
+		ids[sp.pack] = sp.id
+	}
+	doc := document{Format: "CycloneDX", SpecVersion: "1.5", SerialNumber: "urn:uuid:" + new_uuid(), Version: 1,
+		Components: []component{}}
+	doc.Metadata.Timestamp = time.Now().UTC().Format(time.RFC3339)
+	doc.Metadata.Tools = map[string][]tool{"components": {{"application", "cpm", Version}}}
+	for i, sp := range list {
+		c := component{Type: "library", Ref: sp.id, Name: sp.pack.Name, Version: sp.version, Purl: purl(sp)}
+		if c.Version == "" {
+			c.Version = sp.commit
+		}
+		if sp.license != "" {
+			switch {
+			case !spdx_expression(sp.license):
+				c.Licenses = []license_choice{{License: &license{Name: sp.license}}}
+			case spdx_id_re.MatchString(sp.license):
+				//compound expression like "MIT OR Apache-2.0"
+				c.Licenses = []license_choice{{Expression: sp.license}}
+			default:
+				c.Licenses = []license_choice{{License: &license{Id: sp.license}}}
+			}
+		}
+		if sp.source != "" {
+			kind := "vcs"
+			if sp.vcs == "" {
+				kind = "distribution"
+			}
+			c.References = []reference{{kind, sp.source}}
+		}
+		if sp.commit != "" {
+			c.Properties = []property{{"cpm:commit", sp.commit}}
+		}
+		if i == 0 {
+			c.Type = "application"
+			doc.Metadata.Component = c
+		} else {
+			doc.Components = append(doc.Components, c)
+		}
+		dep := dependency{Ref: sp.id, DependsOn: []string{}}
+		for _, q := range sp.depends {
+			dep.DependsOn = append(dep.DependsOn, ids[q])
+		}
+		doc.Dependencies = append(doc.Dependencies, dep)
+	}
+	return doc
+}
+
+// Return SPDX document
+func spdx_sbom(list []*sbom_package) any {
+	type external_ref struct {
+		Category string `json:"referenceCategory"`
+		Type     string `json:"referenceType"`
+		Locator  string `json:"referenceLocator"`
+	}
+	type pkg struct {
+		Id               string         `json:"SPDXID"`
+		Name             string         `json:"name"`
+		VersionInfo      string         `json:"versionInfo,omitempty"`
+		DownloadLocation string         `json:"downloadLocation"`
+		FilesAnalyzed    bool           `json:"filesAnalyzed"`
+		LicenseConcluded string         `json:"licenseConcluded"`
+		LicenseDeclared  string         `json:"licenseDeclared"`
+		LicenseComments  string         `json:"licenseComments,omitempty"`
+		CopyrightText    string         `json:"copyrightText"`
+		ExternalRefs     []external_ref `json:"externalRefs"`
+	}
+	type relationship struct {
+		Element string `json:"spdxElementId"`
+		Type    string `json:"relationshipType"`
+		Related string `json:"relatedSpdxElement"`
+	}
+	type creation_info struct {
+		Created  string   `json:"created"`
+		Creators []string `json:"creators"`
+	}
+	type document struct {
+		SpdxVersion       string         `json:"spdxVersion"`
+		DataLicense       string         `json:"dataLicense"`
+		Id                string         `json:"SPDXID"`
+		Name              string         `json:"name"`
+		DocumentNamespace string         `json:"documentNamespace"`
+		CreationInfo      creation_info  `json:"creationInfo"`
+		Packages          []pkg          `json:"packages"`
+		Relationships     []relationship `json:"relationships"`
+	}
+
+	ids := make(map[*PacUnit]string)
+	for _, sp := range list {
+		ids[sp.pack] = "SPDXRef-Package-" + sp.id
+	}
+	root := list[0].pack.Name
+	doc := document{SpdxVersion: "SPDX-2.3", DataLicense: "CC0-1.0", Id: "SPDXRef-DOCUMENT", Name: root,
+		DocumentNamespace: "https://spdx.org/spdxdocs/" + url.PathEscape(root) + "-" + new_uuid()}
+	doc.CreationInfo = creation_info{time.Now().UTC().Format(time.RFC3339), []string{"Tool: cpm-" + Version}}
+	doc.Relationships = append(doc.Relationships, relationship{doc.Id, "DESCRIBES", ids[list[0].pack]})
+	for _, sp := range list {
+		p := pkg{Id: ids[sp.pack], Name: sp.pack.Name, VersionInfo: sp.version, DownloadLocation: "NOASSERTION",
+			LicenseConcluded: "NOASSERTION", LicenseDeclared: "NOASSERTION", CopyrightText: "NOASSERTION"}
+		if p.VersionInfo == "" {
+			p.VersionInfo = sp.commit
+		}
+		if spdx_expression(sp.license) {
+			p.LicenseDeclared = sp.license
+		} else if sp.license != "" {
+			p.LicenseComments = "Declared license: " + sp.license
+		}
+		switch {
+		case sp.source == "":
+		case sp.vcs == "":
+			p.DownloadLocation = sp.source
+		case sp.vcs == "p4" || sp.commit == "":
+			p.DownloadLocation = sp.vcs + "+" + vcs_url(sp.source)
+		default:
+			p.DownloadLocation = sp.vcs + "+" + vcs_url(sp.source) + "@" + sp.commit
+		}
+		p.ExternalRefs = []external_ref{{"PACKAGE-MANAGER", "purl", purl(sp)}}
+		doc.Packages = append(doc.Packages, p)
+		for _, q := range sp.depends {
+			doc.Relationships = append(doc.Relationships, relationship{ids[sp.pack], "DEPENDS_ON", ids[q]})
+		}
+	}
+	return doc
+}
+
+// Implementation of 'cpm sbom [--format cyclonedx|spdx] [--output <file>] [<package>]' command
+func sbom(args []string) {
+	flags := flag.NewFlagSet("sbom", flag.ExitOnError)
+	format := flags.String("format", "cyclonedx", "document format (cyclonedx or spdx)")
+	output := flags.String("output", "", "write document to file")
+	pos := parse_interspersed(flags, args)
+	if len(pos) > 1 || *format != "cyclonedx" && *format != "spdx" {
+		log.Fatal("Usage: cpm sbom [--format cyclonedx|spdx] [--output <file>] [<package>]")
+	}
+	pkg := ""
+	if len(pos) == 1 {
+		pkg = pos[0]
+	}
+	load_tree(pkg)
+	list := sbom_packages()
+
+	var doc any
+	if *format == "spdx" {
+		doc = spdx_sbom(list)
+	} else {
+		doc = cyclonedx_sbom(list)
+	}
+	data, _ := json.MarshalIndent(doc, "", "  ")
+	data = append(data, '\n')
+	if *output == "" {
+		os.Stdout.Write(data)
+		return
+	}
+	if err := os.WriteFile(*output, data, 0644); err != nil {
+		log.Fatalf("Cannot write %s - %v", *output, err)
+	}
+	fmt.Printf("Bill of materials of %d packages written to %s\n", len(list), *output)
+}
@@ -0,0 +1,341 @@
+package main
+
+/*
+  Descriptor validation.
+
+  Descriptors and overlays are checked against the JSON schema embedded in
+  the program (cpm.schema.json) before they are used. Syntax errors and
+  attributes of the wrong type are fatal; unknown attributes, that would be
+  silently ignored, produce 'unknown-attribute' warnings. Problems are
+  reported with their line and column.
+
+  The validator supports the subset of JSON Schema used by the descriptor
+  schema: 'type', 'properties', 'additionalProperties', 'items', 'enum',
+  'pattern', 'minimum', 'exclusiveMinimum', '$ref' and '$defs'. Like JSON unmarshalling, attribute names are not case sensitive.
+
+  The 'cpm validate' command checks a descriptor without fetching anything.
+  The 'cpm schema' command prints the descriptor or lockfile schema, for
+  editors and tools that generate descriptors.
+*/
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+//go:embed cpm.schema.json
+var descriptor_schema []byte
+
+//go:embed cpm.lock.schema.json
+var lockfile_schema []byte
+
+// Subset of JSON Schema used by the descriptor schema
+type Schema struct {
+	Ref                  string             `json:"$ref"`
+	Defs                 map[string]*Schema `json:"$defs"`
+	Type                 json.RawMessage    `json:"type"` //type name or array of names
+	Properties           map[string]*Schema `json:"properties"`
+	AdditionalProperties json.RawMessage    `json:"additionalProperties"`
+	Items                *Schema            `json:"items"`
+	Enum                 []any              `json:"enum"`
+	Pattern              string             `json:"pattern"`
+	Minimum              *float64           `json:"minimum"`
+	ExclusiveMinimum     *float64           `json:"exclusiveMinimum"`
+	Description          string             `json:"description"`
+}
+
+// Problem found in a descriptor
+type SchemaError struct {
+	Pos     int //offset in file
+	Msg     string
+	Unknown bool //unknown attribute
+}
+
+var root_schema *Schema
+
+// Return the parsed descriptor schema
+func get_schema() *Schema {
+	if root_schema == nil {
+		root_schema = new(Schema)
+		if err := json.Unmarshal(descriptor_schema, root_schema); err != nil {
+			log.Fatalf("Fatal - invalid descriptor schema - %v", err)
+		}
+	}
+	return root_schema
+}
+
+// Resolve schema references
+func (s *Schema) resolve() *Schema {
+	for s.Ref != "" {
+		name, ok := strings.CutPrefix(s.Ref, "#/$defs/")
+		if s = get_schema().Defs[name]; !ok || s == nil {
+			log.Fatalf("Fatal - invalid schema reference %s", name)
+		}
+	}
+	return s
+}
+
+// Return allowed types (empty if any type is allowed)
+func (s *Schema) types() []string {
+	var types []string
+	if json.Unmarshal(s.Type, &types) != nil {
+		var t string
+		if json.Unmarshal(s.Type, &t) == nil {
+			types = []string{t}
+		}
+	}
+	return types
+}
+
+// Return schema of an object member or nil if the member is not allowed
+func (s *Schema) member(name string) *Schema {
+	for key, prop := range s.Properties {
+		if strings.EqualFold(key, name) {
+			return prop
+		}
+	}
+	additional := &Schema{}
+	if len(s.AdditionalProperties) != 0 && json.Unmarshal(s.AdditionalProperties, additional) != nil {
+		return nil //additionalProperties: false
+	}
+	return additional
+}
+
+// Return JSON type of a node
+func node_type(data []byte, n *JNode) string {
+	switch n.kind {
+	case '{':
+		return "object"
+	case '[':
+		return "array"
+	case '"':
+		return "string"
+	}
+	switch v := string(data[n.start:n.end]); v {
+	case "true", "false":
+		return "boolean"
+	case "null":
+		return "null"
+	default:
+		if strings.ContainsAny(v, ".eE") {
+			return "number"
+		}
+		return "integer"
+	}
+}
+
+// Validate a descriptor against the schema
+func validate_descriptor(data []byte) []SchemaError {
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		var serr *json.SyntaxError
+		if errors.As(err, &serr) {
+			return []SchemaError{{Pos: int(serr.Offset) - 1, Msg: serr.Error()}}
+		}
+		return []SchemaError{{Msg: err.Error()}}
+	}
+	root, err := parse_jnodes(data)
+	if err != nil {
+		return []SchemaError{{Msg: err.Error()}}
+	}
+	var problems []SchemaError
+	validate_node(data, root, get_schema(), "", &problems)
+	return problems
+}
+
+func validate_node(data []byte, n *JNode, s *Schema, path string, problems *[]SchemaError) {
+	s = s.resolve()
+	name := path
+	if name == "" {
+		name = "descriptor"
+	}
+	typ := node_type(data, n)
+	if types := s.types(); len(types) != 0 && !slices.Contains(types, typ) &&
+		!(typ == "integer" && slices.Contains(types, "number")) {
+		*problems = append(*problems, SchemaError{Pos: n.start,
+			Msg: fmt.Sprintf("'%s' must be %s, not %s", name, strings.Join(types, " or "), typ)})
+		return
+	}
+	check_value(data, n, s, name, problems)
+	switch n.kind {
+	case '{':
+		for i, key := range n.keys {
+			member := key
+			if path != "" {
+				member = path + "." + key
+			}
+			ms := s.member(key)
+			if ms == nil {
+				*problems = append(*problems, SchemaError{Pos: n.key_pos[i],
+					Msg: fmt.Sprintf("unknown attribute '%s'", member), Unknown: true})
+				continue
+			}
+			validate_node(data, n.items[i], ms, member, problems)
+		}
+	case '[':
+		if s.Items == nil {
+			return
+		}
+		for i, item := range n.items {
+			validate_node(data, item, s.Items, fmt.Sprintf("%s[%d]", path, i), problems)
+		}
+	}
+}
+
+// Check a value against the 'enum', 'pattern', 'minimum' and
+// 'exclusiveMinimum' keywords of its schema
+func check_value(data []byte, n *JNode, s *Schema, name string, problems *[]SchemaError) {
+	if len(s.Enum) == 0 && s.Pattern == "" && s.Minimum == nil && s.ExclusiveMinimum == nil {
+		return
+	}
+	var v any
+	if json.Unmarshal(data[n.start:n.end], &v) != nil {
+		return
+	}
+	fail := func(format string, args ...any) {
+		*problems = append(*problems, SchemaError{Pos: n.start, Msg: fmt.Sprintf(format, args...)})
+	}
+	if len(s.Enum) != 0 && !slices.ContainsFunc(s.Enum, func(e any) bool { return reflect.DeepEqual(e, v) }) {
+		var values []string
+		for _, e := range s.Enum {
+			text, _ := json.Marshal(e)
+			values = append(values, string(text))
+		}
+		fail("'%s' must be one of %s", name, strings.Join(values, ", "))
+	}
+	if str, ok := v.(string); ok && s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			log.Fatalf("Fatal - invalid schema pattern %s - %v", s.Pattern, err)
+		}
+		if !re.MatchString(str) {
+			fail("'%s' doesn't match pattern %s", name, s.Pattern)
+		}
+	}
+	if num, ok := v.(float64); ok {
+		if s.Minimum != nil && num < *s.Minimum {
+			fail("'%s' must be at least %v", name, *s.Minimum)
+		}
+		if s.ExclusiveMinimum != nil && num <= *s.ExclusiveMinimum {
+			fail("'%s' must be greater than %v", name, *s.ExclusiveMinimum)
+		}
+	}
+}
+
+// Return line and column (1-based) of an offset in data
+func line_col(data []byte, pos int) (int, int) {
+	if pos > len(data) {
+		pos = len(data)
+	}
+	line := strings.Count(string(data[:pos]), "\n") + 1
+	col := pos - strings.LastIndexByte(string(data[:pos]), '\n')
+	return line, col
+}
+
+// Format a descriptor problem as file:line:col: message
+func format_problem(fname string, data []byte, p SchemaError) string {
+	line, col := line_col(data, p.Pos)
+	return fmt.Sprintf("%s:%d:%d: %s", fname, line, col, p.Msg)
+}
+
+var checked_descriptors = make(map[string]bool)
+var unknown_attributes = make(map[string]bool) //descriptors with unknown attributes
+
+// Validate a descriptor before use. Unknown attributes are reported once
+// per file; other problems are returned as an error.
+func check_descriptor(fname string, data []byte) error {
+	var errs []string
+	for _, p := range validate_descriptor(data) {
+		if !p.Unknown {
+			errs = append(errs, format_problem(fname, data, p))
+		} else if !checked_descriptors[fname] {
+			warn("unknown-attribute", "%s", format_problem(fname, data, p))
+			unknown_attributes[fname] = true
+		}
+	}
+	checked_descriptors[fname] = true
+	if len(errs) != 0 {
+		return fmt.Errorf("invalid descriptor\n  %s", strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+// Implementation of 'cpm validate' command
+func validate(args []string) {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	pos := parse_interspersed(flags, args)
+	if len(pos) > 1 {
+		log.Fatal("Usage: cpm validate [<package>|<file>]")
+	}
+	var fname string
+	if len(pos) == 1 && strings.HasSuffix(strings.ToLower(pos[0]), ".json") {
+		fname = pos[0]
+	} else {
+		arg := ""
+		if len(pos) == 1 {
+			arg = pos[0]
+		}
+		_, fname = find_root(arg)
+	}
+
+	files := []string{fname}
+	if ovname := filepath.Join(filepath.Dir(fname), overlay_name); ovname != fname {
+		if _, err := os.Stat(ovname); err == nil {
+			files = append(files, ovname)
+		}
+	}
+	count := 0
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			log.Fatalf("Cannot read %s - %v", f, err)
+		}
+		for _, p := range validate_descriptor(data) {
+			fmt.Println(format_problem(f, data, p))
+			count++
+		}
+	}
+	if count != 0 {
+		fmt.Printf("%d problems found\n", count)
+		exit_failed("invalid descriptor")
+	}
+	fmt.Printf("%s is valid\n", strings.Join(files, ", "))
+}
+
+// Implementation of 'cpm schema [descriptor|lockfile]' command
+func print_schema(args []string) {
+	flags := flag.NewFlagSet("schema", flag.ExitOnError)
+	output := flags.String("output", "", "write schema to file")
+	pos := parse_interspersed(flags, args)
+	if len(pos) > 1 {
+		log.Fatal("Usage: cpm schema [--output <file>] [descriptor|lockfile]")
+	}
+	data := descriptor_schema
+	if len(pos) == 1 {
+		switch pos[0] {
+		case "descriptor":
+		case "lockfile":
+			data = lockfile_schema
+		default:
+			log.Fatalf("Unknown schema %s. Valid schemas are: descriptor, lockfile", pos[0])
+		}
+	}
+	if *output == "" {
+		os.Stdout.Write(data)
+		return
+	}
+	if err := os.WriteFile(*output, data, 0644); err != nil {
+		log.Fatalf("Cannot write %s - %v", *output, err)
+	}
+	fmt.Printf("Schema written to %s\n", *output)
+}
@@ -0,0 +1,91 @@
+package main
+
+/*
+  Shallow and sparse clones.
+
+  For large dependencies, the descriptor can limit what is downloaded:
+  - 'shallow': true fetches only the latest commit ('depth' 1);
+  - 'depth': N fetches only the last N commits;
+  - 'sparsePaths': [...] checks out only the listed folders (Git sparse
+    checkout in cone mode). Files in the package root and the 'include'
+    folder are always checked out. Blobs are downloaded only when needed.
+
+  With the '--locked' option, the commit recorded in the lockfile may be
+  older than the history fetched. CPM fetches it by its SHA, with the same
+  depth, and, if the server doesn't allow fetching commits by SHA,
+  unshallows the clone.
+*/
+
+import (
+	"log"
+	"strconv"
+	"strings"
+)
+
+// Return clone depth of a dependency or 0 for full history
+func dependency_depth(d *DependencyDescriptor) int {
+	if d.Depth > 0 {
+		return d.Depth
+	}
+	if d.Shallow {
+		return 1
+	}
+	return 0
+}
+
+// Return git options limiting the history fetched for a package
+func depth_args(p *PacUnit) []string {
+	if p.depth == 0 {
+		return nil
+	}
+	return []string{"--depth", strconv.Itoa(p.depth)}
+}
+
+// Fetch a commit by its SHA with the given depth options. If the server
+// refuses it, all branches are fetched instead, with their whole history if
+// the clone is shallow.
+func fetch_commit(dir string, rev string, depth []string) {
+	args := append([]string{"-C", dir, "fetch"}, depth...)
+	what := "Fetching commit " + rev + " in " + dir
+	Verboseln("git", args, "origin", rev)
+	if stat, err := run_network(dir, what, "git", append(args, "origin", rev)); err == nil && stat == 0 {
+		return
+	}
+	if out, _ := Output("git", "-C", dir, "rev-parse", "--is-shallow-repository"); strings.TrimSpace(out) != "true" {
+		vcs_fetch(dir, "git", "Fetching "+dir, "-C", dir, "fetch", "origin")
+		return
+	}
+	Verbosef("Cannot fetch commit %s by SHA. Fetching all history of %s\n", rev, dir)
+	vcs_fetch(dir, "git", "Unshallowing "+dir, "-C", dir, "fetch", "--unshallow", "origin")
+}
+
+// Return git clone options for a package
+func shallow_clone_args(p *PacUnit) []string {
+	args := depth_args(p)
+	if len(p.sparse) != 0 {
+		args = append(args, "--no-checkout", "--filter=blob:none")
+	}
+	return args
+}
+
+// Configure sparse checkout of a package and update its working tree. If
+// package doesn't have sparse paths, sparse checkout is disabled.
+func setup_sparse(p *PacUnit, dir string, cloned bool) {
+	if len(p.sparse) == 0 {
+		if out, _ := Output("git", "-C", dir, "config", "--bool", "core.sparseCheckout"); strings.TrimSpace(out) == "true" {
+			Verboseln("Disabling sparse checkout in", dir)
+			run_for(dir, "git", []string{"-C", dir, "sparse-checkout", "disable"})
+		}
+		return
+	}
+	args := append([]string{"-C", dir, "sparse-checkout", "set", "--cone", "include"}, p.sparse...)
+	Verboseln("Running git ", args)
+	if stat, err := run_for(dir, "git", args); err != nil || stat != 0 {
+		log.Fatalf("Package %s - cannot set sparse checkout \nStatus %d Error: %v\n", p.Name, stat, err)
+	}
+	if cloned {
+		if stat, err := run_for(dir, "git", []string{"-C", dir, "checkout"}); err != nil || stat != 0 {
+			log.Fatalf("Package %s - checkout failed \nStatus %d Error: %v\n", p.Name, stat, err)
+		}
+	}
+}
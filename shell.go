@@ -0,0 +1,329 @@
+package main
+
+/*
+  Shell environments for build commands.
+
+  A build command with a 'shell' attribute is not started directly: the
+  command, which can be any shell snippet, followed by its quoted arguments,
+  is passed to the requested shell. On Windows, the POSIX-like environments
+  MSYS2, Cygwin and Git Bash are supported; absolute Windows paths in the
+  command arguments are translated to the path format of the environment.
+  On other systems, these commands are run by 'sh'. PowerShell commands are
+  run by Windows PowerShell ('powershell') or PowerShell 7 ('pwsh'). The
+  'system' shell, selected also by '"shell": true', is CMD on Windows and
+  'sh' on other systems.
+*/
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"unicode/utf16"
+)
+
+// A shell used to run build commands
+type ShellEnv struct {
+	prog  string              //shell executable
+	args  []string            //arguments placed before the command line
+	env   []string            //environment variables
+	paths func(string) string //translation of absolute Windows paths
+	quote func(string) string //quoting of arguments
+	wrap  func(string) string //transformation of command line
+}
+
+// Name of the shell used to run a build command. In descriptors, it can be
+// also a boolean: true selects the system shell.
+type ShellName string
+
+func (s *ShellName) UnmarshalJSON(data []byte) error {
+	var b bool
+	if err := json.Unmarshal(data, &b); err == nil {
+		*s = ""
+		if b {
+			*s = "system"
+		}
+		return nil
+	}
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		return fmt.Errorf("shell must be a string or a boolean")
+	}
+	*s = ShellName(name)
+	return nil
+}
+
+// Functions that locate the supported shells
+var shell_finders = map[string]func() *ShellEnv{
+	"msys2":   find_msys2,
+	"cygwin":  find_cygwin,
+	"gitbash": find_gitbash,
+	//PowerShell is not a POSIX shell
+	"powershell": find_powershell,
+	"pwsh":       find_pwsh,
+	"system":     find_system,
+}
+
+var shell_cache = make(map[string]*ShellEnv)
+var shell_mutex sync.Mutex
+
+// Return the shell with the given name. Fails if shell cannot be found.
+func find_shell(name string) *ShellEnv {
+	shell_mutex.Lock()
+	defer shell_mutex.Unlock()
+	name = strings.ToLower(name)
+	if sh, ok := shell_cache[name]; ok {
+		return sh
+	}
+	finder, ok := shell_finders[name]
+	if !ok {
+		var names []string
+		for n := range shell_finders {
+			names = append(names, n)
+		}
+		slices.Sort(names)
+		log.Fatalf("Unknown shell %s. Valid shells are: %s", name, strings.Join(names, ", "))
+	}
+	var sh *ShellEnv
+	if runtime.GOOS != "windows" && name != "powershell" && name != "pwsh" {
+		sh = &ShellEnv{prog: "sh", args: []string{"-c"}}
+	} else if sh = finder(); sh == nil {
+		if name == "powershell" || name == "pwsh" {
+			log.Fatalf("Fatal - %s not found in PATH", name)
+		}
+		log.Fatalf("Fatal - %s shell not found. Use '%s.root' setting to indicate its location.", name, name)
+	}
+	Verbosef("Using %s shell %s\n", name, sh.prog)
+	shell_cache[name] = sh
+	return sh
+}
+
+// Return the program, arguments and environment that run a command in a
+// shell
+func shell_command(name ShellName, prog string, args []string) (string, []string, []string) {
+	sh := find_shell(string(name))
+	quote := sh.quote
+	if quote == nil {
+		quote = sh_quote
+	}
+	words := []string{prog}
+	for _, a := range args {
+		if sh.paths != nil {
+			a = translate_paths(a, sh.paths)
+		}
+		words = append(words, quote(a))
+	}
+	line := strings.Join(words, " ")
+	if sh.wrap != nil {
+		line = sh.wrap(line)
+	}
+	return sh.prog, append(slices.Clone(sh.args), line), sh.env
+}
+
+// Quote a word for a POSIX shell
+func sh_quote(s string) string {
+	if s != "" && strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./=:,+@%", r))
+	}) < 0 {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+var winpath_re = regexp.MustCompile(`^([A-Za-z]):[\\/]`)
+
+// Translate an argument that is an absolute Windows path, or has the form
+// 'option=path', using the translation function tr
+func translate_paths(arg string, tr func(string) string) string {
+	if winpath_re.MatchString(arg) {
+		return tr(arg)
+	}
+	if opt, path, ok := strings.Cut(arg, "="); ok && winpath_re.MatchString(path) {
+		return opt + "=" + tr(path)
+	}
+	return arg
+}
+
+// Return a function translating 'C:\dir\file' to '<prefix>/c/dir/file'
+func drive_paths(prefix string) func(string) string {
+	return func(p string) string {
+		return prefix + "/" + strings.ToLower(p[:1]) + strings.ReplaceAll(p[2:], `\`, "/")
+	}
+}
+
+// Return the first folder from a list where file exists
+func find_root_with(file string, roots ...string) string {
+	for _, root := range roots {
+		if root == "" {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(root, file)); err == nil {
+			return root
+		}
+	}
+	return ""
+}
+
+// Return root folder of the environment that provides a program found in
+// PATH. The program is assumed to be in '<root>/<subdir>'.
+func root_of_program(prog string, subdir string) string {
+	path, err := exec.LookPath(prog)
+	if err != nil {
+		return ""
+	}
+	dir := filepath.Dir(path)
+	root := dir
+	for range strings.Split(subdir, "/") {
+		root = filepath.Dir(root)
+	}
+	if !strings.EqualFold(filepath.Join(root, filepath.FromSlash(subdir)), dir) {
+		return ""
+	}
+	return root
+}
+
+func find_msys2() *ShellEnv {
+	bash := filepath.Join("usr", "bin", "bash.exe")
+	root := find_root_with(bash,
+		config_get("msys2.root", os.Getenv("MSYS2_ROOT")),
+		root_of_program("pacman", "usr/bin"), //running inside MSYS2
+		`C:\msys64`, `C:\msys32`)
+	if root == "" {
+		return nil
+	}
+	msystem := os.Getenv("MSYSTEM")
+	if msystem == "" {
+		msystem = config_get("msys2.msystem", "UCRT64")
+	}
+	return &ShellEnv{
+		prog:  filepath.Join(root, bash),
+		args:  []string{"--login", "-c"},
+		env:   []string{"MSYSTEM=" + msystem, "CHERE_INVOKING=1"},
+		paths: drive_paths(""),
+	}
+}
+
+func find_cygwin() *ShellEnv {
+	bash := filepath.Join("bin", "bash.exe")
+	root := find_root_with(filepath.Join("bin", "cygwin1.dll"),
+		config_get("cygwin.root", os.Getenv("CYGWIN_ROOT")),
+		root_of_program("cygpath", "bin"),
+		`C:\cygwin64`, `C:\cygwin`)
+	if root == "" {
+		return nil
+	}
+	return &ShellEnv{
+		prog:  filepath.Join(root, bash),
+		args:  []string{"--login", "-c"},
+		env:   []string{"CHERE_INVOKING=1"},
+		paths: drive_paths("/cygdrive"),
+	}
+}
+
+func find_gitbash() *ShellEnv {
+	bash := filepath.Join("bin", "bash.exe")
+	root := find_root_with(bash,
+		config_get("gitbash.root", ""),
+		root_of_program("git", "cmd"),
+		root_of_program("git", "mingw64/bin"),
+		`C:\Program Files\Git`)
+	if root == "" {
+		return nil
+	}
+	return &ShellEnv{
+		prog:  filepath.Join(root, bash),
+		args:  []string{"--login", "-c"},
+		env:   []string{"MSYSTEM=MINGW64", "CHERE_INVOKING=1"},
+		paths: drive_paths(""),
+	}
+}
+
+// Quote a word for PowerShell
+func ps_quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// Return a PowerShell environment using the given executable. Commands are
+// passed encoded to avoid quoting problems and the exit code of the last
+// program becomes the exit code of the shell.
+func powershell_env(prog string) *ShellEnv {
+	args := []string{"-NoProfile", "-NonInteractive"}
+	if runtime.GOOS == "windows" {
+		args = append(args, "-ExecutionPolicy", "Bypass")
+	}
+	return &ShellEnv{
+		prog:  prog,
+		args:  append(args, "-EncodedCommand"),
+		quote: ps_quote,
+		wrap: func(line string) string {
+			script := "$ErrorActionPreference = 'Stop'\n" + line + "\nif ($LASTEXITCODE) { exit $LASTEXITCODE }\n"
+			var buf []byte
+			for _, c := range utf16.Encode([]rune(script)) {
+				buf = append(buf, byte(c), byte(c>>8))
+			}
+			return base64.StdEncoding.EncodeToString(buf)
+		},
+	}
+}
+
+func find_powershell() *ShellEnv {
+	prog, err := exec.LookPath("powershell")
+	if err != nil {
+		//PowerShell 7 is the only one on other systems
+		return find_pwsh()
+	}
+	return powershell_env(prog)
+}
+
+func find_pwsh() *ShellEnv {
+	prog, err := exec.LookPath("pwsh")
+	if err != nil {
+		return nil
+	}
+	return powershell_env(prog)
+}
+
+// Return CMD executable
+func cmd_exe() string {
+	if comspec := os.Getenv("ComSpec"); comspec != "" {
+		return comspec
+	}
+	return "cmd.exe"
+}
+
+// Quote a word for CMD. CMD has no escape character inside quotes; quotes
+// are doubled.
+func cmd_quote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\"&|<>^(),;=") {
+		return s
+	}
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+// Return true if prog is a batch file. Batch files are run by CMD.
+func is_batch_file(prog string) bool {
+	path, err := exec.LookPath(prog)
+	if err != nil {
+		return false
+	}
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".bat" || ext == ".cmd"
+}
+
+// System shell on Windows. The command line is passed to CMD verbatim.
+func find_system() *ShellEnv {
+	return &ShellEnv{
+		prog:  cmd_exe(),
+		args:  []string{"/d", "/s", "/c"},
+		quote: cmd_quote,
+		wrap:  func(line string) string { return `"` + line + `"` },
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+/*
+  Status of the development tree.
+
+  'cpm status [<package>]' shows, for every package of the tree, the
+  checked-out branch and commit, whether the working copy has local
+  changes, how many commits it is ahead of and behind its upstream branch
+  and whether the checked-out commit is the one recorded in the lockfile of
+  the root package.
+
+  The upstream of a branch is its tracking branch; a detached HEAD is
+  compared with 'origin/<branch>' when the dependency has a branch. Remote
+  branches are as of the last fetch; with the '--fetch' option they are
+  fetched first. Ahead/behind counts are available only for Git
+  repositories.
+*/
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// Status of a package working copy
+type PackageStatus struct {
+	Name     string `json:"name"`
+	Branch   string `json:"branch"`
+	Commit   string `json:"commit"`
+	Modified bool   `json:"modified"`
+	Upstream string `json:"upstream,omitempty"` //branch compared for ahead/behind counts
+	Ahead    int    `json:"ahead"`
+	Behind   int    `json:"behind"`
+	Lock     string `json:"lock"` //"match", "differs", "not locked" or "-"
+}
+
+// Return upstream branch of a Git working copy or "" if it has none
+func git_upstream(dir string, p *PacUnit) string {
+	if branch := (git_vcs{}).Branch(dir); branch != "" {
+		out, _ := Output("git", "-C", dir, "for-each-ref", "--format=%(upstream:short)", "refs/heads/"+branch)
+		return strings.TrimSpace(out)
+	}
+	if p.Branch == "" {
+		return ""
+	}
+	out, _ := Output("git", "-C", dir, "for-each-ref", "--format=%(refname:short)", "refs/remotes/origin/"+p.Branch)
+	return strings.TrimSpace(out)
+}
+
+// Return status of a package
+func package_status(p *PacUnit, lock *Lockfile, fetch bool) PackageStatus {
+	dir := package_dir(p)
+	st := PackageStatus{Name: p.Name, Lock: "-"}
+	st.Branch, st.Commit = checked_out(dir)
+	v := folder_vcs(dir)
+	if v == nil || load_archive_state(dir) != nil || workspace && dir == devroot {
+		return st
+	}
+	st.Modified = v.Modified(dir)
+	rev, err := v.Revision(dir)
+	if err != nil {
+		return st
+	}
+	if e := lock.find(p.Name); e != nil {
+		st.Lock = "differs"
+		if e.Commit == rev {
+			st.Lock = "match"
+		}
+	} else if lock != nil && p != all_packs[0] && p.path == "" {
+		st.Lock = "not locked"
+	}
+	if v.Name() != "git" {
+		return st
+	}
+	if fetch && !*local_flag {
+		what := "Fetching " + dir
+		if stat, err := run_network(dir, what, "git", []string{"-C", dir, "fetch", "-q", "origin"}); err != nil || stat != 0 {
+			fmt.Printf("WARNING - %s failed. Status %d Error: %v\n", what, stat, err)
+		}
+	}
+	if st.Upstream = git_upstream(dir, p); st.Upstream != "" {
+		out, err := Output("git", "-C", dir, "rev-list", "--left-right", "--count", "HEAD..."+st.Upstream)
+		if err == nil {
+			fmt.Sscan(out, &st.Ahead, &st.Behind)
+		}
+	}
+	return st
+}
+
+// Implementation of 'cpm status' command
+func status(args []string) {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	fetch := flags.Bool("fetch", false, "fetch remote branches first")
+	format := flags.String("format", "text", "output format (text or json)")
+	pos := parse_interspersed(flags, args)
+	if len(pos) > 1 || *format != "text" && *format != "json" {
+		log.Fatal("Usage: cpm status [--fetch] [--format text|json] [<package>]")
+	}
+	pkg := ""
+	if len(pos) == 1 {
+		pkg = pos[0]
+	}
+	//warnings don't mix with JSON output
+	out := os.Stdout
+	if *format == "json" {
+		os.Stdout = os.Stderr
+	}
+	root := load_tree(pkg)
+	lock, err := read_lockfile(root_lockfile())
+	if err != nil {
+		fmt.Printf("WARNING - cannot read lockfile of %s - %v\n", root.Name, err)
+	}
+
+	list := []PackageStatus{}
+	for _, p := range all_packs {
+		list = append(list, package_status(p, lock, *fetch))
+	}
+	if *format == "json" {
+		data, _ := json.MarshalIndent(list, "", "  ")
+		fmt.Fprintln(out, string(data))
+		return
+	}
+	fmt.Printf("%-20s %-20s %-10s %-8s %-16s %s\n", "PACKAGE", "BRANCH", "COMMIT", "STATE", "UPSTREAM", "LOCK")
+	for _, st := range list {
+		state := "clean"
+		if st.Modified {
+			state = "dirty"
+		}
+		upstream := "-"
+		if st.Upstream != "" {
+			switch {
+			case st.Ahead == 0 && st.Behind == 0:
+				upstream = "up to date"
+			case st.Behind == 0:
+				upstream = fmt.Sprintf("ahead %d", st.Ahead)
+			case st.Ahead == 0:
+				upstream = fmt.Sprintf("behind %d", st.Behind)
+			default:
+				upstream = fmt.Sprintf("+%d -%d", st.Ahead, st.Behind)
+			}
+		}
+		fmt.Printf("%-20s %-20s %-10s %-8s %-16s %s\n", st.Name, st.Branch, st.Commit, state, upstream, st.Lock)
+	}
+	if summary := maintenance_summary(); summary != "" {
+		fmt.Println(summary)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+/*
+  Failure summary.
+
+  The output of fetch and build commands is also written, converted to
+  UTF-8 (see encoding.go), to the log of the package:
+  '<devroot>/.cpm/logs/<package>.log'. When updating a package
+  tree fails, CPM ends with a summary of the failure: the error, the command
+  that failed, the last lines of its log and suggested commands. A failed
+  command is forgotten when a later command succeeds in the same folder, so
+  failed probes and retried commands are not shown.
+*/
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const summary_lines = 20 //log lines shown in failure summary
+
+var build_logs sync.Map      //package folder -> *build_log
+var logged_packages sync.Map //names of packages logged in this run
+
+// Log of a package build
+type build_log struct {
+	file *os.File
+	w    *utf8_writer
+}
+
+// Command that failed
+type CommandFailure struct {
+	Dir     string
+	Command string
+	Log     string //log file or empty if output was not logged
+}
+
+// Failed commands not followed by a successful command in the same folder,
+// most recent last
+var failures []*CommandFailure
+var failure_mutex sync.Mutex
+var run_phase string //"fetch" or "build" while updating a package tree
+var summary_once sync.Once
+
+// Return log file of a package
+func build_log_name(p *PacUnit) string {
+	return filepath.Join(devroot, ".cpm", "logs", p.Name+".log")
+}
+
+// Start logging output of commands run in folder of package p. The log is
+// created by the first call in a run; later calls append to it, so the log
+// has the output of the fetch and build of the package.
+func open_build_log(p *PacUnit) {
+	fname := build_log_name(p)
+	os.MkdirAll(filepath.Dir(fname), 0755)
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if _, seen := logged_packages.LoadOrStore(p.Name, true); !seen {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(fname, flags, 0644)
+	if err != nil {
+		Verbosef("Cannot create log %s - %v\n", fname, err)
+		return
+	}
+	var w io.Writer = f
+	if run_phase == "build" {
+		//diagnostics are searched in build output only
+		w = &problem_writer{f, p.Name}
+	}
+	build_logs.Store(package_dir(p), &build_log{f, new_utf8_writer(w)})
+}
+
+// Stop logging output of commands run in folder of package p
+func close_build_log(p *PacUnit) {
+	if l, ok := build_logs.LoadAndDelete(package_dir(p)); ok {
+		l.(*build_log).w.Flush()
+		l.(*build_log).file.Close()
+	}
+}
+
+// Return writers for standard output and error of a command run in dir
+func command_output(dir string) (io.Writer, io.Writer) {
+	if l, ok := build_logs.Load(dir); ok {
+		return progress_output(l.(*build_log).w)
+	}
+	return os.Stdout, os.Stderr
+}
+
+// Record a command that failed
+func record_failure(dir string, prog string, args []string) {
+	words := []string{prog}
+	for _, a := range args {
+		words = append(words, sh_quote(a))
+	}
+	failure := &CommandFailure{Dir: dir, Command: strings.Join(words, " ")}
+	if l, ok := build_logs.Load(dir); ok {
+		failure.Log = l.(*build_log).file.Name()
+	}
+	failure_mutex.Lock()
+	failures = append(slices.DeleteFunc(failures, func(f *CommandFailure) bool { return f.Dir == dir }), failure)
+	failure_mutex.Unlock()
+}
+
+// Forget the failure of a command run in dir after a command succeeds in the
+// same folder: the failure was a probe or was retried
+func clear_failure(dir string) {
+	failure_mutex.Lock()
+	failures = slices.DeleteFunc(failures, func(f *CommandFailure) bool { return f.Dir == dir })
+	failure_mutex.Unlock()
+}
+
+// Return the last n lines of a file
+func tail_lines(fname string, n int) []string {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+		if len(lines) > n {
+			lines = lines[1:]
+		}
+	}
+	return lines
+}
+
+// Return command line of this run, with changed options
+func command_line(options ...string) string {
+	words := append([]string{"cpm"}, options...)
+	for _, a := range os.Args[1:] {
+		words = append(words, sh_quote(a))
+	}
+	return strings.Join(words, " ")
+}
+
+// Print summary of a failed run. Msg is the error that stopped CPM.
+func print_failure_summary(msg string) {
+	if run_phase == "" {
+		return
+	}
+	summary_once.Do(func() {
+		failure_mutex.Lock()
+		var failure *CommandFailure
+		if len(failures) != 0 {
+			failure = failures[len(failures)-1]
+		}
+		failure_mutex.Unlock()
+
+		w := os.Stderr
+		fmt.Fprintf(w, "\n======== CPM failed during %s ========\n", run_phase)
+		fmt.Fprintf(w, "Error: %s\n", msg)
+		network_mutex.Lock()
+		if network_failure != "" {
+			fmt.Fprintf(w, "Network: %s\n", network_failure)
+		}
+		network_mutex.Unlock()
+		var pack *PacUnit
+		if failure != nil {
+			for _, p := range all_packs {
+				if package_dir(p) == failure.Dir {
+					pack = p
+				}
+			}
+			if pack != nil {
+				fmt.Fprintf(w, "Package: %s\n", pack.Name)
+			}
+			fmt.Fprintf(w, "Command: %s\n", failure.Command)
+			if failure.Dir != "" {
+				fmt.Fprintf(w, "Folder:  %s\n", failure.Dir)
+			}
+			if failure.Log != "" {
+				if l, ok := build_logs.Load(failure.Dir); ok {
+					l.(*build_log).w.Flush()
+				}
+				fmt.Fprintf(w, "Last lines of log:\n")
+				for _, line := range tail_lines(failure.Log, summary_lines) {
+					fmt.Fprintf(w, "  | %s\n", line)
+				}
+				fmt.Fprintf(w, "Full log: %s\n", failure.Log)
+			}
+		}
+		print_problems(w)
+
+		fmt.Fprintf(w, "Next steps:\n")
+		fmt.Fprintf(w, "  retry:                 %s\n", command_line())
+		if !*verbose_flag {
+			fmt.Fprintf(w, "  retry with details:    %s\n", command_line("-v"))
+		}
+		if run_phase == "fetch" && !*local_flag {
+			fmt.Fprintf(w, "  build without fetching: %s\n", command_line("-l"))
+		}
+		if run_phase == "build" && pack != nil && pack != all_packs[0] {
+			fmt.Fprintf(w, "  build only %s: cpm -r %s -l %s\n", pack.Name, sh_quote(devroot), pack.Name)
+			for _, c := range all_packs {
+				for _, d := range c.Depends {
+					if d.pack == pack {
+						fmt.Fprintf(w, "  exclude %s from build: add {\"depends\": [{\"name\": %q, \"fetchOnly\": true}]} to %s\n",
+							pack.Name, pack.Name, filepath.Join(package_dir(c), overlay_name))
+					}
+				}
+			}
+		}
+		fmt.Fprintf(w, "  report a bug:          cpm -r %s report-bug\n", sh_quote(devroot))
+	})
+}
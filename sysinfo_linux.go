@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// Run a command
+func run_process(cmd *exec.Cmd) error {
+	return cmd.Run()
+}
+
+// Peak memory (bytes) used by a finished process
+func process_peak_mem(state *os.ProcessState) uint64 {
+	if ru, ok := state.SysUsage().(*syscall.Rusage); ok {
+		return uint64(ru.Maxrss) * 1024
+	}
+	return 0
+}
+
+// Available physical memory (bytes) or 0 if unknown
+func available_memory() uint64 {
+	data, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if f := strings.Fields(line); len(f) >= 2 && f[0] == "MemAvailable:" {
+			kb, _ := strconv.ParseUint(f[1], 10, 64)
+			return kb * 1024
+		}
+	}
+	return 0
+}
+
+var last_swapout atomic.Uint64
+
+// Return true if pages have been swapped out since previous call
+func swapping() bool {
+	data, err := os.ReadFile("/proc/vmstat")
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if f := strings.Fields(line); len(f) == 2 && f[0] == "pswpout" {
+			n, _ := strconv.ParseUint(f[1], 10, 64)
+			last := last_swapout.Swap(n)
+			return last != 0 && n > last
+		}
+	}
+	return false
+}
@@ -0,0 +1,36 @@
+//go:build !linux && !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+)
+
+// Run a command
+func run_process(cmd *exec.Cmd) error {
+	return cmd.Run()
+}
+
+// Peak memory (bytes) used by a finished process
+func process_peak_mem(state *os.ProcessState) uint64 {
+	if ru, ok := state.SysUsage().(*syscall.Rusage); ok {
+		if runtime.GOOS == "darwin" {
+			return uint64(ru.Maxrss) //already in bytes
+		}
+		return uint64(ru.Maxrss) * 1024
+	}
+	return 0
+}
+
+// Available physical memory (bytes) or 0 if unknown
+func available_memory() uint64 {
+	return 0
+}
+
+// Swapping detection is not available on this platform
+func swapping() bool {
+	return false
+}
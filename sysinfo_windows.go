@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+var kernel32 = syscall.NewLazyDLL("kernel32.dll")
+var proc_global_memory_status = kernel32.NewProc("GlobalMemoryStatusEx")
+var proc_get_process_memory_info = kernel32.NewProc("K32GetProcessMemoryInfo")
+
+const (
+	process_query_limited_information = 0x1000
+	process_vm_read                   = 0x10
+)
+
+var peak_mems sync.Map //*os.ProcessState -> peak working set
+
+// MEMORYSTATUSEX structure
+type memory_status struct {
+	Length               uint32
+	MemoryLoad           uint32
+	TotalPhys            uint64
+	AvailPhys            uint64
+	TotalPageFile        uint64
+	AvailPageFile        uint64
+	TotalVirtual         uint64
+	AvailVirtual         uint64
+	AvailExtendedVirtual uint64
+}
+
+// PROCESS_MEMORY_COUNTERS structure
+type process_memory_counters struct {
+	Cb                         uint32
+	PageFaultCount             uint32
+	PeakWorkingSetSize         uintptr
+	WorkingSetSize             uintptr
+	QuotaPeakPagedPoolUsage    uintptr
+	QuotaPagedPoolUsage        uintptr
+	QuotaPeakNonPagedPoolUsage uintptr
+	QuotaNonPagedPoolUsage     uintptr
+	PagefileUsage              uintptr
+	PeakPagefileUsage          uintptr
+}
+
+// Run a command and record its peak memory
+func run_process(cmd *exec.Cmd) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	ph, err := syscall.OpenProcess(process_query_limited_information|process_vm_read, false, uint32(cmd.Process.Pid))
+	if err != nil {
+		return cmd.Wait()
+	}
+	defer syscall.CloseHandle(ph)
+	return wait_process(cmd, ph)
+}
+
+// Wait for a started command and record its peak memory. The handle ph of
+// the process keeps its counters available after it exits.
+func wait_process(cmd *exec.Cmd, ph syscall.Handle) error {
+	err := cmd.Wait()
+	var pmc process_memory_counters
+	pmc.Cb = uint32(unsafe.Sizeof(pmc))
+	if r, _, _ := proc_get_process_memory_info.Call(uintptr(ph), uintptr(unsafe.Pointer(&pmc)), uintptr(pmc.Cb)); r != 0 && cmd.ProcessState != nil {
+		peak_mems.Store(cmd.ProcessState, uint64(pmc.PeakWorkingSetSize))
+	}
+	return err
+}
+
+// Peak memory (bytes) used by a finished process run by run_process. The
+// value is returned only once.
+func process_peak_mem(state *os.ProcessState) uint64 {
+	if m, ok := peak_mems.LoadAndDelete(state); ok {
+		return m.(uint64)
+	}
+	return 0
+}
+
+func global_memory_status() (ms memory_status, ok bool) {
+	ms.Length = uint32(unsafe.Sizeof(ms))
+	r, _, _ := proc_global_memory_status.Call(uintptr(unsafe.Pointer(&ms)))
+	return ms, r != 0
+}
+
+// Available physical memory (bytes) or 0 if unknown
+func available_memory() uint64 {
+	if ms, ok := global_memory_status(); ok {
+		return ms.AvailPhys
+	}
+	return 0
+}
+
+// Return true if memory load is so high that the system is likely paging
+func swapping() bool {
+	ms, ok := global_memory_status()
+	return ok && ms.MemoryLoad >= 95
+}
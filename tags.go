@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Return true if package is developed in-house. In-house packages are those
+// whose URL starts with one of the prefixes in the 'inhouse' configuration
+// setting. If the setting is missing, all packages are in-house.
+func is_inhouse(p *PacUnit) bool {
+	prefixes := strings.Fields(config_get("inhouse", ""))
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range prefixes {
+		if (p.Git != "" && strings.HasPrefix(p.Git, prefix)) ||
+			(p.Https != "" && strings.HasPrefix(p.Https, prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return true if package is a Git repository of its own. Local packages are
+// part of another repository and are not checked.
+func is_git_package(p *PacUnit) bool {
+	return p.path == "" && p.archive == "" && p.prebuilt == nil && p.repository == "" &&
+		p.provider == "" && package_vcs(p).Name() == "git"
+}
+
+const skipped_not_git = "skipped (not git)"
+
+// Return release readiness of package p: "OK" or the problem found
+func release_status(p *PacUnit, release string, lock *Lockfile) string {
+	if !is_git_package(p) {
+		return skipped_not_git
+	}
+	dir := package_dir(p)
+	if _, err := Output("git", "-C", dir, "rev-parse", "-q", "--verify", "refs/tags/"+release); err != nil {
+		return "missing tag"
+	}
+	if _, err := Output("git", "-C", dir, "merge-base", "--is-ancestor", release, "HEAD"); err != nil {
+		return "tag not reachable from HEAD"
+	}
+	if lock != nil {
+		head, _ := Output("git", "-C", dir, "rev-parse", "HEAD")
+		if e := lock.find(p.Name); e == nil {
+			return "not in lockfile"
+		} else if e.Commit != strings.TrimSpace(head) {
+			return "HEAD doesn't match lockfile"
+		}
+	}
+	return "OK"
+}
+
+// Implementation of 'cpm check-tags <release> [<package>]' command
+func check_tags(args []string) {
+	flags := flag.NewFlagSet("check-tags", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		log.Fatal("Usage: cpm check-tags <release> [<package>]")
+	}
+	release := flags.Arg(0)
+	root := load_tree(flags.Arg(1))
+
+	lock, err := read_lockfile(root_lockfile())
+	if err != nil {
+		fmt.Printf("WARNING - cannot read lockfile of %s - %v\n", root.Name, err)
+	}
+
+	problems := 0
+	fmt.Printf("Release readiness for %s:\n", release)
+	for _, p := range all_packs {
+		if p == root || !is_inhouse(p) {
+			continue
+		}
+		status := release_status(p, release, lock)
+		if status != "OK" && status != skipped_not_git {
+			problems++
+		}
+		fmt.Printf("  %-20s %s\n", p.Name, status)
+	}
+
+	if problems != 0 {
+		fmt.Printf("%d package(s) not ready for release %s\n", problems, release)
+		exit_failed("packages not ready for release")
+	}
+	fmt.Printf("All packages ready for release %s\n", release)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestReleaseStatusSkipsNonGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	saved_root := devroot
+	defer func() { devroot = saved_root }()
+	devroot = t.TempDir()
+
+	//dev tree is a Git repository tagged with the release
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-C", devroot, "-c", "user.name=t", "-c", "user.email=t@t"}, args...)...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v - %v\n%s", args, err, out)
+		}
+	}
+	git("init", "-q")
+	git("commit", "-q", "--allow-empty", "-m", "init")
+	git("tag", "v1.0")
+
+	packs := []*PacUnit{
+		{Name: "zlib", archive: "https://example.com/zlib.tar.gz"},
+		{Name: "local", path: filepath.Join(devroot, "local")},
+		{Name: "hglib", Hg: "https://example.com/hglib"},
+		{Name: "svnlib", Svn: "https://example.com/svnlib"},
+		{Name: "p4lib", Depot: "//depot/p4lib"},
+		{Name: "bin", prebuilt: &PrebuiltBinary{Url: "https://example.com/bin.zip"}},
+		{Name: "art", repository: "https://example.com/artifactory"},
+		{Name: "plug", provider: "custom"},
+	}
+	for _, p := range packs {
+		os.MkdirAll(package_dir(p), 0755)
+		if status := release_status(p, "v1.0", nil); status != skipped_not_git {
+			t.Errorf("package %s - status %q, want %q", p.Name, status, skipped_not_git)
+		}
+	}
+
+	p := &PacUnit{Name: "utils", Git: "https://example.com/utils.git"}
+	os.MkdirAll(package_dir(p), 0755)
+	if status := release_status(p, "v1.0", nil); status == skipped_not_git {
+		t.Errorf("Git package %s skipped", p.Name)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+/*
+  Build targets.
+
+  By default packages are built for the host OS. The '--target <name>' or
+  '--target <name>:<variant>' option selects a cross-compilation target
+  (the variant is an ABI or an SDK). A target:
+  - selects the build commands: commands whose 'os' attribute contains the
+    target name are issued instead of those for the host OS;
+  - sets environment variables for the toolchain of the target;
+  - routes build artifacts to the 'lib/<target>[/<variant>]' folder: the
+    'lib' symlink of every package points to this folder.
+  Build commands can use the CPM_TARGET and CPM_LIBDIR environment variables.
+*/
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+var target_flag = flag.String("target", "", "build target")
+
+var target_name string    //name of selected target
+var target_variant string //ABI or SDK of selected target
+
+// Setup functions of known targets. They receive the requested variant (ABI
+// or SDK) and return the selected variant and environment variables for the
+// target toolchain.
+var targets = map[string]func(variant string) (string, map[string]string){
+	"wasm":    wasm_target,
+	"android": android_target,
+	"ios":     ios_target,
+}
+
+// Return name of target OS used to select build commands
+func target_os() string {
+	if target_name != "" {
+		return target_name
+	}
+	return runtime.GOOS
+}
+
+// Return processor architecture of selected target and variant, named like
+// Go architectures ('amd64', 'arm64'...)
+func target_arch() string {
+	switch target_name {
+	case "wasm":
+		return "wasm"
+	case "android":
+		return android_archs[target_variant]
+	case "ios":
+		if target_variant == "iphoneos" {
+			return "arm64"
+		}
+	}
+	//simulators run on host processor
+	return runtime.GOARCH
+}
+
+// Return folder where libraries are placed
+func lib_dir() string {
+	return filepath.Join(devroot, "lib", target_name, target_variant)
+}
+
+// Set up environment for selected target
+func setup_target() {
+	if *target_flag != "" {
+		target_name, target_variant, _ = strings.Cut(*target_flag, ":")
+		setup, ok := targets[target_name]
+		if !ok {
+			var names []string
+			for name := range targets {
+				names = append(names, name)
+			}
+			slices.Sort(names)
+			log.Fatalf("Unknown target %s. Valid targets are: %s", target_name, strings.Join(names, ", "))
+		}
+		var env map[string]string
+		target_variant, env = setup(target_variant)
+		for key, value := range env {
+			Verbosef("Setting %s=%s\n", key, value)
+			os.Setenv(key, value)
+		}
+	}
+	os.Setenv("CPM_TARGET", target_os())
+	os.Setenv("CPM_LIBDIR", lib_dir())
+}
+
+// Emscripten (WebAssembly) target. Experimental.
+func wasm_target(variant string) (string, map[string]string) {
+	if variant != "" {
+		log.Fatalf("Target wasm doesn't have variants")
+	}
+	fmt.Println("WARNING - wasm target is experimental")
+	emcc, err := exec.LookPath("emcc")
+	if err != nil {
+		log.Fatal("Fatal - emcc not found. Activate Emscripten SDK (emsdk_env) before using wasm target.")
+	}
+	env := map[string]string{
+		"CC":     "emcc",
+		"CXX":    "em++",
+		"AR":     "emar",
+		"RANLIB": "emranlib",
+	}
+	//Emscripten toolchain file for CMake builds
+	toolchain := filepath.Join(filepath.Dir(emcc), "cmake", "Modules", "Platform", "Emscripten.cmake")
+	if _, err := os.Stat(toolchain); err == nil {
+		env["CMAKE_TOOLCHAIN_FILE"] = toolchain
+	}
+	return "", env
+}
+
+// Android ABIs and corresponding compiler target triples
+var android_abis = map[string]string{
+	"arm64-v8a":   "aarch64-linux-android",
+	"armeabi-v7a": "armv7a-linux-androideabi",
+	"x86":         "i686-linux-android",
+	"x86_64":      "x86_64-linux-android",
+}
+
+// Processor architectures of Android ABIs
+var android_archs = map[string]string{
+	"arm64-v8a":   "arm64",
+	"armeabi-v7a": "arm",
+	"x86":         "386",
+	"x86_64":      "amd64",
+}
+
+// Android target using the NDK. Variant is the ABI (default 'arm64-v8a').
+func android_target(abi string) (string, map[string]string) {
+	if abi == "" {
+		abi = "arm64-v8a"
+	}
+	triple, ok := android_abis[abi]
+	if !ok {
+		log.Fatalf("Unknown Android ABI %s. Valid ABIs are: arm64-v8a, armeabi-v7a, x86, x86_64", abi)
+	}
+	ndk := config_get("android.ndk", os.Getenv("ANDROID_NDK_ROOT"))
+	if ndk == "" {
+		ndk = os.Getenv("ANDROID_NDK_HOME")
+	}
+	if ndk == "" {
+		log.Fatal("Fatal - Android NDK not found. Set ANDROID_NDK_ROOT environment variable or 'android.ndk' setting.")
+	}
+	api := config_get("android.platform", "24")
+
+	host := runtime.GOOS + "-x86_64"
+	bin := filepath.Join(ndk, "toolchains", "llvm", "prebuilt", host, "bin")
+	if _, err := os.Stat(bin); err != nil {
+		log.Fatalf("Fatal - Android NDK toolchain not found in %s", bin)
+	}
+	compiler := func(name string) string {
+		if runtime.GOOS == "windows" {
+			name += ".cmd"
+		}
+		return filepath.Join(bin, triple+api+"-"+name)
+	}
+	return abi, map[string]string{
+		"ANDROID_NDK_ROOT":     ndk,
+		"ANDROID_ABI":          abi,
+		"ANDROID_PLATFORM":     "android-" + api,
+		"CC":                   compiler("clang"),
+		"CXX":                  compiler("clang++"),
+		"AR":                   filepath.Join(bin, "llvm-ar"),
+		"RANLIB":               filepath.Join(bin, "llvm-ranlib"),
+		"CMAKE_TOOLCHAIN_FILE": filepath.Join(ndk, "build", "cmake", "android.toolchain.cmake"),
+	}
+}
+
+// iOS target using Xcode tools. Variant is the SDK: 'iphoneos' (default) or
+// 'iphonesimulator'.
+func ios_target(sdk string) (string, map[string]string) {
+	if runtime.GOOS != "darwin" {
+		log.Fatal("Fatal - ios target requires macOS")
+	}
+	if sdk == "" {
+		sdk = "iphoneos"
+	}
+	arch := "arm64"
+	switch sdk {
+	case "iphoneos":
+	case "iphonesimulator":
+		if runtime.GOARCH == "amd64" {
+			arch = "x86_64"
+		}
+	default:
+		log.Fatalf("Unknown iOS SDK %s. Valid SDKs are: iphoneos, iphonesimulator", sdk)
+	}
+	xcrun := func(args ...string) string {
+		out, err := Output("xcrun", append([]string{"--sdk", sdk}, args...)...)
+		if err != nil {
+			log.Fatalf("Fatal - xcrun %v failed - %v", args, err)
+		}
+		return strings.TrimSpace(out)
+	}
+	return sdk, map[string]string{
+		"SDKROOT":                    xcrun("--show-sdk-path"),
+		"CPM_SDK":                    sdk,
+		"CMAKE_OSX_ARCHITECTURES":    arch,
+		"IPHONEOS_DEPLOYMENT_TARGET": config_get("ios.deployment-target", "13.0"),
+		"CC":                         xcrun("-f", "clang"),
+		"CXX":                        xcrun("-f", "clang++"),
+		"AR":                         xcrun("-f", "ar"),
+		"RANLIB":                     xcrun("-f", "ranlib"),
+	}
+}
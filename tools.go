@@ -0,0 +1,184 @@
+package main
+
+/*
+  Build tools.
+
+  The root descriptor can list the tools needed to build the tree, with a
+  version constraint and, optionally, portable versions for each platform:
+    "tools": [
+      {"name": "cmake", "version": ">=3.25",
+       "downloads": {
+         "linux-amd64": {"url": "https://github.com/Kitware/CMake/releases/download/v3.28.1/cmake-3.28.1-linux-x86_64.tar.gz",
+                         "sha256": "..."},
+         "windows": {"url": "https://.../cmake-3.28.1-windows-x86_64.zip", "sha256": "..."}}},
+      {"name": "ninja", "version": ">=1.11"}
+    ]
+  Platforms are named '<os>-<arch>' or '<os>', using Go names (linux, darwin,
+  windows, amd64, arm64).
+
+  'cpm bootstrap-tools' downloads, verifies and extracts the portable
+  version of each tool in '<devroot>/.cpm/tools/<name>' and checks that the
+  version reported by '<name> --version' (or the 'versionArgs' of the tool)
+  satisfies the constraint. Tools without a download for the platform are
+  checked in the PATH.
+
+  When building, the 'bin' folder of installed tools (or the folder given by
+  the 'bin' attribute of the tool) is placed first in the PATH.
+*/
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Tool required to build the tree
+type Tool struct {
+	Name        string
+	Version     string                  //version constraint
+	VersionArgs []string                //arguments that make the tool show its version
+	Bin         string                  //folder of programs in the portable version
+	Downloads   map[string]ToolDownload //portable versions by platform
+}
+
+// Portable version of a tool
+type ToolDownload struct {
+	Url    string
+	Sha256 string
+}
+
+// Return folder of the portable version of a tool
+func tool_dir(t *Tool) string {
+	return filepath.Join(devroot, ".cpm", "tools", t.Name)
+}
+
+// Return portable version of a tool for this platform
+func tool_download(t *Tool) (ToolDownload, bool) {
+	if d, ok := t.Downloads[runtime.GOOS+"-"+runtime.GOARCH]; ok {
+		return d, true
+	}
+	d, ok := t.Downloads[runtime.GOOS]
+	return d, ok
+}
+
+// Return folder of the programs of an installed tool or "" if the portable
+// version of the tool is not installed
+func tool_bin(t *Tool) string {
+	d, ok := tool_download(t)
+	if !ok {
+		return ""
+	}
+	dir := tool_dir(t)
+	if st := load_archive_state(dir); st == nil || st.Url != d.Url {
+		return ""
+	}
+	if t.Bin != "" {
+		return filepath.Join(dir, t.Bin)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "bin")); err == nil && fi.IsDir() {
+		return filepath.Join(dir, "bin")
+	}
+	return dir
+}
+
+// Return version of a tool program
+func tool_version(t *Tool, prog string) (string, error) {
+	args := t.VersionArgs
+	if len(args) == 0 {
+		args = []string{"--version"}
+	}
+	return probe_version(append([]string{prog}, args...))
+}
+
+// Check that a tool program satisfies the version constraint of the tool.
+// Returns the program version.
+func check_tool(t *Tool, prog string) (string, error) {
+	v, err := tool_version(t, prog)
+	if err != nil {
+		return v, err
+	}
+	return v, check_constraint(v, t.Version)
+}
+
+// Download and extract the portable version of a tool
+func install_tool(t *Tool, d ToolDownload) {
+	pt := &PacUnit{Name: t.Name, path: tool_dir(t), archive: d.Url, sha256: d.Sha256}
+	os.MkdirAll(filepath.Dir(pt.path), 0755)
+	fetch_archive(pt)
+}
+
+// Read root descriptor of package given on command line
+func load_root(arg string) *PacUnit {
+	name, descriptor := find_root(arg)
+	root := new(PacUnit)
+	if err := read_descriptor(root_source(descriptor), root); err != nil {
+		log.Fatalf("cannot read %s - %v", root_source(descriptor), err)
+	}
+	root.Name = name
+	return root
+}
+
+// Download and check tools required by the root package
+func bootstrap_tools(args []string) {
+	flags := flag.NewFlagSet("bootstrap-tools", flag.ExitOnError)
+	pos := parse_interspersed(flags, args)
+	if len(pos) > 1 {
+		log.Fatal("Usage: cpm bootstrap-tools [<package>]")
+	}
+	pkg := ""
+	if len(pos) == 1 {
+		pkg = pos[0]
+	}
+	root := load_root(pkg)
+	if len(root.Tools) == 0 {
+		fmt.Printf("Package %s doesn't require any tools\n", root.Name)
+		return
+	}
+
+	var failed []string
+	for i := range root.Tools {
+		t := &root.Tools[i]
+		prog := t.Name
+		if d, ok := tool_download(t); ok {
+			install_tool(t, d)
+			prog = filepath.Join(tool_bin(t), t.Name)
+		} else if path, err := exec.LookPath(t.Name); err != nil {
+			failed = append(failed, fmt.Sprintf("%s - not found in PATH and no download for %s-%s", t.Name, runtime.GOOS, runtime.GOARCH))
+			continue
+		} else {
+			prog = path
+		}
+		v, err := check_tool(t, prog)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s - %v", t.Name, err))
+			continue
+		}
+		fmt.Printf("%-12s %-10s %s\n", t.Name, v, prog)
+	}
+	if len(failed) != 0 {
+		log.Fatalf("Fatal - %d tools are missing or have wrong versions:\n  %s", len(failed), strings.Join(failed, "\n  "))
+	}
+}
+
+// Place folders of installed tools first in the PATH
+func setup_tools(root *PacUnit) {
+	var dirs []string
+	for i := range root.Tools {
+		t := &root.Tools[i]
+		if bin := tool_bin(t); bin != "" {
+			Verbosef("Using %s from %s\n", t.Name, bin)
+			dirs = append(dirs, bin)
+		} else if _, ok := tool_download(t); ok {
+			fmt.Printf("WARNING - tool %s is not installed. Run 'cpm bootstrap-tools' to install it\n", t.Name)
+		}
+	}
+	if len(dirs) != 0 {
+		dirs = append(dirs, os.Getenv("PATH"))
+		os.Setenv("PATH", strings.Join(dirs, string(os.PathListSeparator)))
+	}
+}
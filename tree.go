@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Read and parse a package descriptor, merged with its overlay
+func read_descriptor(fname string, p *PacUnit) error {
+	data, err := load_descriptor(fname)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(data, p); err != nil {
+		return err
+	}
+	filter_dependencies(p)
+	return nil
+}
+
+// Return package with given name from list of all packages or nil if
+// not found
+func find_pack(name string) *PacUnit {
+	for _, p := range all_packs {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// Read descriptors of the root package (specified as in command line) and of
+// all its dependencies from the development tree without fetching anything
+// or changing the file system.
+func load_tree(arg string) *PacUnit {
+	name, descriptor := find_root(arg)
+	root_descriptor = descriptor
+	descriptor = root_source(descriptor)
+	setup_profiles()
+	root := new(PacUnit)
+	if err := read_descriptor(descriptor, root); err != nil {
+		log.Fatalf("cannot read %s - %v", descriptor, err)
+	}
+	if name != "" {
+		root.Name = name
+	}
+	root.descriptor = descriptor
+	setup_workspace(root)
+	all_packs = append(all_packs, root)
+	add_members(root)
+	load_dependencies(root, read_tree_descriptor)
+	save_descriptor_cache()
+	check_profiles()
+	return root
+}
+
+// Function reading the descriptor of the package of dependency d of package
+// p while loading a dependency tree
+type descriptor_reader func(p *PacUnit, d *DependencyDescriptor) error
+
+// Read the descriptor of a dependency from the development tree
+func read_tree_descriptor(p *PacUnit, d *DependencyDescriptor) error {
+	fname := filepath.Join(package_dir(d.pack), descriptor_name)
+	if err := read_descriptor(fname, d.pack); err != nil {
+		return fmt.Errorf("cannot read %s - %v", fname, err)
+	}
+	return nil
+}
+
+// Add the dependencies of package p to the list of all packages, reading
+// their descriptors with function read
+func load_dependencies(p *PacUnit, read descriptor_reader) {
+	for i := range p.Depends {
+		d := &p.Depends[i]
+		apply_override(p, d)
+		registry_provider{}.Check(p, d)
+		if d.pack = find_pack(d.Name); d.pack != nil {
+			continue
+		}
+		d.pack = &PacUnit{Name: d.Name, Git: d.Git, Https: d.Https, Hg: d.Hg, Svn: d.Svn, P4Port: d.P4Port, Depot: d.Depot, Branch: d.Branch, archive: d.Archive}
+		d.pack.path = dependency_path(package_dir(p), d)
+		d.pack.registry, d.pack.provider, d.pack.source = d.Registry, d.Provider, d.Source
+		if d.Repository != "" {
+			d.pack.archive, d.pack.repository, d.pack.artifact = artifact_url(d), d.Repository, d.Artifact
+		}
+		if b := select_prebuilt(p, d); b != nil {
+			d.pack.prebuilt, d.pack.archive = b, b.Url
+		}
+		all_packs = append(all_packs, d.pack)
+		if err := read(p, d); err != nil {
+			Verbosef("Package %s - %v. Assuming no dependencies\n", d.Name, err)
+			continue
+		}
+		override_build(d.pack)
+		load_dependencies(d.pack, read)
+	}
+}
+
+// A workspace package that depends on a given package
+type Consumer struct {
+	Name       string //name of consumer package
+	Descriptor string //descriptor file of consumer package
+	Dep        DependencyDescriptor
+}
+
+// Return all packages in the development tree that depend directly on a
+// package
+func find_consumers(pkg string) []Consumer {
+	var consumers []Consumer
+	entries, _ := os.ReadDir(devroot)
+	for _, e := range entries {
+		fname := filepath.Join(devroot, e.Name(), descriptor_name)
+		//consumers are edited; overlay is not used
+		var p PacUnit
+		data, err := os.ReadFile(fname)
+		if err != nil || json.Unmarshal(data, &p) != nil {
+			continue
+		}
+		for _, d := range p.Depends {
+			if strings.EqualFold(d.Name, pkg) {
+				consumers = append(consumers, Consumer{e.Name(), fname, d})
+			}
+		}
+	}
+	return consumers
+}
+
+// Edit the descriptor of a dependency in a descriptor file. The edit function
+// receives the file content and the node of the dependency descriptor and
+// returns the new content.
+func edit_dependency(fname string, pkg string, edit func(data []byte, deps *JNode, idx int) []byte) error {
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return err
+	}
+	root, err := parse_jnodes(data)
+	if err != nil {
+		return fmt.Errorf("cannot parse %s - %v", fname, err)
+	}
+	deps, idx, _ := find_dependency_node(data, root, pkg)
+	if idx < 0 {
+		return fmt.Errorf("%s has no dependency %s", fname, pkg)
+	}
+	data = edit(data, deps, idx)
+	if _, err = parse_jnodes(data); err != nil {
+		return fmt.Errorf("cannot edit %s - %v", fname, err)
+	}
+	return os.WriteFile(fname, data, 0644)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Implementation of 'cpm uninstall' command
+func uninstall(args []string) {
+	flags := flag.NewFlagSet("uninstall", flag.ExitOnError)
+	from := flags.String("from", "", "remove dependency only from this package")
+	force := flags.Bool("force", false, "remove clone even if it has local changes")
+	pos := parse_interspersed(flags, args)
+	if len(pos) != 1 {
+		log.Fatal("Usage: cpm uninstall <package> [--from <package>] [--force]")
+	}
+	pkg := pos[0]
+
+	consumers := find_consumers(pkg)
+	pacdir := filepath.Join(devroot, pkg)
+	for _, c := range consumers {
+		if c.Dep.Path != "" {
+			pacdir = dependency_path(filepath.Dir(c.Descriptor), &c.Dep)
+		}
+	}
+
+	removed := 0
+	for _, c := range consumers {
+		if *from != "" && !strings.EqualFold(c.Name, *from) {
+			continue
+		}
+		err := edit_dependency(c.Descriptor, pkg, func(data []byte, deps *JNode, idx int) []byte {
+			return remove_item(data, deps, idx)
+		})
+		if err != nil {
+			fmt.Printf("WARNING - cannot update %s - %v\n", c.Descriptor, err)
+			continue
+		}
+		fmt.Printf("Removed %s from %s\n", pkg, c.Descriptor)
+		unlink_dependency(filepath.Dir(c.Descriptor), include_name(&c.Dep), pacdir)
+		removed++
+	}
+	if removed == 0 {
+		log.Fatalf("No package depends on %s", pkg)
+	}
+
+	//is package still needed?
+	if remaining := find_consumers(pkg); len(remaining) != 0 {
+		fmt.Printf("Package %s is still used by %s. Keeping its folder and libraries.\n", pkg, remaining[0].Name)
+		return
+	}
+
+	//indirect consumers have links to the propagated include folder
+	entries, _ := os.ReadDir(devroot)
+	for _, e := range entries {
+		if dir := filepath.Join(devroot, e.Name()); dir != pacdir && links_into(dir, pacdir) {
+			Verboseln("Removing links to", pkg, "from", dir)
+			unlink_dependency(dir, pkg, pacdir)
+		}
+	}
+
+	edit_lockfiles(func(l *Lockfile) bool { return l.remove(pkg) })
+	for _, lib := range package_libs(lib_dir(), pkg) {
+		Verboseln("Removing", lib)
+		remove_file(lib)
+	}
+
+	if pacdir != filepath.Join(devroot, pkg) {
+		fmt.Printf("Local package folder %s not removed\n", pacdir)
+		return
+	}
+	if v := folder_vcs(pacdir); v != nil && v.Modified(pacdir) && !*force {
+		fmt.Printf("Folder %s has local changes and was not removed. Use --force to remove it.\n", pacdir)
+		return
+	}
+	if out, _ := Output("git", "-C", pacdir, "log", "--branches", "--not", "--remotes", "--oneline"); out != "" && !*force {
+		fmt.Printf("Folder %s has unpushed commits and was not removed. Use --force to remove it.\n", pacdir)
+		return
+	}
+	if err := remove_all(pacdir); err != nil {
+		log.Fatalf("Cannot remove %s - %v", pacdir, err)
+	}
+	fmt.Printf("Package %s uninstalled\n", pkg)
+}
+
+// Remove objects created by CPM in a consumer package for a dependency in
+// folder depdir whose include folder is 'name'
+func unlink_dependency(dir string, name string, depdir string) {
+	m := load_manifest(dir)
+	m.Links = slices.DeleteFunc(m.Links, func(rel string) bool {
+		link := filepath.Join(dir, rel)
+		if t, err := os.Readlink(link); err == nil && strings.HasPrefix(t, depdir+string(filepath.Separator)) {
+			Verboseln("Removing symlink", link)
+			return os.Remove(link) == nil
+		}
+		return false
+	})
+	//mirrored headers
+	inc := filepath.Join("include", name)
+	if i := slices.IndexFunc(m.Dirs, func(rel string) bool { return strings.EqualFold(rel, inc) }); i >= 0 {
+		inc = m.Dirs[i]
+		Verboseln("Removing folder", filepath.Join(dir, inc))
+		if err := os.RemoveAll(filepath.Join(dir, inc)); err != nil {
+			fmt.Printf("WARNING - cannot remove %s - %v\n", filepath.Join(dir, inc), err)
+		}
+		for _, list := range []*[]string{&m.Links, &m.Copies, &m.Dirs} {
+			*list = slices.DeleteFunc(*list, func(rel string) bool {
+				return rel == inc || strings.HasPrefix(rel, inc+string(filepath.Separator))
+			})
+		}
+	}
+	save_manifest(dir, m)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUninstallUnlinksIndirectConsumers(t *testing.T) {
+	saved_root := devroot
+	defer func() { devroot = saved_root }()
+	devroot = t.TempDir()
+
+	//A depends on B, B depends on C; A has a propagated link to C
+	descriptor := func(name string, deps ...string) {
+		p := PacUnit{Name: name}
+		for _, d := range deps {
+			p.Depends = append(p.Depends, DependencyDescriptor{Name: d})
+		}
+		data, _ := json.Marshal(p)
+		os.MkdirAll(filepath.Join(devroot, name, "include", name), 0755)
+		os.WriteFile(filepath.Join(devroot, name, descriptor_name), data, 0644)
+	}
+	descriptor("A", "B")
+	descriptor("B", "C")
+	descriptor("C")
+	link := func(pkg string, dep string) {
+		rel := filepath.Join("include", dep)
+		if err := os.Symlink(filepath.Join(devroot, dep, rel), filepath.Join(devroot, pkg, rel)); err != nil {
+			t.Skipf("cannot create symlinks - %v", err)
+		}
+		dir := filepath.Join(devroot, pkg)
+		m := load_manifest(dir)
+		m.Links = append(m.Links, rel)
+		save_manifest(dir, m)
+	}
+	link("A", "B")
+	link("A", "C")
+	link("B", "C")
+
+	uninstall([]string{"C"})
+
+	if _, err := os.Stat(filepath.Join(devroot, "C")); err == nil {
+		t.Errorf("folder of C not removed")
+	}
+	for _, pkg := range []string{"A", "B"} {
+		dir := filepath.Join(devroot, pkg)
+		if _, err := os.Lstat(filepath.Join(dir, "include", "C")); err == nil {
+			t.Errorf("package %s - link include/C not removed", pkg)
+		}
+	}
+	want := []string{filepath.Join("include", "B")}
+	if m := load_manifest(filepath.Join(devroot, "A")); len(m.Links) != 1 || m.Links[0] != want[0] {
+		t.Errorf("package A - manifest links %v, want %v", m.Links, want)
+	}
+}
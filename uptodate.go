@@ -0,0 +1,137 @@
+package main
+
+/*
+  No-op fast path.
+
+  After a successful build, CPM records in
+  '<devroot>/.cpm/last-run.json' the folders of all packages and a
+  fingerprint of the run: command line, configuration, compilers and
+  target, process environment, root descriptor and lockfile, and the names,
+  sizes and modification times of all files in the package folders
+  (including descriptors and overlays) and in the shared 'lib' folder.
+
+  When a later run doesn't have to contact remote repositories (local-only
+  mode, offline mode or '--locked'), CPM computes the fingerprint again and,
+  if nothing changed, finishes immediately without reading descriptors or
+  invoking build commands. Deleting the file forces a full run.
+*/
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Record of last successful run
+type LastRun struct {
+	Fingerprint string
+	Folders     []string //package folders
+}
+
+func last_run_file() string {
+	return filepath.Join(devroot, ".cpm", "last-run.json")
+}
+
+// Return true if the fast path can be used for this run: remote
+// repositories are not contacted and no report is requested
+func fast_path_allowed() bool {
+	return (*local_flag || *locked_flag) && root_uri == "" && *report_flag == "" && !*fetch_flag
+}
+
+// Forget last successful run
+func clear_last_run() {
+	os.Remove(last_run_file())
+}
+
+// Process environment when the run started, before CPM changes it
+var start_env []string
+
+// Environment variables of the shell session that don't affect builds
+var session_vars = []string{"PWD", "OLDPWD", "SHLVL", "_", "WINDOWID", "TERM_SESSION_ID", "SSH_CLIENT", "SSH_CONNECTION", "SSH_TTY"}
+
+// Return fingerprint of the development tree for the given package folders
+func tree_fingerprint(folders []string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%q\n%s\n", Version, os.Args[1:], root_descriptor)
+	//compilers and target, like the build cache key
+	fmt.Fprintf(h, "%s\n", toolchain_id())
+	//package environments are made from descriptors and process environment
+	if start_env == nil {
+		start_env = os.Environ()
+	}
+	env := slices.Clone(start_env)
+	slices.Sort(env)
+	for _, v := range env {
+		if name, _, _ := strings.Cut(v, "="); !slices.Contains(session_vars, name) {
+			fmt.Fprintf(h, "%s\n", v)
+		}
+	}
+	//files outside package folders
+	for _, fname := range []string{filepath.Join(cpm_home(), "config"), filepath.Join(devroot, ".cpm", "config"),
+		root_source(root_descriptor), root_lockfile()} {
+		if data, err := os.ReadFile(fname); err == nil {
+			fmt.Fprintf(h, "[%s]\n", fname)
+			h.Write(data)
+		}
+	}
+	for _, dir := range append(folders, lib_dir()) {
+		fmt.Fprintf(h, "[%s]\n", dir)
+		filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				fmt.Fprintf(h, "%s error\n", path)
+				return nil
+			}
+			if d.IsDir() && d.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			if info, err := d.Info(); err == nil {
+				fmt.Fprintf(h, "%s %d %d %v\n", path, info.Size(), info.ModTime().UnixNano(), info.Mode())
+			}
+			return nil
+		})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Return true if nothing changed since the last successful run
+func up_to_date() bool {
+	start_env = os.Environ()
+	if !fast_path_allowed() {
+		return false
+	}
+	data, err := os.ReadFile(last_run_file())
+	if err != nil {
+		return false
+	}
+	var last LastRun
+	if json.Unmarshal(data, &last) != nil || len(last.Folders) == 0 {
+		return false
+	}
+	if tree_fingerprint(last.Folders) != last.Fingerprint {
+		Verboseln("Development tree changed since last run")
+		return false
+	}
+	return true
+}
+
+// Record successful run
+func record_last_run() {
+	var last LastRun
+	for _, p := range all_packs {
+		if !workspace || p != all_packs[0] {
+			last.Folders = append(last.Folders, package_dir(p))
+		}
+	}
+	last.Fingerprint = tree_fingerprint(last.Folders)
+	data, _ := json.MarshalIndent(&last, "", "  ")
+	os.MkdirAll(filepath.Dir(last_run_file()), 0755)
+	if err := os.WriteFile(last_run_file(), data, 0644); err != nil {
+		Verbosef("Cannot save %s - %v\n", last_run_file(), err)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+/*
+  Version control systems.
+
+  Besides Git, packages can be kept in Mercurial or Subversion repositories,
+  selected by the 'hg' or 'svn' attribute of a dependency instead of 'git'
+  and 'https', or in Perforce depots (see perforce.go). All operations on
+  package repositories needed for fetching (clone, update, current
+  revision) go through the Vcs interface.
+
+  For Mercurial, 'branch' is a named branch or bookmark. For Subversion,
+  the URL is the repository root of the package: without a branch, the
+  'trunk' folder is checked out; otherwise the 'branches/<branch>' folder.
+  Version constraints, commits, tree hashes, shallow clones, sparse checkouts
+  and mirrors are available only for Git repositories.
+*/
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Operations on package repositories
+type Vcs interface {
+	Name() string
+	Uri(p *PacUnit) string
+	Clone(p *PacUnit, dir string)
+	Update(p *PacUnit, dir string)
+	Revision(dir string) (string, error)
+	Branch(dir string) string
+	Checkout(dir string, rev string)
+	Modified(dir string) bool
+}
+
+type git_vcs struct{}
+type hg_vcs struct{}
+type svn_vcs struct{}
+
+// Return version control system of a package
+func package_vcs(p *PacUnit) Vcs {
+	switch {
+	case p.Hg != "":
+		return hg_vcs{}
+	case p.Svn != "":
+		return svn_vcs{}
+	case p.Depot != "":
+		return p4_vcs{}
+	}
+	return git_vcs{}
+}
+
+// Return version control system of working copy in dir or nil if dir is not
+// a working copy
+func folder_vcs(dir string) Vcs {
+	for _, v := range []Vcs{git_vcs{}, hg_vcs{}, svn_vcs{}, p4_vcs{}} {
+		if _, err := os.Stat(filepath.Join(dir, "."+v.Name())); err == nil {
+			return v
+		}
+	}
+	return nil
+}
+
+// Stop if a dependency in a Mercurial or Subversion repository has
+// attributes that apply only to Git repositories
+func check_vcs_dependency(p *PacUnit, d *DependencyDescriptor) {
+	if d.Hg == "" && d.Svn == "" {
+		return
+	}
+	if (d.Hg != "" && d.Svn != "") || d.Git != "" || d.Https != "" || d.Archive != "" {
+		log.Fatalf("Package %s - dependency %s has more than one repository", p.Name, d.Name)
+	}
+	if d.Version != "" || d.Commit != "" || d.Tree != "" || d.Shallow || d.Depth != 0 || len(d.SparsePaths) != 0 {
+		log.Fatalf("Package %s - dependency %s - version, commit, tree, shallow, depth and sparsePaths attributes are available only for Git repositories",
+			p.Name, d.Name)
+	}
+}
+
+// Run a VCS command for the package in folder pacdir and stop if it fails
+func vcs_run(pacdir string, prog string, what string, args ...string) {
+	Verboseln(prog, args)
+	if stat, err := run_for(pacdir, prog, args); err != nil || stat != 0 {
+		log.Fatalf("%s failed \nStatus %d Error: %v\n", what, stat, err)
+	}
+}
+
+// Run a VCS command that uses the network for the package in folder pacdir,
+// retrying it after transient failures, and stop if it fails
+func vcs_fetch(pacdir string, prog string, what string, args ...string) {
+	Verboseln(prog, args)
+	if stat, err := run_network(pacdir, what, prog, args); err != nil || stat != 0 {
+		log.Fatalf("%s failed \nStatus %d Error: %v\n", what, stat, err)
+	}
+}
+
+func (git_vcs) Name() string { return "git" }
+
+func (git_vcs) Uri(p *PacUnit) string { return package_uri(p.Git, p.Https) }
+
+func (git_vcs) Clone(p *PacUnit, dir string) {
+	check_protocol(p)
+	if *cache_flag {
+		cache_mirror(package_uri(p.Git, p.Https))
+	}
+	git_clone(p)
+	if *locked_flag && p.depth != 0 && p != all_packs[0] {
+		//a shallow clone may not have the locked commit
+		if _, err := Output("git", "-C", dir, "cat-file", "-e", locked_commit(p)+"^{commit}"); err != nil {
+			fetch_commit(dir, locked_commit(p), depth_args(p))
+		}
+	}
+}
+
+func (git_vcs) Update(p *PacUnit, dir string) {
+	check_protocol(p)
+	sync_origin(p, dir)
+	if *cache_flag {
+		cache_mirror(package_uri(p.Git, p.Https))
+	}
+	fetch_from_mirror(dir, package_uri(p.Git, p.Https))
+	setup_sparse(p, dir, false)
+	if *locked_flag && p != all_packs[0] {
+		//commit from lockfile is checked out later. A shallow fetch of
+		//the branches may not reach it.
+		if p.depth != 0 {
+			fetch_commit(dir, locked_commit(p), depth_args(p))
+		} else {
+			vcs_fetch(dir, "git", "Fetching "+dir, "-C", dir, "fetch", "origin")
+		}
+	} else if p.version != "" {
+		args := append([]string{"-C", dir, "fetch"}, depth_args(p)...)
+		vcs_fetch(dir, "git", "Fetching "+dir, append(args, "origin", "--tags")...)
+		git_detach(dir, p.version)
+	} else {
+		git_pull(dir, p.Branch, depth_args(p)...)
+	}
+}
+
+func (git_vcs) Revision(dir string) (string, error) {
+	out, err := Output("git", "-C", dir, "rev-parse", "HEAD")
+	return strings.TrimSpace(out), err
+}
+
+func (git_vcs) Branch(dir string) string {
+	out, _ := Output("git", "-C", dir, "symbolic-ref", "-q", "--short", "HEAD")
+	return strings.TrimSpace(out)
+}
+
+func (git_vcs) Checkout(dir string, rev string) {
+	if _, err := Output("git", "-C", dir, "cat-file", "-e", rev+"^{commit}"); err != nil {
+		if *local_flag {
+			log.Fatalf("Fatal - local-only mode and %s doesn't have commit %s", dir, rev)
+		}
+		fetch_commit(dir, rev, nil)
+	}
+	git_detach(dir, rev)
+}
+
+func (git_vcs) Modified(dir string) bool {
+	out, _ := Output("git", "-C", dir, "status", "--porcelain")
+	return out != ""
+}
+
+func (hg_vcs) Name() string { return "hg" }
+
+func (hg_vcs) Uri(p *PacUnit) string { return p.Hg }
+
+func (hg_vcs) Clone(p *PacUnit, dir string) {
+	Verbosef("Cloning: %s in %s\n", p.Name, dir)
+	args := []string{"clone"}
+	if p.Branch != "" {
+		args = append(args, "-u", p.Branch)
+	}
+	vcs_fetch(dir, "hg", "Package "+p.Name+" - cloning", append(args, p.Hg, dir)...)
+}
+
+func (hg_vcs) Update(p *PacUnit, dir string) {
+	args := []string{"pull", "-R", dir}
+	if p.Hg != "" {
+		args = append(args, p.Hg)
+	}
+	vcs_fetch(dir, "hg", "Pulling "+dir, args...)
+	if *locked_flag && p != all_packs[0] {
+		//revision from lockfile is checked out later
+		return
+	}
+	args = []string{"update", "-R", dir}
+	if *force_flag {
+		args = append(args, "-C")
+	}
+	if p.Branch != "" {
+		args = append(args, p.Branch)
+	}
+	vcs_run(dir, "hg", "Updating", args...)
+}
+
+func (hg_vcs) Revision(dir string) (string, error) {
+	out, err := Output("hg", "log", "-R", dir, "-r", ".", "-T", "{node}")
+	return strings.TrimSpace(out), err
+}
+
+func (hg_vcs) Branch(dir string) string {
+	out, _ := Output("hg", "branch", "-R", dir)
+	return strings.TrimSpace(out)
+}
+
+func (hg_vcs) Checkout(dir string, rev string) {
+	if _, err := Output("hg", "log", "-R", dir, "-r", rev, "-T", "{node}"); err != nil {
+		if *local_flag {
+			log.Fatalf("Fatal - local-only mode and %s doesn't have revision %s", dir, rev)
+		}
+		vcs_fetch(dir, "hg", "Pulling revision "+rev+" in "+dir, "pull", "-R", dir, "-r", rev)
+	}
+	args := []string{"update", "-R", dir}
+	if *force_flag {
+		args = append(args, "-C")
+	}
+	vcs_run(dir, "hg", "Updating", append(args, "-r", rev)...)
+}
+
+func (hg_vcs) Modified(dir string) bool {
+	out, _ := Output("hg", "status", "-R", dir)
+	return out != ""
+}
+
+func (svn_vcs) Name() string { return "svn" }
+
+// Return URL of branch or trunk of Subversion package
+func (svn_vcs) Uri(p *PacUnit) string {
+	uri := strings.TrimSuffix(p.Svn, "/")
+	if p.Branch != "" {
+		return uri + "/branches/" + p.Branch
+	}
+	return uri + "/trunk"
+}
+
+func (v svn_vcs) Clone(p *PacUnit, dir string) {
+	Verbosef("Checking out: %s in %s\n", p.Name, dir)
+	vcs_fetch(dir, "svn", "Package "+p.Name+" - checkout", "checkout", "--non-interactive", v.Uri(p), dir)
+}
+
+func (v svn_vcs) Update(p *PacUnit, dir string) {
+	if *locked_flag && p != all_packs[0] {
+		//revision from lockfile is checked out later
+		return
+	}
+	if info, err := Output("svn", "info", "--show-item", "url", dir); err == nil && p.Svn != "" && strings.TrimSpace(info) != v.Uri(p) {
+		vcs_fetch(dir, "svn", "Switching "+dir, "switch", "--non-interactive", v.Uri(p), dir)
+		return
+	}
+	vcs_fetch(dir, "svn", "Updating "+dir, "update", "--non-interactive", dir)
+}
+
+func (svn_vcs) Revision(dir string) (string, error) {
+	out, err := Output("svn", "info", "--show-item", "revision", dir)
+	return strings.TrimSpace(out), err
+}
+
+func (svn_vcs) Branch(dir string) string {
+	out, _ := Output("svn", "info", "--show-item", "relative-url", dir)
+	return strings.TrimPrefix(strings.TrimSpace(out), "^/")
+}
+
+func (v svn_vcs) Checkout(dir string, rev string) {
+	if cur, _ := v.Revision(dir); cur == rev {
+		return
+	}
+	if *local_flag {
+		log.Fatalf("Fatal - local-only mode and cannot update %s to revision %s", dir, rev)
+	}
+	vcs_fetch(dir, "svn", "Updating "+dir, "update", "--non-interactive", "-r", rev, dir)
+}
+
+func (svn_vcs) Modified(dir string) bool {
+	out, _ := Output("svn", "status", "-q", dir)
+	return out != ""
+}
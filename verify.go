@@ -0,0 +1,70 @@
+package main
+
+/*
+  Verification of fetched dependencies.
+
+  A dependency descriptor can specify the expected 'commit' of the package
+  and/or the expected 'tree', the Git hash of its content. After fetching,
+  CPM checks that the checked-out commit matches them and stops if it
+  doesn't. This detects rewritten tags and tampered repositories. Commits
+  can be abbreviated (at least 7 hex digits).
+*/
+
+import (
+	"log"
+	"strings"
+)
+
+// Check that a dependency of another package doesn't expect a different
+// commit or tree than the one already configured
+func check_expected(p *PacUnit, d *DependencyDescriptor) {
+	if d.Commit != "" {
+		if p.commit != "" && !same_hash(p.commit, d.Commit) {
+			log.Fatalf("Package %s - expected commit %s conflicts with commit %s configured before", p.Name, d.Commit, p.commit)
+		}
+		p.commit = d.Commit
+	}
+	if d.Tree != "" {
+		if p.tree != "" && !same_hash(p.tree, d.Tree) {
+			log.Fatalf("Package %s - expected tree %s conflicts with tree %s configured before", p.Name, d.Tree, p.tree)
+		}
+		p.tree = d.Tree
+	}
+}
+
+// Return true if two (possibly abbreviated) hashes are the same
+func same_hash(a string, b string) bool {
+	a, b = strings.ToLower(a), strings.ToLower(b)
+	return strings.HasPrefix(a, b) || strings.HasPrefix(b, a)
+}
+
+// Verify that checked out commit of a package matches the expected commit
+// and tree. Stops if it doesn't.
+func verify_checkout(p *PacUnit) {
+	if p.commit == "" && p.tree == "" {
+		return
+	}
+	dir := package_dir(p)
+	if p.commit != "" {
+		if len(p.commit) < 7 {
+			log.Fatalf("Package %s - expected commit %s is too short", p.Name, p.commit)
+		}
+		out, err := Output("git", "-C", dir, "rev-parse", "HEAD")
+		if err != nil {
+			log.Fatalf("Package %s - cannot find checked out commit - %v", p.Name, err)
+		}
+		if head := strings.TrimSpace(out); !same_hash(head, p.commit) {
+			log.Fatalf("Fatal - Package %s - checked out commit %s doesn't match expected commit %s", p.Name, head, p.commit)
+		}
+	}
+	if p.tree != "" {
+		out, err := Output("git", "-C", dir, "rev-parse", "HEAD^{tree}")
+		if err != nil {
+			log.Fatalf("Package %s - cannot find checked out tree - %v", p.Name, err)
+		}
+		if tree := strings.TrimSpace(out); !same_hash(tree, p.tree) {
+			log.Fatalf("Fatal - Package %s - content (tree %s) doesn't match expected tree %s", p.Name, tree, p.tree)
+		}
+	}
+	Verbosef("Package %s - verified checked out commit\n", p.Name)
+}
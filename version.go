@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// A version number (major.minor.patch) with optional pre-release suffix
+type SemVer struct {
+	Major, Minor, Patch int
+	Pre                 string
+}
+
+// Parse a version tag like 'v1.2.3', '1.2' or 'V2.0.1-rc1'
+func parse_version(s string) (v SemVer, ok bool) {
+	s = strings.TrimLeft(s, "vV")
+	s, v.Pre, _ = strings.Cut(s, "-")
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 || parts[0] == "" {
+		return v, false
+	}
+	nums := []*int{&v.Major, &v.Minor, &v.Patch}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return v, false
+		}
+		*nums[i] = n
+	}
+	return v, true
+}
+
+func (v SemVer) compare(w SemVer) int {
+	if d := v.Major - w.Major; d != 0 {
+		return d
+	}
+	if d := v.Minor - w.Minor; d != 0 {
+		return d
+	}
+	if d := v.Patch - w.Patch; d != 0 {
+		return d
+	}
+	//a pre-release has lower precedence than the release
+	switch {
+	case v.Pre == w.Pre:
+		return 0
+	case v.Pre == "":
+		return 1
+	case w.Pre == "":
+		return -1
+	}
+	return compare_pre(v.Pre, w.Pre)
+}
+
+// Compare pre-release suffixes: dot-separated identifiers are compared in
+// order, numeric identifiers as numbers and with lower precedence than
+// alphanumeric ones. A longer list of identifiers has higher precedence.
+func compare_pre(a string, b string) int {
+	ida, idb := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(ida) && i < len(idb); i++ {
+		na, erra := strconv.ParseUint(ida[i], 10, 64)
+		nb, errb := strconv.ParseUint(idb[i], 10, 64)
+		switch {
+		case erra == nil && errb == nil:
+			if na != nb {
+				if na < nb {
+					return -1
+				}
+				return 1
+			}
+		case erra == nil:
+			return -1
+		case errb == nil:
+			return 1
+		default:
+			if d := strings.Compare(ida[i], idb[i]); d != 0 {
+				return d
+			}
+		}
+	}
+	return len(ida) - len(idb)
+}
+
+// Compare two version tags. Returns a negative number if a < b, 0 if a == b,
+// and a positive number if a > b.
+func compare_versions(a string, b string) int {
+	va, _ := parse_version(a)
+	vb, _ := parse_version(b)
+	return va.compare(vb)
+}
+
+// A version constraint: a list of alternatives ('||' separated), each one a
+// list of comparisons that must all be satisfied
+type VersionConstraint [][]version_cmp
+
+type version_cmp struct {
+	op string //one of "=", ">", ">=", "<", "<="
+	v  SemVer
+}
+
+func (c version_cmp) match(v SemVer) bool {
+	d := v.compare(c.v)
+	switch c.op {
+	case ">":
+		return d > 0
+	case ">=":
+		return d >= 0
+	case "<":
+		return d < 0
+	case "<=":
+		return d <= 0
+	}
+	return d == 0
+}
+
+// Parse a version constraint like '^1.2', '~1.4.2', '>=2.0 <3.0', '1.2' or
+// '1.2.3 || 2.x'. Partial versions match all versions with the given
+// components.
+func parse_constraint(s string) (VersionConstraint, error) {
+	var vc VersionConstraint
+	for _, alt := range strings.Split(s, "||") {
+		var cmps []version_cmp
+		fields := strings.Fields(alt)
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("empty version constraint")
+		}
+		for i := 0; i < len(fields); i++ {
+			f := fields[i]
+			if strings.Trim(f, "<>=^~") == "" && i+1 < len(fields) {
+				//operator separated from version
+				i++
+				f += fields[i]
+			}
+			k := strings.IndexFunc(f, func(r rune) bool { return !strings.ContainsRune("<>=^~", r) })
+			if k < 0 {
+				k = len(f)
+			}
+			op := f[:k]
+			f = f[k:]
+			if f == "*" || f == "x" || f == "X" {
+				cmps = append(cmps, version_cmp{">=", SemVer{}})
+				continue
+			}
+			//count components before removing wildcards
+			parts := strings.Split(strings.SplitN(strings.TrimLeft(f, "vV"), "-", 2)[0], ".")
+			for len(parts) > 0 && (parts[len(parts)-1] == "x" || parts[len(parts)-1] == "X" || parts[len(parts)-1] == "*") {
+				parts = parts[:len(parts)-1]
+				f = f[:strings.LastIndexByte(f, '.')]
+			}
+			v, ok := parse_version(f)
+			if !ok {
+				return nil, fmt.Errorf("invalid version %q", f)
+			}
+			n := len(parts)
+			//upper bound of range starting at v
+			next := func(level int) SemVer {
+				switch level {
+				case 0:
+					return SemVer{Major: v.Major + 1}
+				case 1:
+					return SemVer{Major: v.Major, Minor: v.Minor + 1}
+				}
+				return SemVer{Major: v.Major, Minor: v.Minor, Patch: v.Patch + 1}
+			}
+			switch op {
+			case "^":
+				//compatible with: first non-zero component doesn't change
+				level := 0
+				if v.Major == 0 && n > 1 {
+					level = 1
+					if v.Minor == 0 && n > 2 {
+						level = 2
+					}
+				}
+				cmps = append(cmps, version_cmp{">=", v}, version_cmp{"<", next(level)})
+			case "~":
+				level := 1
+				if n == 1 {
+					level = 0
+				}
+				cmps = append(cmps, version_cmp{">=", v}, version_cmp{"<", next(level)})
+			case "", "=":
+				if n < 3 {
+					cmps = append(cmps, version_cmp{">=", v}, version_cmp{"<", next(n - 1)})
+				} else {
+					cmps = append(cmps, version_cmp{"=", v})
+				}
+			case ">", ">=", "<", "<=":
+				cmps = append(cmps, version_cmp{op, v})
+			default:
+				return nil, fmt.Errorf("invalid operator %q", op)
+			}
+		}
+		vc = append(vc, cmps)
+	}
+	return vc, nil
+}
+
+// Return true if version satisfies the constraint. Pre-release versions
+// match only if a comparison of the constraint names a pre-release.
+func (vc VersionConstraint) match(v SemVer) bool {
+	for _, alt := range vc {
+		ok := true
+		pre_allowed := v.Pre == ""
+		for _, c := range alt {
+			ok = ok && c.match(v)
+			if c.v.Pre != "" && c.v.Major == v.Major && c.v.Minor == v.Minor && c.v.Patch == v.Patch {
+				pre_allowed = true
+			}
+		}
+		if ok && pre_allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolved version tags, keyed by package URL and constraint
+var resolved_versions = make(map[string]string)
+
+// Return the highest version tag of a dependency that satisfies its version
+// constraint. A constraint that names an existing tag selects that tag.
+// In local-only mode, tags of the package folder dir are used.
+func resolve_version(dep *DependencyDescriptor, dir string) string {
+	uri := package_uri(dep.Git, dep.Https)
+	key := uri + " " + dep.Version
+	if tag, ok := resolved_versions[key]; ok {
+		return tag
+	}
+
+	var tags []string
+	if *local_flag {
+		if tag, ok := cached_version(key, dir); ok {
+			Verbosef("Package %s - version %s resolved to %s (cached)\n", dep.Name, dep.Version, tag)
+			resolved_versions[key] = tag
+			return tag
+		}
+		out, err := Output("git", "-C", dir, "tag")
+		if err != nil {
+			log.Fatalf("Fatal - local-only mode and cannot list tags of %s", dir)
+		}
+		tags = strings.Fields(out)
+	} else {
+		tags = remote_tags(uri)
+	}
+
+	tag := ""
+	if slices.Contains(tags, dep.Version) {
+		tag = dep.Version
+	} else {
+		vc, err := parse_constraint(dep.Version)
+		if err != nil {
+			log.Fatalf("Package %s - version %s - %v", dep.Name, dep.Version, err)
+		}
+		for _, t := range version_tags(tags) {
+			if v, _ := parse_version(t); vc.match(v) {
+				tag = t
+			}
+		}
+	}
+	if tag == "" {
+		log.Fatalf("Package %s - no tag satisfies version %s", dep.Name, dep.Version)
+	}
+	Verbosef("Package %s - version %s resolved to %s\n", dep.Name, dep.Version, tag)
+	resolved_versions[key] = tag
+	if *local_flag {
+		cache_version(key, dir, tag)
+	}
+	return tag
+}
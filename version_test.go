@@ -0,0 +1,86 @@
+package main
+
+import "testing"
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"v1.2.3", "1.2.3", 0},
+		{"1.2", "1.2.0", 0},
+		{"v1.10.0", "v1.9.0", 1},
+		{"v2.0.0", "v10.0.0", -1},
+		{"v1.0.0-rc1", "v1.0.0", -1},
+		{"v1.0.0-rc.9", "v1.0.0-rc.10", -1},
+		{"v1.0.0-alpha", "v1.0.0-alpha.1", -1},
+		{"v1.0.0-alpha.1", "v1.0.0-alpha.beta", -1},
+		{"v1.0.0-alpha.beta", "v1.0.0-beta", -1},
+		{"v1.0.0-beta.2", "v1.0.0-beta.11", -1},
+		{"v1.0.0-1", "v1.0.0-alpha", -1},
+	}
+	sign := func(n int) int {
+		switch {
+		case n < 0:
+			return -1
+		case n > 0:
+			return 1
+		}
+		return 0
+	}
+	for _, tt := range tests {
+		if got := sign(compare_versions(tt.a, tt.b)); got != tt.want {
+			t.Errorf("compare_versions(%s, %s) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := sign(compare_versions(tt.b, tt.a)); got != -tt.want {
+			t.Errorf("compare_versions(%s, %s) = %d, want %d", tt.b, tt.a, got, -tt.want)
+		}
+	}
+}
+
+func TestParseConstraint(t *testing.T) {
+	for _, bad := range []string{"", "1.2 ||", "!1.0", "^a.b", "1.2.3.4"} {
+		if _, err := parse_constraint(bad); err == nil {
+			t.Errorf("constraint %q parsed without error", bad)
+		}
+	}
+}
+
+func TestConstraintMatch(t *testing.T) {
+	tests := []struct {
+		constraint string
+		match      []string
+		nomatch    []string
+	}{
+		{"^1.2", []string{"1.2.0", "1.9.3"}, []string{"1.1.9", "2.0.0", "1.3.0-rc1"}},
+		{"^0.2.3", []string{"0.2.3", "0.2.9"}, []string{"0.3.0", "0.2.2"}},
+		{"^0.0.3", []string{"0.0.3"}, []string{"0.0.4"}},
+		{"~1.4.2", []string{"1.4.2", "1.4.9"}, []string{"1.5.0", "1.4.1"}},
+		{"~1", []string{"1.0.0", "1.9.0"}, []string{"2.0.0"}},
+		{">=2.0 <3.0", []string{"2.0.0", "2.9.9"}, []string{"1.9.9", "3.0.0"}},
+		{">= 2.0", []string{"2.0.0", "7.0.0"}, []string{"1.0.0"}},
+		{"1.2", []string{"1.2.0", "1.2.7"}, []string{"1.3.0", "1.1.0"}},
+		{"1.2.3", []string{"1.2.3"}, []string{"1.2.4"}},
+		{"1.2.3 || 2.x", []string{"1.2.3", "2.0.0", "2.5.1"}, []string{"1.2.4", "3.0.0"}},
+		{"*", []string{"0.0.1", "9.9.9"}, []string{"1.0.0-rc1"}},
+		{">=1.0.0-rc.9", []string{"1.0.0-rc.9", "1.0.0-rc.10", "1.0.0"}, []string{"1.0.0-rc.8", "1.0.0-beta"}},
+		{"<1.0.0-rc.10", []string{"1.0.0-rc.9", "0.9.0"}, []string{"1.0.0-rc.10", "1.0.0"}},
+	}
+	for _, tt := range tests {
+		vc, err := parse_constraint(tt.constraint)
+		if err != nil {
+			t.Errorf("parse_constraint(%q) - %v", tt.constraint, err)
+			continue
+		}
+		for _, s := range tt.match {
+			if v, _ := parse_version(s); !vc.match(v) {
+				t.Errorf("%s should satisfy %q", s, tt.constraint)
+			}
+		}
+		for _, s := range tt.nomatch {
+			if v, _ := parse_version(s); vc.match(v) {
+				t.Errorf("%s should not satisfy %q", s, tt.constraint)
+			}
+		}
+	}
+}
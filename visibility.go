@@ -0,0 +1,66 @@
+package main
+
+/*
+  Package visibility.
+
+  A package can restrict the packages allowed to depend on it with the
+  'visibility' attribute of its descriptor: a list of glob patterns matched
+  against the names of consumer packages. For example:
+
+    "visibility": ["drivers*", "hal"]
+
+  A dependency marked 'private' is an implementation detail of the package
+  that declares it and is not re-exported: other packages in the dependency
+  tree cannot depend on it, unless they also declare it as private.
+
+  Dependencies that a package isn't allowed to see stop the fetch and are
+  reported by the 'check-graph' command.
+*/
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Return true if package p allows package consumer to depend on it
+func visible_to(p *PacUnit, consumer string) bool {
+	if len(p.Visibility) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(p.Visibility, func(pattern string) bool {
+		return name_matches(pattern, consumer)
+	})
+}
+
+// Return a description of every dependency that its consumer isn't allowed
+// to see
+func visibility_violations() []string {
+	//packages declaring a private dependency
+	owners := make(map[*PacUnit][]string)
+	for _, p := range all_packs {
+		for _, d := range p.Depends {
+			if d.Private && d.pack != nil {
+				owners[d.pack] = append(owners[d.pack], p.Name)
+			}
+		}
+	}
+
+	var violations []string
+	for _, p := range all_packs {
+		for _, d := range p.Depends {
+			if d.pack == nil {
+				continue
+			}
+			if !visible_to(d.pack, p.Name) {
+				violations = append(violations, fmt.Sprintf("Package %s - cannot depend on %s (visible only to %s)",
+					p.Name, d.Name, strings.Join(d.pack.Visibility, ", ")))
+			}
+			if len(owners[d.pack]) != 0 && !d.Private {
+				violations = append(violations, fmt.Sprintf("Package %s - cannot depend on %s (private dependency of %s)",
+					p.Name, d.Name, strings.Join(owners[d.pack], ", ")))
+			}
+		}
+	}
+	return violations
+}
@@ -0,0 +1,284 @@
+package main
+
+/*
+  Warning budgets.
+
+  A package can limit the compiler warnings of its build (see problems.go)
+  with the 'warnings' attribute of its descriptor:
+    "warnings": {"max": 20}
+  fails the build of the package if its output has more than 20 distinct
+  warnings, and
+    "warnings": {"baseline": true}
+  fails it if there are warnings that are not in the baseline of the
+  package, the 'cpm-warnings.json' file in the package folder. Baseline
+  warnings are compared by file, code and message, not by line, so that
+  edits elsewhere in a file don't make them new. Both limits can be used
+  together. Failures stop CPM like other build failures (see keepgoing.go).
+
+  The warnings of the last build of each package are kept in
+  '<devroot>/.cpm/warnings/<package>.json'. Incremental builds compile only
+  changed files, so warnings of files that were not changed since the
+  previous build are kept there, even if the build didn't show them. 'cpm warnings' shows them
+  against the budgets and 'cpm warnings baseline [<package>...]' writes
+  them as the baselines of the given packages (default is all built
+  packages of the tree). Baselines are meant to be committed with the
+  package.
+*/
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const warnings_baseline_name = "cpm-warnings.json"
+
+// Warning limits of a package
+type WarningBudget struct {
+	Max      *int //maximum number of warnings
+	Baseline bool //no warnings besides those in the baseline
+}
+
+// Warning in a baseline
+type BaselineWarning struct {
+	File    string `json:"file,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+	Count   int    `json:"count"` //number of occurrences in different lines
+}
+
+// Return file with warnings of the last build of a package
+func last_warnings_file(name string) string {
+	return filepath.Join(devroot, ".cpm", "warnings", name+".json")
+}
+
+// Return baseline file of a package
+func baseline_file(p *PacUnit) string {
+	return filepath.Join(package_dir(p), warnings_baseline_name)
+}
+
+// Read the warnings of the last build of a package. Returns false if the
+// package was never built.
+func load_last_warnings(name string) ([]Problem, bool) {
+	data, err := os.ReadFile(last_warnings_file(name))
+	if err != nil {
+		return nil, false
+	}
+	var list []Problem
+	if err = json.Unmarshal(data, &list); err != nil {
+		return nil, false
+	}
+	return list, true
+}
+
+// Read the baseline of a package. A missing baseline is empty.
+func load_baseline(p *PacUnit) []BaselineWarning {
+	var baseline []BaselineWarning
+	data, err := os.ReadFile(baseline_file(p))
+	if err != nil {
+		return nil
+	}
+	if err = json.Unmarshal(data, &baseline); err != nil {
+		log.Fatalf("Fatal - cannot parse %s - %v", baseline_file(p), err)
+	}
+	return baseline
+}
+
+// Return warnings grouped as in baselines
+func baseline_of(warnings []Problem) []BaselineWarning {
+	var baseline []BaselineWarning
+	for _, w := range warnings {
+		i := slices.IndexFunc(baseline, func(b BaselineWarning) bool {
+			return b.File == w.File && b.Code == w.Code && b.Message == w.Message
+		})
+		if i < 0 {
+			baseline = append(baseline, BaselineWarning{w.File, w.Code, w.Message, 0})
+			i = len(baseline) - 1
+		}
+		baseline[i].Count++
+	}
+	return baseline
+}
+
+// Return warnings that are not in a baseline
+func new_warnings(warnings []Problem, baseline []BaselineWarning) []Problem {
+	left := slices.Clone(baseline)
+	var added []Problem
+	for _, w := range warnings {
+		i := slices.IndexFunc(left, func(b BaselineWarning) bool {
+			return b.File == w.File && b.Code == w.Code && b.Message == w.Message && b.Count > 0
+		})
+		if i < 0 {
+			added = append(added, w)
+			continue
+		}
+		left[i].Count--
+	}
+	return added
+}
+
+// Return the modification time of the source file of a warning. Returns
+// false if the warning has no file or the file is not found.
+func warning_source_time(p *PacUnit, w Problem) (time.Time, bool) {
+	if w.File == "" {
+		return time.Time{}, false
+	}
+	fnames := []string{w.File}
+	if !filepath.IsAbs(w.File) {
+		fnames = []string{filepath.Join(devroot, w.File), filepath.Join(package_dir(p), w.File)}
+	}
+	for _, fname := range fnames {
+		if st, err := os.Stat(fname); err == nil {
+			return st.ModTime(), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Merge the warnings of a build with those of the previous build, recorded
+// at time 'since'. An incremental build compiles only some files, so
+// previous warnings of files that are not in the new warnings and were not
+// changed since are kept. Warnings without a file, like linker warnings,
+// are those of the new build.
+func merge_warnings(p *PacUnit, warnings []Problem, last []Problem, since time.Time) []Problem {
+	merged := slices.Clone(warnings)
+	for _, w := range last {
+		if slices.ContainsFunc(warnings, func(n Problem) bool { return n.File == w.File }) {
+			continue //file was compiled again
+		}
+		if t, ok := warning_source_time(p, w); ok && !t.After(since) {
+			merged = append(merged, w)
+		}
+	}
+	slices.SortStableFunc(merged, func(a, b Problem) int {
+		if a.File != b.File {
+			return strings.Compare(a.File, b.File)
+		}
+		if a.Line != b.Line {
+			return a.Line - b.Line
+		}
+		return strings.Compare(a.Message, b.Message)
+	})
+	return merged
+}
+
+// Record the warnings of a package build and check them against the
+// budget of the package
+func check_warning_budget(p *PacUnit) error {
+	if l, ok := build_logs.Load(package_dir(p)); ok {
+		l.(*build_log).w.Flush()
+	}
+	fname := last_warnings_file(p.Name)
+	warnings := package_warnings(p.Name)
+	if st, err := os.Stat(fname); err == nil {
+		last, _ := load_last_warnings(p.Name)
+		warnings = merge_warnings(p, warnings, last, st.ModTime())
+	}
+	os.MkdirAll(filepath.Dir(fname), 0755)
+	data, _ := json.MarshalIndent(warnings, "", "  ")
+	if err := os.WriteFile(fname, data, 0644); err != nil {
+		Verbosef("Cannot save %s - %v\n", fname, err)
+	}
+
+	b := p.Warnings
+	if b == nil {
+		return nil
+	}
+	if b.Max != nil && len(warnings) > *b.Max {
+		return fmt.Errorf("package %s - %d compiler warnings exceed the budget of %d", p.Name, len(warnings), *b.Max)
+	}
+	if b.Baseline {
+		added := new_warnings(warnings, load_baseline(p))
+		if len(added) != 0 {
+			fmt.Fprintf(os.Stderr, "Package %s - new compiler warnings:\n", p.Name)
+			for _, w := range added {
+				fmt.Fprintf(os.Stderr, "  %s\n", w)
+			}
+			return fmt.Errorf("package %s - %d compiler warnings not in baseline %s. Fix them or run 'cpm warnings baseline %s'",
+				p.Name, len(added), baseline_file(p), p.Name)
+		}
+	}
+	return nil
+}
+
+// Implementation of 'cpm warnings' command
+func warnings_command(args []string) {
+	flags := flag.NewFlagSet("warnings", flag.ExitOnError)
+	pos := parse_interspersed(flags, args)
+	if len(pos) != 0 && pos[0] == "baseline" {
+		write_baselines(pos[1:])
+		return
+	}
+	if len(pos) > 1 {
+		log.Fatal("Usage: cpm warnings [<package>] | cpm warnings baseline [<package>...]")
+	}
+	pkg := ""
+	if len(pos) == 1 {
+		pkg = pos[0]
+	}
+	load_tree(pkg)
+	fmt.Printf("%-20s %-10s %-10s %-10s %s\n", "PACKAGE", "WARNINGS", "MAX", "BASELINE", "NEW")
+	for _, p := range all_packs {
+		warnings, built := load_last_warnings(p.Name)
+		if !built {
+			continue
+		}
+		limit, baseline, added := "-", "-", "-"
+		if b := p.Warnings; b != nil {
+			if b.Max != nil {
+				limit = fmt.Sprint(*b.Max)
+			}
+			if b.Baseline {
+				base := load_baseline(p)
+				n := 0
+				for _, w := range base {
+					n += w.Count
+				}
+				baseline, added = fmt.Sprint(n), fmt.Sprint(len(new_warnings(warnings, base)))
+			}
+		}
+		fmt.Printf("%-20s %-10d %-10s %-10s %s\n", p.Name, len(warnings), limit, baseline, added)
+	}
+}
+
+// Write the warnings of the last build of packages as their baselines. If
+// no packages are given, baselines of all built packages are written.
+func write_baselines(names []string) {
+	load_tree("")
+	var packs []*PacUnit
+	for _, name := range names {
+		p := find_pack(name)
+		if p == nil {
+			log.Fatalf("Fatal - package %s is not in the development tree", name)
+		}
+		if _, built := load_last_warnings(p.Name); !built {
+			log.Fatalf("Fatal - package %s has not been built", name)
+		}
+		packs = append(packs, p)
+	}
+	if len(names) == 0 {
+		for _, p := range all_packs {
+			if _, built := load_last_warnings(p.Name); built && !(workspace && p == all_packs[0]) {
+				packs = append(packs, p)
+			}
+		}
+	}
+	for _, p := range packs {
+		warnings, _ := load_last_warnings(p.Name)
+		baseline := baseline_of(warnings)
+		if baseline == nil {
+			baseline = []BaselineWarning{}
+		}
+		data, _ := json.MarshalIndent(baseline, "", "  ")
+		if err := os.WriteFile(baseline_file(p), append(data, '\n'), 0644); err != nil {
+			log.Fatalf("Fatal - cannot write %s - %v", baseline_file(p), err)
+		}
+		fmt.Printf("%-20s %d warnings in %s\n", p.Name, len(warnings), strings.TrimPrefix(baseline_file(p), devroot+string(filepath.Separator)))
+	}
+}
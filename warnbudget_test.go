@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMergeWarnings(t *testing.T) {
+	saved_root := devroot
+	defer func() { devroot = saved_root }()
+	devroot = t.TempDir()
+	p := &PacUnit{Name: "app"}
+	os.MkdirAll(filepath.Join(devroot, "app", "src"), 0755)
+
+	since := time.Now()
+	old := since.Add(-time.Hour)
+	source := func(name string, mtime time.Time) {
+		fname := filepath.Join(devroot, "app", "src", name)
+		os.WriteFile(fname, nil, 0644)
+		os.Chtimes(fname, mtime, mtime)
+	}
+	source("a.c", old)                    //not compiled again
+	source("b.c", old)                    //compiled again with other warnings
+	source("c.c", since.Add(time.Minute)) //changed and compiled without warnings
+
+	last := []Problem{
+		{File: "src/a.c", Line: 1, Severity: "warning", Message: "unused a"},
+		{File: "src/b.c", Line: 2, Severity: "warning", Message: "unused b"},
+		{File: "src/c.c", Line: 3, Severity: "warning", Message: "unused c"},
+		{File: "src/gone.c", Line: 4, Severity: "warning", Message: "unused gone"},
+		{Severity: "warning", Message: "linker warning"},
+	}
+	current := []Problem{{File: "src/b.c", Line: 5, Severity: "warning", Message: "unused b2"}}
+
+	got := merge_warnings(p, current, last, since)
+	want := []string{"unused a", "unused b2"}
+	if len(got) != len(want) {
+		t.Fatalf("merged warnings %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i].Message != want[i] {
+			t.Errorf("warning %d is %q, want %q", i, got[i].Message, want[i])
+		}
+	}
+
+	//no-op build keeps all warnings of unchanged files
+	if got := merge_warnings(p, []Problem{}, last[:2], since); len(got) != 2 {
+		t.Errorf("no-op build kept %v, want 2 warnings", got)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+/*
+  Warning codes.
+
+  Hygiene warnings have codes that can be suppressed or escalated to errors:
+  - 'name-mismatch': package folder doesn't match the package name in its
+    descriptor;
+  - 'missing-https', 'missing-git': git package being fetched doesn't have
+    a URL for the preferred protocol;
+  - 'no-build': package has build files but no build commands;
+  - 'dangling-module': include folder has a link to a module that no longer
+    exists or a copy of a module no dependency includes;
+  - 'unknown-attribute': descriptor has an attribute CPM doesn't know;
+  - 'undefined-profile': selected profile is not defined by any package;
+  - 'unpinned-archive': archive dependency doesn't have a hash;
+  - 'fetch-cycle': dependency cycle through a fetch-only dependency;
+  - 'duplicate-symbol': libraries of different packages define the same
+    symbol;
+  - 'generated-file': a file generated for build systems, like a pkg-config
+    file or the CMake file of the root package, cannot be written;
+  - 'no-remote': 'cpm init' doesn't find an 'origin' remote for the package
+    URLs.
+
+  The 'warnings.suppress' setting is a comma separated list of codes that
+  are not shown. The 'warnings.errors' setting lists codes that stop CPM;
+  the '--werror' option stops CPM on every warning that is not suppressed.
+  'all' can be used instead of a list of codes.
+*/
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+)
+
+var werror_flag = flag.Bool("werror", false, "treat warnings as errors")
+
+var warning_codes = []string{"name-mismatch", "missing-https", "missing-git", "no-build", "dangling-module", "unknown-attribute", "undefined-profile", "unpinned-archive", "fetch-cycle", "duplicate-symbol", "generated-file", "no-remote"}
+
+var shown_warnings = make(map[string]bool)
+var warnings_mutex sync.Mutex
+
+// Return true if a warning code is in the list of codes of a setting
+func warning_listed(setting string, code string) bool {
+	for _, c := range strings.Split(config_get(setting, ""), ",") {
+		if c = strings.TrimSpace(c); strings.EqualFold(c, code) || strings.EqualFold(c, "all") {
+			return true
+		}
+	}
+	return false
+}
+
+// Show a warning with a code unless it is suppressed. Stops CPM if the
+// warning is escalated to an error. The same warning is shown only once.
+func warn(code string, format string, args ...any) {
+	if !slices.Contains(warning_codes, code) {
+		log.Fatalf("Fatal - unknown warning code %s", code)
+	}
+	msg := fmt.Sprintf(format, args...)
+	if warning_listed("warnings.suppress", code) {
+		Verbosef("Suppressed warning [%s] %s\n", code, msg)
+		return
+	}
+	if *werror_flag || warning_listed("warnings.errors", code) {
+		log.Fatalf("Fatal - [%s] %s", code, msg)
+	}
+	warnings_mutex.Lock()
+	defer warnings_mutex.Unlock()
+	if !shown_warnings[code+msg] {
+		shown_warnings[code+msg] = true
+		fmt.Printf("WARNING [%s] - %s\n", code, msg)
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+/*
+  Conditions.
+
+  Dependencies and commands can have a 'when' attribute with a condition
+  that must be true for them to be used, like:
+    "when": "os == 'windows' && arch == 'amd64' && feature('gui')"
+
+  Conditions are made of:
+  - variables: 'os' (target OS, same as for the 'os' attribute of commands),
+    'arch' (processor architecture of the target, like 'amd64' or 'arm64'),
+    'host' (OS CPM runs on), 'target' and 'variant' (selected with the '--target' option);
+    other names are environment variables of the package, of the root
+    package (for dependencies) or of CPM;
+  - string literals in single or double quotes;
+  - functions: feature(name) is true if the feature was selected with the
+    '--features' option, profile(name) if the profile is selected and
+    env(name) returns an environment variable;
+  - operators: '==', '!=', '!', '&&', '||' and parentheses.
+  A value is true if it is not empty, "false" or "0".
+*/
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+var features_flag = flag.String("features", "", "selected features (comma separated)")
+
+// Return features selected with '--features' option
+func selected_features() []string {
+	var features []string
+	for _, f := range strings.Split(*features_flag, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			features = append(features, strings.ToLower(f))
+		}
+	}
+	return features
+}
+
+// Return true if condition of a dependency or command is satisfied. An
+// empty condition is always true. Where identifies the condition in error
+// messages.
+func when_true(where string, expr string, vars map[string]string) bool {
+	if strings.TrimSpace(expr) == "" {
+		return true
+	}
+	ok, err := eval_when(expr, vars)
+	if err != nil {
+		log.Fatalf("Fatal - %s - invalid condition '%s' - %v", where, expr, err)
+	}
+	if !ok {
+		Verbosef("%s - condition '%s' is false\n", where, expr)
+	}
+	return ok
+}
+
+// Remove dependencies of a package whose condition is false
+func filter_dependencies(p *PacUnit) {
+	vars := dependency_vars(p)
+	p.Depends = slices.DeleteFunc(p.Depends, func(d DependencyDescriptor) bool {
+		return !when_true(fmt.Sprintf("Package %s - dependency %s", p.Name, d.Name), d.When, vars)
+	})
+}
+
+// Return variables of conditions of dependencies of package p: environment
+// of the root package overridden by environment of p. Values are expanded;
+// names not found are taken from the process environment.
+func dependency_vars(p *PacUnit) map[string]string {
+	vars := make(map[string]string)
+	if len(all_packs) != 0 && all_packs[0] != p {
+		merge_env(vars, all_packs[0].Env)
+	}
+	merge_env(vars, p.Env)
+	return vars
+}
+
+// Condition parser. Expressions are evaluated while parsing.
+type when_parser struct {
+	toks []string
+	pos  int
+	vars map[string]string
+}
+
+// Evaluate a condition
+func eval_when(expr string, vars map[string]string) (bool, error) {
+	toks, err := when_tokens(expr)
+	if err != nil {
+		return false, err
+	}
+	w := &when_parser{toks: toks, vars: vars}
+	v, err := w.or()
+	if err != nil {
+		return false, err
+	}
+	if w.pos != len(w.toks) {
+		return false, fmt.Errorf("unexpected '%s'", w.toks[w.pos])
+	}
+	return truthy(v), nil
+}
+
+// Split condition in tokens. String literals keep their opening quote.
+func when_tokens(expr string) ([]string, error) {
+	var toks []string
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '\'' || c == '"':
+			end := strings.IndexByte(expr[i+1:], c)
+			if end < 0 {
+				return nil, errors.New("unterminated string")
+			}
+			toks = append(toks, expr[i:i+end+1])
+			i += end + 2
+		case strings.HasPrefix(expr[i:], "&&") || strings.HasPrefix(expr[i:], "||") ||
+			strings.HasPrefix(expr[i:], "==") || strings.HasPrefix(expr[i:], "!="):
+			toks = append(toks, expr[i:i+2])
+			i += 2
+		case strings.IndexByte("!(),", c) >= 0:
+			toks = append(toks, expr[i:i+1])
+			i++
+		case is_ident_char(c):
+			j := i
+			for j < len(expr) && is_ident_char(expr[j]) {
+				j++
+			}
+			toks = append(toks, expr[i:j])
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected character '%c'", c)
+		}
+	}
+	return toks, nil
+}
+
+func is_ident_char(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// Return true if value is not empty, "false" or "0"
+func truthy(v string) bool {
+	return v != "" && v != "false" && v != "0"
+}
+
+func bool_value(b bool) string {
+	if b {
+		return "true"
+	}
+	return "false"
+}
+
+func (w *when_parser) peek() string {
+	if w.pos < len(w.toks) {
+		return w.toks[w.pos]
+	}
+	return ""
+}
+
+func (w *when_parser) next() string {
+	t := w.peek()
+	w.pos++
+	return t
+}
+
+// or := and ('||' and)*
+func (w *when_parser) or() (string, error) {
+	v, err := w.and()
+	for err == nil && w.peek() == "||" {
+		w.next()
+		var r string
+		if r, err = w.and(); err == nil {
+			v = bool_value(truthy(v) || truthy(r))
+		}
+	}
+	return v, err
+}
+
+// and := compare ('&&' compare)*
+func (w *when_parser) and() (string, error) {
+	v, err := w.compare()
+	for err == nil && w.peek() == "&&" {
+		w.next()
+		var r string
+		if r, err = w.compare(); err == nil {
+			v = bool_value(truthy(v) && truthy(r))
+		}
+	}
+	return v, err
+}
+
+// compare := unary [('==' | '!=') unary]
+func (w *when_parser) compare() (string, error) {
+	v, err := w.unary()
+	if err != nil {
+		return "", err
+	}
+	if op := w.peek(); op == "==" || op == "!=" {
+		w.next()
+		r, err := w.unary()
+		if err != nil {
+			return "", err
+		}
+		return bool_value(strings.EqualFold(v, r) == (op == "==")), nil
+	}
+	return v, nil
+}
+
+// unary := '!' unary | '(' or ')' | string | name | name '(' string ')'
+func (w *when_parser) unary() (string, error) {
+	t := w.next()
+	switch {
+	case t == "":
+		return "", errors.New("unexpected end of condition")
+	case t == "!":
+		v, err := w.unary()
+		return bool_value(!truthy(v)), err
+	case t == "(":
+		v, err := w.or()
+		if err == nil && w.next() != ")" {
+			err = errors.New("missing ')'")
+		}
+		return v, err
+	case t[0] == '\'' || t[0] == '"':
+		return t[1:], nil
+	case is_ident_char(t[0]):
+		if w.peek() == "(" {
+			return w.call(t)
+		}
+		return w.variable(t), nil
+	}
+	return "", fmt.Errorf("unexpected '%s'", t)
+}
+
+// Evaluate function call
+func (w *when_parser) call(name string) (string, error) {
+	w.next()
+	arg, err := w.or()
+	if err != nil {
+		return "", err
+	}
+	if w.next() != ")" {
+		return "", fmt.Errorf("missing ')' after argument of %s", name)
+	}
+	switch name {
+	case "feature":
+		return bool_value(slices.Contains(selected_features(), strings.ToLower(arg))), nil
+	case "profile":
+		return bool_value(slices.ContainsFunc(selected_profiles(), func(p string) bool { return strings.EqualFold(p, arg) })), nil
+	case "env":
+		return w.env(arg), nil
+	}
+	return "", fmt.Errorf("unknown function %s", name)
+}
+
+// Return value of a variable
+func (w *when_parser) variable(name string) string {
+	switch name {
+	case "true", "false":
+		return name
+	case "os":
+		return target_os()
+	case "arch":
+		return target_arch()
+	case "host":
+		return runtime.GOOS
+	case "target":
+		return target_name
+	case "variant":
+		return target_variant
+	}
+	return w.env(name)
+}
+
+// Return environment variable of package or of CPM
+func (w *when_parser) env(name string) string {
+	if v, ok := w.vars[name]; ok {
+		return v
+	}
+	return os.Getenv(name)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"runtime"
+	"slices"
+	"testing"
+)
+
+func TestWhenTokens(t *testing.T) {
+	tests := []struct {
+		expr string
+		want []string
+	}{
+		{"os == 'windows'", []string{"os", "==", "'windows"}},
+		{`!feature("gui")&&(a||b)`, []string{"!", "feature", "(", `"gui`, ")", "&&", "(", "a", "||", "b", ")"}},
+		{"x != ''", []string{"x", "!=", "'"}},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		got, err := when_tokens(tt.expr)
+		if err != nil {
+			t.Errorf("when_tokens(%q) - %v", tt.expr, err)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("when_tokens(%q) = %q, want %q", tt.expr, got, tt.want)
+		}
+	}
+	for _, bad := range []string{"os == 'windows", "a = b", "a & b", "a + b"} {
+		if _, err := when_tokens(bad); err == nil {
+			t.Errorf("when_tokens(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestEvalWhen(t *testing.T) {
+	saved_features, saved_target, saved_variant := *features_flag, target_name, target_variant
+	defer func() { *features_flag, target_name, target_variant = saved_features, saved_target, saved_variant }()
+	*features_flag = "GUI, net"
+	target_name, target_variant = "", ""
+
+	vars := map[string]string{"MODE": "debug", "EMPTY": "", "ZERO": "0"}
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"true", true},
+		{"false", false},
+		{"'x'", true},
+		{"''", false},
+		{"ZERO", false},
+		{"EMPTY", false},
+		{"MODE", true},
+		{"MODE == 'DEBUG'", true},
+		{"MODE != 'debug'", false},
+		{"!MODE", false},
+		{"feature('gui') && feature('NET')", true},
+		{"feature('gui') && feature('ssl')", false},
+		{"feature('ssl') || MODE == 'debug'", true},
+		{"!(feature('ssl') || EMPTY)", true},
+		{"false && true || true", true},
+		{"false && (true || true)", false},
+		{"host == '" + runtime.GOOS + "'", true},
+		{"os == '" + runtime.GOOS + "'", true},
+		{"arch == '" + runtime.GOARCH + "'", true},
+		{"target == ''", true},
+	}
+	for _, tt := range tests {
+		got, err := eval_when(tt.expr, vars)
+		if err != nil {
+			t.Errorf("eval_when(%q) - %v", tt.expr, err)
+		} else if got != tt.want {
+			t.Errorf("eval_when(%q) = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+	for _, bad := range []string{"(a", "a b", "== a", "a ==", "unknown('x')", "feature('x'", "!"} {
+		if _, err := eval_when(bad, vars); err == nil {
+			t.Errorf("eval_when(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestWhenTarget(t *testing.T) {
+	saved_target, saved_variant := target_name, target_variant
+	defer func() { target_name, target_variant = saved_target, saved_variant }()
+	tests := []struct {
+		target, variant, expr string
+	}{
+		{"android", "arm64-v8a", "os == 'android' && arch == 'arm64' && variant == 'arm64-v8a'"},
+		{"android", "armeabi-v7a", "arch == 'arm'"},
+		{"android", "x86_64", "arch == 'amd64'"},
+		{"ios", "iphoneos", "os == 'ios' && arch == 'arm64'"},
+		{"ios", "iphonesimulator", "arch == '" + runtime.GOARCH + "'"},
+		{"wasm", "", "target == 'wasm' && arch == 'wasm' && host == '" + runtime.GOOS + "'"},
+	}
+	for _, tt := range tests {
+		target_name, target_variant = tt.target, tt.variant
+		if ok, err := eval_when(tt.expr, nil); err != nil || !ok {
+			t.Errorf("target %s:%s - eval_when(%q) = %v, %v", tt.target, tt.variant, tt.expr, ok, err)
+		}
+	}
+}
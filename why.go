@@ -0,0 +1,60 @@
+package main
+
+/*
+  Dependency explanations.
+
+  'cpm why <package> [<root>]' shows all dependency chains leading from the
+  root package to a package and, for every dependency in a chain, the
+  descriptor or overlay file that declares it, so users can see why a
+  package is fetched or built and which descriptors to edit to remove it:
+
+    utils is required through 2 dependency chains:
+      app -> cool_A -> utils
+        app -> cool_A       declared in /dev/app/cpm.json
+        cool_A -> utils     declared in /dev/cool_A/cpm.json
+      app -> utils
+        app -> utils        declared in /dev/app/cpm.json
+*/
+
+import (
+	"flag"
+	"fmt"
+	"log"
+)
+
+const max_why_chains = 100 //chains shown by 'cpm why'
+
+// Implementation of 'cpm why <package> [<root>]' command
+func why(args []string) {
+	flags := flag.NewFlagSet("why", flag.ExitOnError)
+	pos := parse_interspersed(flags, args)
+	if len(pos) < 1 || len(pos) > 2 {
+		log.Fatal("Usage: cpm why <package> [<root>]")
+	}
+	root_arg := ""
+	if len(pos) == 2 {
+		root_arg = pos[1]
+	}
+	root := load_tree(root_arg)
+	target := find_pack(pos[0])
+	if target == nil {
+		log.Fatalf("Fatal - package %s is not a dependency of %s", pos[0], root.Name)
+	}
+	if target == root {
+		fmt.Printf("%s is the root package\n", target.Name)
+		return
+	}
+
+	chains := all_chains(root, target, max_why_chains)
+	more := len(chains) > max_why_chains
+	if more {
+		chains = chains[:max_why_chains]
+	}
+	fmt.Printf("%s is required through %d dependency chains:\n", target.Name, len(chains))
+	for _, chain := range chains {
+		fmt.Printf("  %s\n%s\n", chain_names(chain), chain_details(chain, "    "))
+	}
+	if more {
+		fmt.Printf("  ... and more chains\n")
+	}
+}
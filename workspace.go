@@ -0,0 +1,84 @@
+package main
+
+/*
+  Workspaces.
+
+  A development tree can hold several top-level packages, like applications
+  sharing the same libraries. A 'cpm.work' file in the development tree root
+  lists them:
+    {"packages": ["app1", "app2", "tools"]}
+  When CPM is started in a folder without a package descriptor, like the
+  development tree root, and the tree has a 'cpm.work' file, it fetches and
+  builds all listed packages as one dependency graph. Shared dependencies
+  are fetched and built once and conflicting branches are detected like in
+  any other tree.
+
+  The workspace file is the descriptor of a virtual root package whose
+  folder is the development tree root. Besides 'packages', it can have the
+  attributes of root packages, like 'overrides', 'replace', 'resolutions',
+  'conflicts' or 'tools', but not build commands. The lockfile of the
+  workspace is the 'cpm.lock' file in the development tree root.
+*/
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const workspace_name = "cpm.work"
+
+var workspace bool //root package is a workspace
+
+// Return workspace file used when no root package is given and the current
+// folder doesn't have a descriptor, or "" if there is none
+func workspace_descriptor(arg string) string {
+	if arg != "" {
+		return ""
+	}
+	cwd, _ := os.Getwd()
+	if _, err := os.Stat(filepath.Join(cwd, descriptor_name)); err == nil {
+		return ""
+	}
+	fname := filepath.Join(devroot, workspace_name)
+	if _, err := os.Stat(fname); err != nil {
+		return ""
+	}
+	return fname
+}
+
+// Set up the root package of a workspace
+func setup_workspace(root *PacUnit) {
+	if !workspace {
+		return
+	}
+	if root.Name == "" {
+		root.Name = "workspace"
+	}
+	root.path = devroot
+	if len(root.Build) != 0 || len(root.Builds) != 0 {
+		log.Fatalf("Fatal - %s cannot have build commands", filepath.Join(devroot, workspace_name))
+	}
+	if len(root.Packages) == 0 {
+		log.Fatalf("Fatal - %s doesn't list any packages", filepath.Join(devroot, workspace_name))
+	}
+	Verbosef("Workspace with packages %s\n", strings.Join(root.Packages, ", "))
+}
+
+// Add packages of a workspace to the dependencies of its root package
+func add_members(root *PacUnit) {
+	if !workspace {
+		return
+	}
+	for _, name := range root.Packages {
+		if slices.ContainsFunc(root.Depends, func(d DependencyDescriptor) bool { return strings.EqualFold(d.Name, name) }) {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(devroot, name)); err != nil {
+			log.Fatalf("Fatal - workspace package %s not found in %s", name, devroot)
+		}
+		root.Depends = append(root.Depends, DependencyDescriptor{Name: name})
+	}
+}